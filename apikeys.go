@@ -0,0 +1,29 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+// Scopes of API keys.
+const (
+	// ScopeRead allows only requests that don't change data.
+	ScopeRead = "read"
+	// ScopeReadWrite allows all requests.
+	ScopeReadWrite = "read-write"
+)
+
+// APIKey describes the holder of a key listed in APIKeys.
+type APIKey struct {
+	// Name identifies the holder in logs and rate limits, e.g. "mobile-app".
+	Name string
+	// Scope is ScopeRead or ScopeReadWrite.
+	Scope string
+	// RateLimit is the number of requests the key may make within
+	// APIKeyRateWindow. Zero means no limit.
+	RateLimit int
+}
+
+// CanWrite reports whether the key allows requests that change data.
+func (k APIKey) CanWrite() bool {
+	return k.Scope == ScopeReadWrite
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// AbuseStore holds the state of an abuseDetector: recent events and blocks,
+// by principal. The in-memory store is local to an instance; a store shared
+// between instances, such as one in Redis, makes limits apply across them.
+type AbuseStore interface {
+	// Hit records an event for key at now and returns the number of its
+	// events in the window ending at now.
+	Hit(key string, now time.Time, window time.Duration) int
+	// Block blocks key until the given time.
+	Block(key string, until time.Time)
+	// BlockedUntil returns when the block on key ends, or the zero time if
+	// it isn't blocked at now.
+	BlockedUntil(key string, now time.Time) time.Time
+}
+
+// memoryAbuseStore is an AbuseStore kept in the memory of one instance.
+// Principals whose events and blocks have all expired are pruned every
+// sweep interval, so that one-off principals don't accumulate.
+type memoryAbuseStore struct {
+	mu        sync.Mutex
+	events    map[string][]time.Time // oldest first
+	blocked   map[string]time.Time
+	lastSweep time.Time
+}
+
+// abuseSweepInterval is how often a memoryAbuseStore prunes expired entries.
+const abuseSweepInterval = time.Minute
+
+// newMemoryAbuseStore returns an empty memoryAbuseStore.
+func newMemoryAbuseStore() *memoryAbuseStore {
+	return &memoryAbuseStore{
+		events:  make(map[string][]time.Time),
+		blocked: make(map[string]time.Time),
+	}
+}
+
+// Hit records an event for key, dropping those older than window.
+func (s *memoryAbuseStore) Hit(key string, now time.Time, window time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= abuseSweepInterval {
+		s.sweep(now, window)
+		s.lastSweep = now
+	}
+
+	// Drop the events that slid out of the window.
+	events := s.events[key]
+	i := 0
+	for i < len(events) && !events[i].After(now.Add(-window)) {
+		i++
+	}
+	events = append(events[i:], now)
+	s.events[key] = events
+	return len(events)
+}
+
+// sweep deletes the principals whose latest event is older than window and
+// the blocks that ended by now. The caller must hold s.mu.
+func (s *memoryAbuseStore) sweep(now time.Time, window time.Duration) {
+	for key, events := range s.events {
+		if len(events) == 0 || !events[len(events)-1].After(now.Add(-window)) {
+			delete(s.events, key)
+		}
+	}
+	for key, until := range s.blocked {
+		if !until.After(now) {
+			delete(s.blocked, key)
+		}
+	}
+}
+
+// Block blocks key until the given time, forgetting its events.
+func (s *memoryAbuseStore) Block(key string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blocked[key] = until
+	delete(s.events, key)
+}
+
+// BlockedUntil returns when the block on key ends, clearing it once past.
+func (s *memoryAbuseStore) BlockedUntil(key string, now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.blocked[key]
+	if !ok {
+		return time.Time{}
+	}
+	if !until.After(now) {
+		delete(s.blocked, key)
+		return time.Time{}
+	}
+	return until
+}
+
+// abuseDetector blocks principals, such as users or IP addresses, that
+// create more than vyfe_api.AbuseCreateLimit sessions within
+// vyfe_api.AbuseWindow, for vyfe_api.AbuseBlockDuration.
+type abuseDetector struct {
+	store AbuseStore
+	// now returns the current time. It is a field so tests can move time.
+	now func() time.Time
+}
+
+// newAbuseDetector returns an abuseDetector keeping its state in store.
+func newAbuseDetector(store AbuseStore) *abuseDetector {
+	return &abuseDetector{store: store, now: time.Now}
+}
+
+// allow records a create by each of principals and reports whether it may go
+// ahead. If not, it returns how long until the principal's block ends.
+func (d *abuseDetector) allow(principals ...string) (retryAfter time.Duration, ok bool) {
+	now := d.now()
+	for _, p := range principals {
+		if until := d.store.BlockedUntil(p, now); !until.IsZero() {
+			return until.Sub(now), false
+		}
+	}
+	for _, p := range principals {
+		if d.store.Hit(p, now, vyfe_api.AbuseWindow) > vyfe_api.AbuseCreateLimit {
+			d.store.Block(p, now.Add(vyfe_api.AbuseBlockDuration))
+			log.Printf("Blocking creates from %s for %v: more than %d in %v",
+				p, vyfe_api.AbuseBlockDuration, vyfe_api.AbuseCreateLimit, vyfe_api.AbuseWindow)
+			return vyfe_api.AbuseBlockDuration, false
+		}
+	}
+	return 0, true
+}
+
+// checkCreateRate returns a 429 appError, setting Retry-After, if the
+// signed-in user or the client's IP address is blocked for creating too many
+// sessions. Anonymous creators are only tracked by IP address, and admins
+// aren't tracked. The user is that of the request, not the creator given in
+// the session, which clients control.
+func (a *App) checkCreateRate(w http.ResponseWriter, r *http.Request, user *Profile) *appError {
+	if a.abuse == nil || vyfe_api.AbuseCreateLimit <= 0 || isAdmin(user) {
+		return nil
+	}
+	principals := []string{"ip:" + clientIP(r)}
+	if user != nil && user.ID != "" {
+		principals = append(principals, "user:"+user.ID)
+	}
+	retryAfter, ok := a.abuse.allow(principals...)
+	if ok {
+		return nil
+	}
+	secs := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	return apiErrorf(errRateLimited, "too many sessions created, try again in %d seconds", secs)
+}
+
+// clientIP returns the IP address of the client that sent r: the last
+// address in X-Forwarded-For, appended by the App Engine and load balancer
+// frontends, or else the address of the connection. Earlier addresses are
+// sent by the client and can't be trusted.
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		addrs := strings.Split(fwd, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
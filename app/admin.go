@@ -0,0 +1,277 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/iterator"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// maxBatchDeleteIDs is the most session IDs batchDeleteHandler accepts in one
+// request.
+const maxBatchDeleteIDs = 1000
+
+// batchDeleteHandler deletes the sessions listed in a JSON request body such as
+// {"ids": [1, 2, 3]}, along with their uploaded files. It writes the number
+// deleted and an error message for each ID that wasn't.
+func (a *App) batchDeleteHandler(w http.ResponseWriter, r *http.Request) *appError {
+	var req struct {
+		IDs []int64 `json:"ids"`
+	}
+	if appErr := decodeJSON(w, r, &req); appErr != nil {
+		return appErr
+	}
+	if len(req.IDs) == 0 {
+		return badRequest(nil, "no session ids given")
+	}
+	if len(req.IDs) > maxBatchDeleteIDs {
+		return badRequest(nil, "too many session ids: got %d, at most %d are allowed", len(req.IDs), maxBatchDeleteIDs)
+	}
+
+	// Look the sessions up first so that their files can be removed once
+	// they are deleted.
+	var ids []int64
+	var sessions []*vyfe_api.Session
+	seen := make(map[int64]bool)
+	for _, id := range req.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+		if s, err := a.DB.GetSession(id); err == nil {
+			sessions = append(sessions, s)
+		}
+	}
+
+	ctx := context.Background()
+	deleted, errs := a.DB.DeleteSessions(ctx, ids)
+	for _, s := range sessions {
+		if errs[s.ID] == nil {
+			a.deleteSessionObjects(ctx, s)
+			a.publishEventAsync(vyfe_api.EventDeleted, s.ID)
+		}
+	}
+
+	resp := struct {
+		Deleted int              `json:"deleted"`
+		Errors  map[int64]string `json:"errors,omitempty"`
+	}{Deleted: deleted}
+	for id, err := range errs {
+		if resp.Errors == nil {
+			resp.Errors = make(map[int64]string)
+		}
+		resp.Errors[id] = err.Error()
+	}
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// duplicatesHandler writes the groups of likely duplicate sessions found by
+// vyfe_api.FindDuplicateSessions as a JSON array of arrays, for curators to
+// review and merge with mergeHandler.
+func (a *App) duplicatesHandler(w http.ResponseWriter, r *http.Request) *appError {
+	groups, err := vyfe_api.FindDuplicateSessions(context.Background(), a.DB)
+	if err != nil {
+		return appErrorf(err, "could not find duplicates: %v", err)
+	}
+	return writeJSON(w, http.StatusOK, groups)
+}
+
+// mergeHandler merges the duplicate session given in the "merge" form value
+// into the one in "keep", deletes the duplicate's uploaded files and writes
+// the resulting session.
+func (a *App) mergeHandler(w http.ResponseWriter, r *http.Request) *appError {
+	keepID, err := strconv.ParseInt(r.FormValue("keep"), 10, 64)
+	if err != nil {
+		return badRequest(err, "bad session id: %v", err)
+	}
+	mergeID, err := strconv.ParseInt(r.FormValue("merge"), 10, 64)
+	if err != nil {
+		return badRequest(err, "bad session id: %v", err)
+	}
+	if keepID == mergeID {
+		return badRequest(vyfe_api.ErrMergeIntoSelf, "%v", vyfe_api.ErrMergeIntoSelf)
+	}
+
+	ctx := context.Background()
+	merged, err := a.DB.GetSession(mergeID)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err != nil {
+		return appErrorf(err, "could not find session: %v", err)
+	}
+	err = a.DB.MergeSessions(ctx, keepID, mergeID)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err != nil {
+		return appErrorf(err, "could not merge sessions: %v", err)
+	}
+	a.deleteSessionObjects(ctx, merged)
+
+	kept, err := a.DB.GetSession(keepID)
+	if err != nil {
+		return appErrorf(err, "could not find session: %v", err)
+	}
+	a.publishEventAsync(vyfe_api.EventUpdated, keepID)
+	a.publishEventAsync(vyfe_api.EventDeleted, mergeID)
+	return writeJSON(w, http.StatusOK, kept)
+}
+
+// migrationHandler sets the percentage of reads served by the new database
+// during a migration, from the "readPercent" form value, and turns shadow
+// comparison of reads on or off with the "shadow" form value.
+func (a *App) migrationHandler(w http.ResponseWriter, r *http.Request) *appError {
+	percent, err := strconv.Atoi(r.FormValue("readPercent"))
+	if err != nil {
+		return badRequest(err, "bad readPercent value: %q", r.FormValue("readPercent"))
+	}
+	shadow := false
+	if v := r.FormValue("shadow"); v != "" {
+		if shadow, err = strconv.ParseBool(v); err != nil {
+			return badRequest(err, "bad shadow value: %q", v)
+		}
+	}
+	if err := vyfe_api.SetMigrationReads(a.DB, percent, shadow); err != nil {
+		return badRequest(err, "%v", err)
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{"readPercent": percent, "shadow": shadow})
+}
+
+// renameTagHandler renames the tag given in the "old" form value to the one
+// in "new" across all sessions.
+func (a *App) renameTagHandler(w http.ResponseWriter, r *http.Request) *appError {
+	oldTag, newTag := r.FormValue("old"), r.FormValue("new")
+	if oldTag == "" || newTag == "" {
+		return badRequest(nil, "old and new tags are required")
+	}
+
+	affected, err := a.DB.RenameTag(context.Background(), oldTag, newTag)
+	if err != nil {
+		return appErrorf(err, "could not rename tag: %v", err)
+	}
+	return writeJSON(w, http.StatusOK, map[string]int{"affected": affected})
+}
+
+// removeTagHandler removes the tag given in the "tag" form value from all
+// sessions.
+func (a *App) removeTagHandler(w http.ResponseWriter, r *http.Request) *appError {
+	tag := r.FormValue("tag")
+	if tag == "" {
+		return badRequest(nil, "tag is required")
+	}
+
+	affected, err := a.DB.RemoveTag(context.Background(), tag)
+	if err != nil {
+		return appErrorf(err, "could not remove tag: %v", err)
+	}
+	return writeJSON(w, http.StatusOK, map[string]int{"affected": affected})
+}
+
+// maxBatchTagIDs is the most session IDs batchTagHandler accepts in one
+// request.
+const maxBatchTagIDs = 1000
+
+// batchTagHandler adds a tag to the sessions listed in a JSON request body
+// such as {"ids": [1, 2, 3], "tag": "go"}, unless they already carry it. It
+// writes the number of sessions updated and the number of IDs with no
+// session.
+func (a *App) batchTagHandler(w http.ResponseWriter, r *http.Request) *appError {
+	var req struct {
+		IDs []int64 `json:"ids"`
+		Tag string  `json:"tag"`
+	}
+	if appErr := decodeJSON(w, r, &req); appErr != nil {
+		return appErr
+	}
+	tag := strings.TrimSpace(req.Tag)
+	if tag == "" || strings.Contains(tag, ",") {
+		return badRequest(nil, "bad tag: %q", req.Tag)
+	}
+	if len(req.IDs) == 0 {
+		return badRequest(nil, "no session ids given")
+	}
+	if len(req.IDs) > maxBatchTagIDs {
+		return badRequest(nil, "too many session ids: got %d, at most %d are allowed", len(req.IDs), maxBatchTagIDs)
+	}
+
+	updated, missing, err := a.DB.AddTagToSessions(context.Background(), req.IDs, tag)
+	if err != nil {
+		return appErrorf(err, "could not tag sessions (%d updated): %v", updated, err)
+	}
+	return writeJSON(w, http.StatusOK, map[string]int{"updated": updated, "missing": missing})
+}
+
+// backfillHandler fills in derived fields missing from sessions saved before
+// the fields existed, and writes the number of sessions updated. It is safe
+// to run repeatedly, e.g. from a scheduled job, after each schema change.
+func (a *App) backfillHandler(w http.ResponseWriter, r *http.Request) *appError {
+	updated, err := a.DB.BackfillDerivedFields(context.Background())
+	if err != nil {
+		return appErrorf(err, "could not backfill sessions (%d updated): %v", updated, err)
+	}
+	log.Printf("backfill: updated %d sessions", updated)
+	return writeJSON(w, http.StatusOK, map[string]int{"updated": updated})
+}
+
+// adminStatsHandler writes an overview of the catalog as JSON: the number of
+// sessions, how many were added in the last day and week, the number of
+// distinct authors and the bytes stored in the storage bucket.
+func (a *App) adminStatsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := context.Background()
+	stats, err := vyfe_api.CollectStats(ctx, a.DB, time.Now())
+	if err != nil {
+		return appErrorf(err, "could not collect stats: %v", err)
+	}
+
+	resp := struct {
+		*vyfe_api.Stats
+		StorageBytes *int64 `json:"storageBytes,omitempty"`
+	}{Stats: stats}
+	if a.StorageBucket != nil {
+		n, err := a.bucketSize(ctx)
+		if err != nil {
+			return appErrorf(err, "could not list storage objects: %v", err)
+		}
+		resp.StorageBytes = &n
+	}
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// storageUsageHandler writes the bytes uploaded for each user's sessions as a
+// JSON object keyed by user ID.
+func (a *App) storageUsageHandler(w http.ResponseWriter, r *http.Request) *appError {
+	usage, err := a.DB.StorageUsageByUser(context.Background())
+	if err != nil {
+		return appErrorf(err, "could not get storage usage: %v", err)
+	}
+	return writeJSON(w, http.StatusOK, usage)
+}
+
+// bucketSize returns the total size of the objects in the app's storage bucket.
+func (a *App) bucketSize(ctx context.Context) (int64, error) {
+	var total int64
+	it := a.StorageBucket.Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return total, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		total += attrs.Size
+	}
+}
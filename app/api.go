@@ -0,0 +1,537 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// parsePageParams returns the page size given by the "limit" query
+// parameter and the page given by "pageToken". The limit defaults to
+// vyfe_api.PageSize and is clamped to [1, vyfe_api.MaxPageSize]; negative or
+// non-numeric limits are rejected.
+func parsePageParams(r *http.Request) (limit int, token string, appErr *appError) {
+	limit = vyfe_api.PageSize
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, "", badRequest(err, "bad limit: %q", v)
+		}
+		limit = n
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > vyfe_api.MaxPageSize {
+		limit = vyfe_api.MaxPageSize
+	}
+	return limit, r.FormValue("pageToken"), nil
+}
+
+// pageOf returns the page of up to limit sessions starting at the offset
+// given by token, and the token of the next page, for lists that aren't
+// paged by the database.
+func pageOf(sessions []*vyfe_api.Session, limit int, token string) ([]*vyfe_api.Session, string, *appError) {
+	start := 0
+	if token != "" {
+		n, err := strconv.Atoi(token)
+		if err != nil || n < 0 || n > len(sessions) {
+			return nil, "", badRequest(vyfe_api.ErrBadPageToken, "bad page token: %q", token)
+		}
+		start = n
+	}
+	end := start + limit
+	if end >= len(sessions) {
+		return sessions[start:], "", nil
+	}
+	return sessions[start:end], strconv.Itoa(end), nil
+}
+
+// apiListHandler writes a page of sessions, ordered by title, as a
+// vyfe_api.ListResponse. The page is selected with the "limit" and
+// "pageToken" query parameters. Sessions the viewer may not see listed are
+// left out of the page, which may then be short, and of the total count.
+func (a *App) apiListHandler(w http.ResponseWriter, r *http.Request) *appError {
+	limit, token, appErr := parsePageParams(r)
+	if appErr != nil {
+		return appErr
+	}
+	count, appErr := withCount(r)
+	if appErr != nil {
+		return appErr
+	}
+	ctx := context.Background()
+	list, err := a.DB.ListSessionsPage(ctx, token, limit)
+	if err == vyfe_api.ErrBadPageToken {
+		return badRequest(err, "bad page token: %q", token)
+	}
+	if err != nil {
+		return appErrorf(err, "could not list sessions: %v", err)
+	}
+	v := a.viewer(r)
+	visible := list.Sessions[:0]
+	for _, s := range list.Sessions {
+		if v.CanList(s) {
+			visible = append(visible, s)
+		}
+	}
+	resp := vyfe_api.NewListResponse(visible, list.NextPageToken)
+	if count {
+		n, err := a.countListed(ctx, v)
+		if err != nil {
+			return appErrorf(err, "could not count sessions: %v", err)
+		}
+		resp.TotalCount = &n
+	}
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// countListed returns the number of sessions v may see listed. Admins see
+// them all, so only other viewers' sessions are read to be counted.
+func (a *App) countListed(ctx context.Context, v vyfe_api.Viewer) (int, error) {
+	if v.Admin {
+		return a.DB.CountSessionsCreatedBy(ctx, "")
+	}
+	sessions, err := a.DB.ListSessionsFor(ctx, v)
+	return len(sessions), err
+}
+
+// apiListMineHandler writes a page of the sessions created by the logged in
+// user as a vyfe_api.ListResponse, in the order given by the "sort" and
+// "order" query parameters as for listMineHandler. The page is selected with
+// the "limit" and "pageToken" query parameters.
+func (a *App) apiListMineHandler(w http.ResponseWriter, r *http.Request) *appError {
+	user := a.profileFromSession(r)
+	if user == nil {
+		return apiErrorf(errUnauthorized, "you must be logged in to list your sessions")
+	}
+	order, desc, appErr := sortParams(r)
+	if appErr != nil {
+		return appErr
+	}
+	limit, token, appErr := parsePageParams(r)
+	if appErr != nil {
+		return appErr
+	}
+	count, appErr := withCount(r)
+	if appErr != nil {
+		return appErr
+	}
+	sessions, err := a.DB.ListSessionsCreatedBy(context.Background(), user.ID, order, desc)
+	if err == vyfe_api.ErrBadSortOrder {
+		return badRequest(err, "unknown sort order %q", order)
+	}
+	if err != nil {
+		return appErrorf(err, "could not list sessions: %v", err)
+	}
+	page, next, appErr := pageOf(sessions, limit, token)
+	if appErr != nil {
+		return appErr
+	}
+	resp := vyfe_api.NewListResponse(page, next)
+	if count {
+		n := len(sessions)
+		resp.TotalCount = &n
+	}
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// withCount reports whether the "withCount" query parameter asks for the
+// total count of a list response.
+func withCount(r *http.Request) (bool, *appError) {
+	v := r.FormValue("withCount")
+	if v == "" {
+		return false, nil
+	}
+	count, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, badRequest(err, "bad withCount: %q", v)
+	}
+	return count, nil
+}
+
+// searchResults is the response of apiSearchHandler.
+type searchResults struct {
+	vyfe_api.ListResponse
+
+	// Facets maps each tag of the results, other than those searched for,
+	// to the number of results carrying it.
+	Facets map[string]int `json:"facets"`
+}
+
+// apiSearchHandler writes a page of the sessions matching the "q" query
+// parameter and carrying every "tag" parameter, with the tag facets of all
+// the results, as a vyfe_api.ListResponse. Only the sessions the viewer may
+// see listed are included, and counted in the facets. The page is selected
+// with the "limit" and "pageToken" query parameters.
+func (a *App) apiSearchHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if err := r.ParseForm(); err != nil {
+		return badRequest(err, "could not parse query: %v", err)
+	}
+	limit, token, appErr := parsePageParams(r)
+	if appErr != nil {
+		return appErr
+	}
+	count, appErr := withCount(r)
+	if appErr != nil {
+		return appErr
+	}
+	tags := r.Form["tag"]
+	results, facets, err := a.DB.SearchWithFacets(context.Background(), strings.TrimSpace(r.Form.Get("q")), tags)
+	if err != nil {
+		return appErrorf(err, "could not search sessions: %v", err)
+	}
+
+	v := a.viewer(r)
+	visible := results[:0]
+	for _, s := range results {
+		if v.CanList(s) {
+			visible = append(visible, s)
+		}
+	}
+	if len(visible) != len(results) {
+		facets = vyfe_api.TagFacets(visible, tags)
+	}
+	page, next, appErr := pageOf(visible, limit, token)
+	if appErr != nil {
+		return appErr
+	}
+	resp := searchResults{ListResponse: *vyfe_api.NewListResponse(page, next), Facets: facets}
+	if count {
+		n := len(visible)
+		resp.TotalCount = &n
+	}
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// apiGetHandler writes a single session as JSON. Its attachment URLs are
+// signed if uploads are private. With the "fields" query parameter, e.g.
+// "?fields=title,author", only the listed fields are written.
+func (a *App) apiGetHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	view, err := vyfe_api.GetSessionWithURLs(context.Background(), a.DB, id)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err != nil {
+		return appErrorf(err, "could not find session: %v", err)
+	}
+	if !a.viewer(r).CanGet(&view.Session) {
+		return sessionForbidden(vyfe_api.ErrForbidden)
+	}
+	if fields := r.FormValue("fields"); fields != "" {
+		projected, err := projectFields(view, fields)
+		if err != nil {
+			return appErrorf(err, "could not select fields: %v", err)
+		}
+		return writeJSON(w, http.StatusOK, projected)
+	}
+	return writeJSON(w, http.StatusOK, view)
+}
+
+// projectFields returns the JSON fields of v named in the comma-separated
+// fields list, e.g. "title,author,videoUrl", as a map to be marshaled in place
+// of v. Names that v doesn't have are ignored.
+func projectFields(v interface{}, fields string) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+
+	projected := make(map[string]json.RawMessage)
+	for _, name := range strings.Split(fields, ",") {
+		name = strings.TrimSpace(name)
+		if value, ok := all[name]; ok {
+			projected[name] = value
+		}
+	}
+	return projected, nil
+}
+
+// apiCreateHandler adds the session in the JSON request body to the database
+// and writes it back, including its new ID.
+func (a *App) apiCreateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	session := &vyfe_api.Session{}
+	if appErr := decodeJSON(w, r, session); appErr != nil {
+		return appErr
+	}
+	session.ID = 0
+	// Nothing is uploaded with API requests, so the session has no files
+	// of its own whatever size or content hash the client sent.
+	session.SizeBytes = 0
+	session.ContentHash = ""
+	a.setCreator(r, session)
+	baseline, err := a.writeBaseline(r, 0)
+	if err != nil {
+		return appErrorf(err, "could not get session: %v", err)
+	}
+	if appErr := a.protectFields(r, session, baseline); appErr != nil {
+		return appErr
+	}
+	if appErr := validateSession(session); appErr != nil {
+		return appErr
+	}
+	user := a.profileFromSession(r)
+	if appErr := a.checkSessionQuota(user); appErr != nil {
+		return appErr
+	}
+	if appErr := a.checkCreateRate(w, r, user); appErr != nil {
+		return appErr
+	}
+
+	id, err := a.DB.AddSession(session)
+	if err != nil {
+		return appErrorf(err, "could not save session: %v", err)
+	}
+	session.ID = id
+	a.publishEventAsync(vyfe_api.EventCreated, id)
+
+	w.Header().Set("Location", "/api/sessions/"+session.URLID())
+	return writeJSON(w, http.StatusCreated, session)
+}
+
+// apiValidateHandler checks the session in the JSON request body without
+// saving it, so forms can show errors before they are submitted. It responds
+// with {"valid":true}, or with 422 and the invalid fields.
+func apiValidateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	session := &vyfe_api.Session{}
+	if appErr := decodeJSON(w, r, session); appErr != nil {
+		return appErr
+	}
+	if appErr := validateSession(session); appErr != nil {
+		appErr.Code = http.StatusUnprocessableEntity
+		return appErr
+	}
+	return writeJSON(w, http.StatusOK, map[string]bool{"valid": true})
+}
+
+// apiUpdateHandler replaces a session with the one in the JSON request body.
+// Only the session's creator and admins may replace it.
+func (a *App) apiUpdateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	if _, appErr := a.managedSession(r, id, "edit"); appErr != nil {
+		return appErr
+	}
+
+	session := &vyfe_api.Session{}
+	if appErr := decodeJSON(w, r, session); appErr != nil {
+		return appErr
+	}
+	session.ID = id
+	// UpdateSession keeps the stored size unless the video or thumbnail
+	// changes, in which case it is no longer an uploaded file's. The content
+	// hash is kept the same way by keepContentHash below.
+	session.SizeBytes = 0
+	session.ContentHash = ""
+	a.setCreator(r, session)
+	baseline, err := a.writeBaseline(r, id)
+	if err != nil {
+		return appErrorf(err, "could not get session: %v", err)
+	}
+	if appErr := a.protectFields(r, session, baseline); appErr != nil {
+		return appErr
+	}
+	if appErr := validateSession(session); appErr != nil {
+		return appErr
+	}
+	a.keepContentHash(session)
+	a.keepCaptions(session)
+
+	if err := a.saveSession(context.Background(), session); err != nil {
+		return appErrorf(err, "could not save session: %v", err)
+	}
+	a.publishUpdateAsync(id, session.ChangedFields)
+	return writeJSON(w, http.StatusOK, session)
+}
+
+// apiDeleteHandler deletes a session and removes its uploaded files. Only the
+// session's creator and admins may delete it.
+func (a *App) apiDeleteHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	// The session is looked up first so that its files can be removed
+	// once it is deleted.
+	session, appErr := a.managedSession(r, id, "delete")
+	if appErr != nil {
+		return appErr
+	}
+	if err := a.DB.DeleteSession(id); err != nil {
+		return appErrorf(err, "could not delete session: %v", err)
+	}
+	a.deleteSessionObjects(context.Background(), session)
+	a.publishEventAsync(vyfe_api.EventDeleted, id)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// apiCreatedStatsHandler writes the sessions added between the "from" and "to"
+// query parameters, inclusive, ordered by creation time. Both accept RFC 3339
+// times or "2006-01-02" dates; from defaults to the zero time and to defaults
+// to now. With "count=true" only the number of sessions is written. Sessions
+// the viewer may not see listed are neither written nor counted.
+func (a *App) apiCreatedStatsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	from, err := parseTimeParam(r.FormValue("from"), time.Time{})
+	if err != nil {
+		return badRequest(err, "bad from time: %v", err)
+	}
+	to, err := parseTimeParam(r.FormValue("to"), time.Now())
+	if err != nil {
+		return badRequest(err, "bad to time: %v", err)
+	}
+	if from.After(to) {
+		return badRequest(nil, "from (%v) must not be after to (%v)", from, to)
+	}
+
+	sessions, err := a.DB.ListSessionsCreatedBetween(context.Background(), from, to)
+	if err != nil {
+		return appErrorf(err, "could not list sessions: %v", err)
+	}
+
+	v := a.viewer(r)
+	visible := sessions[:0]
+	for _, s := range sessions {
+		if v.CanList(s) {
+			visible = append(visible, s)
+		}
+	}
+
+	resp := struct {
+		Count    int                 `json:"count"`
+		Sessions []*vyfe_api.Session `json:"sessions,omitempty"`
+	}{Count: len(visible)}
+	if r.FormValue("count") != "true" {
+		resp.Sessions = visible
+	}
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// parseTimeParam parses a time given as an RFC 3339 time or a "2006-01-02"
+// date, returning def if s is empty.
+func parseTimeParam(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// apiFormSchemaHandler describes the session form fields and their validation
+// rules, so that forms rendered by clients agree with Session.Validate.
+func (a *App) apiFormSchemaHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return writeJSON(w, http.StatusOK, struct {
+		Fields []vyfe_api.FormField `json:"fields"`
+	}{vyfe_api.SessionFormFields})
+}
+
+// writeJSON writes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) *appError {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return appErrorf(err, "could not write response: %v", err)
+	}
+	return nil
+}
+
+// maxJSONBodySize is the largest JSON request body decodeJSON accepts.
+const maxJSONBodySize = 1 << 20
+
+// decodeJSON decodes the JSON request body into v. Fields v doesn't have,
+// data after the JSON value and bodies larger than maxJSONBodySize are
+// rejected. It returns a 400 appError saying what is wrong with the body, and
+// where, rather than the decoder's own message.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) *appError {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badJSON(err)
+	}
+	end := dec.InputOffset()
+	var extra json.RawMessage
+	if err := dec.Decode(&extra); err != io.EOF {
+		return badRequest(err, "request body must contain a single JSON value, found more after position %d", end)
+	}
+	return nil
+}
+
+// badJSON returns the 400 appError for an error decoding a JSON request body.
+func badJSON(err error) *appError {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return badRequest(err, "request body contains malformed JSON at position %d: %v", e.Offset, err)
+	case *json.UnmarshalTypeError:
+		if e.Field == "" {
+			return badRequest(err, "request body must be a JSON %s, not %s", jsonType(e.Type), e.Value)
+		}
+		return badRequest(err, "field %q must be a JSON %s, not %s, at position %d", e.Field, jsonType(e.Type), e.Value, e.Offset)
+	}
+	switch {
+	case err == io.EOF:
+		return badRequest(err, "request body must not be empty")
+	case err == io.ErrUnexpectedEOF:
+		return badRequest(err, "request body contains malformed JSON: it ends in the middle of a value")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return badRequest(err, "request body contains unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	case err.Error() == "http: request body too large":
+		return badRequest(err, "request body must not be larger than %d bytes", maxJSONBodySize)
+	}
+	return badRequest(err, "could not parse request body: %v", err)
+}
+
+// jsonType returns the name of the JSON type a Go value of type t is decoded
+// from, for error messages.
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return t.String()
+}
+
+// badRequest returns a 400 appError.
+func badRequest(err error, format string, v ...interface{}) *appError {
+	return &appError{
+		Error:   err,
+		Message: fmt.Sprintf(format, v...),
+		Code:    http.StatusBadRequest,
+		format:  format,
+		args:    v,
+	}
+}
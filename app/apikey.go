@@ -0,0 +1,63 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// apiKeyHeader is the request header carrying an API key.
+const apiKeyHeader = "X-API-Key"
+
+// apiKeyMiddleware checks requests carrying an API key in the X-API-Key
+// header against vyfe_api.APIKeys. Unknown keys get 401, keys over their
+// RateLimit get 429, and read-only keys get 403 for requests that may change
+// data; all requests with a known key count towards its limit. Requests to
+// /api/ routes without a key get 401 if vyfe_api.RequireAPIKey is set; other
+// requests without a key are passed on as they are.
+func (a *App) apiKeyMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(apiKeyHeader)
+		var e *appError
+		switch {
+		case secret != "":
+			e = a.checkAPIKey(w, r, secret)
+		case vyfe_api.RequireAPIKey && isAPIRequest(r):
+			e = apiErrorf(errUnauthorized, "an API key is required in the %s header", apiKeyHeader)
+		}
+		if e != nil {
+			p := printerFor(r)
+			writeError(w, r, p, localize(p, e))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// checkAPIKey returns an appError if the API key with the given secret is
+// unknown or may not make r.
+func (a *App) checkAPIKey(w http.ResponseWriter, r *http.Request, secret string) *appError {
+	key, ok := vyfe_api.APIKeys[secret]
+	if !ok {
+		return apiErrorf(errUnauthorized, "unknown API key")
+	}
+	if key.RateLimit > 0 && a.apiKeyRate != nil {
+		now := a.apiKeyRate.now()
+		window := vyfe_api.APIKeyRateWindow
+		if a.apiKeyRate.store.Hit("apikey:"+key.Name, now, window) > key.RateLimit {
+			secs := int((window + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			return apiErrorf(errRateLimited, "API key %q made more than %d requests in %v", key.Name, key.RateLimit, window)
+		}
+	}
+	if !isSafeMethod(r.Method) && !key.CanWrite() {
+		return apiErrorf(errForbidden, "API key %q is read-only", key.Name)
+	}
+	return nil
+}
@@ -1,76 +1,325 @@
-
 // Sample sessionshelf is a fully-featured app demonstrating several Google Cloud APIs, including Datastore, Cloud SQL, Cloud Storage.
 // See https://cloud.google.com/go/getting-started/tutorial-app
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 	"cloud.google.com/go/storage"
 
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
 	uuid "github.com/satori/go.uuid"
 
-	"google.golang.org/appengine"
-
 	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
 )
 
 var (
 	// See template.go
-	listTmpl   = parseTemplate("list.html")
-	editTmpl   = parseTemplate("edit.html")
-	detailTmpl = parseTemplate("detail.html")
+	listTmpl    = parseTemplate("list.html")
+	editTmpl    = parseTemplate("edit.html")
+	detailTmpl  = parseTemplate("detail.html")
+	archiveTmpl = parseTemplate("archive.html")
+	searchTmpl  = parseTemplate("search.html")
+
+	notFoundTmpl    = parseTemplate("404.html")
+	serverErrorTmpl = parseTemplate("500.html")
+	errorTmpl       = parseTemplate("error.html")
 )
 
+// App holds the clients the handlers depend on. Handlers are methods on App,
+// so they don't read package-level state and can be tested with fakes.
+type App struct {
+	DB            vyfe_api.SessionDatabase
+	StorageBucket *storage.BucketHandle
+	PubsubClient  *pubsub.Client
+	OAuthConfig   *oauth2.Config
+	SessionStore  sessions.Store
+	// Scanner checks uploads before they are stored. Nil disables scanning.
+	Scanner Scanner
+	// Objects stores uploaded files. It is nil if no storage bucket is
+	// configured.
+	Objects ObjectStore
+	// Cleanup queues the deletion of objects, or is nil to delete them
+	// during the request.
+	Cleanup vyfe_api.CleanupQueue
+	// History keeps recent versions of sessions for apiDiffHandler.
+	History *vyfe_api.History
+
+	// startResumable starts resumable uploads and returns their session
+	// URI. It defaults to startBucketResumable.
+	startResumable func(ctx context.Context, name, contentType, origin string) (string, error)
+	// objectAttrs returns the size and content type of a stored object. It
+	// defaults to bucketObjectAttrs.
+	objectAttrs func(ctx context.Context, name string) (size int64, contentType string, err error)
+	// readObject opens length bytes of a stored object from offset. It
+	// defaults to readBucketObject.
+	readObject func(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+	// checkBucket checks that the storage bucket can be reached. It
+	// defaults to checkBucketAttrs.
+	checkBucket func(ctx context.Context) error
+	// publishObject makes a stored object readable by anyone. It defaults
+	// to publishBucketObject.
+	publishObject func(ctx context.Context, name string) error
+
+	// events fans session changes out to /events clients.
+	events *broker
+	// topic is the Pub/Sub topic session updates are published to, or nil
+	// without a PubsubClient.
+	topic *pubsub.Topic
+	// pending tracks work started by background, so drain can wait for it.
+	pending *sync.WaitGroup
+	// views buffers view counts, or is nil to count each view as it
+	// happens.
+	views *vyfe_api.ViewBuffer
+	// abuse blocks creators that create sessions too quickly. Nil disables
+	// the check.
+	abuse *abuseDetector
+	// apiKeyRate counts the requests made with each API key, to enforce
+	// their RateLimit. Nil disables the limits.
+	apiKeyRate *abuseDetector
+	// cleaner runs the jobs of Cleanup, or is nil without it.
+	cleaner *vyfe_api.CleanupWorker
+}
+
+// newApp returns an App using the clients set up in config.go.
+func newApp() *App {
+	a := &App{
+		DB:            vyfe_api.DB,
+		StorageBucket: vyfe_api.StorageBucket,
+		PubsubClient:  vyfe_api.PubsubClient,
+		OAuthConfig:   vyfe_api.OAuthConfig,
+		SessionStore:  vyfe_api.SessionStore,
+		Scanner:       noopScanner{},
+		History:       vyfe_api.SessionHistory,
+		Cleanup:       vyfe_api.CleanupJobs,
+		events:        newBroker(),
+		pending:       &sync.WaitGroup{},
+		abuse:         newAbuseDetector(newMemoryAbuseStore()),
+		apiKeyRate:    newAbuseDetector(newMemoryAbuseStore()),
+	}
+	if a.PubsubClient != nil {
+		a.topic = a.PubsubClient.Topic(vyfe_api.PubsubTopicID)
+	}
+	if a.StorageBucket != nil {
+		a.Objects = bucketStore{a.StorageBucket}
+	}
+	if a.Cleanup != nil && a.Objects != nil {
+		a.cleaner = vyfe_api.NewCleanupWorker(a.Cleanup, a.Objects.Delete, vyfe_api.CleanupInterval)
+	}
+	if vyfe_api.BufferViews {
+		a.views = vyfe_api.NewViewBuffer(a.DB, vyfe_api.ViewFlushInterval, vyfe_api.ViewFlushThreshold)
+	}
+	a.startResumable = a.startBucketResumable
+	a.objectAttrs = a.bucketObjectAttrs
+	a.readObject = a.readBucketObject
+	a.checkBucket = a.checkBucketAttrs
+	a.publishObject = a.publishBucketObject
+	return a
+}
+
 func main() {
-	registerHandlers()
-	appengine.Main()
+	// Set SEED to load example sessions, e.g. into the in-memory database.
+	if os.Getenv("SEED") != "" {
+		if err := vyfe_api.SeedSessions(context.Background(), vyfe_api.DB); err != nil {
+			log.Fatalf("could not seed sessions: %v", err)
+		}
+	}
+	a := newApp()
+	ctx, cancel := context.WithTimeout(context.Background(), vyfe_api.StartupRetryTimeout)
+	err := a.checkStorage(ctx)
+	cancel()
+	if err != nil {
+		log.Fatal(err)
+	}
+	registerHandlers(a)
+	// The flexible environment checks that instances are healthy here.
+	http.HandleFunc("/_ah/health", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	srv := &http.Server{Addr: ":" + port}
+	drained := a.drainOnShutdown(srv)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-drained
 }
 
-func registerHandlers() {
+// sessionIDVar is the route variable for session IDs, matching numeric IDs
+// and public IDs but not words such as "search" that share their paths.
+const sessionIDVar = "{id:" + vyfe_api.SessionIDPattern + "}"
+
+func registerHandlers(a *App) {
 	// Use gorilla/mux for rich routing.
 	// See http://www.gorillatoolkit.org/pkg/mux
 	r := mux.NewRouter()
+	r.NotFoundHandler = appHandler(notFoundHandler)
+
+	// Read routes are wrapped in readAuth, so that private deployments can
+	// require users to log in to see anything.
 
 	r.Handle("/", http.RedirectHandler("/sessions", http.StatusFound))
 
 	r.Methods("GET").Path("/sessions").
-		Handler(appHandler(listHandler))
-	r.Methods("GET").Path("/sessions/{id:[0-9]+}").
-		Handler(appHandler(detailHandler))
+		Handler(a.readAuth(a.listHandler))
+	r.Methods("GET").Path("/sessions/" + sessionIDVar).
+		Handler(a.readAuth(a.detailHandler))
+	r.Methods("HEAD").Path("/sessions/" + sessionIDVar).
+		Handler(a.readAuth(a.detailHeadHandler))
+	r.Methods("GET").Path("/sessions/search").
+		Handler(a.readAuth(a.searchHandler))
+	r.Methods("GET").Path("/sessions/random").
+		Handler(a.readAuth(a.randomHandler))
+	r.Methods("GET").Path("/sessions/mine").
+		Handler(a.readAuth(a.listMineHandler))
+	r.Methods("GET").Path("/sessions/archive").
+		Handler(a.readAuth(a.archiveHandler))
+	r.Methods("GET").Path("/sessions/archive/{year:[0-9]+}/{month:[0-9]+}").
+		Handler(a.readAuth(a.archiveMonthHandler))
+	r.Methods("GET").Path("/sessions/tag/{tag}").
+		Handler(a.readAuth(a.tagHandler))
+	r.Methods("GET").Path("/sessions/on-this-day").
+		Handler(a.readAuth(a.onThisDayHandler))
+	r.Methods("GET").Path("/sessions/near").
+		Handler(a.readAuth(a.nearHandler))
+	r.Methods("GET").Path("/sessions/feed.xml").
+		Handler(a.readAuth(a.feedHandler))
+	r.Methods("GET").Path("/s/{slug}").
+		Handler(a.readAuth(a.slugHandler))
 	r.Methods("GET").Path("/sessions/add").
-		Handler(appHandler(addFormHandler))
-	r.Methods("GET").Path("/sessions/{id:[0-9]+}/edit").
-		Handler(appHandler(editFormHandler))
+		Handler(a.readAuth(a.addFormHandler))
+	r.Methods("GET").Path("/sessions/" + sessionIDVar + "/edit").
+		Handler(a.readAuth(a.editFormHandler))
 
 	r.Methods("POST").Path("/sessions").
-		Handler(appHandler(createHandler))
-	r.Methods("POST", "PUT").Path("/sessions/{id:[0-9]+}").
-		Handler(appHandler(updateHandler))
-	r.Methods("POST").Path("/sessions/{id:[0-9]+}:delete").
-		Handler(appHandler(deleteHandler)).Name("delete")
+		Handler(appHandler(a.createHandler))
+	r.Methods("POST").Path("/sessions/preview").
+		Handler(appHandler(a.previewHandler))
+	r.Methods("POST", "PUT").Path("/sessions/" + sessionIDVar).
+		Handler(appHandler(a.updateHandler))
+	r.Methods("GET").Path("/sessions/" + sessionIDVar + "/video").
+		Handler(a.readAuth(a.videoHandler))
+	r.Methods("GET").Path("/sessions/" + sessionIDVar + "/captions/{lang}").
+		Handler(a.readAuth(a.captionHandler))
+	r.Methods("POST").Path("/sessions/" + sessionIDVar + "/touch").
+		Handler(appHandler(a.touchHandler))
+	r.Methods("POST").Path("/sessions/" + sessionIDVar + "/lock").
+		Handler(appHandler(a.lockHandler))
+	r.Methods("POST").Path("/sessions/" + sessionIDVar + "/unlock").
+		Handler(appHandler(a.unlockHandler))
+	r.Methods("POST").Path("/sessions/" + sessionIDVar + ":delete").
+		Handler(appHandler(a.deleteHandler)).Name("delete")
+	r.Methods("POST").Path("/sessions/reorder").
+		Handler(a.adminOnly(a.reorderHandler))
+
+	// The following handlers are defined in api.go.
+	r.Methods("GET").Path("/api/sessions").
+		Handler(a.readAuth(a.apiListHandler))
+	r.Methods("GET").Path("/api/sessions/search").
+		Handler(a.readAuth(a.apiSearchHandler))
+	r.Methods("GET").Path("/api/sessions/mine").
+		Handler(appHandler(a.apiListMineHandler))
+	r.Methods("GET").Path("/api/sessions/all").
+		Handler(a.readAuth(a.apiListAllHandler))
+	r.Methods("POST").Path("/api/sessions").
+		Handler(appHandler(a.apiCreateHandler))
+	r.Methods("GET").Path("/api/sessions/" + sessionIDVar).
+		Handler(a.readAuth(a.apiGetHandler))
+	r.Methods("PUT").Path("/api/sessions/" + sessionIDVar).
+		Handler(appHandler(a.apiUpdateHandler))
+	r.Methods("DELETE").Path("/api/sessions/" + sessionIDVar).
+		Handler(appHandler(a.apiDeleteHandler))
+	r.Methods("POST").Path("/api/sessions/validate").
+		Handler(appHandler(apiValidateHandler))
+	r.Methods("GET").Path("/api/sessions/form-schema").
+		Handler(appHandler(a.apiFormSchemaHandler))
+	r.Methods("POST").Path("/api/uploads").
+		Handler(appHandler(a.apiStartUploadHandler))
+	r.Methods("POST").Path("/api/sessions/" + sessionIDVar + "/upload").
+		Handler(appHandler(a.apiFinishUploadHandler))
+	r.Methods("GET").Path("/api/stats/created").
+		Handler(a.readAuth(a.apiCreatedStatsHandler))
+
+	// The following handler is defined in files.go.
+	r.Methods("GET").Path("/api/sessions/" + sessionIDVar + "/files").
+		Handler(a.readAuth(a.apiFilesHandler))
+
+	// The following handlers are defined in diff.go.
+	r.Methods("GET").Path("/sessions/" + sessionIDVar + "/diff").
+		Handler(a.readAuth(a.apiDiffHandler))
+	r.Methods("GET").Path("/api/sessions/" + sessionIDVar + "/diff").
+		Handler(a.readAuth(a.apiDiffHandler))
+
+	// The following handler is defined in events.go.
+	r.Methods("GET").Path("/events").
+		Handler(a.readAuth(a.eventsHandler))
+
+	// The following handlers are defined in admin.go.
+	r.Methods("POST").Path("/api/sessions/batch-delete").
+		Handler(a.adminOnly(a.batchDeleteHandler))
+	r.Methods("POST").Path("/admin/sessions/merge").
+		Handler(a.adminOnly(a.mergeHandler))
+	r.Methods("POST").Path("/admin/sessions/tag").
+		Handler(a.adminOnly(a.batchTagHandler))
+	r.Methods("POST").Path("/admin/tags/rename").
+		Handler(a.adminOnly(a.renameTagHandler))
+	r.Methods("POST").Path("/admin/tags/remove").
+		Handler(a.adminOnly(a.removeTagHandler))
+	r.Methods("POST").Path("/admin/backfill").
+		Handler(a.adminOnly(a.backfillHandler))
+	r.Methods("GET").Path("/admin/duplicates").
+		Handler(a.adminOnly(a.duplicatesHandler))
+
+	r.Methods("GET").Path("/api/admin/stats").
+		Handler(a.adminOnly(a.adminStatsHandler))
+	r.Methods("GET").Path("/api/admin/storage-usage").
+		Handler(a.adminOnly(a.storageUsageHandler))
+	r.Methods("POST").Path("/admin/maintenance").
+		Handler(a.adminOnly(maintenanceHandler))
+	r.Methods("POST").Path("/admin/migration").
+		Handler(a.adminOnly(a.migrationHandler))
+
+	// The following handler is defined in consistency.go.
+	r.Methods("GET").Path("/admin/consistency").
+		Handler(a.adminOnly(a.consistencyHandler))
+	r.Methods("POST").Path("/admin/consistency").
+		Handler(a.adminOnly(a.consistencyHandler))
 
 	// The following handlers are defined in auth.go and used in the
 	// "Authenticating Users" part of the Getting Started guide.
 	r.Methods("GET").Path("/login").
-		Handler(appHandler(loginHandler))
+		Handler(appHandler(a.loginHandler))
 	r.Methods("POST").Path("/logout").
-		Handler(appHandler(logoutHandler))
+		Handler(appHandler(a.logoutHandler))
 	r.Methods("GET").Path("/oauth2callback").
-		Handler(appHandler(oauthCallbackHandler))
+		Handler(appHandler(a.oauthCallbackHandler))
 
 	// Respond to App Engine and Compute Engine health checks.
 	// Indicate the server is healthy.
@@ -81,220 +330,1375 @@ func registerHandlers() {
 
 	// [START request_logging]
 	// Delegate all of the HTTP routing and serving to the gorilla/mux router.
-	// Log all requests using the standard Apache format.
-	http.Handle("/", handlers.CombinedLoggingHandler(os.Stderr, r))
+	// Log all requests using the standard Apache format, and turn panics,
+	// including in the health checks, into 500s. Requests with an API key
+	// are checked against its scope and rate limit.
+	setMaintenance(vyfe_api.MaintenanceMode)
+	http.Handle("/", handlers.CombinedLoggingHandler(os.Stderr, recoverMiddleware(httpsMiddleware(a.apiKeyMiddleware(maintenanceMiddleware(r))))))
 	// [END request_logging]
 }
 
-// listHandler displays a list with summaries of sessions in the database.
-func listHandler(w http.ResponseWriter, r *http.Request) *appError {
-	sessions, err := vyfe_api.DB.ListSessions()
+// listHandler displays a list with summaries of sessions in the database. The
+// sort query parameter orders them by title (the default), favorites or views.
+// The created and deleted query parameters name a session the viewer has just
+// added or deleted, for readYourWrites.
+func (a *App) listHandler(w http.ResponseWriter, r *http.Request) *appError {
+	order := r.FormValue("sort")
+	if order == "" {
+		order = vyfe_api.SortByTitle
+	}
+	v := a.viewer(r)
+	page, err := a.listSessionsSorted(v, order)
+	if err == vyfe_api.ErrBadSortOrder {
+		return badRequest(err, "unknown sort order %q", order)
+	}
 	if err != nil {
 		return appErrorf(err, "could not list sessions: %v", err)
 	}
+	if err := a.readYourWrites(r, v, order, page); err != nil {
+		return appErrorf(err, "could not list sessions: %v", err)
+	}
+
+	preloadThumbnails(w, page.Sessions)
+	return listTmpl.Execute(a, w, r, page)
+}
+
+// listPage is the data of listTmpl.
+type listPage struct {
+	Sessions []*vyfe_api.SessionSummary
+	// Partial is set if the sessions were cut short by
+	// vyfe_api.ListSoftDeadline.
+	Partial bool
+
+	// Tag is the tag the sessions are listed for, if any.
+	Tag string
+	// NextPageURL links to the next page of a paged list, or is empty on
+	// the last page.
+	NextPageURL string
+}
+
+// readYourWrites makes page show the writes named by the "created" and
+// "deleted" query parameters, which hold the session's URL ID.
+//
+// Lists are read with Datastore queries, which are eventually consistent: a
+// session added or deleted a moment ago may be missing from, or still in, the
+// list they return. Lookups by key, like GetSession, are strongly consistent,
+// so a created session is read by its ID and merged into the list, and a
+// deleted one dropped from it once a lookup confirms it is gone. A created
+// session is placed by title in lists ordered by title, and last in the
+// others, as it has no favorites or views yet. Public IDs are resolved with
+// a query, so a session created with one may still be missed.
+func (a *App) readYourWrites(r *http.Request, v vyfe_api.Viewer, order string, page *listPage) error {
+	if raw := r.FormValue("deleted"); raw != "" {
+		for i, s := range page.Sessions {
+			if s.PublicID != raw && strconv.FormatInt(s.ID, 10) != raw {
+				continue
+			}
+			_, err := a.DB.GetSession(s.ID)
+			if err == vyfe_api.ErrSessionNotFound {
+				page.Sessions = append(page.Sessions[:i], page.Sessions[i+1:]...)
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	raw := r.FormValue("created")
+	if raw == "" {
+		return nil
+	}
+	id, err := a.resolveSessionID(raw)
+	if err == vyfe_api.ErrSessionNotFound || err == errBadSessionID {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, s := range page.Sessions {
+		if s.ID == id {
+			return nil
+		}
+	}
+	session, err := a.DB.GetSession(id)
+	if err == vyfe_api.ErrSessionNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !v.CanList(session) {
+		return nil
+	}
+	i := len(page.Sessions)
+	if order == vyfe_api.SortByTitle {
+		i = sort.Search(len(page.Sessions), func(i int) bool { return page.Sessions[i].Title > session.Title })
+	}
+	page.Sessions = append(page.Sessions, nil)
+	copy(page.Sessions[i+1:], page.Sessions[i:])
+	page.Sessions[i] = session.Summary()
+	return nil
+}
 
-	return listTmpl.Execute(w, r, sessions)
+// listSessionsSorted returns the summaries of the sessions v may see listed,
+// in the given order. If vyfe_api.ListSoftDeadline is set, sessions in title
+// order are read with that deadline, and may be partial.
+func (a *App) listSessionsSorted(v vyfe_api.Viewer, order string) (*listPage, error) {
+	ctx := context.Background()
+	page := &listPage{}
+	var all []*vyfe_api.SessionSummary
+	switch {
+	case order == vyfe_api.SortByTitle && vyfe_api.ListSoftDeadline > 0:
+		sessions, partial, err := vyfe_api.ListSessionsWithDeadline(ctx, a.DB, vyfe_api.ListSoftDeadline)
+		if err != nil {
+			return nil, err
+		}
+		all, page.Partial = summaries(sessions), partial
+	case order == vyfe_api.SortByTitle:
+		var err error
+		if all, err = a.DB.ListSessionSummaries(ctx); err != nil {
+			return nil, err
+		}
+	default:
+		sessions, err := a.DB.ListSessionsSorted(ctx, order)
+		if err != nil {
+			return nil, err
+		}
+		all = summaries(sessions)
+	}
+	for _, s := range all {
+		if v.CanListSummary(s) {
+			page.Sessions = append(page.Sessions, s)
+		}
+	}
+	return page, nil
+}
+
+// summaries returns the summaries of sessions, for listTmpl.
+func summaries(sessions []*vyfe_api.Session) []*vyfe_api.SessionSummary {
+	list := make([]*vyfe_api.SessionSummary, len(sessions))
+	for i, s := range sessions {
+		list[i] = s.Summary()
+	}
+	return list
+}
+
+// randomSessionCandidates is the number of random sessions randomHandler
+// fetches to find one the viewer may see.
+const randomSessionCandidates = 10
+
+// randomHandler redirects to the detail page of a random session the viewer
+// may see listed, or to the session list if there is none.
+func (a *App) randomHandler(w http.ResponseWriter, r *http.Request) *appError {
+	sessions, err := a.DB.RandomSessions(context.Background(), randomSessionCandidates)
+	if err != nil {
+		return appErrorf(err, "could not pick a random session: %v", err)
+	}
+	v := a.viewer(r)
+	for _, s := range sessions {
+		if v.CanList(s) {
+			http.Redirect(w, r, "/sessions/"+s.URLID(), http.StatusFound)
+			return nil
+		}
+	}
+	http.Redirect(w, r, "/sessions", http.StatusFound)
+	return nil
+}
+
+// archiveHandler displays the number of sessions the viewer may see listed
+// published in each month.
+func (a *App) archiveHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := context.Background()
+	v := a.viewer(r)
+	var buckets []vyfe_api.ArchiveBucket
+	if v.Admin {
+		var err error
+		if buckets, err = a.DB.ListArchiveCounts(ctx); err != nil {
+			return appErrorf(err, "could not list archive: %v", err)
+		}
+	} else {
+		// Only admins may see every session counted, so count the
+		// viewer's own list.
+		sessions, err := a.DB.ListSessionsFor(ctx, v)
+		if err != nil {
+			return appErrorf(err, "could not list archive: %v", err)
+		}
+		buckets = vyfe_api.ArchiveBuckets(sessions)
+	}
+	return archiveTmpl.Execute(a, w, r, buckets)
+}
+
+// archiveMonthHandler displays the sessions published in a month, or those
+// without a published date for /sessions/archive/0/0.
+func (a *App) archiveMonthHandler(w http.ResponseWriter, r *http.Request) *appError {
+	year, err := strconv.Atoi(mux.Vars(r)["year"])
+	if err != nil {
+		return badRequest(err, "bad year: %v", err)
+	}
+	month, err := strconv.Atoi(mux.Vars(r)["month"])
+	if err != nil {
+		return badRequest(err, "bad month: %v", err)
+	}
+	if !(year == 0 && month == 0) && (year < 1 || month < 1 || month > 12) {
+		return badRequest(nil, "bad archive month: %d/%d", year, month)
+	}
+
+	sessions, err := a.DB.ListSessionsByMonth(context.Background(), year, month)
+	if err != nil {
+		return appErrorf(err, "could not list sessions: %v", err)
+	}
+	v := a.viewer(r)
+	visible := sessions[:0]
+	for _, s := range sessions {
+		if v.CanList(s) {
+			visible = append(visible, s)
+		}
+	}
+	page := &listPage{Sessions: summaries(visible)}
+	preloadThumbnails(w, page.Sessions)
+	return listTmpl.Execute(a, w, r, page)
+}
+
+// onThisDayHandler displays the sessions published on today's month and day,
+// in UTC, in any year, most recently published first.
+func (a *App) onThisDayHandler(w http.ResponseWriter, r *http.Request) *appError {
+	sessions, err := a.DB.ListSessionsOnThisDay(context.Background(), time.Now().UTC())
+	if err != nil {
+		return appErrorf(err, "could not list sessions: %v", err)
+	}
+	v := a.viewer(r)
+	visible := sessions[:0]
+	for _, s := range sessions {
+		if v.CanList(s) {
+			visible = append(visible, s)
+		}
+	}
+	page := &listPage{Sessions: summaries(visible)}
+	preloadThumbnails(w, page.Sessions)
+	return listTmpl.Execute(a, w, r, page)
+}
+
+// defaultNearRadiusKm is the radius searched by nearHandler when the request
+// doesn't give one.
+const defaultNearRadiusKm = 25
+
+// nearHandler displays the sessions held within "radius" km, 25 by default,
+// of the point given by the "lat" and "lng" query parameters, nearest first.
+func (a *App) nearHandler(w http.ResponseWriter, r *http.Request) *appError {
+	var lat, lng float64
+	radius := float64(defaultNearRadiusKm)
+	for _, p := range []struct {
+		name     string
+		v        *float64
+		required bool
+	}{
+		{"lat", &lat, true},
+		{"lng", &lng, true},
+		{"radius", &radius, false},
+	} {
+		v := r.FormValue(p.name)
+		if v == "" && !p.required {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return badRequest(err, "bad %s: %q", p.name, v)
+		}
+		*p.v = f
+	}
+
+	sessions, err := a.DB.ListSessionsNear(context.Background(), lat, lng, radius, vyfe_api.PageSize)
+	if err == vyfe_api.ErrBadLocation {
+		return badRequest(err, "location out of range: lat=%v lng=%v radius=%v", lat, lng, radius)
+	}
+	if err != nil {
+		return appErrorf(err, "could not list sessions: %v", err)
+	}
+	v := a.viewer(r)
+	visible := sessions[:0]
+	for _, s := range sessions {
+		if v.CanList(s) {
+			visible = append(visible, s)
+		}
+	}
+	page := &listPage{Sessions: summaries(visible)}
+	preloadThumbnails(w, page.Sessions)
+	return listTmpl.Execute(a, w, r, page)
+}
+
+// tagHandler displays a page of the sessions with the tag in the URL, in
+// title order, taking the page size from the "limit" query parameter and
+// the page from "pageToken". Sessions the user may not see listed are left
+// out, so pages may be short.
+func (a *App) tagHandler(w http.ResponseWriter, r *http.Request) *appError {
+	tag := mux.Vars(r)["tag"]
+	limit, token, appErr := parsePageParams(r)
+	if appErr != nil {
+		return appErr
+	}
+	sessions, next, err := a.DB.ListSessionsByTagPage(context.Background(), tag, limit, token)
+	if err == vyfe_api.ErrBadPageToken {
+		return badRequest(err, "bad page token: %q", token)
+	}
+	if err != nil {
+		return appErrorf(err, "could not list sessions: %v", err)
+	}
+	v := a.viewer(r)
+	visible := sessions[:0]
+	for _, s := range sessions {
+		if v.CanList(s) {
+			visible = append(visible, s)
+		}
+	}
+
+	page := &listPage{Tag: tag, Sessions: summaries(visible)}
+	if next != "" {
+		q := url.Values{"pageToken": {next}}
+		if r.FormValue("limit") != "" {
+			q.Set("limit", strconv.Itoa(limit))
+		}
+		page.NextPageURL = "/sessions/tag/" + url.PathEscape(tag) + "?" + q.Encode()
+	}
+	preloadThumbnails(w, page.Sessions)
+	return listTmpl.Execute(a, w, r, page)
+}
+
+// searchPageSize is the number of results per page of /sessions/search.
+const searchPageSize = 20
+
+// searchPage is the data of the search results page.
+type searchPage struct {
+	Query    string
+	Total    int
+	Sessions []*vyfe_api.Session
+	// PrevPage and NextPage are the adjacent page numbers, or 0 if there
+	// is no such page.
+	PrevPage, NextPage int
+}
+
+// searchHandler displays a page of the sessions matching the "q" query
+// parameter, with the total number of matches. Pages are numbered from 1 by
+// the "page" parameter. Sessions the viewer may not see listed are neither
+// shown nor counted.
+func (a *App) searchHandler(w http.ResponseWriter, r *http.Request) *appError {
+	page := 1
+	if v := r.FormValue("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return badRequest(err, "bad page: %q", v)
+		}
+		page = n
+	}
+
+	ctx := context.Background()
+	data := searchPage{Query: strings.TrimSpace(r.FormValue("q"))}
+	if v := a.viewer(r); v.Admin {
+		var err error
+		if data.Total, err = a.DB.CountSearchSessions(ctx, data.Query); err != nil {
+			return appErrorf(err, "could not search sessions: %v", err)
+		}
+		data.Sessions, err = a.DB.SearchSessions(ctx, data.Query, searchPageSize, (page-1)*searchPageSize)
+		if err != nil {
+			return appErrorf(err, "could not search sessions: %v", err)
+		}
+	} else {
+		// The database can't page past sessions hidden from the viewer,
+		// so page through all the visible matches here.
+		results, _, err := a.DB.SearchWithFacets(ctx, data.Query, nil)
+		if err != nil {
+			return appErrorf(err, "could not search sessions: %v", err)
+		}
+		visible := results[:0]
+		for _, s := range results {
+			if v.CanList(s) {
+				visible = append(visible, s)
+			}
+		}
+		data.Total = len(visible)
+		if start := (page - 1) * searchPageSize; start < len(visible) {
+			data.Sessions = visible[start:]
+			if len(data.Sessions) > searchPageSize {
+				data.Sessions = data.Sessions[:searchPageSize]
+			}
+		}
+	}
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if page*searchPageSize < data.Total {
+		data.NextPage = page + 1
+	}
+	return searchTmpl.Execute(a, w, r, data)
+}
+
+// preloadThumbnails adds Link preload headers for the thumbnails of the first
+// vyfe_api.ThumbnailPreloadCount sessions so browsers can start fetching them
+// before the page is parsed. Sessions without a thumbnail, or with one that
+// isn't a valid URL, are skipped.
+func preloadThumbnails(w http.ResponseWriter, sessions []*vyfe_api.SessionSummary) {
+	for i, s := range sessions {
+		if i == vyfe_api.ThumbnailPreloadCount {
+			break
+		}
+		if s.ThumbnailURL == "" {
+			continue
+		}
+		u, err := url.Parse(s.ThumbnailURL)
+		if err != nil {
+			continue
+		}
+		// Thumbnail URLs come from clients; re-encode the query so a
+		// stray ">" or "," can't end the link or start another one.
+		if u.RawQuery != "" {
+			u.RawQuery = u.Query().Encode()
+		}
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=preload; as=image", u))
+	}
 }
 
 // listMineHandler displays a list of sessions created by the currently
-// authenticated user.
-func listMineHandler(w http.ResponseWriter, r *http.Request) *appError {
-	user := profileFromSession(r)
+// authenticated user. The sort query parameter orders them by title (the
+// default), created or updated time, and order=desc reverses the order.
+func (a *App) listMineHandler(w http.ResponseWriter, r *http.Request) *appError {
+	user := a.profileFromSession(r)
 	if user == nil {
 		http.Redirect(w, r, "/login?redirect=/sessions/mine", http.StatusFound)
 		return nil
 	}
 
-	sessions, err := vyfe_api.DB.ListSessionsCreatedBy(user.ID)
+	order, desc, appErr := sortParams(r)
+	if appErr != nil {
+		return appErr
+	}
+	sessions, err := a.DB.ListSessionsCreatedBy(context.Background(), user.ID, order, desc)
+	if err == vyfe_api.ErrBadSortOrder {
+		return badRequest(err, "unknown sort order %q", order)
+	}
 	if err != nil {
 		return appErrorf(err, "could not list sessions: %v", err)
 	}
 
-	return listTmpl.Execute(w, r, sessions)
+	page := &listPage{Sessions: summaries(sessions)}
+	preloadThumbnails(w, page.Sessions)
+	return listTmpl.Execute(a, w, r, page)
+}
+
+// sortParams returns the order of a list of the user's sessions given by the
+// "sort" query parameter, SortByTitle by default, and whether the "order"
+// query parameter asks for it reversed with "desc" rather than "asc".
+func sortParams(r *http.Request) (order string, desc bool, appErr *appError) {
+	order = r.FormValue("sort")
+	if order == "" {
+		order = vyfe_api.SortByTitle
+	}
+	switch dir := r.FormValue("order"); dir {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		return "", false, badRequest(nil, "unknown sort direction %q", dir)
+	}
+	return order, desc, nil
+}
+
+// errBadSessionID is returned by resolveSessionID for an ID that is neither
+// numeric nor a public ID.
+var errBadSessionID = errors.New("bad session id")
+
+// resolveSessionID returns the numeric ID of the session with the given ID
+// from a URL, which is either a public ID or, if vyfe_api.NumericIDs is set
+// or the session has no public ID, its numeric ID.
+func (a *App) resolveSessionID(raw string) (int64, error) {
+	if vyfe_api.IsPublicID(raw) {
+		session, err := a.DB.GetSessionByPublicID(context.Background(), raw)
+		if err != nil {
+			return 0, err
+		}
+		return session.ID, nil
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, errBadSessionID
+	}
+	if !vyfe_api.NumericIDs {
+		session, err := a.DB.GetSession(id)
+		if err != nil {
+			return 0, err
+		}
+		if session.PublicID != "" {
+			return 0, vyfe_api.ErrSessionNotFound
+		}
+	}
+	return id, nil
+}
+
+// sessionIDFromRequest returns the numeric ID of the session given by the
+// session ID in the URL's path, as resolveSessionID does.
+func (a *App) sessionIDFromRequest(r *http.Request) (int64, *appError) {
+	id, err := a.resolveSessionID(mux.Vars(r)["id"])
+	switch err {
+	case nil:
+		return id, nil
+	case vyfe_api.ErrSessionNotFound:
+		return 0, sessionNotFound(err)
+	case errBadSessionID:
+		return 0, badRequest(err, "%v", err)
+	}
+	return 0, appErrorf(err, "could not find session: %v", err)
 }
 
 // sessionFromRequest retrieves a session from the database given a session ID in the
 // URL's path.
-func sessionFromRequest(r *http.Request) (*vyfe_api.Session, error) {
-	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("bad session id: %v", err)
+func (a *App) sessionFromRequest(r *http.Request) (*vyfe_api.Session, error) {
+	id, err := a.resolveSessionID(mux.Vars(r)["id"])
+	if err == errBadSessionID {
+		return nil, err
+	}
+	var session *vyfe_api.Session
+	if err == nil {
+		session, err = vyfe_api.GetSessionFor(a.DB, id, a.viewer(r))
+	}
+	if err == vyfe_api.ErrSessionNotFound || err == vyfe_api.ErrForbidden {
+		return nil, err
 	}
-	session, err := vyfe_api.DB.GetSession(id)
 	if err != nil {
 		return nil, fmt.Errorf("could not find session: %v", err)
 	}
 	return session, nil
 }
 
+// sessionNotFound returns a 404 appError for a session that doesn't exist.
+func sessionNotFound(err error) *appError {
+	return &appError{Error: err, Message: "session not found", Code: http.StatusNotFound, format: "session not found"}
+}
+
+// sessionForbidden returns a 403 appError for a session the user may not see.
+func sessionForbidden(err error) *appError {
+	msg := "you may not view this session"
+	return &appError{Error: err, Message: msg, Code: http.StatusForbidden, format: msg}
+}
+
 // detailHandler displays the details of a given session.
-func detailHandler(w http.ResponseWriter, r *http.Request) *appError {
-	session, err := sessionFromRequest(r)
+func (a *App) detailHandler(w http.ResponseWriter, r *http.Request) *appError {
+	session, err := a.sessionFromRequest(r)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err == vyfe_api.ErrForbidden {
+		return sessionForbidden(err)
+	}
 	if err != nil {
 		return appErrorf(err, "%v", err)
 	}
+	return a.renderDetail(w, r, session)
+}
+
+// slugHandler displays the details of the session with a given slug.
+func (a *App) slugHandler(w http.ResponseWriter, r *http.Request) *appError {
+	session, err := a.DB.GetSessionBySlug(context.Background(), mux.Vars(r)["slug"])
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err != nil {
+		return appErrorf(err, "could not find session: %v", err)
+	}
+	if !a.viewer(r).CanGet(session) {
+		return sessionForbidden(vyfe_api.ErrForbidden)
+	}
+	return a.renderDetail(w, r, session)
+}
+
+// countView counts a view of the session with the given ID. Failing to
+// count it is only logged, so the page is still shown.
+func (a *App) countView(sessionID int64) {
+	if a.views != nil {
+		a.views.Add(sessionID)
+		return
+	}
+	if err := a.DB.IncrementViewCount(context.Background(), sessionID, 1); err != nil {
+		log.Printf("Could not count view of session %d: %v", sessionID, err)
+	}
+}
+
+// renderDetail writes the detail page of session, including related sessions,
+// and counts the view.
+func (a *App) renderDetail(w http.ResponseWriter, r *http.Request, session *vyfe_api.Session) *appError {
+	a.countView(session.ID)
+
+	related, err := a.DB.RelatedSessions(context.Background(), session.ID, relatedSessionsLimit)
+	if err != nil {
+		return appErrorf(err, "could not find related sessions: %v", err)
+	}
+	v := a.viewer(r)
+	var visible []*vyfe_api.Session
+	for _, s := range related {
+		if v.CanList(s) {
+			visible = append(visible, s)
+		}
+	}
 
-	return detailTmpl.Execute(w, r, session)
+	prev, next, err := a.DB.AdjacentSessions(context.Background(), session.ID)
+	if err != nil {
+		return appErrorf(err, "could not find adjacent sessions: %v", err)
+	}
+	if prev != nil && !v.CanList(prev) {
+		prev = nil
+	}
+	if next != nil && !v.CanList(next) {
+		next = nil
+	}
+
+	return detailTmpl.Execute(a, w, r, &sessionDetail{
+		Session: session,
+		Related: visible,
+		Prev:    prev,
+		Next:    next,
+		Meta:    shareMetaFor(r, session),
+	})
+}
+
+// relatedSessionsLimit is the number of related sessions shown on a session's
+// detail page.
+const relatedSessionsLimit = 5
+
+// sessionDetail is the data for detailTmpl.
+type sessionDetail struct {
+	*vyfe_api.Session
+	Related []*vyfe_api.Session
+
+	// Prev and Next are the sessions before and after this one in title
+	// order, if the viewer may see them listed.
+	Prev, Next *vyfe_api.Session
+
+	// Meta is the link preview metadata of the page.
+	Meta *shareMeta
+
+	// Preview is set when the session hasn't been saved, so the page
+	// leaves out the actions on it.
+	Preview bool
+}
+
+// detailHeadHandler answers HEAD requests for a session's detail page with
+// the same status and headers as detailHandler, but no body. It only checks
+// that the session exists rather than fetching it.
+func (a *App) detailHeadHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	ok, err := a.DB.SessionExists(context.Background(), id)
+	if err != nil {
+		return appErrorf(err, "could not find session: %v", err)
+	}
+	if !ok {
+		return sessionNotFound(vyfe_api.ErrSessionNotFound)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
 // addFormHandler displays a form that captures details of a new session to add to
-// the database.
-func addFormHandler(w http.ResponseWriter, r *http.Request) *appError {
-	return editTmpl.Execute(w, r, nil)
+// the database, prefilled with vyfe_api.NewSessionDefaults.
+func (a *App) addFormHandler(w http.ResponseWriter, r *http.Request) *appError {
+	form := &editForm{Session: vyfe_api.NewSessionDefaults.Session(time.Now())}
+	return editTmpl.Execute(a, w, r, form)
 }
 
 // editFormHandler displays a form that allows the user to edit the details of
-// a given session.
-func editFormHandler(w http.ResponseWriter, r *http.Request) *appError {
-	session, err := sessionFromRequest(r)
+// a given session, taking the edit lock on it for the logged in user. If
+// someone else holds the lock, the form says so, but may still be used.
+func (a *App) editFormHandler(w http.ResponseWriter, r *http.Request) *appError {
+	session, err := a.sessionFromRequest(r)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err == vyfe_api.ErrForbidden {
+		return sessionForbidden(err)
+	}
 	if err != nil {
 		return appErrorf(err, "%v", err)
 	}
 
-	return editTmpl.Execute(w, r, session)
+	form, err := a.lockForEditing(r, session)
+	if err != nil {
+		return appErrorf(err, "could not lock session: %v", err)
+	}
+	return editTmpl.Execute(a, w, r, form)
 }
 
 // sessionFromForm populates the fields of a Session from form values
 // (see templates/edit.html).
-func sessionFromForm(r *http.Request) (*vyfe_api.Session, error) {
-	videoURL, err := uploadFileFromForm(r)
+func (a *App) sessionFromForm(r *http.Request) (*vyfe_api.Session, error) {
+	up, err := a.uploadFileFromForm(r)
+	if err == errUnsafeUpload || err == errUploadsDisabled {
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("could not upload file: %v", err)
 	}
-	if videoURL == "" {
-		videoURL = r.FormValue("videoURL")
+	captions, err := a.uploadCaptionsFromForm(r)
+	if err == errBadCaption || err == errUploadsDisabled {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not upload captions: %v", err)
+	}
+	return a.sessionFromFormValues(r, up, captions), nil
+}
+
+// sessionFromFormValues populates the fields of a Session from form values,
+// taking the video and captions from those uploaded by sessionFromForm. With
+// no upload, the video is the one given by URL in the form.
+func (a *App) sessionFromFormValues(r *http.Request, up *upload, captions []vyfe_api.Caption) *vyfe_api.Session {
+	if up == nil {
+		up = &upload{
+			URL:          r.FormValue("videoURL"),
+			ThumbnailURL: r.FormValue("thumbnailURL"),
+		}
+	}
+	if up.ThumbnailURL == "" {
+		up.ThumbnailURL = r.FormValue("thumbnailURL")
 	}
 
 	session := &vyfe_api.Session{
 		Title:         r.FormValue("title"),
 		Author:        r.FormValue("author"),
 		PublishedDate: r.FormValue("publishedDate"),
-		VideoURL:      videoURL,
+		VideoURL:      up.URL,
+		ThumbnailURL:  up.ThumbnailURL,
+		ContentHash:   up.ContentHash,
+		SizeBytes:     up.SizeBytes,
 		Description:   r.FormValue("description"),
+		Visibility:    r.FormValue("visibility"),
 		CreatedBy:     r.FormValue("createdBy"),
 		CreatedByID:   r.FormValue("createdByID"),
+		Tags:          parseTags(r.FormValue("tags")),
+		Captions:      captions,
+		Objects:       up.Objects,
+	}
+	for _, c := range captions {
+		if name, ok := vyfe_api.ObjectName(c.URL); ok {
+			session.Objects = append(session.Objects, name)
+		}
 	}
+	session.Presenters = parsePresenters(r.Form["presenter"], session.Author)
 
 	// If the form didn't carry the user information for the creator, populate it
 	// from the currently logged in user (or mark as anonymous).
-	if session.CreatedByID == "" {
-		user := profileFromSession(r)
-		if user != nil {
-			// Logged in.
-			session.CreatedBy = user.DisplayName
-			session.CreatedByID = user.ID
-		} else {
-			// Not logged in.
-			session.SetCreatorAnonymous()
+	a.setCreator(r, session)
+
+	return session
+}
+
+// validateSession returns a 400 appError if the session is invalid. Otherwise
+// it fills in the session's canonical PublishedAt time.
+func validateSession(session *vyfe_api.Session) *appError {
+	if err := session.Validate(); err != nil {
+		return badRequest(err, "%v", err)
+	}
+	session.PublishedAt = time.Time{}
+	if session.PublishedDate != "" {
+		// Validate has already checked that the date parses.
+		session.PublishedAt, _ = vyfe_api.ParsePublishedDate(session.PublishedDate)
+	}
+	return nil
+}
+
+// setCreator populates the creator of a session from the currently logged in
+// user (or marks it as anonymous) if it isn't already set.
+func (a *App) setCreator(r *http.Request, session *vyfe_api.Session) {
+	if session.CreatedByID != "" {
+		return
+	}
+	user := a.profileFromSession(r)
+	if user != nil {
+		// Logged in.
+		session.CreatedBy = user.DisplayName
+		session.CreatedByID = user.ID
+	} else {
+		// Not logged in.
+		session.SetCreatorAnonymous()
+	}
+}
+
+// parseTags splits a comma-separated list of tags, trimming whitespace and
+// dropping empty and repeated tags.
+func parseTags(s string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
 		}
+		seen[t] = true
+		tags = append(tags, t)
 	}
+	return tags
+}
 
-	return session, nil
+// parsePresenters returns the co-presenters given in repeated "presenter"
+// form fields, trimming whitespace and dropping empty and repeated names and
+// the author, who is already the primary presenter.
+func parsePresenters(names []string, author string) []string {
+	var presenters []string
+	seen := map[string]bool{strings.TrimSpace(author): true, "": true}
+	for _, p := range names {
+		p = strings.TrimSpace(p)
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		presenters = append(presenters, p)
+	}
+	return presenters
 }
 
-// uploadFileFromForm uploads a file if it's present in the "image" form field.
-func uploadFileFromForm(r *http.Request) (url string, err error) {
+// upload describes a file uploaded with a session form.
+type upload struct {
+	URL          string
+	ThumbnailURL string
+	ContentHash  string
+	// SizeBytes is the total size of the stored objects.
+	SizeBytes int64
+	// Objects are the names of the objects stored by the upload, or those
+	// of another session that were reused instead. Sessions sharing objects
+	// each list them, so whichever is deleted last removes them.
+	Objects []string
+}
+
+// uploadFileFromForm uploads a file if it's present in the "image" form field,
+// returning nil if it isn't, or errUploadsDisabled if
+// vyfe_api.UploadsEnabled isn't set. If a session already has a file with the same
+// content, its URLs are reused instead of storing the file again.
+// If vyfe_api.ConvertImagesToWebP is set and the file is a JPEG or PNG image,
+// a WebP copy is stored next to it and its URL returned as the thumbnail.
+func (a *App) uploadFileFromForm(r *http.Request) (*upload, error) {
 	f, fh, err := r.FormFile("image")
 	if err == http.ErrMissingFile {
-		return "", nil
+		return nil, nil
 	}
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if !vyfe_api.UploadsEnabled {
+		return nil, errUploadsDisabled
 	}
 
-	if vyfe_api.StorageBucket == nil {
-		return "", errors.New("storage bucket is missing - check config.go")
+	ctx := context.Background()
+
+	// Hash the file as it's read, then rewind it for storing.
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	up := &upload{ContentHash: hex.EncodeToString(h.Sum(nil))}
+
+	// Scan before anything is stored, so a flagged file never becomes public.
+	if a.Scanner != nil {
+		clean, err := a.Scanner.Scan(ctx, f)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan file: %v", err)
+		}
+		if !clean {
+			return nil, errUnsafeUpload
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	existing, err := a.DB.LookupByContentHash(ctx, up.ContentHash)
+	if err != nil && err != vyfe_api.ErrSessionNotFound {
+		return nil, err
+	}
+	if err == nil {
+		// Only reuse objects we stored, not URLs a user has edited in.
+		if _, ok := vyfe_api.ObjectName(existing.VideoURL); ok {
+			up.URL, up.ThumbnailURL = existing.VideoURL, existing.ThumbnailURL
+			up.SizeBytes = existing.SizeBytes
+			for _, name := range existing.Objects {
+				if url := vyfe_api.ObjectURL(name); url == up.URL || url == up.ThumbnailURL {
+					up.Objects = append(up.Objects, name)
+				}
+			}
+			return up, nil
+		}
 	}
 
 	// random filename, retaining existing extension.
-	name := uuid.Must(uuid.NewV4()).String() + path.Ext(fh.Filename)
+	base := uuid.Must(uuid.NewV4()).String()
+	name := base + path.Ext(fh.Filename)
+	contentType := fh.Header.Get("Content-Type")
 
-	ctx := context.Background()
-	w := vyfe_api.StorageBucket.Object(name).NewWriter(ctx)
-	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
-	w.ContentType = fh.Header.Get("Content-Type")
+	if a.Objects == nil {
+		// checkStorage makes sure this doesn't happen with uploads enabled.
+		return nil, errors.New("storage bucket is missing - check config.go")
+	}
+	up.URL, err = a.Objects.Upload(ctx, name, contentType, f)
+	if err != nil {
+		return nil, err
+	}
+	up.Objects = append(up.Objects, name)
+	up.SizeBytes = fh.Size
 
-	// Entries are immutable, be aggressive about caching (1 day).
-	w.CacheControl = "public, max-age=86400"
+	if !vyfe_api.ConvertImagesToWebP || !isWebPConvertible(contentType) {
+		return up, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	webp, err := transcodeToWebP(f)
+	if err != nil {
+		// Keep the original upload, without a WebP variant.
+		log.Printf("Could not convert %s to WebP: %v", name, err)
+		return up, nil
+	}
+	up.ThumbnailURL, err = a.Objects.Upload(ctx, base+".webp", "image/webp", bytes.NewReader(webp))
+	if err != nil {
+		return nil, err
+	}
+	up.Objects = append(up.Objects, base+".webp")
+	up.SizeBytes += int64(len(webp))
+	return up, nil
+}
+
+// keepContentHash copies the stored session's content hash to an edited
+// session that still has the same video, since the edit form doesn't carry
+// it. The size is kept by UpdateSession.
+func (a *App) keepContentHash(session *vyfe_api.Session) {
+	if session.ContentHash != "" {
+		return
+	}
+	old, err := a.DB.GetSession(session.ID)
+	if err == nil && old.VideoURL == session.VideoURL {
+		session.ContentHash = old.ContentHash
+	}
+}
 
-	if _, err := io.Copy(w, f); err != nil {
-		return "", err
+// cacheControlFor returns the Cache-Control of an uploaded object with the
+// given content type, as configured in vyfe_api.UploadCacheControl.
+func cacheControlFor(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return vyfe_api.DefaultUploadCacheControl
+	}
+	if cc, ok := vyfe_api.UploadCacheControl[mediaType]; ok {
+		return cc
 	}
-	if err := w.Close(); err != nil {
-		return "", err
+	if i := strings.Index(mediaType, "/"); i >= 0 {
+		if cc, ok := vyfe_api.UploadCacheControl[mediaType[:i]+"/*"]; ok {
+			return cc
+		}
 	}
+	return vyfe_api.DefaultUploadCacheControl
+}
+
+// deleteSessionObjects removes the files uploaded for a deleted session.
+// Failures are only logged, since the session itself is already gone.
+func (a *App) deleteSessionObjects(ctx context.Context, session *vyfe_api.Session) {
+	a.deleteObjects(ctx, session, sessionURLs(session))
+}
 
-	const publicURL = "https://storage.googleapis.com/%s/%s"
-	return fmt.Sprintf(publicURL, vyfe_api.StorageBucketName, name), nil
+// sessionURLs returns the video, thumbnail and caption URLs of session.
+func sessionURLs(session *vyfe_api.Session) []string {
+	return append([]string{session.VideoURL, session.ThumbnailURL}, captionURLs(session)...)
 }
 
-// createHandler adds a session to the database.
-func createHandler(w http.ResponseWriter, r *http.Request) *appError {
-	session, err := sessionFromForm(r)
+// saveSession updates session in the database and then, if
+// vyfe_api.ObjectWrites.DeleteReplaced is set, deletes the files uploaded
+// for its previous video, thumbnail and caption URLs if they changed.
+// The objects uploaded for the stored session that session still uses are
+// kept in session.Objects, along with those just uploaded for it.
+func (a *App) saveSession(ctx context.Context, session *vyfe_api.Session) error {
+	var old vyfe_api.Session
+	stored, err := a.DB.GetSession(session.ID)
+	if err != nil && err != vyfe_api.ErrSessionNotFound {
+		return err
+	}
+	if stored != nil {
+		// Copy it, as the database may update the stored session in place.
+		old = *stored
+	}
+
+	current := make(map[string]bool)
+	for _, url := range sessionURLs(session) {
+		current[url] = true
+	}
+	uploaded := append(append([]string(nil), old.Objects...), session.Objects...)
+	session.Objects = nil
+	kept := make(map[string]bool)
+	for _, name := range uploaded {
+		if current[vyfe_api.ObjectURL(name)] && !kept[name] {
+			session.Objects = append(session.Objects, name)
+			kept[name] = true
+		}
+	}
+	if err := a.DB.UpdateSession(session); err != nil {
+		return err
+	}
+
+	if !vyfe_api.ObjectWrites.DeleteReplaced {
+		return nil
+	}
+	var replaced []string
+	for _, url := range sessionURLs(&old) {
+		if url != "" && !current[url] {
+			replaced = append(replaced, url)
+		}
+	}
+	a.deleteObjects(ctx, &old, replaced)
+	return nil
+}
+
+// deleteObjects removes the files uploaded for session at the given URLs, or
+// queues their removal if a.Cleanup is set. URLs of objects that weren't
+// uploaded for session, as listed in session.Objects, are skipped. Failures
+// are only logged.
+func (a *App) deleteObjects(ctx context.Context, session *vyfe_api.Session, urls []string) {
+	if a.Objects == nil || len(urls) == 0 || len(session.Objects) == 0 {
+		return
+	}
+	// Uploads with the same content share objects, so leave them while
+	// another session still uses them.
+	if session.ContentHash != "" {
+		if other, err := a.DB.LookupByContentHash(ctx, session.ContentHash); err == nil && other.ID != session.ID {
+			return
+		}
+	}
+	uploaded := make(map[string]bool)
+	for _, name := range session.Objects {
+		uploaded[name] = true
+	}
+	for _, url := range urls {
+		name, ok := vyfe_api.ObjectName(url)
+		if !ok || !uploaded[name] {
+			continue
+		}
+		if a.Cleanup != nil {
+			err := a.Cleanup.Enqueue(ctx, name)
+			if err == nil {
+				continue
+			}
+			log.Printf("Could not queue deleting %s for session %d, deleting it now: %v", name, session.ID, err)
+		}
+		if err := a.Objects.Delete(ctx, name); err != nil {
+			log.Printf("Could not delete %s for session %d: %v", name, session.ID, err)
+		}
+	}
+}
+
+// createHandler adds a session to the database, filling in the fields left
+// blank from vyfe_api.NewSessionDefaults.
+func (a *App) createHandler(w http.ResponseWriter, r *http.Request) *appError {
+	// Check what can be checked before any files are stored, so a rejected
+	// submission doesn't leave orphaned objects in the bucket.
+	user := a.profileFromSession(r)
+	draft := a.sessionFromFormValues(r, nil, nil)
+	if _, _, err := r.FormFile("image"); err == nil {
+		// The uploaded file replaces any video URL in the form.
+		draft.VideoURL = ""
+	}
+	vyfe_api.NewSessionDefaults.Apply(draft, time.Now())
+	if appErr := validateSession(draft); appErr != nil {
+		return appErr
+	}
+	if appErr := a.checkSessionQuota(user); appErr != nil {
+		return appErr
+	}
+	if appErr := a.checkCreateRate(w, r, user); appErr != nil {
+		return appErr
+	}
+
+	session, err := a.sessionFromForm(r)
+	if err == errUnsafeUpload {
+		return &appError{Error: err, Message: err.Error(), Code: http.StatusUnprocessableEntity}
+	}
+	if err == errUploadsDisabled {
+		return &appError{Error: err, Message: err.Error(), Code: http.StatusNotImplemented}
+	}
+	if err == errBadCaption {
+		return badRequest(err, "%v", err)
+	}
 	if err != nil {
 		return appErrorf(err, "could not parse session from form: %v", err)
 	}
-	id, err := vyfe_api.DB.AddSession(session)
+	baseline, err := a.writeBaseline(r, 0)
+	if err != nil {
+		return appErrorf(err, "could not get session: %v", err)
+	}
+	if appErr := a.protectFields(r, session, baseline); appErr != nil {
+		return appErr
+	}
+	vyfe_api.NewSessionDefaults.Apply(session, time.Now())
+	if appErr := validateSession(session); appErr != nil {
+		return appErr
+	}
+	id, err := a.DB.AddSession(session)
 	if err != nil {
 		return appErrorf(err, "could not save session: %v", err)
 	}
-	go publishUpdate(id)
-	http.Redirect(w, r, fmt.Sprintf("/sessions/%d", id), http.StatusFound)
+	a.publishEventAsync(vyfe_api.EventCreated, id)
+	// The list merges in the created session, which its query may not see
+	// yet (see readYourWrites).
+	http.Redirect(w, r, "/sessions?created="+url.QueryEscape(session.URLID()), http.StatusFound)
 	return nil
 }
 
-// updateHandler updates the details of a given session.
-func updateHandler(w http.ResponseWriter, r *http.Request) *appError {
-	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+// previewHandler renders the detail page of the session described by the
+// same form fields as createHandler takes, without saving it. Files aren't
+// uploaded, so the preview shows the video and thumbnail given by URL, if any.
+func (a *App) previewHandler(w http.ResponseWriter, r *http.Request) *appError {
+	session := a.sessionFromFormValues(r, nil, nil)
+	vyfe_api.NewSessionDefaults.Apply(session, time.Now())
+	if appErr := validateSession(session); appErr != nil {
+		return appErr
+	}
+	return detailTmpl.Execute(a, w, r, &sessionDetail{Session: session, Preview: true})
+}
+
+// checkSessionQuota returns a 403 appError if the logged in user has already
+// created vyfe_api.SessionQuota sessions. The quota is kept by the user's
+// profile ID rather than the creator given with the session, which clients
+// control. Anonymous users share a single quota and admins have none.
+func (a *App) checkSessionQuota(user *Profile) *appError {
+	if vyfe_api.SessionQuota <= 0 || isAdmin(user) {
+		return nil
+	}
+	creatorID := "anonymous"
+	if user != nil {
+		creatorID = user.ID
+	}
+	n, err := a.DB.CountSessionsCreatedBy(context.Background(), creatorID)
 	if err != nil {
-		return appErrorf(err, "bad session id: %v", err)
+		return appErrorf(err, "could not count sessions: %v", err)
+	}
+	if n >= vyfe_api.SessionQuota {
+		return &appError{
+			Message: fmt.Sprintf("session quota reached: each user may create at most %d sessions", vyfe_api.SessionQuota),
+			Code:    http.StatusForbidden,
+		}
+	}
+	return nil
+}
+
+// updateHandler updates the details of a given session. Only the session's
+// creator and admins may update it.
+func (a *App) updateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	// Check before any files are stored for the update.
+	if _, appErr := a.managedSession(r, id, "edit"); appErr != nil {
+		return appErr
 	}
 
-	session, err := sessionFromForm(r)
+	session, err := a.sessionFromForm(r)
+	if err == errUnsafeUpload {
+		return &appError{Error: err, Message: err.Error(), Code: http.StatusUnprocessableEntity}
+	}
+	if err == errUploadsDisabled {
+		return &appError{Error: err, Message: err.Error(), Code: http.StatusNotImplemented}
+	}
+	if err == errBadCaption {
+		return badRequest(err, "%v", err)
+	}
 	if err != nil {
 		return appErrorf(err, "could not parse session from form: %v", err)
 	}
+	baseline, err := a.writeBaseline(r, id)
+	if err != nil {
+		return appErrorf(err, "could not get session: %v", err)
+	}
+	if appErr := a.protectFields(r, session, baseline); appErr != nil {
+		return appErr
+	}
+	if appErr := validateSession(session); appErr != nil {
+		return appErr
+	}
 	session.ID = id
+	a.keepContentHash(session)
+	a.keepCaptions(session)
 
-	err = vyfe_api.DB.UpdateSession(session)
+	err = a.saveSession(context.Background(), session)
 	if err != nil {
 		return appErrorf(err, "could not save session: %v", err)
 	}
-	go publishUpdate(session.ID)
-	http.Redirect(w, r, fmt.Sprintf("/sessions/%d", session.ID), http.StatusFound)
+	a.releaseEditLock(r, session.ID)
+	a.publishUpdateAsync(session.ID, session.ChangedFields)
+	http.Redirect(w, r, "/sessions/"+session.URLID(), http.StatusFound)
 	return nil
 }
 
-// deleteHandler deletes a given session.
-func deleteHandler(w http.ResponseWriter, r *http.Request) *appError {
-	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+// managedSession returns the stored session with the given ID, or a 403
+// appError unless the user logged in to r may manage it, as only a session's
+// creator and admins may change or delete it. action names what the user is
+// about to do, for the error message.
+func (a *App) managedSession(r *http.Request, id int64, action string) (*vyfe_api.Session, *appError) {
+	session, err := a.DB.GetSession(id)
+	if err == vyfe_api.ErrSessionNotFound {
+		return nil, sessionNotFound(err)
+	}
 	if err != nil {
-		return appErrorf(err, "bad session id: %v", err)
+		return nil, appErrorf(err, "could not find session: %v", err)
+	}
+	if !a.viewer(r).CanManage(session) {
+		return nil, &appError{Message: fmt.Sprintf("only the session's creator may %s it", action), Code: http.StatusForbidden}
+	}
+	return session, nil
+}
+
+// touchHandler marks a session as updated now without changing it, moving it
+// up lists ordered by recency. Only the session's creator and admins may
+// touch it.
+func (a *App) touchHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	if _, appErr := a.managedSession(r, id, "touch"); appErr != nil {
+		return appErr
+	}
+	err := a.DB.TouchSession(context.Background(), id)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
 	}
-	err = vyfe_api.DB.DeleteSession(id)
 	if err != nil {
+		return appErrorf(err, "could not touch session: %v", err)
+	}
+	http.Redirect(w, r, "/sessions/"+mux.Vars(r)["id"], http.StatusFound)
+	return nil
+}
+
+// deleteHandler deletes a given session and removes its uploaded files. Only
+// the session's creator and admins may delete it.
+func (a *App) deleteHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	// The session is looked up first so that its files can be removed
+	// once it is deleted.
+	session, appErr := a.managedSession(r, id, "delete")
+	if appErr != nil {
+		return appErr
+	}
+	if err := a.DB.DeleteSession(id); err != nil {
 		return appErrorf(err, "could not delete session: %v", err)
 	}
-	http.Redirect(w, r, "/sessions", http.StatusFound)
+	a.deleteSessionObjects(context.Background(), session)
+	a.publishEventAsync(vyfe_api.EventDeleted, id)
+	http.Redirect(w, r, "/sessions?deleted="+url.QueryEscape(mux.Vars(r)["id"]), http.StatusFound)
+	return nil
+}
+
+// reorderHandler sets the playlist order of sessions. The request body is a
+// JSON object listing session IDs in their new order, e.g. {"ids": [3, 1, 2]}.
+// The listed sessions swap the slots they hold between them, so sessions not
+// listed keep their order. Only admins may reorder the playlist.
+func (a *App) reorderHandler(w http.ResponseWriter, r *http.Request) *appError {
+	var req struct {
+		IDs []int64 `json:"ids"`
+	}
+	if appErr := decodeJSON(w, r, &req); appErr != nil {
+		return appErr
+	}
+	if len(req.IDs) == 0 {
+		return badRequest(nil, "no session ids given")
+	}
+	if len(req.IDs) > vyfe_api.MaxReorderSessions {
+		return badRequest(nil, "at most %d sessions can be reordered at once", vyfe_api.MaxReorderSessions)
+	}
+
+	seen := make(map[int64]bool)
+	for _, id := range req.IDs {
+		if seen[id] {
+			return badRequest(nil, "duplicate session id %d", id)
+		}
+		seen[id] = true
+	}
+
+	err := a.DB.ReorderSessions(context.Background(), req.IDs)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err != nil {
+		return appErrorf(err, "could not reorder sessions: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
-// publishUpdate notifies Pub/Sub subscribers that the session identified with
-// the given ID has been added/modified.
-func publishUpdate(sessionID int64) {
-	if vyfe_api.PubsubClient == nil {
+// publishEvent notifies clients connected to /events and Pub/Sub subscribers
+// that the session identified with the given ID has been created, updated or
+// deleted, as given by typ (one of the vyfe_api.Event constants). Clients
+// connected to /events aren't told about deletes.
+func (a *App) publishEvent(typ string, sessionID int64) {
+	a.publish(typ, sessionID, nil)
+}
+
+// publishUpdate is publishEvent for an update that changed the given fields
+// of the session, as set in Session.ChangedFields by UpdateSession, which are
+// included in the Pub/Sub event.
+func (a *App) publishUpdate(sessionID int64, changed []string) {
+	a.publish(vyfe_api.EventUpdated, sessionID, changed)
+}
+
+// publish notifies clients connected to /events and Pub/Sub subscribers of
+// an event, as described for publishEvent. changed is the event's
+// ChangedFields.
+func (a *App) publish(typ string, sessionID int64, changed []string) {
+	if typ != vyfe_api.EventDeleted {
+		a.events.publish(sessionID)
+	}
+
+	if a.topic == nil {
+		return
+	}
+	if typ == vyfe_api.EventDeleted && vyfe_api.LegacyPubsubPayload {
 		return
 	}
 
 	ctx := context.Background()
 
-	b, err := json.Marshal(sessionID)
+	event := a.sessionEvent(typ, sessionID)
+	event.ChangedFields = changed
+	b, err := eventPayload(event)
 	if err != nil {
 		return
 	}
-	topic := vyfe_api.PubsubClient.Topic(vyfe_api.PubsubTopicID)
-	_, err = topic.Publish(ctx, &pubsub.Message{Data: b}).Get(ctx)
-	log.Printf("Published update to Pub/Sub for Session ID %d: %v", sessionID, err)
+	_, err = a.topic.Publish(ctx, &pubsub.Message{Data: b}).Get(ctx)
+	log.Printf("Published %s event to Pub/Sub for Session ID %d: %v", typ, sessionID, err)
+}
+
+// sessionEvent returns the event of type typ for the session with the given
+// ID, reading the session back unless it was deleted.
+func (a *App) sessionEvent(typ string, sessionID int64) *vyfe_api.SessionEvent {
+	event := &vyfe_api.SessionEvent{Type: typ, SessionID: sessionID, Timestamp: time.Now()}
+	if typ != vyfe_api.EventDeleted {
+		session, err := a.DB.GetSession(sessionID)
+		if err != nil {
+			log.Printf("Could not read session %d for its %s event: %v", sessionID, typ, err)
+		}
+		event.Session = session
+	}
+	return event
+}
+
+// eventPayload returns the Pub/Sub message data for event: the JSON of event,
+// or, if vyfe_api.LegacyPubsubPayload is set, the JSON of the bare session ID.
+func eventPayload(event *vyfe_api.SessionEvent) ([]byte, error) {
+	if vyfe_api.LegacyPubsubPayload {
+		return json.Marshal(event.SessionID)
+	}
+	return json.Marshal(event)
 }
 
 // http://blog.golang.org/error-handling-and-go
@@ -304,6 +1708,11 @@ type appError struct {
 	Error   error
 	Message string
 	Code    int
+
+	// format and args are the format string Message was built from, which
+	// is its key in the message catalog (see i18n.go), and its arguments.
+	format string
+	args   []interface{}
 }
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -311,7 +1720,8 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Handler error: status code: %d, message: %s, underlying err: %#v",
 			e.Code, e.Message, e.Error)
 
-		http.Error(w, e.Message, e.Code)
+		p := printerFor(r)
+		writeError(w, r, p, localize(p, e))
 	}
 }
 
@@ -320,5 +1730,7 @@ func appErrorf(err error, format string, v ...interface{}) *appError {
 		Error:   err,
 		Message: fmt.Sprintf(format, v...),
 		Code:    500,
+		format:  format,
+		args:    v,
 	}
 }
@@ -6,24 +6,54 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"mime/multipart"
+	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	"google.golang.org/api/googleapi"
 
 	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
 	"github.com/GoogleCloudPlatform/golang-samples/internal/testutil"
 	"github.com/GoogleCloudPlatform/golang-samples/internal/webtest"
 )
 
-var wt *webtest.W
+var (
+	wt      *webtest.W
+	testApp *App
+)
 
 func TestMain(m *testing.M) {
 	serv := httptest.NewServer(nil)
 	wt = webtest.New(nil, serv.Listener.Addr().String())
-	registerHandlers()
+	testApp = newApp()
+	registerHandlers(testApp)
 
 	os.Exit(m.Run())
 }
@@ -129,15 +159,2972 @@ func TestAddAndDelete(t *testing.T) {
 	}
 }
 
-func bodyContains(t *testing.T, wt *webtest.W, path, contains string) (ok bool) {
-	body, _, err := wt.GetBody(path)
+func TestEditFormShowsLock(t *testing.T) {
+	id, err := testApp.DB.AddSession(&vyfe_api.Session{Title: "Locked"})
 	if err != nil {
-		t.Error(err)
-		return false
+		t.Fatal(err)
 	}
-	if !strings.Contains(body, contains) {
-		t.Errorf("want %s to contain %s", body, contains)
-		return false
+	defer testApp.DB.DeleteSession(id)
+	session, err := testApp.DB.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editPath := "/sessions/" + session.URLID() + "/edit"
+
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", editPath, nil))
+	if strings.Contains(rec.Body.String(), "currently being edited") {
+		t.Errorf("unlocked session: got a lock notice")
+	}
+
+	if err := testApp.DB.LockSession(context.Background(), id, "alice", "Alice <Doe>", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", editPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if want := "currently being edited by Alice &lt;Doe&gt;"; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("locked session: edit form doesn't contain %q", want)
+	}
+
+	// Locks are held by user, so anonymous requests can't take them.
+	rec = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("POST", "/sessions/"+session.URLID()+"/lock", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous lock: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestShareMetaTags(t *testing.T) {
+	defer func(base string) { vyfe_api.CanonicalBaseURL = base }(vyfe_api.CanonicalBaseURL)
+	vyfe_api.CanonicalBaseURL = "https://vyfe.example/"
+
+	id, err := testApp.DB.AddSession(&vyfe_api.Session{
+		Title:        `Go & "friends"`,
+		Description:  "A talk\n about <b>Go</b>.",
+		ThumbnailURL: "https://storage.googleapis.com/bucket/thumb.jpg",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+	session, err := testApp.DB.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", "/sessions/"+session.URLID(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	body := rec.Body.String()
+	head := body[:strings.Index(body, "</head>")]
+
+	url := "https://vyfe.example/sessions/" + session.URLID()
+	for _, want := range []string{
+		`<meta property="og:title" content="Go &amp; &#34;friends&#34;">`,
+		`<meta property="og:description" content="A talk about &lt;b&gt;Go&lt;/b&gt;.">`,
+		`<meta property="og:image" content="https://storage.googleapis.com/bucket/thumb.jpg">`,
+		`<meta property="og:url" content="` + url + `">`,
+		`<link rel="canonical" href="` + url + `">`,
+		`<meta name="twitter:card" content="summary_large_image">`,
+		`<meta name="twitter:title" content="Go &amp; &#34;friends&#34;">`,
+	} {
+		if !strings.Contains(head, want) {
+			t.Errorf("head doesn't contain %s:\n%s", want, head)
+		}
+	}
+}
+
+func TestSessionDetailHead(t *testing.T) {
+	id, err := testApp.DB.AddSession(&vyfe_api.Session{
+		Title: "head mchead",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+
+	for _, path := range []string{fmt.Sprintf("/sessions/%d", id), "/sessions/987654321"} {
+		get := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(get, httptest.NewRequest("GET", path, nil))
+		head := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(head, httptest.NewRequest("HEAD", path, nil))
+
+		if got, want := head.Code, get.Code; got != want {
+			t.Errorf("HEAD %s: got status %d, want %d", path, got, want)
+		}
+		for _, h := range []string{"ETag", "Last-Modified"} {
+			if got, want := head.Header().Get(h), get.Header().Get(h); got != want {
+				t.Errorf("HEAD %s: got %s %q, want %q", path, h, got, want)
+			}
+		}
+		if head.Code == http.StatusOK && head.Body.Len() != 0 {
+			t.Errorf("HEAD %s: got body %q, want empty", path, head.Body.String())
+		}
+	}
+}
+
+func TestSessionQuota(t *testing.T) {
+	defer func(quota int, admins []string) {
+		vyfe_api.SessionQuota = quota
+		vyfe_api.AdminUserIDs = admins
+	}(vyfe_api.SessionQuota, vyfe_api.AdminUserIDs)
+	vyfe_api.SessionQuota = 2
+	vyfe_api.AdminUserIDs = []string{"admin"}
+
+	const userID = "quota-tester"
+	user := &Profile{ID: userID}
+
+	for n := 0; n <= 3; n++ {
+		appErr := testApp.checkSessionQuota(user)
+		if n < vyfe_api.SessionQuota && appErr != nil {
+			t.Errorf("%d sessions: got err %v, want nil", n, appErr.Message)
+		}
+		if n >= vyfe_api.SessionQuota && (appErr == nil || appErr.Code != http.StatusForbidden) {
+			t.Errorf("%d sessions: got %v, want 403", n, appErr)
+		}
+		if err := testApp.checkSessionQuota(&Profile{ID: "admin"}); err != nil {
+			t.Errorf("%d sessions: got err %v for admin, want nil", n, err.Message)
+		}
+
+		id, err := testApp.DB.AddSession(&vyfe_api.Session{CreatedByID: userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer testApp.DB.DeleteSession(id)
+	}
+}
+
+func TestSessionQuotaIgnoresGivenCreator(t *testing.T) {
+	defer func(quota int, protected []string, store sessions.Store) {
+		vyfe_api.SessionQuota = quota
+		vyfe_api.ProtectedFields = protected
+		testApp.SessionStore = store
+	}(vyfe_api.SessionQuota, vyfe_api.ProtectedFields, testApp.SessionStore)
+	vyfe_api.SessionQuota = 1
+	// Let the request set the creator, so only the quota check stands in
+	// the way.
+	vyfe_api.ProtectedFields = nil
+	testApp.SessionStore = loginStore{&Profile{ID: "quota-forger", DisplayName: "Forger"}}
+
+	id, err := testApp.DB.AddSession(&vyfe_api.Session{Title: "Quota used", CreatedByID: "quota-forger"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+
+	body := `{"title":"Over quota","createdById":"someone-else"}`
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/sessions", strings.NewReader(body)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("create with another creator ID: got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestAPIIgnoresClientSizes(t *testing.T) {
+	defer func(store sessions.Store) { testApp.SessionStore = store }(testApp.SessionStore)
+	testApp.SessionStore = loginStore{&Profile{ID: "sizer", DisplayName: "Sizer"}}
+
+	rec := httptest.NewRecorder()
+	body := `{"title":"Sized","videoUrl":"https://example.com/talk.mp4","sizeBytes":999999}`
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/sessions", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+	var created vyfe_api.Session
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(created.ID)
+	if stored, err := testApp.DB.GetSession(created.ID); err != nil || stored.SizeBytes != 0 {
+		t.Fatalf("create: got %v, want the session stored without a size", err)
+	}
+
+	// An upload gives the session a size, which edits keep.
+	uploaded := created
+	uploaded.VideoURL = "https://example.com/uploaded.mp4"
+	uploaded.SizeBytes = 4096
+	if err := testApp.DB.UpdateSession(&uploaded); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	body = `{"title":"Sized and edited","videoUrl":"https://example.com/uploaded.mp4","sizeBytes":1}`
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/sessions/"+created.URLID(), strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if stored, err := testApp.DB.GetSession(created.ID); err != nil || stored.SizeBytes != 4096 {
+		t.Errorf("update: got %v, want the stored size kept", err)
+	}
+}
+
+func TestAPIIgnoresClientContentHashes(t *testing.T) {
+	defer func(store sessions.Store) { testApp.SessionStore = store }(testApp.SessionStore)
+	testApp.SessionStore = loginStore{&Profile{ID: "hasher", DisplayName: "Hasher"}}
+
+	rec := httptest.NewRecorder()
+	body := `{"title":"Hashed","videoUrl":"https://example.com/talk.mp4","contentHash":"forged"}`
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/sessions", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+	var created vyfe_api.Session
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(created.ID)
+	if stored, err := testApp.DB.GetSession(created.ID); err != nil || stored.ContentHash != "" {
+		t.Fatalf("create: got %v, want the session stored without a content hash", err)
+	}
+
+	// An upload gives the session a content hash, which edits keep along
+	// with its captions.
+	uploaded := created
+	uploaded.VideoURL = "https://example.com/uploaded.mp4"
+	uploaded.ContentHash = "uploaded"
+	uploaded.Captions = []vyfe_api.Caption{{Lang: "en", URL: "https://example.com/en.vtt", Format: vyfe_api.CaptionVTT}}
+	if err := testApp.DB.UpdateSession(&uploaded); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	body = `{"title":"Hashed and edited","videoUrl":"https://example.com/uploaded.mp4","contentHash":"forged"}`
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/sessions/"+created.URLID(), strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	stored, err := testApp.DB.GetSession(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ContentHash != "uploaded" {
+		t.Errorf("update: got content hash %q, want the stored one kept", stored.ContentHash)
+	}
+	if len(stored.Captions) != 1 || stored.Captions[0].Lang != "en" {
+		t.Errorf("update: got captions %+v, want the stored ones kept", stored.Captions)
+	}
+
+	// A new video drops the hash of the uploaded one.
+	rec = httptest.NewRecorder()
+	body = `{"title":"Hashed and edited","videoUrl":"https://example.com/other.mp4","contentHash":"forged"}`
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/sessions/"+created.URLID(), strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if stored, err := testApp.DB.GetSession(created.ID); err != nil || stored.ContentHash != "" {
+		t.Errorf("update with a new video: got %v, want no content hash", err)
+	}
+}
+
+func TestListPreloadsThumbnails(t *testing.T) {
+	defer func(n int) { vyfe_api.ThumbnailPreloadCount = n }(vyfe_api.ThumbnailPreloadCount)
+	vyfe_api.ThumbnailPreloadCount = 2
+
+	for _, s := range []*vyfe_api.Session{
+		{Title: "preload 1", ThumbnailURL: "https://example.com/1.jpg"},
+		{Title: "preload 2"},
+		{Title: "preload 3", ThumbnailURL: "https://example.com/3.jpg"},
+	} {
+		id, err := testApp.DB.AddSession(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer testApp.DB.DeleteSession(id)
+	}
+
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", "/sessions", nil))
+
+	links := rec.Header()["Link"]
+	want := []string{"<https://example.com/1.jpg>; rel=preload; as=image"}
+	if fmt.Sprint(links) != fmt.Sprint(want) {
+		t.Errorf("got Link headers %q, want %q", links, want)
+	}
+}
+
+func TestPreloadThumbnailsEscapesURLs(t *testing.T) {
+	defer func(n int) { vyfe_api.ThumbnailPreloadCount = n }(vyfe_api.ThumbnailPreloadCount)
+	vyfe_api.ThumbnailPreloadCount = 3
+
+	rec := httptest.NewRecorder()
+	preloadThumbnails(rec, []*vyfe_api.SessionSummary{
+		{ThumbnailURL: "https://example.com/a>b.jpg?size=1>, <https://evil.example/"},
+		{ThumbnailURL: "%zz"},
+		{ThumbnailURL: "https://example.com/c.jpg?w=1&h=2"},
+	})
+
+	links := rec.Header()["Link"]
+	want := []string{
+		"<https://example.com/a%3Eb.jpg?size=1%3E%2C+%3Chttps%3A%2F%2Fevil.example%2F>; rel=preload; as=image",
+		"<https://example.com/c.jpg?h=2&w=1>; rel=preload; as=image",
+	}
+	if fmt.Sprint(links) != fmt.Sprint(want) {
+		t.Errorf("got Link headers %q, want %q", links, want)
+	}
+}
+
+func TestTouchRequiresEditRights(t *testing.T) {
+	defer func(store sessions.Store) { testApp.SessionStore = store }(testApp.SessionStore)
+
+	id, err := testApp.DB.AddSession(&vyfe_api.Session{Title: "Touch me", CreatedByID: "toucher"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+	before, err := testApp.DB.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := before.UpdatedAt
+
+	touch := func(userID string) int {
+		testApp.SessionStore = loginStore{&Profile{ID: userID}}
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("POST", fmt.Sprintf("/sessions/%d/touch", id), nil))
+		return rec.Code
+	}
+
+	if code := touch("someone-else"); code != http.StatusForbidden {
+		t.Errorf("touch by another user: got status %d, want %d", code, http.StatusForbidden)
+	}
+	if got, err := testApp.DB.GetSession(id); err != nil || !got.UpdatedAt.Equal(updated) {
+		t.Errorf("touch by another user: got %v, %v, want the session unchanged", got, err)
+	}
+	if code := touch("toucher"); code != http.StatusFound {
+		t.Errorf("touch by the creator: got status %d, want %d", code, http.StatusFound)
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	setMaintenance(true)
+	defer setMaintenance(false)
+
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("POST", "/sessions", strings.NewReader("title=blocked")))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST during maintenance: got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("POST during maintenance: want Retry-After header")
+	}
+
+	rec = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", "/sessions", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET during maintenance: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	setMaintenance(false)
+	rec = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/sessions/987654321", nil))
+	if rec.Code == http.StatusServiceUnavailable {
+		t.Error("DELETE after maintenance: got 503")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	defer func(keys map[string]vyfe_api.APIKey, require bool) {
+		vyfe_api.APIKeys, vyfe_api.RequireAPIKey = keys, require
+	}(vyfe_api.APIKeys, vyfe_api.RequireAPIKey)
+	vyfe_api.APIKeys = map[string]vyfe_api.APIKey{
+		"reader-secret": {Name: "test-reader", Scope: vyfe_api.ScopeRead, RateLimit: 3},
+		"writer-secret": {Name: "test-writer", Scope: vyfe_api.ScopeReadWrite, RateLimit: 2},
+	}
+
+	h := testApp.apiKeyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	doPath := func(method, path, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if secret != "" {
+			req.Header.Set(apiKeyHeader, secret)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	do := func(method, secret string) *httptest.ResponseRecorder {
+		return doPath(method, "/api/sessions", secret)
+	}
+
+	if rec := do("POST", "reader-secret"); rec.Code != http.StatusForbidden {
+		t.Errorf("POST with read-only key: got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := do("GET", "reader-secret"); rec.Code != http.StatusOK {
+		t.Errorf("GET with read-only key: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := do("GET", "wrong-secret"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET with unknown key: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := do("POST", ""); rec.Code != http.StatusOK {
+		t.Errorf("POST without key: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// With keys required, only the pages may be requested without one.
+	vyfe_api.RequireAPIKey = true
+	if rec := do("GET", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET without key while required: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := doPath("GET", "/sessions", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET page without key while required: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	vyfe_api.RequireAPIKey = false
+
+	// The writer uses up its limit while the reader, which has made two
+	// requests so far, still has one left.
+	for i := 0; i < 2; i++ {
+		if rec := do("POST", "writer-secret"); rec.Code != http.StatusOK {
+			t.Fatalf("POST %d with writer key: got status %d, want %d", i+1, rec.Code, http.StatusOK)
+		}
+	}
+	rec := do("POST", "writer-secret")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("POST over writer's limit: got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("POST over writer's limit: want Retry-After header")
+	}
+	if rec := do("GET", "reader-secret"); rec.Code != http.StatusOK {
+		t.Errorf("GET with reader key after writer's limit: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := do("GET", "reader-secret"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("GET over reader's limit: got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestRequireAuthForReads(t *testing.T) {
+	defer func(v bool) { vyfe_api.RequireAuthForReads = v }(vyfe_api.RequireAuthForReads)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	// The edit form shows the whole session, so it is gated like the
+	// detail page.
+	id, err := testApp.DB.AddSession(&vyfe_api.Session{Title: "Gated edit form"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+	session, err := testApp.DB.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editPath := "/sessions/" + session.URLID() + "/edit"
+
+	vyfe_api.RequireAuthForReads = true
+	for _, path := range []string{"/sessions", "/sessions/search?q=talk", "/sessions/987654321", "/sessions/add", editPath} {
+		rec := get(path)
+		if loc := rec.Header().Get("Location"); rec.Code != http.StatusFound || !strings.HasPrefix(loc, "/login?") {
+			t.Errorf("enabled: GET %s: got %d to %q, want a redirect to /login", path, rec.Code, loc)
+		}
+		if strings.Contains(rec.Body.String(), session.Title) {
+			t.Errorf("enabled: GET %s: shows the session to an anonymous user", path)
+		}
+	}
+	for _, path := range []string{"/api/sessions", "/api/sessions/search?q=talk", "/api/sessions/987654321"} {
+		if rec := get(path); rec.Code != http.StatusUnauthorized {
+			t.Errorf("enabled: GET %s: got status %d, want %d", path, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	if rec := get("/_ah/health"); rec.Code != http.StatusOK {
+		t.Errorf("enabled: GET /_ah/health: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := get("/login"); rec.Code == http.StatusUnauthorized || strings.HasPrefix(rec.Header().Get("Location"), "/login") {
+		t.Errorf("enabled: GET /login: got %d to %q, want it served", rec.Code, rec.Header().Get("Location"))
+	}
+
+	vyfe_api.RequireAuthForReads = false
+	for _, path := range []string{"/sessions", "/api/sessions", "/api/sessions/search?q=talk", "/sessions/add", editPath} {
+		if rec := get(path); rec.Code != http.StatusOK {
+			t.Errorf("disabled: GET %s: got status %d, want %d", path, rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestEventBroker(t *testing.T) {
+	defer func(n int) { vyfe_api.MaxEventStreams = n }(vyfe_api.MaxEventStreams)
+	vyfe_api.MaxEventStreams = 1
+
+	b := newBroker()
+	ch, err := b.subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.subscribe(); err != errTooManyStreams {
+		t.Errorf("subscribe over the cap: got err %v, want %v", err, errTooManyStreams)
+	}
+
+	b.publish(42)
+	if got := <-ch; got != 42 {
+		t.Errorf("got event for session %d, want 42", got)
+	}
+
+	b.unsubscribe(ch)
+	if _, err := b.subscribe(); err != nil {
+		t.Errorf("subscribe after unsubscribe: %v", err)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    *appError
+		status int
+		code   string
+		fields bool
+	}{
+		{"not found", sessionNotFound(vyfe_api.ErrSessionNotFound), http.StatusNotFound, errNotFound, false},
+		{"validation", validateSession(&vyfe_api.Session{PublishedDate: "someday"}), http.StatusBadRequest, errValidationFailed, true},
+		{"conflict", apiErrorf(errConflict, "already exists"), http.StatusConflict, errConflict, false},
+		{"rate limited", apiErrorf(errRateLimited, "slow down"), http.StatusTooManyRequests, errRateLimited, false},
+		{"bad request", badRequest(nil, "bad limit"), http.StatusBadRequest, errBadRequest, false},
+		{"internal", appErrorf(fmt.Errorf("boom"), "boom"), http.StatusInternalServerError, errInternal, false},
+	}
+	for _, tt := range tests {
+		h := appHandler(func(w http.ResponseWriter, r *http.Request) *appError { return tt.err })
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/sessions", nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		var got APIError
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Errorf("%s: could not decode body: %v", tt.name, err)
+			continue
+		}
+		if got.Code != tt.code {
+			t.Errorf("%s: got code %q, want %q", tt.name, got.Code, tt.code)
+		}
+		if got.Message == "" {
+			t.Errorf("%s: got empty message", tt.name)
+		}
+		if tt.fields && got.Fields["publishedDate"] == "" {
+			t.Errorf("%s: got fields %v, want publishedDate", tt.name, got.Fields)
+		}
+
+		// Browser routes keep the plain text error.
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/sessions", nil))
+		if ct := rec.Header().Get("Content-Type"); strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s: browser route got Content-Type %q", tt.name, ct)
+		}
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("X-Request-Id", "req-42")
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, req)
+		return rec
+	}
+	const browser = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+	// Missing sessions and unknown pages render the 404 template for
+	// browsers.
+	for _, path := range []string{"/sessions/987654321", "/no/such/page"} {
+		rec := get(path, browser)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("%s: got Content-Type %q, want text/html", path, ct)
+		}
+		body := rec.Body.String()
+		for _, want := range []string{"<h3>Page not found</h3>", "Request ID: req-42", "<html>"} {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: body doesn't contain %q:\n%s", path, want, body)
+			}
+		}
+	}
+
+	// API routes get JSON, whatever they accept.
+	rec := get("/api/sessions/987654321", browser)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("API: got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	var apiErr APIError
+	if err := json.NewDecoder(rec.Body).Decode(&apiErr); err != nil || apiErr.Code != errNotFound {
+		t.Errorf("API: got %+v, %v; want a JSON %s error", apiErr, err, errNotFound)
+	}
+
+	// Server errors don't show their message, which may reveal internals.
+	h := appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+		return appErrorf(errors.New("dial tcp 10.0.0.1"), "could not list sessions: dial tcp 10.0.0.1")
+	})
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/sessions", nil)
+	req.Header.Set("Accept", browser)
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "Something went wrong") {
+		t.Errorf("500: got status %d, body %s; want the 500 page", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "10.0.0.1") {
+		t.Errorf("500: page shows the error message")
+	}
+
+	// Other clients, and browsers with HTMLErrorPages off, get plain text.
+	if rec := get("/sessions/987654321", "*/*"); !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("curl: got Content-Type %q, want text/plain", rec.Header().Get("Content-Type"))
+	}
+	defer func(on bool) { vyfe_api.HTMLErrorPages = on }(vyfe_api.HTMLErrorPages)
+	vyfe_api.HTMLErrorPages = false
+	if rec := get("/sessions/987654321", browser); !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("HTMLErrorPages off: got Content-Type %q, want text/plain", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestEnforceHTTPS(t *testing.T) {
+	defer func(on, sub bool) {
+		vyfe_api.EnforceHTTPS = on
+		vyfe_api.HSTSIncludeSubDomains = sub
+	}(vyfe_api.EnforceHTTPS, vyfe_api.HSTSIncludeSubDomains)
+	vyfe_api.EnforceHTTPS = true
+	vyfe_api.HSTSIncludeSubDomains = true
+
+	h := httpsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(path, proto string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("X-Forwarded-Proto", proto)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("/sessions?x=1", "http")
+	if rec.Code != http.StatusMovedPermanently {
+		t.Errorf("http: got status %d, want %d", rec.Code, http.StatusMovedPermanently)
+	}
+	if got, want := rec.Header().Get("Location"), "https://example.com/sessions?x=1"; got != want {
+		t.Errorf("http: got Location %q, want %q", got, want)
+	}
+
+	rec = serve("/sessions", "https")
+	if rec.Code != http.StatusOK {
+		t.Errorf("https: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Strict-Transport-Security"); !strings.Contains(got, "max-age=") || !strings.Contains(got, "includeSubDomains") {
+		t.Errorf("https: got Strict-Transport-Security %q", got)
+	}
+
+	if rec := serve("/_ah/health", "http"); rec.Code != http.StatusOK {
+		t.Errorf("health check: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	vyfe_api.EnforceHTTPS = false
+	if rec := serve("/sessions", "http"); rec.Code != http.StatusOK {
+		t.Errorf("disabled: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+// memoryStore is an ObjectStore keeping objects in memory.
+type memoryStore struct {
+	objects      map[string][]byte
+	contentTypes map[string]string
+	err          error // returned by Upload, if set
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: make(map[string][]byte), contentTypes: make(map[string]string)}
+}
+
+func (s *memoryStore) Upload(ctx context.Context, name, contentType string, r io.Reader) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := s.objects[name]; ok && vyfe_api.ObjectWrites.PreventOverwrite {
+		return "", vyfe_api.ErrObjectExists
+	}
+	s.objects[name] = b
+	s.contentTypes[name] = contentType
+	return vyfe_api.ObjectURL(name), nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, name string) error {
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memoryStore) Attrs(ctx context.Context, name string) (*ObjectAttrs, error) {
+	b, ok := s.objects[name]
+	if !ok {
+		return nil, errObjectNotExist
+	}
+	return &ObjectAttrs{Size: int64(len(b)), ContentType: s.contentTypes[name], Public: !vyfe_api.PrivateObjects}, nil
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]string, error) {
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// uploadRequest returns a session form request uploading a file.
+func uploadRequest(t *testing.T, filename, contentType, content string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="image"; filename=%q`, filename))
+	h.Set("Content-Type", contentType)
+	fw, err := mw.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/sessions", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestUploadStoresObject(t *testing.T) {
+	defer func(bucket string) { vyfe_api.StorageBucketName = bucket }(vyfe_api.StorageBucketName)
+	vyfe_api.StorageBucketName = "upload-test"
+
+	a := *testApp
+	store := newMemoryStore()
+	a.Objects = store
+
+	up, err := a.uploadFileFromForm(uploadRequest(t, "talk.mp4", "video/mp4", "a freshly recorded talk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, ok := vyfe_api.ObjectName(up.URL)
+	if !ok {
+		t.Fatalf("got URL %q, want one in the bucket", up.URL)
+	}
+	if !strings.HasSuffix(name, ".mp4") || strings.HasPrefix(name, "talk") {
+		t.Errorf("got object name %q, want a random name ending in .mp4", name)
+	}
+	if got := string(store.objects[name]); got != "a freshly recorded talk" {
+		t.Errorf("got stored content %q", got)
+	}
+	if got := store.contentTypes[name]; got != "video/mp4" {
+		t.Errorf("got content type %q, want video/mp4", got)
+	}
+
+	// Deleting the session removes its object.
+	if !reflect.DeepEqual(up.Objects, []string{name}) {
+		t.Errorf("got uploaded objects %q, want [%s]", up.Objects, name)
+	}
+	a.deleteSessionObjects(context.Background(), &vyfe_api.Session{VideoURL: up.URL, Objects: up.Objects})
+	if _, ok := store.objects[name]; ok {
+		t.Errorf("object %s not deleted", name)
+	}
+
+	// Storage failures are returned.
+	store.err = errors.New("bucket unavailable")
+	if _, err := a.uploadFileFromForm(uploadRequest(t, "other.mp4", "video/mp4", "another talk")); err != store.err {
+		t.Errorf("failing store: got err %v, want %v", err, store.err)
+	}
+}
+
+func TestCreateValidatesBeforeUpload(t *testing.T) {
+	defer func(bucket string, enabled bool) {
+		vyfe_api.StorageBucketName, vyfe_api.UploadsEnabled = bucket, enabled
+	}(vyfe_api.StorageBucketName, vyfe_api.UploadsEnabled)
+	vyfe_api.StorageBucketName = "validate-test"
+	vyfe_api.UploadsEnabled = true
+
+	a := *testApp
+	store := newMemoryStore()
+	a.Objects = store
+
+	// The upload form has no title, which is required.
+	rec := httptest.NewRecorder()
+	appErr := a.createHandler(rec, uploadRequest(t, "talk.mp4", "video/mp4", "an untitled talk"))
+	if appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Fatalf("create without title: got %v, want a 400 error", appErr)
+	}
+	if stored := len(store.objects); stored != 0 {
+		t.Errorf("create without title: got %d stored objects, want 0", stored)
+	}
+}
+
+func TestCreateRedirectsToList(t *testing.T) {
+	a := *testApp
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "Just created")
+	mw.Close()
+	r := httptest.NewRequest("POST", "/sessions", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	if appErr := a.createHandler(rec, r); appErr != nil {
+		t.Fatal(appErr.Error)
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Path != "/sessions" || loc.Query().Get("created") == "" {
+		t.Fatalf("got redirect to %q, want the list with the created session", loc)
+	}
+	id, err := a.resolveSessionID(loc.Query().Get("created"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.DB.DeleteSession(id)
+}
+
+func TestObjectOverwriteProtection(t *testing.T) {
+	defer func(bucket string, c vyfe_api.ObjectWriteConfig) {
+		vyfe_api.StorageBucketName, vyfe_api.ObjectWrites = bucket, c
+	}(vyfe_api.StorageBucketName, vyfe_api.ObjectWrites)
+	vyfe_api.StorageBucketName = "overwrite-test"
+	vyfe_api.ObjectWrites = vyfe_api.ObjectWriteConfig{PreventOverwrite: true, DeleteReplaced: true}
+
+	// A failed DoesNotExist precondition is reported as a collision.
+	if err := objectWriteError(&googleapi.Error{Code: http.StatusPreconditionFailed}); err != vyfe_api.ErrObjectExists {
+		t.Errorf("precondition failure: got %v, want ErrObjectExists", err)
+	}
+	other := &googleapi.Error{Code: http.StatusForbidden}
+	if err := objectWriteError(other); err != other {
+		t.Errorf("other failure: got %v, want %v", err, other)
+	}
+
+	a := *testApp
+	store := newMemoryStore()
+	a.Objects = store
+	ctx := context.Background()
+
+	if _, err := a.Objects.Upload(ctx, "old.mp4", "video/mp4", strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Objects.Upload(ctx, "old.mp4", "video/mp4", strings.NewReader("clobbered")); err != vyfe_api.ErrObjectExists {
+		t.Errorf("colliding upload: got %v, want ErrObjectExists", err)
+	}
+	if got := string(store.objects["old.mp4"]); got != "old" {
+		t.Errorf("collision overwrote the object with %q", got)
+	}
+
+	// Replacing the video deletes the old object.
+	session := &vyfe_api.Session{Title: "replace", VideoURL: vyfe_api.ObjectURL("old.mp4"), Objects: []string{"old.mp4"}}
+	id, err := a.DB.AddSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.DB.DeleteSession(id)
+	store.objects["new.mp4"] = []byte("new")
+
+	updated := *session
+	updated.VideoURL = vyfe_api.ObjectURL("new.mp4")
+	if err := a.saveSession(ctx, &updated); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.objects["old.mp4"]; ok {
+		t.Error("replaced object old.mp4 not deleted")
+	}
+	if _, ok := store.objects["new.mp4"]; !ok {
+		t.Error("new object new.mp4 deleted")
+	}
+
+	// Objects that weren't uploaded for the session, which clients can
+	// name in its URLs, are left alone.
+	store.objects["newer.mp4"] = []byte("newer")
+	newer := updated
+	newer.VideoURL = vyfe_api.ObjectURL("newer.mp4")
+	newer.Objects = []string{"newer.mp4"}
+	if err := a.saveSession(ctx, &newer); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.objects["new.mp4"]; !ok {
+		t.Error("replaced object new.mp4, not uploaded for the session, deleted")
+	}
+
+	// Nor is anything deleted with DeleteReplaced turned off.
+	vyfe_api.ObjectWrites.DeleteReplaced = false
+	newest := newer
+	newest.VideoURL = vyfe_api.ObjectURL("new.mp4")
+	if err := a.saveSession(ctx, &newest); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.objects["newer.mp4"]; !ok {
+		t.Error("replaced object newer.mp4 deleted with DeleteReplaced off")
+	}
+}
+
+func TestDeleteObjectsQueuesCleanup(t *testing.T) {
+	defer func(bucket string) { vyfe_api.StorageBucketName = bucket }(vyfe_api.StorageBucketName)
+	vyfe_api.StorageBucketName = "cleanup-test"
+
+	ctx := context.Background()
+	a := *testApp
+	store := newMemoryStore()
+	a.Objects = store
+	a.Cleanup = vyfe_api.NewMemoryCleanupQueue()
+	if _, err := store.Upload(ctx, "old.mp4", "video/mp4", strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	a.deleteObjects(ctx, &vyfe_api.Session{Objects: []string{"old.mp4"}}, []string{vyfe_api.ObjectURL("old.mp4")})
+	if _, ok := store.objects["old.mp4"]; !ok {
+		t.Fatal("object deleted during the request, want it queued")
+	}
+	jobs, err := a.Cleanup.Due(ctx, time.Now(), 10)
+	if err != nil || len(jobs) != 1 || jobs[0].Object != "old.mp4" {
+		t.Fatalf("got jobs %+v, %v; want old.mp4 queued", jobs, err)
+	}
+
+	w := vyfe_api.NewCleanupWorker(a.Cleanup, store.Delete, time.Hour)
+	defer w.Close()
+	if n, err := w.Drain(ctx); n != 1 || err != nil {
+		t.Fatalf("Drain: got %d, %v; want 1 job done", n, err)
+	}
+	if _, ok := store.objects["old.mp4"]; ok {
+		t.Error("object still stored after Drain")
+	}
+}
+
+func TestDeleteQueuesCleanup(t *testing.T) {
+	defer func(bucket string) { vyfe_api.StorageBucketName = bucket }(vyfe_api.StorageBucketName)
+	vyfe_api.StorageBucketName = "delete-test"
+	defer func(objects ObjectStore, cleanup vyfe_api.CleanupQueue, store sessions.Store) {
+		testApp.Objects, testApp.Cleanup, testApp.SessionStore = objects, cleanup, store
+	}(testApp.Objects, testApp.Cleanup, testApp.SessionStore)
+	testApp.Objects = newMemoryStore()
+	testApp.SessionStore = loginStore{&Profile{ID: "deleter", DisplayName: "Deleter"}}
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		method, suffix string
+	}{
+		{"POST", ":delete"},
+		{"DELETE", ""},
+	} {
+		testApp.Cleanup = vyfe_api.NewMemoryCleanupQueue()
+		id, err := testApp.DB.AddSession(&vyfe_api.Session{
+			Title:       "Deleted",
+			CreatedByID: "deleter",
+			VideoURL:    vyfe_api.ObjectURL(tt.method + ".mp4"),
+			Objects:     []string{tt.method + ".mp4"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := testApp.DB.GetSession(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := "/sessions/" + session.URLID() + tt.suffix
+		if tt.method == "DELETE" {
+			path = "/api" + path
+		}
+
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest(tt.method, path, nil))
+		if rec.Code >= 400 {
+			t.Fatalf("%s %s: got status %d", tt.method, path, rec.Code)
+		}
+		jobs, err := testApp.Cleanup.Due(ctx, time.Now(), 10)
+		if err != nil || len(jobs) != 1 || jobs[0].Object != tt.method+".mp4" {
+			t.Errorf("%s %s: got jobs %+v, %v; want %s.mp4 queued", tt.method, path, jobs, err, tt.method)
+		}
+	}
+}
+
+func TestConsistency(t *testing.T) {
+	defer func(bucket string) { vyfe_api.StorageBucketName = bucket }(vyfe_api.StorageBucketName)
+	vyfe_api.StorageBucketName = "consistency-test"
+
+	ctx := context.Background()
+	a := *testApp
+	store := newMemoryStore()
+	a.Objects = store
+	const description = "descriptions/abc.gz"
+	for _, name := range []string{"talk.mp4", "orphan.mp4", description} {
+		if _, err := store.Upload(ctx, name, "video/mp4", strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := a.DB.AddSession(&vyfe_api.Session{
+		Title:          "Dangling",
+		VideoURL:       vyfe_api.ObjectURL("talk.mp4"),
+		ThumbnailURL:   vyfe_api.ObjectURL("gone.png"),
+		ContentHash:    "abc",
+		DescriptionRef: description,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.DB.DeleteSession(id)
+	external, err := a.DB.AddSession(&vyfe_api.Session{Title: "External", VideoURL: "https://example.com/talk.mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.DB.DeleteSession(external)
+
+	check := func(method, target string) *ConsistencyReport {
+		rec := httptest.NewRecorder()
+		if appErr := a.consistencyHandler(rec, httptest.NewRequest(method, target, nil)); appErr != nil {
+			t.Fatalf("%s %s: %v", method, target, appErr.Error)
+		}
+		var report ConsistencyReport
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return &report
+	}
+
+	report := check("GET", "/admin/consistency")
+	wantMissing := []MissingObject{{SessionID: id, Field: "thumbnail", Object: "gone.png"}}
+	if !reflect.DeepEqual(report.Missing, wantMissing) {
+		t.Errorf("got missing %+v, want %+v", report.Missing, wantMissing)
+	}
+	if want := []string{"orphan.mp4"}; !reflect.DeepEqual(report.Orphaned, want) {
+		t.Errorf("got orphaned %q, want %q", report.Orphaned, want)
+	}
+	if report.Fixed || len(store.objects) != 3 {
+		t.Errorf("report without fix changed something: %+v", report)
+	}
+
+	rec := httptest.NewRecorder()
+	if appErr := a.consistencyHandler(rec, httptest.NewRequest("GET", "/admin/consistency?fix=true", nil)); appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Errorf("GET with fix=true: got %v, want a 400", appErr)
+	}
+
+	report = check("POST", "/admin/consistency?fix=true")
+	if !report.Fixed || report.Cleared != 1 || !reflect.DeepEqual(report.Deleted, []string{"orphan.mp4"}) {
+		t.Errorf("fix: got %+v, want 1 session cleared and orphan.mp4 deleted", report)
+	}
+	if _, ok := store.objects["orphan.mp4"]; ok {
+		t.Error("orphan.mp4 still stored after fixing")
+	}
+	if _, ok := store.objects[description]; !ok {
+		t.Error("offloaded description deleted as an orphan")
+	}
+	session, err := a.DB.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ThumbnailURL != "" || session.ContentHash != "" || session.VideoURL != vyfe_api.ObjectURL("talk.mp4") {
+		t.Errorf("fixed session: got video %q, thumbnail %q, hash %q; want only the thumbnail and hash cleared", session.VideoURL, session.ThumbnailURL, session.ContentHash)
+	}
+
+	if report := check("GET", "/admin/consistency"); len(report.Missing) != 0 || len(report.Orphaned) != 0 {
+		t.Errorf("after fixing: got %+v, want no missing or orphaned objects", report)
+	}
+}
+
+func TestSessionFiles(t *testing.T) {
+	defer func(bucket string) { vyfe_api.StorageBucketName = bucket }(vyfe_api.StorageBucketName)
+	vyfe_api.StorageBucketName = "files-test"
+
+	ctx := context.Background()
+	a := *testApp
+	store := newMemoryStore()
+	a.Objects = store
+	if _, err := store.Upload(ctx, "talk.mp4", "video/mp4", strings.NewReader("a talk")); err != nil {
+		t.Fatal(err)
+	}
+
+	session := &vyfe_api.Session{
+		CreatedByID:  "owner",
+		VideoURL:     vyfe_api.ObjectURL("talk.mp4"),
+		ThumbnailURL: vyfe_api.ObjectURL("gone.jpg"),
+	}
+	if (vyfe_api.Viewer{}).CanManage(session) || !(vyfe_api.Viewer{UserID: "owner"}).CanManage(session) {
+		t.Error("CanManage: want only the owner allowed")
+	}
+
+	files, err := a.sessionFiles(ctx, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sessionFile{
+		{Field: "video", Name: "talk.mp4", Size: 6, ContentType: "video/mp4", Public: !vyfe_api.PrivateObjects},
+		{Field: "thumbnail", Name: "gone.jpg", Missing: true},
+	}
+	if fmt.Sprintf("%+v", files) != fmt.Sprintf("%+v", want) {
+		t.Errorf("got files %+v, want %+v", files, want)
+	}
+
+	// URLs outside the bucket have no files.
+	files, err = a.sessionFiles(ctx, &vyfe_api.Session{VideoURL: "https://example.com/talk.mp4"})
+	if err != nil || len(files) != 0 {
+		t.Errorf("external URL: got %+v, %v; want no files", files, err)
+	}
+}
+
+func TestResolveSessionID(t *testing.T) {
+	defer func(s, n bool) { vyfe_api.StringIDs, vyfe_api.NumericIDs = s, n }(vyfe_api.StringIDs, vyfe_api.NumericIDs)
+	vyfe_api.StringIDs, vyfe_api.NumericIDs = true, true
+
+	session := &vyfe_api.Session{Title: "public id"}
+	id, err := testApp.DB.AddSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+
+	for _, tt := range []struct {
+		raw     string
+		numeric bool
+		want    int64
+		err     error
+	}{
+		{session.PublicID, true, id, nil},
+		{session.PublicID, false, id, nil},
+		{fmt.Sprint(id), true, id, nil},
+		{fmt.Sprint(id), false, 0, vyfe_api.ErrSessionNotFound},
+		{vyfe_api.NewPublicID(), true, 0, vyfe_api.ErrSessionNotFound},
+		{"search", true, 0, errBadSessionID},
+	} {
+		vyfe_api.NumericIDs = tt.numeric
+		got, err := testApp.resolveSessionID(tt.raw)
+		if got != tt.want || err != tt.err {
+			t.Errorf("resolveSessionID(%q) with NumericIDs %v = %d, %v; want %d, %v", tt.raw, tt.numeric, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSessionIDRoutes(t *testing.T) {
+	defer func(s, n bool) { vyfe_api.StringIDs, vyfe_api.NumericIDs = s, n }(vyfe_api.StringIDs, vyfe_api.NumericIDs)
+	vyfe_api.StringIDs, vyfe_api.NumericIDs = true, false
+
+	session := &vyfe_api.Session{Title: "routed by public id"}
+	id, err := testApp.DB.AddSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+
+	for _, tt := range []struct {
+		path string
+		code int
+	}{
+		{"/api/sessions/" + session.PublicID, http.StatusOK},
+		{fmt.Sprintf("/api/sessions/%d", id), http.StatusNotFound},
+		{"/api/sessions/" + vyfe_api.NewPublicID(), http.StatusNotFound},
+		{"/api/sessions/search?q=routed", http.StatusOK},
+		{"/sessions/" + session.PublicID, http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.code {
+			t.Errorf("GET %s: got status %d, want %d", tt.path, rec.Code, tt.code)
+		}
+	}
+}
+
+func TestUploadDeduplicatesContent(t *testing.T) {
+	defer func(bucket string) { vyfe_api.StorageBucketName = bucket }(vyfe_api.StorageBucketName)
+	vyfe_api.StorageBucketName = "dedupe-test"
+
+	a := *testApp
+	store := newMemoryStore()
+	a.Objects = store
+
+	upload := func() *upload {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("image", "talk.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("the same video bytes"))
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "/sessions", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		up, err := a.uploadFileFromForm(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return up
+	}
+
+	first := upload()
+	if want := int64(len("the same video bytes")); first.SizeBytes != want {
+		t.Errorf("first upload: got size %d, want %d", first.SizeBytes, want)
+	}
+	firstSession := &vyfe_api.Session{VideoURL: first.URL, ContentHash: first.ContentHash, SizeBytes: first.SizeBytes, Objects: first.Objects}
+	if _, err := a.DB.AddSession(firstSession); err != nil {
+		t.Fatal(err)
+	}
+	defer a.DB.DeleteSession(firstSession.ID)
+
+	second := upload()
+	if stored := len(store.objects); stored != 1 {
+		t.Errorf("got %d stored objects, want 1", stored)
+	}
+	if second.URL != first.URL || second.ContentHash != first.ContentHash {
+		t.Errorf("second upload: got %+v, want %+v", second, first)
+	}
+	if !reflect.DeepEqual(second.Objects, first.Objects) {
+		t.Errorf("second upload: got objects %q, want the shared %q", second.Objects, first.Objects)
+	}
+	secondSession := &vyfe_api.Session{VideoURL: second.URL, ContentHash: second.ContentHash, SizeBytes: second.SizeBytes, Objects: second.Objects}
+	if _, err := a.DB.AddSession(secondSession); err != nil {
+		t.Fatal(err)
+	}
+	defer a.DB.DeleteSession(secondSession.ID)
+
+	// The shared object stays until the last session using it is deleted,
+	// whichever order they are deleted in.
+	ctx := context.Background()
+	if err := a.DB.DeleteSession(firstSession.ID); err != nil {
+		t.Fatal(err)
+	}
+	a.deleteSessionObjects(ctx, firstSession)
+	if stored := len(store.objects); stored != 1 {
+		t.Errorf("after deleting the first session: got %d stored objects, want 1", stored)
+	}
+	if err := a.DB.DeleteSession(secondSession.ID); err != nil {
+		t.Fatal(err)
+	}
+	a.deleteSessionObjects(ctx, secondSession)
+	if stored := len(store.objects); stored != 0 {
+		t.Errorf("after deleting both sessions: got %d stored objects, want 0", stored)
+	}
+}
+
+// flaggingScanner is a Scanner that flags files containing "EICAR".
+type flaggingScanner struct{}
+
+func (flaggingScanner) Scan(ctx context.Context, r io.Reader) (bool, error) {
+	b, err := ioutil.ReadAll(r)
+	return !bytes.Contains(b, []byte("EICAR")), err
+}
+
+func TestUploadScanner(t *testing.T) {
+	a := *testApp
+	a.Scanner = flaggingScanner{}
+	store := newMemoryStore()
+	a.Objects = store
+
+	upload := func(content string) error {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("image", "talk.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "/sessions", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		_, err = a.uploadFileFromForm(req)
+		return err
+	}
+
+	if err := upload("X5O!P%@AP EICAR test file"); err != errUnsafeUpload {
+		t.Errorf("flagged upload: got error %v, want %v", err, errUnsafeUpload)
+	}
+	if stored := len(store.objects); stored != 0 {
+		t.Errorf("flagged upload: got %d stored objects, want 0", stored)
+	}
+	if err := upload("a clean scanned video"); err != nil {
+		t.Errorf("clean upload: %v", err)
+	}
+	if stored := len(store.objects); stored != 1 {
+		t.Errorf("clean upload: got %d stored objects, want 1", stored)
+	}
+}
+
+func TestFormSchema(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if appErr := testApp.apiFormSchemaHandler(rec, httptest.NewRequest("GET", "/api/sessions/form-schema", nil)); appErr != nil {
+		t.Fatal(appErr.Error)
+	}
+
+	var schema struct {
+		Fields []struct {
+			Name      string `json:"name"`
+			Required  bool   `json:"required"`
+			MaxLength int    `json:"maxLength"`
+		} `json:"fields"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&schema); err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]int)
+	for i, f := range schema.Fields {
+		fields[f.Name] = i
+	}
+	title, ok := fields["title"]
+	if !ok {
+		t.Fatalf("got fields %+v, want title", schema.Fields)
+	}
+	if f := schema.Fields[title]; !f.Required || f.MaxLength == 0 {
+		t.Errorf("got title %+v, want required with a maxLength", f)
+	}
+	if i, ok := fields["description"]; !ok || schema.Fields[i].MaxLength == 0 {
+		t.Errorf("got fields %+v, want description with a maxLength", schema.Fields)
+	}
+}
+
+func TestListsAndCountsHidePrivateSessions(t *testing.T) {
+	published := time.Date(1901, time.March, 4, 0, 0, 0, 0, time.UTC)
+	id, err := testApp.DB.AddSession(&vyfe_api.Session{
+		Title:         "!Zyzzogeton unveiled",
+		CreatedByID:   "private-owner",
+		Visibility:    vyfe_api.VisibilityPrivate,
+		PublishedDate: "1901-03-04",
+		PublishedAt:   published,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+
+	type view struct {
+		listed      bool
+		total       int
+		search      string
+		archived    bool
+		statsListed bool
+		statsCount  int
+	}
+	read := func(userID string) view {
+		a := *testApp
+		a.SessionStore = loginStore{&Profile{ID: userID}}
+		var v view
+
+		rec := httptest.NewRecorder()
+		if appErr := a.apiListHandler(rec, httptest.NewRequest("GET", "/api/sessions?withCount=true", nil)); appErr != nil {
+			t.Fatal(appErr.Error)
+		}
+		var list vyfe_api.ListResponse
+		if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range list.Data {
+			v.listed = v.listed || s.ID == id
+		}
+		v.total = *list.TotalCount
+
+		rec = httptest.NewRecorder()
+		if appErr := a.searchHandler(rec, httptest.NewRequest("GET", "/sessions/search?q=zyzzogeton", nil)); appErr != nil {
+			t.Fatal(appErr.Error)
+		}
+		if strings.Contains(rec.Body.String(), "Zyzzogeton") {
+			v.search = "shown"
+		}
+		if strings.Contains(rec.Body.String(), "1 result") {
+			v.search += " counted"
+		}
+
+		rec = httptest.NewRecorder()
+		if appErr := a.archiveHandler(rec, httptest.NewRequest("GET", "/sessions/archive", nil)); appErr != nil {
+			t.Fatal(appErr.Error)
+		}
+		v.archived = strings.Contains(rec.Body.String(), "/sessions/archive/1901/3")
+
+		from := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+		rec = httptest.NewRecorder()
+		if appErr := a.apiCreatedStatsHandler(rec, httptest.NewRequest("GET", "/api/stats/created?from="+from, nil)); appErr != nil {
+			t.Fatal(appErr.Error)
+		}
+		var stats struct {
+			Count    int
+			Sessions []*vyfe_api.Session
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range stats.Sessions {
+			v.statsListed = v.statsListed || s.ID == id
+		}
+		v.statsCount = stats.Count
+		return v
+	}
+
+	owner, other := read("private-owner"), read("someone-else")
+	if !owner.listed || owner.search != "shown counted" || !owner.archived || !owner.statsListed {
+		t.Errorf("owner: got %+v, want the private session listed everywhere", owner)
+	}
+	if other.listed || other.search != "" || other.archived || other.statsListed {
+		t.Errorf("other user: got %+v, want the private session listed nowhere", other)
+	}
+	if owner.total != other.total+1 {
+		t.Errorf("got total counts %d for the owner and %d for another user, want one more for the owner", owner.total, other.total)
+	}
+	if owner.statsCount != other.statsCount+1 {
+		t.Errorf("got created counts %d for the owner and %d for another user, want one more for the owner", owner.statsCount, other.statsCount)
+	}
+}
+
+// generatedDB serves n generated sessions from IterateSessions.
+type generatedDB struct {
+	vyfe_api.SessionDatabase
+	n int
+}
+
+func (db generatedDB) IterateSessions(ctx context.Context, fn func(*vyfe_api.Session) error) error {
+	for i := 1; i <= db.n; i++ {
+		s := &vyfe_api.Session{ID: int64(i), Title: fmt.Sprintf("Session %05d", i)}
+		if i%10 == 0 {
+			s.Visibility = vyfe_api.VisibilityPrivate
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestListAllStreamed(t *testing.T) {
+	a := *testApp
+	a.DB = generatedDB{n: 20000}
+
+	for _, gz := range []bool{false, true} {
+		req := httptest.NewRequest("GET", "/api/sessions/all", nil)
+		if gz {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		rec := httptest.NewRecorder()
+		if appErr := a.apiListAllHandler(rec, req); appErr != nil {
+			t.Fatal(appErr.Error)
+		}
+
+		var body io.Reader = rec.Body
+		if got := rec.Header().Get("Content-Encoding") == "gzip"; got != gz {
+			t.Errorf("gzip %v: got Content-Encoding %q", gz, rec.Header().Get("Content-Encoding"))
+			continue
+		}
+		if gz {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+		}
+		var sessions []*vyfe_api.Session
+		if err := json.NewDecoder(body).Decode(&sessions); err != nil {
+			t.Fatalf("gzip %v: invalid JSON: %v", gz, err)
+		}
+		if len(sessions) != 18000 || sessions[0].ID != 1 || sessions[len(sessions)-1].ID != 19999 {
+			t.Errorf("gzip %v: got %d sessions, want the 18000 public ones in order", gz, len(sessions))
+		}
+	}
+
+	// Small lists are sent uncompressed.
+	a.DB = generatedDB{n: 1}
+	req := httptest.NewRequest("GET", "/api/sessions/all", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	if appErr := a.apiListAllHandler(rec, req); appErr != nil {
+		t.Fatal(appErr.Error)
+	}
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("small list: got Content-Encoding %q, want none", enc)
+	}
+	var sessions []*vyfe_api.Session
+	if err := json.NewDecoder(rec.Body).Decode(&sessions); err != nil || len(sessions) != 1 {
+		t.Errorf("small list: got %d sessions, %v, want 1", len(sessions), err)
+	}
+}
+
+func TestListAllColumnar(t *testing.T) {
+	a := *testApp
+	a.DB = generatedDB{n: 50}
+
+	get := func(query string) []byte {
+		rec := httptest.NewRecorder()
+		if appErr := a.apiListAllHandler(rec, httptest.NewRequest("GET", "/api/sessions/all"+query, nil)); appErr != nil {
+			t.Fatal(appErr.Error)
+		}
+		return rec.Body.Bytes()
+	}
+	objects, columnar := get(""), get("?format=columnar")
+
+	var want []*vyfe_api.Session
+	if err := json.Unmarshal(objects, &want); err != nil {
+		t.Fatal(err)
+	}
+	var table struct {
+		Columns []string            `json:"columns"`
+		Rows    [][]json.RawMessage `json:"rows"`
+	}
+	if err := json.Unmarshal(columnar, &table); err != nil {
+		t.Fatalf("invalid columnar JSON: %v", err)
+	}
+	var got []*vyfe_api.Session
+	for _, row := range table.Rows {
+		if len(row) != len(table.Columns) {
+			t.Fatalf("got a row of %d values for %d columns", len(row), len(table.Columns))
+		}
+		fields := make(map[string]json.RawMessage)
+		for i, c := range table.Columns {
+			fields[c] = row[i]
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &vyfe_api.Session{}
+		if err := json.Unmarshal(b, s); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	if len(got) == 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("columnar sessions differ from the object format: got %d sessions, want %d", len(got), len(want))
+	}
+	if len(columnar) >= len(objects) {
+		t.Errorf("columnar format is %d bytes, object format %d; want it smaller", len(columnar), len(objects))
+	}
+
+	rec := httptest.NewRecorder()
+	if appErr := a.apiListAllHandler(rec, httptest.NewRequest("GET", "/api/sessions/all?format=csv", nil)); appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: got %v, want a 400 error", appErr)
+	}
+}
+
+// ListSessionsPage pages through the generated sessions, with the index of
+// the next one as the page token.
+func (db generatedDB) ListSessionsPage(ctx context.Context, pageToken string, limit int) (*vyfe_api.SessionList, error) {
+	start := 1
+	if pageToken != "" {
+		var err error
+		if start, err = strconv.Atoi(pageToken); err != nil {
+			return nil, vyfe_api.ErrBadPageToken
+		}
+	}
+	list := &vyfe_api.SessionList{}
+	for i := start; i <= db.n && len(list.Sessions) < limit; i++ {
+		list.Sessions = append(list.Sessions, &vyfe_api.Session{ID: int64(i)})
+	}
+	if next := start + len(list.Sessions); next <= db.n {
+		list.NextPageToken = strconv.Itoa(next)
+	}
+	return list, nil
+}
+
+func (db generatedDB) CountSessionsCreatedBy(ctx context.Context, userID string) (int, error) {
+	return db.n, nil
+}
+
+func (db generatedDB) ListSessionsFor(ctx context.Context, v vyfe_api.Viewer) ([]*vyfe_api.Session, error) {
+	var sessions []*vyfe_api.Session
+	err := db.IterateSessions(ctx, func(s *vyfe_api.Session) error {
+		if v.CanList(s) {
+			sessions = append(sessions, s)
+		}
+		return nil
+	})
+	return sessions, err
+}
+
+func TestListPageInfo(t *testing.T) {
+	a := *testApp
+	a.DB = generatedDB{n: 5}
+
+	var pages []vyfe_api.ListResponse
+	for cursor := ""; ; {
+		req := httptest.NewRequest("GET", "/api/sessions?limit=2&withCount=true&pageToken="+cursor, nil)
+		rec := httptest.NewRecorder()
+		if appErr := a.apiListHandler(rec, req); appErr != nil {
+			t.Fatal(appErr.Error)
+		}
+		var page vyfe_api.ListResponse
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, page)
+		if !page.PageInfo.HasNextPage || len(pages) > 5 {
+			break
+		}
+		cursor = page.PageInfo.NextCursor
+	}
+
+	if len(pages) != 3 {
+		t.Fatalf("got %d pages, want 3", len(pages))
+	}
+	for i, page := range pages[:2] {
+		if page.PageInfo.NextCursor == "" || page.PageInfo.PageSize != 2 {
+			t.Errorf("page %d: got %+v, want a cursor and 2 sessions", i, page.PageInfo)
+		}
+	}
+	last := pages[2]
+	if last.PageInfo.HasNextPage || last.PageInfo.NextCursor != "" {
+		t.Errorf("last page: got %+v, want no next page and an empty cursor", last.PageInfo)
+	}
+	if last.PageInfo.PageSize != 1 || len(last.Data) != 1 || last.Data[0].ID != 5 {
+		t.Errorf("last page: got %d sessions, want session 5", len(last.Data))
+	}
+	if last.TotalCount == nil || *last.TotalCount != 5 {
+		t.Errorf("last page: got total count %v, want 5", last.TotalCount)
+	}
+
+	// The count is only sent when asked for.
+	rec := httptest.NewRecorder()
+	if appErr := a.apiListHandler(rec, httptest.NewRequest("GET", "/api/sessions", nil)); appErr != nil {
+		t.Fatal(appErr.Error)
+	}
+	if strings.Contains(rec.Body.String(), "totalCount") {
+		t.Errorf("got %s, want no totalCount", rec.Body)
+	}
+}
+
+func TestParsePageParams(t *testing.T) {
+	defer func(size, max int) {
+		vyfe_api.PageSize, vyfe_api.MaxPageSize = size, max
+	}(vyfe_api.PageSize, vyfe_api.MaxPageSize)
+	vyfe_api.PageSize, vyfe_api.MaxPageSize = 20, 100
+
+	for _, tt := range []struct {
+		query string
+		limit int
+		bad   bool
+	}{
+		{"", 20, false},
+		{"limit=10", 10, false},
+		{"limit=100", 100, false},
+		{"limit=1000000", 100, false},
+		{"limit=0", 1, false},
+		{"limit=-1", 0, true},
+		{"limit=ten", 0, true},
+		{"limit=1.5", 0, true},
+	} {
+		r := httptest.NewRequest("GET", "/api/sessions?pageToken=abc&"+tt.query, nil)
+		limit, token, appErr := parsePageParams(r)
+		if tt.bad {
+			if appErr == nil || appErr.Code != http.StatusBadRequest {
+				t.Errorf("%q: got limit %d, err %v; want a 400", tt.query, limit, appErr)
+			}
+			continue
+		}
+		if appErr != nil {
+			t.Errorf("%q: %v", tt.query, appErr.Error)
+			continue
+		}
+		if limit != tt.limit || token != "abc" {
+			t.Errorf("%q: got limit %d, token %q; want %d, %q", tt.query, limit, token, tt.limit, "abc")
+		}
+	}
+}
+
+// SearchWithFacets returns every generated session, all tagged "go", as
+// matching any query.
+func (db generatedDB) SearchWithFacets(ctx context.Context, query string, tags []string) ([]*vyfe_api.Session, map[string]int, error) {
+	var sessions []*vyfe_api.Session
+	db.IterateSessions(ctx, func(s *vyfe_api.Session) error {
+		s.Tags = []string{"go"}
+		sessions = append(sessions, s)
+		return nil
+	})
+	return sessions, vyfe_api.TagFacets(sessions, tags), nil
+}
+
+func TestSearchPaged(t *testing.T) {
+	a := *testApp
+	a.DB = generatedDB{n: 12}
+
+	// Session 10 is private, so isn't found.
+	var ids []int64
+	for cursor, pages := "", 0; pages < 5; pages++ {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/sessions/search?q=talk&limit=4&withCount=true&pageToken="+cursor, nil)
+		if appErr := a.apiSearchHandler(rec, req); appErr != nil {
+			t.Fatal(appErr.Error)
+		}
+		var page searchResults
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		if page.TotalCount == nil || *page.TotalCount != 11 || page.Facets["go"] != 11 {
+			t.Errorf("page %d: got total count %v, facets %v; want 11 of all results", pages, page.TotalCount, page.Facets)
+		}
+		for _, s := range page.Data {
+			ids = append(ids, s.ID)
+		}
+		if !page.PageInfo.HasNextPage {
+			break
+		}
+		cursor = page.PageInfo.NextCursor
+	}
+	if want := []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 11, 12}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+
+	rec := httptest.NewRecorder()
+	appErr := a.apiSearchHandler(rec, httptest.NewRequest("GET", "/api/sessions/search?q=talk&pageToken=99", nil))
+	if appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Errorf("bad page token: got %v, want a 400", appErr)
+	}
+}
+
+func TestTagPage(t *testing.T) {
+	for _, title := range []string{"Tagged alpha", "Tagged beta"} {
+		id, err := testApp.DB.AddSession(&vyfe_api.Session{Title: title, Tags: []string{"tag-page-test"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer testApp.DB.DeleteSession(id)
+	}
+
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %d, want %d", path, rec.Code, http.StatusOK)
+		}
+		return rec.Body.String()
+	}
+
+	body := get("/sessions/tag/tag-page-test?limit=1")
+	if !strings.Contains(body, "Tagged alpha") || strings.Contains(body, "Tagged beta") || !strings.Contains(body, "More sessions") {
+		t.Errorf("first page: want only the first session and a link to more, got %s", body)
+	}
+
+	body = get("/sessions/tag/tag-page-test")
+	if !strings.Contains(body, "Tagged alpha") || !strings.Contains(body, "Tagged beta") || strings.Contains(body, "More sessions") {
+		t.Errorf("whole list: want both sessions and no link to more, got %s", body)
+	}
+}
+
+// ListRecentSessions returns the last limit generated sessions, newest
+// first. Odd ones have a published date.
+func (db generatedDB) ListRecentSessions(ctx context.Context, limit int) ([]*vyfe_api.Session, error) {
+	var sessions []*vyfe_api.Session
+	for i := db.n; i > 0 && len(sessions) < limit; i-- {
+		s := &vyfe_api.Session{ID: int64(i), Title: fmt.Sprintf("Session %05d", i), Description: "About <" + strconv.Itoa(i) + ">"}
+		if i%2 == 1 {
+			s.PublishedAt = time.Date(2016, time.March, i, 0, 0, 0, 0, time.UTC)
+		}
+		if i%10 == 0 {
+			s.Visibility = vyfe_api.VisibilityPrivate
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+func TestFeed(t *testing.T) {
+	defer func(n int, base string) {
+		vyfe_api.FeedItems, vyfe_api.CanonicalBaseURL = n, base
+	}(vyfe_api.FeedItems, vyfe_api.CanonicalBaseURL)
+	vyfe_api.FeedItems, vyfe_api.CanonicalBaseURL = 3, "https://vyfe.example"
+
+	a := *testApp
+	a.DB = generatedDB{n: 25}
+	rec := httptest.NewRecorder()
+	if appErr := a.feedHandler(rec, httptest.NewRequest("GET", "/sessions/feed.xml", nil)); appErr != nil {
+		t.Fatal(appErr.Error)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/rss+xml; charset=utf-8" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+
+	var feed struct {
+		Version string `xml:"version,attr"`
+		Channel struct {
+			Title string `xml:"title"`
+			Items []struct {
+				Title       string `xml:"title"`
+				Link        string `xml:"link"`
+				GUID        string `xml:"guid"`
+				Description string `xml:"description"`
+				PubDate     string `xml:"pubDate"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, rec.Body)
+	}
+	if feed.Version != "2.0" || feed.Channel.Title == "" {
+		t.Errorf("got version %q, title %q; want an RSS 2.0 channel", feed.Version, feed.Channel.Title)
+	}
+	// Session 25 is the newest; session 20 is private.
+	items := feed.Channel.Items
+	if len(items) != 3 {
+		t.Fatalf("got %d items, want 3", len(items))
+	}
+	first := items[0]
+	if first.Title != "Session 00025" || first.Link != "https://vyfe.example/sessions/25" || first.GUID != first.Link ||
+		first.Description != "About <25>" || first.PubDate != "Fri, 25 Mar 2016 00:00:00 +0000" {
+		t.Errorf("got first item %+v", first)
+	}
+	if items[1].Title != "Session 00024" || items[1].PubDate != "" {
+		t.Errorf("got second item %+v, want session 24 without pubDate", items[1])
+	}
+}
+
+func TestServeObjectRanges(t *testing.T) {
+	content := []byte("0123456789")
+	a := *testApp
+	a.objectAttrs = func(ctx context.Context, name string) (int64, string, error) {
+		if name != "talk.mp4" {
+			return 0, "", storage.ErrObjectNotExist
+		}
+		return int64(len(content)), "video/mp4", nil
+	}
+	a.readObject = func(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(content[offset : offset+length])), nil
+	}
+
+	for _, tt := range []struct {
+		rangeHeader string
+		wantCode    int
+		wantBody    string
+		wantRange   string
+		wantLength  string
+	}{
+		{"", http.StatusOK, "0123456789", "", "10"},
+		{"bytes=2-5", http.StatusPartialContent, "2345", "bytes 2-5/10", "4"},
+		{"bytes=7-", http.StatusPartialContent, "789", "bytes 7-9/10", "3"},
+		{"bytes=-3", http.StatusPartialContent, "789", "bytes 7-9/10", "3"},
+		{"bytes=8-100", http.StatusPartialContent, "89", "bytes 8-9/10", "2"},
+		{"bytes=10-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10", ""},
+		{"bytes=5-2", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10", ""},
+		{"bytes=0-1,4-5", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10", ""},
+		{"lines=1-2", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10", ""},
+	} {
+		req := httptest.NewRequest("GET", "/sessions/1/video", nil)
+		if tt.rangeHeader != "" {
+			req.Header.Set("Range", tt.rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		if appErr := a.serveObject(rec, req, "talk.mp4"); appErr != nil {
+			rec.Code = appErr.Code
+		}
+		if rec.Code != tt.wantCode {
+			t.Errorf("Range %q: got status %d, want %d", tt.rangeHeader, rec.Code, tt.wantCode)
+			continue
+		}
+		if got := rec.Header().Get("Content-Range"); got != tt.wantRange {
+			t.Errorf("Range %q: got Content-Range %q, want %q", tt.rangeHeader, got, tt.wantRange)
+		}
+		if tt.wantCode == http.StatusRequestedRangeNotSatisfiable {
+			continue
+		}
+		if got := rec.Body.String(); got != tt.wantBody {
+			t.Errorf("Range %q: got body %q, want %q", tt.rangeHeader, got, tt.wantBody)
+		}
+		if got := rec.Header().Get("Content-Length"); got != tt.wantLength {
+			t.Errorf("Range %q: got Content-Length %q, want %q", tt.rangeHeader, got, tt.wantLength)
+		}
+		if got := rec.Header().Get("Accept-Ranges"); got != "bytes" {
+			t.Errorf("Range %q: got Accept-Ranges %q, want bytes", tt.rangeHeader, got)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	if appErr := a.serveObject(rec, httptest.NewRequest("GET", "/sessions/1/video", nil), "missing.mp4"); appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("missing object: got %v, want 404", appErr)
+	}
+}
+
+func TestDrainWaitsForBackgroundWork(t *testing.T) {
+	a := *testApp
+	a.pending = &sync.WaitGroup{}
+	a.topic = nil
+
+	release := make(chan struct{})
+	var published int32
+	a.background(func() {
+		<-release
+		atomic.StoreInt32(&published, 1)
+	})
+
+	drained := make(chan bool)
+	go func() { drained <- a.drain(time.Minute) }()
+	select {
+	case <-drained:
+		t.Fatal("drain returned before the publish finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if !<-drained {
+		t.Error("drain: got false, want true")
+	}
+	if atomic.LoadInt32(&published) != 1 {
+		t.Error("drain returned before the publish finished")
+	}
+
+	// Work that doesn't finish in time is abandoned.
+	stuck := make(chan struct{})
+	defer close(stuck)
+	a.background(func() { <-stuck })
+	if a.drain(10 * time.Millisecond) {
+		t.Error("drain with stuck work: got true, want false")
+	}
+}
+
+func TestShutdownWaitsForRequestsBeforeDraining(t *testing.T) {
+	a := *testApp
+	a.pending = &sync.WaitGroup{}
+	a.topic = nil
+
+	// A request that is still running when shutdown starts, and starts
+	// background work as it finishes.
+	started, release := make(chan struct{}), make(chan struct{})
+	var published int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		a.background(func() {
+			time.Sleep(10 * time.Millisecond)
+			atomic.StoreInt32(&published, 1)
+		})
+	}))
+	defer srv.Close()
+	go http.Get(srv.URL)
+	<-started
+
+	finished := make(chan bool)
+	go func() { finished <- a.shutdown(srv.Config, time.Minute) }()
+	select {
+	case <-finished:
+		t.Fatal("shutdown returned before the request finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if !<-finished {
+		t.Error("shutdown: got false, want true")
+	}
+	if atomic.LoadInt32(&published) != 1 {
+		t.Error("shutdown returned before the request's background work finished")
+	}
+}
+
+func TestCreateRateBlocksBursts(t *testing.T) {
+	defer func(n int, w, b time.Duration) {
+		vyfe_api.AbuseCreateLimit, vyfe_api.AbuseWindow, vyfe_api.AbuseBlockDuration = n, w, b
+	}(vyfe_api.AbuseCreateLimit, vyfe_api.AbuseWindow, vyfe_api.AbuseBlockDuration)
+	vyfe_api.AbuseCreateLimit = 3
+	vyfe_api.AbuseWindow = time.Minute
+	vyfe_api.AbuseBlockDuration = 10 * time.Minute
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := *testApp
+	a.abuse = newAbuseDetector(newMemoryAbuseStore())
+	a.abuse.now = func() time.Time { return now }
+
+	create := func(ip, userID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/sessions", nil)
+		r.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		var user *Profile
+		if userID != "anonymous" {
+			user = &Profile{ID: userID}
+		}
+		if appErr := a.checkCreateRate(rec, r, user); appErr != nil {
+			rec.WriteHeader(appErr.Code)
+		}
+		return rec
+	}
+
+	// A burst from one user is blocked after the limit, from any address.
+	for i := 0; i < 3; i++ {
+		if rec := create(fmt.Sprintf("192.0.2.%d", i), "spammer"); rec.Code != http.StatusOK {
+			t.Fatalf("create %d: got %d, want 200", i, rec.Code)
+		}
+		now = now.Add(time.Second)
+	}
+	rec := create("192.0.2.9", "spammer")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("create over the limit: got %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "600" {
+		t.Errorf("Retry-After: got %q, want 600", got)
+	}
+
+	// Others are unaffected.
+	if rec := create("198.51.100.1", "someone"); rec.Code != http.StatusOK {
+		t.Errorf("create by another user: got %d, want 200", rec.Code)
+	}
+
+	// The block stays while it lasts, and clears after it.
+	now = now.Add(5 * time.Minute)
+	if rec := create("192.0.2.1", "spammer"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("create while blocked: got %d, want 429", rec.Code)
+	} else if got := rec.Header().Get("Retry-After"); got != "300" {
+		t.Errorf("Retry-After while blocked: got %q, want 300", got)
+	}
+	now = now.Add(5 * time.Minute)
+	if rec := create("192.0.2.1", "spammer"); rec.Code != http.StatusOK {
+		t.Errorf("create after the block: got %d, want 200", rec.Code)
+	}
+
+	// Anonymous creates are only counted by address.
+	for i := 0; i < 3; i++ {
+		create("203.0.113.1", "anonymous")
+	}
+	if rec := create("203.0.113.1", "anonymous"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("anonymous burst: got %d, want 429", rec.Code)
+	}
+	if rec := create("203.0.113.2", "anonymous"); rec.Code != http.StatusOK {
+		t.Errorf("anonymous create from another address: got %d, want 200", rec.Code)
+	}
+}
+
+func TestClientIPUsesLastForwardedAddress(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/sessions", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	if got, want := clientIP(r), "10.0.0.1"; got != want {
+		t.Errorf("without X-Forwarded-For: got %q, want %q", got, want)
+	}
+	r.Header.Set("X-Forwarded-For", "192.0.2.1, 198.51.100.7")
+	if got, want := clientIP(r), "198.51.100.7"; got != want {
+		t.Errorf("with a spoofed X-Forwarded-For: got %q, want %q", got, want)
+	}
+}
+
+func TestMemoryAbuseStorePrunes(t *testing.T) {
+	s := newMemoryAbuseStore()
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Hit("ip:192.0.2.1", now, time.Minute)
+	s.Block("ip:192.0.2.2", now.Add(time.Minute))
+
+	now = now.Add(2 * time.Minute)
+	s.Hit("ip:192.0.2.3", now, time.Minute)
+	if len(s.events) != 1 || len(s.blocked) != 0 {
+		t.Errorf("got %d principals with events and %d blocked, want 1 and 0", len(s.events), len(s.blocked))
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	h := recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	for _, tt := range []struct {
+		path     string
+		wantJSON bool
+	}{
+		{"/sessions", false},
+		{"/api/sessions", true},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s: got status %d, want %d", tt.path, rec.Code, http.StatusInternalServerError)
+		}
+		if got := strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json"); got != tt.wantJSON {
+			t.Errorf("%s: got Content-Type %q, want JSON %v", tt.path, rec.Header().Get("Content-Type"), tt.wantJSON)
+		}
+	}
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	validation := appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+		return validateSession(&vyfe_api.Session{})
+	})
+	badID := appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+		return badRequest(nil, "bad session id: %v", "x")
+	})
+
+	for _, tt := range []struct {
+		acceptLanguage string
+		wantField      string
+		wantMessage    string
+	}{
+		{"", "is required", "bad session id: x"},
+		{"en-US,en;q=0.9", "is required", "bad session id: x"},
+		{"de-DE,de;q=0.9,en;q=0.8", "ist erforderlich", "ungültige Session-ID: x"},
+	} {
+		req := httptest.NewRequest("POST", "/api/sessions", nil)
+		req.Header.Set("Accept-Language", tt.acceptLanguage)
+		rec := httptest.NewRecorder()
+		validation.ServeHTTP(rec, req)
+		var got APIError
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Fields["title"] != tt.wantField {
+			t.Errorf("%q: got title message %q, want %q", tt.acceptLanguage, got.Fields["title"], tt.wantField)
+		}
+
+		req = httptest.NewRequest("GET", "/sessions/x", nil)
+		req.Header.Set("Accept-Language", tt.acceptLanguage)
+		rec = httptest.NewRecorder()
+		badID.ServeHTTP(rec, req)
+		if got := strings.TrimSpace(rec.Body.String()); got != tt.wantMessage {
+			t.Errorf("%q: got message %q, want %q", tt.acceptLanguage, got, tt.wantMessage)
+		}
+	}
+}
+
+func TestValidateSessionPayload(t *testing.T) {
+	h := appHandler(apiValidateHandler)
+
+	for _, tt := range []struct {
+		body       string
+		wantStatus int
+		wantField  string
+	}{
+		{`{"title":"Go", "publishedDate":"2016-03-04"}`, http.StatusOK, ""},
+		{`{"publishedDate":"someday"}`, http.StatusUnprocessableEntity, "title"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/sessions/validate", strings.NewReader(tt.body)))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.body, rec.Code, tt.wantStatus)
+		}
+
+		var got struct {
+			Valid  bool              `json:"valid"`
+			Code   string            `json:"code"`
+			Fields map[string]string `json:"fields"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if tt.wantField == "" {
+			if !got.Valid {
+				t.Errorf("%s: got %+v, want valid", tt.body, got)
+			}
+			continue
+		}
+		if got.Code != errValidationFailed || got.Fields[tt.wantField] == "" || got.Fields["publishedDate"] == "" {
+			t.Errorf("%s: got %+v, want title and publishedDate errors", tt.body, got)
+		}
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	h := appHandler(apiValidateHandler)
+
+	for _, tt := range []struct {
+		name, body, want string
+	}{
+		{"syntax", `{"title": "Go",}`, "malformed JSON at position 16"},
+		{"type", `{"title": 42}`, `field "title" must be a JSON string, not number`},
+		{"not an object", `["Go"]`, "must be a JSON object, not array"},
+		{"trailing", `{"title":"Go"} {"title":"again"}`, "single JSON value"},
+		{"empty", ``, "must not be empty"},
+		{"truncated", `{"title": "Go"`, "ends in the middle of a value"},
+		{"unknown field", `{"title":"Go","speaker":"Gopher"}`, `unknown field "speaker"`},
+		{"too large", `{"title":"` + strings.Repeat("x", maxJSONBodySize) + `"}`, "must not be larger than"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/sessions/validate", strings.NewReader(tt.body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, http.StatusBadRequest)
+		}
+		var got APIError
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: could not decode body: %v", tt.name, err)
+		}
+		if got.Code != errBadRequest || !strings.Contains(got.Message, tt.want) {
+			t.Errorf("%s: got %s %q, want %s mentioning %q", tt.name, got.Code, got.Message, errBadRequest, tt.want)
+		}
+	}
+}
+
+func TestCacheControlFor(t *testing.T) {
+	defer func(m map[string]string) { vyfe_api.UploadCacheControl = m }(vyfe_api.UploadCacheControl)
+	vyfe_api.UploadCacheControl = map[string]string{
+		"video/*":    "video",
+		"image/*":    "image",
+		"image/webp": "webp",
+	}
+
+	for contentType, want := range map[string]string{
+		"video/mp4":                "video",
+		"image/png":                "image",
+		"image/webp":               "webp",
+		"IMAGE/JPEG; charset=utf8": "image",
+		"application/pdf":          vyfe_api.DefaultUploadCacheControl,
+		"":                         vyfe_api.DefaultUploadCacheControl,
+	} {
+		if got := cacheControlFor(contentType); got != want {
+			t.Errorf("cacheControlFor(%q) = %q, want %q", contentType, got, want)
+		}
+	}
+}
+
+func TestStartResumableUpload(t *testing.T) {
+	a := *testApp
+	var gotName, gotType, gotOrigin string
+	a.startResumable = func(ctx context.Context, name, contentType, origin string) (string, error) {
+		gotName, gotType, gotOrigin = name, contentType, origin
+		return "https://storage.example.com/session", nil
+	}
+
+	req := httptest.NewRequest("POST", "/api/uploads", strings.NewReader(`{"filename":"talk.mp4","contentType":"video/mp4"}`))
+	req.Header.Set("Origin", "https://vyfe.example.com")
+	rec := httptest.NewRecorder()
+	if appErr := a.apiStartUploadHandler(rec, req); appErr != nil {
+		t.Fatal(appErr.Error)
+	}
+
+	var got resumableUpload
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.UploadURL != "https://storage.example.com/session" || got.Object != gotName || got.ChunkSize != vyfe_api.ResumableChunkSize {
+		t.Errorf("got %+v, want the session URI for object %q", got, gotName)
+	}
+	if !strings.HasSuffix(gotName, ".mp4") || gotType != "video/mp4" || gotOrigin != "https://vyfe.example.com" {
+		t.Errorf("started upload of %q (%s) for origin %q", gotName, gotType, gotOrigin)
+	}
+
+	rec = httptest.NewRecorder()
+	if appErr := a.apiStartUploadHandler(rec, httptest.NewRequest("POST", "/api/uploads", strings.NewReader(`{"filename":"talk.mp4"}`))); appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Errorf("missing contentType: got %v, want 400", appErr)
+	}
+}
+
+func TestFinishResumableUpload(t *testing.T) {
+	defer func(enabled, private bool, store sessions.Store) {
+		vyfe_api.UploadsEnabled, vyfe_api.PrivateObjects = enabled, private
+		testApp.SessionStore = store
+	}(vyfe_api.UploadsEnabled, vyfe_api.PrivateObjects, testApp.SessionStore)
+	vyfe_api.UploadsEnabled, vyfe_api.PrivateObjects = true, false
+
+	a := *testApp
+	a.Scanner = flaggingScanner{}
+	store := newMemoryStore()
+	a.Objects = store
+	a.objectAttrs = func(ctx context.Context, name string) (int64, string, error) {
+		b, ok := store.objects[name]
+		if !ok {
+			return 0, "", storage.ErrObjectNotExist
+		}
+		return int64(len(b)), store.contentTypes[name], nil
+	}
+	a.readObject = func(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(store.objects[name])), nil
+	}
+	published := make(map[string]bool)
+	a.publishObject = func(ctx context.Context, name string) error {
+		published[name] = true
+		return nil
+	}
+	a.startResumable = func(ctx context.Context, name, contentType, origin string) (string, error) {
+		return "https://storage.example.com/session", nil
+	}
+
+	id, err := a.DB.AddSession(&vyfe_api.Session{Title: "Resumed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.DB.DeleteSession(id)
+
+	// start begins an upload as the given user, storing content as if the
+	// client had sent it.
+	start := func(userID, content string) resumableUpload {
+		a.SessionStore = loginStore{&Profile{ID: userID}}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/uploads", strings.NewReader(`{"filename":"talk.mp4","contentType":"video/mp4"}`))
+		if appErr := a.apiStartUploadHandler(rec, req); appErr != nil {
+			t.Fatal(appErr.Error)
+		}
+		var up resumableUpload
+		if err := json.NewDecoder(rec.Body).Decode(&up); err != nil {
+			t.Fatal(err)
+		}
+		store.objects[up.Object] = []byte(content)
+		return up
+	}
+	finish := func(userID string, up resumableUpload) *appError {
+		a.SessionStore = loginStore{&Profile{ID: userID}}
+		body := fmt.Sprintf(`{"object":%q,"token":%q}`, up.Object, up.Token)
+		req := mux.SetURLVars(httptest.NewRequest("POST", "/api/sessions/x/upload", strings.NewReader(body)), map[string]string{"id": strconv.FormatInt(id, 10)})
+		return a.apiFinishUploadHandler(httptest.NewRecorder(), req)
+	}
+
+	up := start("uploader", "a clean talk")
+	if appErr := finish("someone-else", up); appErr == nil || appErr.Code != http.StatusForbidden {
+		t.Errorf("another user's upload: got %v, want a 403 error", appErr)
+	}
+
+	flagged := start("uploader", "an EICAR talk")
+	if appErr := finish("uploader", flagged); appErr == nil || appErr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("flagged upload: got %v, want a 422 error", appErr)
+	}
+	if _, ok := store.objects[flagged.Object]; ok || published[flagged.Object] {
+		t.Errorf("flagged upload: object kept or published")
+	}
+
+	if appErr := finish("uploader", up); appErr != nil {
+		t.Fatal(appErr.Error)
+	}
+	if !published[up.Object] {
+		t.Errorf("clean upload: object not published")
+	}
+	got, err := a.DB.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VideoURL != vyfe_api.ObjectURL(up.Object) || got.SizeBytes != int64(len("a clean talk")) {
+		t.Errorf("got video %q of %d bytes, want the uploaded object", got.VideoURL, got.SizeBytes)
+	}
+}
+
+func TestProjectFields(t *testing.T) {
+	session := &vyfe_api.Session{ID: 7, Title: "t", Author: "a", VideoURL: "v", Description: "d"}
+
+	got, err := projectFields(session, "title, author,videoUrl,nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"author":"a","title":"t","videoUrl":"v"}`; string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
+
+func TestTranscodeToWebPRejectsCorruptImages(t *testing.T) {
+	if _, err := transcodeToWebP(strings.NewReader("not an image")); err == nil {
+		t.Error("want non-nil err for corrupt image")
+	}
+	if isWebPConvertible("video/mp4") {
+		t.Error("video/mp4: got convertible, want not convertible")
+	}
+}
+
+func bodyContains(t *testing.T, wt *webtest.W, path, contains string) (ok bool) {
+	body, _, err := wt.GetBody(path)
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	if !strings.Contains(body, contains) {
+		t.Errorf("want %s to contain %s", body, contains)
+		return false
+	}
+	return true
+}
+
+func TestEventPayload(t *testing.T) {
+	defer func(legacy bool) { vyfe_api.LegacyPubsubPayload = legacy }(vyfe_api.LegacyPubsubPayload)
+
+	id, err := testApp.DB.AddSession(&vyfe_api.Session{Title: "evented"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+
+	vyfe_api.LegacyPubsubPayload = false
+	for _, typ := range []string{vyfe_api.EventCreated, vyfe_api.EventUpdated, vyfe_api.EventDeleted} {
+		b, err := eventPayload(testApp.sessionEvent(typ, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got struct {
+			Type      string                 `json:"type"`
+			SessionID int64                  `json:"sessionId"`
+			Session   map[string]interface{} `json:"session"`
+			Timestamp time.Time              `json:"timestamp"`
+		}
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: could not decode payload %s: %v", typ, b, err)
+		}
+		if got.Type != typ || got.SessionID != id || got.Timestamp.IsZero() {
+			t.Errorf("%s: got payload %s", typ, b)
+		}
+		if typ == vyfe_api.EventDeleted {
+			if !strings.Contains(string(b), `"session":null`) {
+				t.Errorf("%s: got payload %s, want a null session", typ, b)
+			}
+		} else if got.Session["title"] != "evented" {
+			t.Errorf("%s: got session %v, want the saved session", typ, got.Session)
+		}
+	}
+
+	vyfe_api.LegacyPubsubPayload = true
+	b, err := eventPayload(testApp.sessionEvent(vyfe_api.EventUpdated, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), fmt.Sprint(id); got != want {
+		t.Errorf("legacy payload: got %s, want %s", got, want)
+	}
+}
+
+func TestCheckStorage(t *testing.T) {
+	defer func(enabled bool) { vyfe_api.UploadsEnabled = enabled }(vyfe_api.UploadsEnabled)
+	ctx := context.Background()
+
+	a := *testApp
+	a.Objects = nil
+	vyfe_api.UploadsEnabled = false
+	if err := a.checkStorage(ctx); err != nil {
+		t.Errorf("uploads disabled without a bucket: got %v, want nil", err)
+	}
+	vyfe_api.UploadsEnabled = true
+	if err := a.checkStorage(ctx); err == nil {
+		t.Error("uploads enabled without a bucket: got nil error")
+	}
+
+	a.Objects = newMemoryStore()
+	a.checkBucket = func(ctx context.Context) error { return nil }
+	if err := a.checkStorage(ctx); err != nil {
+		t.Errorf("reachable bucket: got %v, want nil", err)
+	}
+	a.checkBucket = func(ctx context.Context) error { return errors.New("storage: bucket doesn't exist") }
+	if err := a.checkStorage(ctx); err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Errorf("unreachable bucket: got %v, want the bucket's error", err)
+	}
+}
+
+func TestUploadsDisabled(t *testing.T) {
+	defer func(enabled bool) { vyfe_api.UploadsEnabled = enabled }(vyfe_api.UploadsEnabled)
+
+	form := func() string {
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", "/sessions/add", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /sessions/add: got status %d, want %d", rec.Code, http.StatusOK)
+		}
+		return rec.Body.String()
+	}
+	create := func() int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("title", "Uploaded talk")
+		fw, err := mw.CreateFormFile("image", "talk.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("a video"))
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "/sessions", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		appHandler(testApp.createHandler).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	vyfe_api.UploadsEnabled = true
+	if !strings.Contains(form(), `name="image"`) {
+		t.Error("uploads enabled: form has no upload field")
+	}
+
+	vyfe_api.UploadsEnabled = false
+	if strings.Contains(form(), `name="image"`) {
+		t.Error("uploads disabled: form has an upload field")
+	}
+	if code := create(); code != http.StatusNotImplemented {
+		t.Errorf("uploads disabled: create with a file got status %d, want %d", code, http.StatusNotImplemented)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/uploads", strings.NewReader(`{"filename":"talk.mp4","contentType":"video/mp4"}`))
+	appHandler(testApp.apiStartUploadHandler).ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("uploads disabled: starting a resumable upload got status %d, want %d", rec.Code, http.StatusNotImplemented)
+	}
+}
+
+// loginStore is a sessions.Store that has every request logged in as the
+// user with the given profile.
+type loginStore struct{ profile *Profile }
+
+func (s loginStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return s.New(r, name)
+}
+
+func (s loginStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	session.Values[oauthTokenSessionKey] = &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)}
+	session.Values[googleProfileSessionKey] = s.profile
+	return session, nil
+}
+
+func (loginStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	return nil
+}
+
+func TestListMine(t *testing.T) {
+	defer func(store sessions.Store) { testApp.SessionStore = store }(testApp.SessionStore)
+
+	for _, title := range []string{"Mine B", "Mine A"} {
+		id, err := testApp.DB.AddSession(&vyfe_api.Session{Title: title, CreatedByID: "lister"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer testApp.DB.DeleteSession(id)
+	}
+	id, err := testApp.DB.AddSession(&vyfe_api.Session{Title: "Not mine", CreatedByID: "someone else"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+
+	if rec := get("/sessions/mine"); rec.Code != http.StatusFound || !strings.HasPrefix(rec.Header().Get("Location"), "/login") {
+		t.Errorf("anonymous: got status %d to %q, want a redirect to log in", rec.Code, rec.Header().Get("Location"))
+	}
+
+	testApp.SessionStore = loginStore{&Profile{ID: "lister", DisplayName: "Lister"}}
+	for _, tt := range []struct {
+		target      string
+		first, last string
+	}{
+		{"/sessions/mine", "Mine A", "Mine B"},
+		{"/sessions/mine?sort=created&order=desc", "Mine A", "Mine B"},
+		{"/sessions/mine?sort=created", "Mine B", "Mine A"},
+	} {
+		rec := get(tt.target)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", tt.target, rec.Code, http.StatusOK)
+			continue
+		}
+		body := rec.Body.String()
+		if strings.Contains(body, "Not mine") {
+			t.Errorf("%s: lists another user's session", tt.target)
+		}
+		if i, j := strings.Index(body, tt.first), strings.Index(body, tt.last); i < 0 || j < 0 || i > j {
+			t.Errorf("%s: want %q listed before %q", tt.target, tt.first, tt.last)
+		}
+	}
+	if rec := get("/sessions/mine?sort=views"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown sort: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestWritesRequireCreator(t *testing.T) {
+	defer func(store sessions.Store) { testApp.SessionStore = store }(testApp.SessionStore)
+	anonymous := testApp.SessionStore
+	owner := loginStore{&Profile{ID: "writer", DisplayName: "Writer"}}
+	other := loginStore{&Profile{ID: "intruder", DisplayName: "Intruder"}}
+
+	id, err := testApp.DB.AddSession(&vyfe_api.Session{
+		Title:       "Mine",
+		CreatedByID: "writer",
+		Visibility:  vyfe_api.VisibilityPrivate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+	session, err := testApp.DB.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/sessions/" + session.URLID()
+	update := `{"title":"Yours","visibility":"public"}`
+
+	for _, store := range []sessions.Store{anonymous, other} {
+		testApp.SessionStore = store
+		for _, req := range []*http.Request{
+			httptest.NewRequest("PUT", "/api"+path, strings.NewReader(update)),
+			httptest.NewRequest("DELETE", "/api"+path, nil),
+			httptest.NewRequest("POST", path, strings.NewReader("title=Yours&visibility=public")),
+			httptest.NewRequest("POST", path+":delete", nil),
+		} {
+			rec := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("%s %s by a non-creator: got status %d, want %d", req.Method, req.URL.Path, rec.Code, http.StatusForbidden)
+			}
+		}
+	}
+	stored, err := testApp.DB.GetSession(id)
+	if err != nil {
+		t.Fatalf("non-creators deleted the session: %v", err)
+	}
+	if stored.Title != "Mine" || stored.Visibility != vyfe_api.VisibilityPrivate {
+		t.Errorf("non-creators changed the session to %q, %q", stored.Title, stored.Visibility)
+	}
+
+	testApp.SessionStore = owner
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("PUT", "/api"+path, strings.NewReader(update)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("update by the creator: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if stored, err := testApp.DB.GetSession(id); err != nil || stored.Visibility != vyfe_api.VisibilityPublic {
+		t.Errorf("update by the creator: got %v, want the session made public", err)
+	}
+}
+
+func TestReorderRequiresAdmin(t *testing.T) {
+	defer func(admins []string, store sessions.Store) {
+		vyfe_api.AdminUserIDs = admins
+		testApp.SessionStore = store
+	}(vyfe_api.AdminUserIDs, testApp.SessionStore)
+	vyfe_api.AdminUserIDs = []string{"admin"}
+
+	var ids []int64
+	for _, title := range []string{"Reorder A", "Reorder B"} {
+		id, err := testApp.DB.AddSession(&vyfe_api.Session{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer testApp.DB.DeleteSession(id)
+		ids = append(ids, id)
+	}
+	for i, id := range ids {
+		if err := testApp.DB.MoveSession(context.Background(), id, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reorder := func(userID string) int {
+		testApp.SessionStore = loginStore{&Profile{ID: userID, DisplayName: userID}}
+		body := fmt.Sprintf(`{"ids":[%d,%d]}`, ids[1], ids[0])
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("POST", "/sessions/reorder", strings.NewReader(body)))
+		return rec.Code
+	}
+	position := func(id int64) int {
+		s, err := testApp.DB.GetSession(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Position
+	}
+
+	if code := reorder("someone"); code != http.StatusForbidden {
+		t.Errorf("non-admin reorder: got status %d, want %d", code, http.StatusForbidden)
+	}
+	if position(ids[0]) > position(ids[1]) {
+		t.Error("non-admin reorder changed the order")
+	}
+	if code := reorder("admin"); code != http.StatusNoContent {
+		t.Errorf("admin reorder: got status %d, want %d", code, http.StatusNoContent)
+	}
+	if position(ids[0]) < position(ids[1]) {
+		t.Error("admin reorder didn't change the order")
+	}
+}
+
+func TestProtectFields(t *testing.T) {
+	defer func(admins []string, reject bool, store sessions.Store) {
+		vyfe_api.AdminUserIDs = admins
+		vyfe_api.RejectProtectedFieldChanges = reject
+		testApp.SessionStore = store
+	}(vyfe_api.AdminUserIDs, vyfe_api.RejectProtectedFieldChanges, testApp.SessionStore)
+	vyfe_api.AdminUserIDs = []string{"admin"}
+	vyfe_api.RejectProtectedFieldChanges = false
+
+	id, err := testApp.DB.AddSession(&vyfe_api.Session{Title: "Protected", CreatedBy: "Owner", CreatedByID: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testApp.DB.DeleteSession(id)
+
+	update := func(userID string) (*httptest.ResponseRecorder, *vyfe_api.Session) {
+		body := `{"title":"Taken over","createdBy":"Thief","createdById":"thief"}`
+		req := httptest.NewRequest("PUT", fmt.Sprintf("/api/sessions/%d", id), strings.NewReader(body))
+		testApp.SessionStore = loginStore{&Profile{ID: userID, DisplayName: userID}}
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, req)
+		stored, err := testApp.DB.GetSession(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec, stored
+	}
+
+	rec, stored := update("owner")
+	if rec.Code != http.StatusOK || stored.Title != "Taken over" || stored.CreatedByID != "owner" || stored.CreatedBy != "Owner" {
+		t.Errorf("non-admin update: got status %d, session %+v; want the title changed and the creator kept", rec.Code, stored)
+	}
+
+	vyfe_api.RejectProtectedFieldChanges = true
+	testApp.DB.UpdateSession(&vyfe_api.Session{ID: id, Title: "Protected", CreatedBy: "Owner", CreatedByID: "owner"})
+	if rec, _ := update("owner"); rec.Code != http.StatusForbidden {
+		t.Errorf("non-admin update, rejecting: got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if stored, _ := testApp.DB.GetSession(id); stored.Title != "Protected" {
+		t.Errorf("rejected update saved the title %q", stored.Title)
+	}
+
+	rec, stored = update("admin")
+	if rec.Code != http.StatusOK || stored.CreatedByID != "thief" || stored.CreatedBy != "Thief" {
+		t.Errorf("admin update: got status %d, session %+v; want the creator changed", rec.Code, stored)
+	}
+
+	// A new session's creator is the user creating it.
+	req := httptest.NewRequest("POST", "/api/sessions", nil)
+	testApp.SessionStore = loginStore{&Profile{ID: "owner", DisplayName: "Owner"}}
+	session := &vyfe_api.Session{Title: "New", CreatedBy: "Thief", CreatedByID: "thief"}
+	baseline, err := testApp.writeBaseline(req, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vyfe_api.RejectProtectedFieldChanges = false
+	if appErr := testApp.protectFields(req, session, baseline); appErr != nil {
+		t.Fatalf("non-admin create: %v", appErr.Message)
+	}
+	if session.CreatedByID != "owner" || session.CreatedBy != "Owner" || session.Title != "New" {
+		t.Errorf("non-admin create: got %+v, want the logged in creator", session)
+	}
+}
+
+func TestNewSessionDefaults(t *testing.T) {
+	defer func(d vyfe_api.SessionDefaults) { vyfe_api.NewSessionDefaults = d }(vyfe_api.NewSessionDefaults)
+	vyfe_api.NewSessionDefaults = vyfe_api.SessionDefaults{
+		Tags:           []string{"meetup"},
+		Description:    "Recorded at the meetup.",
+		PublishedToday: true,
+	}
+
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", "/sessions/add", nil))
+	today := time.Now().Format("2006-01-02")
+	for _, want := range []string{"Add session", `value="meetup"`, `value="Recorded at the meetup."`, `value="` + today + `"`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("add form: want %s, got %s", want, rec.Body.String())
+		}
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "Defaults test")
+	mw.WriteField("description", "My own description.")
+	mw.Close()
+	req := httptest.NewRequest("POST", "/sessions", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	appHandler(testApp.createHandler).ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("create: got status %d, want %d", rec.Code, http.StatusFound)
+	}
+
+	sessions, err := testApp.DB.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created *vyfe_api.Session
+	for _, s := range sessions {
+		if s.Title == "Defaults test" {
+			created = s
+		}
+	}
+	if created == nil {
+		t.Fatal("created session not found")
+	}
+	defer testApp.DB.DeleteSession(created.ID)
+	if created.Description != "My own description." || !reflect.DeepEqual(created.Tags, []string{"meetup"}) || created.PublishedDate != today {
+		t.Errorf("created %+v, want the given description and the default tags and date", created)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	before, err := testApp.DB.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "Preview test")
+	mw.WriteField("author", "ann")
+	mw.WriteField("description", "A long description to check.")
+	mw.Close()
+	req := httptest.NewRequest("POST", "/sessions/preview", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("preview: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	for _, want := range []string{"Preview test", "By ann", "A long description to check.", "This is a preview."} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("preview: want %q, got %s", want, rec.Body.String())
+		}
+	}
+	if strings.Contains(rec.Body.String(), "Delete session") {
+		t.Error("preview: got the delete button of a saved session")
+	}
+
+	after, err := testApp.DB.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("preview: got %d sessions afterwards, want %d", len(after), len(before))
+	}
+}
+
+// staleDB is a SessionDatabase whose lists lag behind its writes, as
+// Datastore queries can: they leave out the hidden sessions and still
+// include the ghost ones.
+type staleDB struct {
+	vyfe_api.SessionDatabase
+	hidden map[int64]bool
+	ghosts []*vyfe_api.Session
+}
+
+func (db *staleDB) stale(sessions []*vyfe_api.Session) []*vyfe_api.Session {
+	var list []*vyfe_api.Session
+	for _, s := range sessions {
+		if !db.hidden[s.ID] {
+			list = append(list, s)
+		}
+	}
+	list = append(list, db.ghosts...)
+	sort.Slice(list, func(i, j int) bool { return list[i].Title < list[j].Title })
+	return list
+}
+
+func (db *staleDB) ListSessionSummaries(ctx context.Context) ([]*vyfe_api.SessionSummary, error) {
+	sessions, err := db.SessionDatabase.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	return summaries(db.stale(sessions)), nil
+}
+
+func (db *staleDB) IterateSessions(ctx context.Context, fn func(*vyfe_api.Session) error) error {
+	sessions, err := db.SessionDatabase.ListSessions()
+	if err != nil {
+		return err
+	}
+	for _, s := range db.stale(sessions) {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestListReadsYourWrites(t *testing.T) {
+	a := *testApp
+	db := &staleDB{SessionDatabase: testApp.DB, hidden: make(map[int64]bool)}
+	a.DB = db
+
+	list := func(query string) string {
+		rec := httptest.NewRecorder()
+		if appErr := a.listHandler(rec, httptest.NewRequest("GET", "/sessions"+query, nil)); appErr != nil {
+			t.Fatal(appErr.Error)
+		}
+		return rec.Body.String()
+	}
+
+	fresh := &vyfe_api.Session{Title: "Freshly created"}
+	id, err := a.DB.AddSession(fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.DB.DeleteSession(id)
+	db.hidden[id] = true
+
+	if strings.Contains(list(""), "Freshly created") {
+		t.Fatal("the stale list already has the new session")
+	}
+	if !strings.Contains(list("?created="+fresh.URLID()), "Freshly created") {
+		t.Error("list after create: the new session is missing")
+	}
+
+	gone := &vyfe_api.Session{Title: "Just deleted"}
+	id, err = a.DB.AddSession(gone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DB.DeleteSession(id); err != nil {
+		t.Fatal(err)
+	}
+	db.ghosts = append(db.ghosts, gone)
+
+	if !strings.Contains(list(""), "Just deleted") {
+		t.Fatal("the stale list doesn't have the deleted session")
+	}
+	if strings.Contains(list("?deleted="+gone.URLID()), "Just deleted") {
+		t.Error("list after delete: the deleted session is still listed")
+	}
+}
+
+func TestCaptions(t *testing.T) {
+	defer func(name string) { vyfe_api.StorageBucketName = name }(vyfe_api.StorageBucketName)
+	vyfe_api.StorageBucketName = "captions-test"
+
+	a := *testApp
+	store := newMemoryStore()
+	a.Objects = store
+	a.objectAttrs = func(ctx context.Context, name string) (int64, string, error) {
+		b, ok := store.objects[name]
+		if !ok {
+			return 0, "", storage.ErrObjectNotExist
+		}
+		return int64(len(b)), store.contentTypes[name], nil
+	}
+	a.readObject = func(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(store.objects[name][offset : offset+length])), nil
+	}
+
+	create := func(title, filename, content string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("title", title)
+		mw.WriteField("captionLang", "en")
+		fw, err := mw.CreateFormFile("caption", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "/sessions", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		appHandler(a.createHandler).ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := create("Bad captions", "talk.vtt", "1\n00:00:01,000 --> 00:00:02,000\nHello\n"); rec.Code != http.StatusBadRequest {
+		t.Errorf("SubRip content in a .vtt file: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	const vtt = "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHello, captions.\n"
+	if rec := create("Captioned talk", "talk.vtt", vtt); rec.Code != http.StatusFound {
+		t.Fatalf("create: got status %d, want %d", rec.Code, http.StatusFound)
+	}
+	sessions, err := a.DB.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session *vyfe_api.Session
+	for _, s := range sessions {
+		if s.Title == "Captioned talk" {
+			session = s
+		}
+	}
+	if session == nil {
+		t.Fatal("created session not found")
+	}
+	defer a.DB.DeleteSession(session.ID)
+	if len(session.Captions) != 1 || session.Captions[0].Lang != "en" || session.Captions[0].Format != vyfe_api.CaptionVTT {
+		t.Fatalf("got captions %+v, want one in en and vtt", session.Captions)
+	}
+
+	get := func(lang string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/sessions/"+session.URLID()+"/captions/"+lang, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": session.URLID(), "lang": lang})
+		rec := httptest.NewRecorder()
+		appHandler(a.captionHandler).ServeHTTP(rec, req)
+		return rec
+	}
+	rec := get("en")
+	if rec.Code != http.StatusOK || rec.Body.String() != vtt {
+		t.Errorf("GET en captions: got status %d, body %q; want %d, %q", rec.Code, rec.Body.String(), http.StatusOK, vtt)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/vtt") {
+		t.Errorf("GET en captions: got Content-Type %q, want text/vtt", ct)
+	}
+	if rec := get("fr"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET fr captions: got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// Captions outside the bucket aren't redirected to.
+	session.SetCaption(vyfe_api.Caption{Lang: "de", URL: "https://evil.example.com/", Format: vyfe_api.CaptionVTT})
+	if err := a.DB.UpdateSession(session); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("de"); rec.Code != http.StatusNotFound || rec.Header().Get("Location") != "" {
+		t.Errorf("GET captions outside the bucket: got status %d to %q, want %d", rec.Code, rec.Header().Get("Location"), http.StatusNotFound)
 	}
-	return true
 }
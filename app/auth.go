@@ -7,8 +7,11 @@ package main
 import (
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strings"
 
 	plus "google.golang.org/api/plus/v1"
 
@@ -39,10 +42,10 @@ func init() {
 }
 
 // loginHandler initiates an OAuth flow to authenticate the user.
-func loginHandler(w http.ResponseWriter, r *http.Request) *appError {
+func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) *appError {
 	sessionID := uuid.Must(uuid.NewV4()).String()
 
-	oauthFlowSession, err := vyfe_api.SessionStore.New(r, sessionID)
+	oauthFlowSession, err := a.SessionStore.New(r, sessionID)
 	if err != nil {
 		return appErrorf(err, "could not create oauth session: %v", err)
 	}
@@ -61,7 +64,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) *appError {
 	// Use the session ID for the "state" parameter.
 	// This protects against CSRF (cross-site request forgery).
 	// See https://godoc.org/golang.org/x/oauth2#Config.AuthCodeURL for more detail.
-	url := vyfe_api.OAuthConfig.AuthCodeURL(sessionID, oauth2.ApprovalForce,
+	url := a.OAuthConfig.AuthCodeURL(sessionID, oauth2.ApprovalForce,
 		oauth2.AccessTypeOnline)
 	http.Redirect(w, r, url, http.StatusFound)
 	return nil
@@ -89,8 +92,8 @@ func validateRedirectURL(path string) (string, error) {
 
 // oauthCallbackHandler completes the OAuth flow, retreives the user's profile
 // information and stores it in a session.
-func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
-	oauthFlowSession, err := vyfe_api.SessionStore.Get(r, r.FormValue("state"))
+func (a *App) oauthCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
+	oauthFlowSession, err := a.SessionStore.Get(r, r.FormValue("state"))
 	if err != nil {
 		return appErrorf(err, "invalid state parameter. try logging in again.")
 	}
@@ -102,18 +105,18 @@ func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
 	}
 
 	code := r.FormValue("code")
-	tok, err := vyfe_api.OAuthConfig.Exchange(context.Background(), code)
+	tok, err := a.OAuthConfig.Exchange(context.Background(), code)
 	if err != nil {
 		return appErrorf(err, "could not get auth token: %v", err)
 	}
 
-	session, err := vyfe_api.SessionStore.New(r, defaultSessionID)
+	session, err := a.SessionStore.New(r, defaultSessionID)
 	if err != nil {
 		return appErrorf(err, "could not get default session: %v", err)
 	}
 
 	ctx := context.Background()
-	profile, err := fetchProfile(ctx, tok)
+	profile, err := a.fetchProfile(ctx, tok)
 	if err != nil {
 		return appErrorf(err, "could not fetch Google profile: %v", err)
 	}
@@ -131,8 +134,8 @@ func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
 
 // fetchProfile retrieves the Google+ profile of the user associated with the
 // provided OAuth token.
-func fetchProfile(ctx context.Context, tok *oauth2.Token) (*plus.Person, error) {
-	client := oauth2.NewClient(ctx, vyfe_api.OAuthConfig.TokenSource(ctx, tok))
+func (a *App) fetchProfile(ctx context.Context, tok *oauth2.Token) (*plus.Person, error) {
+	client := oauth2.NewClient(ctx, a.OAuthConfig.TokenSource(ctx, tok))
 	plusService, err := plus.New(client)
 	if err != nil {
 		return nil, err
@@ -141,8 +144,8 @@ func fetchProfile(ctx context.Context, tok *oauth2.Token) (*plus.Person, error)
 }
 
 // logoutHandler clears the default session.
-func logoutHandler(w http.ResponseWriter, r *http.Request) *appError {
-	session, err := vyfe_api.SessionStore.New(r, defaultSessionID)
+func (a *App) logoutHandler(w http.ResponseWriter, r *http.Request) *appError {
+	session, err := a.SessionStore.New(r, defaultSessionID)
 	if err != nil {
 		return appErrorf(err, "could not get default session: %v", err)
 	}
@@ -160,8 +163,8 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) *appError {
 
 // profileFromSession retreives the Google+ profile from the default session.
 // Returns nil if the profile cannot be retreived (e.g. user is logged out).
-func profileFromSession(r *http.Request) *Profile {
-	session, err := vyfe_api.SessionStore.Get(r, defaultSessionID)
+func (a *App) profileFromSession(r *http.Request) *Profile {
+	session, err := a.SessionStore.Get(r, defaultSessionID)
 	if err != nil {
 		return nil
 	}
@@ -176,6 +179,112 @@ func profileFromSession(r *http.Request) *Profile {
 	return profile
 }
 
+// isAdmin reports whether the given user is listed in vyfe_api.AdminUserIDs.
+func isAdmin(p *Profile) bool {
+	if p == nil {
+		return false
+	}
+	for _, id := range vyfe_api.AdminUserIDs {
+		if p.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// viewer returns the vyfe_api.Viewer for the user logged in to r, or an
+// anonymous viewer.
+func (a *App) viewer(r *http.Request) vyfe_api.Viewer {
+	p := a.profileFromSession(r)
+	if p == nil {
+		return vyfe_api.Viewer{}
+	}
+	return vyfe_api.Viewer{UserID: p.ID, Admin: isAdmin(p)}
+}
+
+// adminOnly wraps a handler so that it responds with 403 unless the current
+// user is an admin.
+func (a *App) adminOnly(fn appHandler) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		if !isAdmin(a.profileFromSession(r)) {
+			return &appError{Message: "admin access required", Code: http.StatusForbidden}
+		}
+		return fn(w, r)
+	}
+}
+
+// protectFields enforces vyfe_api.ProtectedFields on session, which the user
+// logged in to r is about to write over baseline, as returned by
+// writeBaseline. Admins may change anything. For other users, changes to
+// protected fields are reverted to their baseline values, or rejected with a
+// 403 appError if vyfe_api.RejectProtectedFieldChanges is set.
+func (a *App) protectFields(r *http.Request, session, baseline *vyfe_api.Session) *appError {
+	if len(vyfe_api.ProtectedFields) == 0 || isAdmin(a.profileFromSession(r)) {
+		return nil
+	}
+	protected := make(map[string]bool)
+	for _, f := range vyfe_api.ProtectedFields {
+		protected[f] = true
+	}
+	var changed []string
+	for _, f := range vyfe_api.ChangedFields(baseline, session) {
+		if protected[f] {
+			changed = append(changed, f)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if vyfe_api.RejectProtectedFieldChanges {
+		return &appError{
+			Message: fmt.Sprintf("only admins may change %s", strings.Join(changed, ", ")),
+			Code:    http.StatusForbidden,
+		}
+	}
+	to, from := reflect.ValueOf(session).Elem(), reflect.ValueOf(baseline).Elem()
+	for _, f := range changed {
+		to.FieldByName(f).Set(from.FieldByName(f))
+	}
+	return nil
+}
+
+// writeBaseline returns the session with the given ID as it is before a write
+// by the user logged in to r, for protectFields. That's the stored session,
+// or, if there is none, a new session with its creator filled in as
+// setCreator does.
+func (a *App) writeBaseline(r *http.Request, id int64) (*vyfe_api.Session, error) {
+	if id != 0 {
+		stored, err := a.DB.GetSession(id)
+		if err == nil {
+			// Copy it, as the database may update the stored session in place.
+			baseline := *stored
+			return &baseline, nil
+		}
+		if err != vyfe_api.ErrSessionNotFound {
+			return nil, err
+		}
+	}
+	baseline := &vyfe_api.Session{}
+	a.setCreator(r, baseline)
+	return baseline, nil
+}
+
+// readAuth wraps the handler of a read route so that, when
+// vyfe_api.RequireAuthForReads is set, only logged in users reach it. Others
+// are redirected to log in, or get a 401 from /api/ routes.
+func (a *App) readAuth(fn appHandler) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		if !vyfe_api.RequireAuthForReads || a.profileFromSession(r) != nil {
+			return fn(w, r)
+		}
+		if isAPIRequest(r) {
+			return apiErrorf(errUnauthorized, "you must be logged in to read sessions")
+		}
+		http.Redirect(w, r, "/login?redirect="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return nil
+	}
+}
+
 type Profile struct {
 	ID, DisplayName, ImageURL string
 }
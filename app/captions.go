@@ -0,0 +1,164 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// maxCaptionBytes is the largest caption file accepted.
+const maxCaptionBytes = 5 << 20
+
+// errBadCaption is returned by uploadCaptionsFromForm for a caption file
+// that isn't valid WebVTT or SubRip, or comes without a language.
+var errBadCaption = errors.New("captions must be WebVTT (.vtt) or SubRip (.srt) files of at most 5 MB, each with a language such as en or pt-BR")
+
+// srtCuePattern matches the start of a SubRip file: a cue number and its
+// timings.
+var srtCuePattern = regexp.MustCompile(`^\s*\d+\r?\n\d{2}:\d{2}:\d{2},\d{3} --> \d{2}:\d{2}:\d{2},\d{3}`)
+
+// captionFormat returns the format of the caption file with the given name
+// and content, as told by its extension, or false if its content isn't in
+// that format.
+func captionFormat(filename string, content []byte) (string, bool) {
+	if !utf8.Valid(content) {
+		return "", false
+	}
+	content = bytes.TrimPrefix(content, []byte("\uFEFF"))
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".vtt":
+		// The header is "WEBVTT", alone or followed by a space, tab or
+		// newline.
+		if !bytes.HasPrefix(content, []byte("WEBVTT")) {
+			return "", false
+		}
+		if rest := content[len("WEBVTT"):]; len(rest) > 0 && !strings.ContainsRune(" \t\r\n", rune(rest[0])) {
+			return "", false
+		}
+		return vyfe_api.CaptionVTT, true
+	case ".srt":
+		return vyfe_api.CaptionSRT, srtCuePattern.Match(content)
+	}
+	return "", false
+}
+
+// uploadCaptionsFromForm stores the caption files in the "caption" form
+// fields, the first in the language given by the first "captionLang" field
+// and so on, returning errBadCaption if any is invalid, or
+// errUploadsDisabled if vyfe_api.UploadsEnabled isn't set.
+func (a *App) uploadCaptionsFromForm(r *http.Request) ([]vyfe_api.Caption, error) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File["caption"]) == 0 {
+		return nil, nil
+	}
+	if !vyfe_api.UploadsEnabled {
+		return nil, errUploadsDisabled
+	}
+	if a.Objects == nil {
+		// checkStorage makes sure this doesn't happen with uploads enabled.
+		return nil, errors.New("storage bucket is missing - check config.go")
+	}
+
+	langs := r.MultipartForm.Value["captionLang"]
+	var captions []vyfe_api.Caption
+	for i, fh := range r.MultipartForm.File["caption"] {
+		var lang string
+		if i < len(langs) {
+			lang = strings.TrimSpace(langs[i])
+		}
+		if !vyfe_api.ValidLang(lang) || fh.Size > maxCaptionBytes {
+			return nil, errBadCaption
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(f, maxCaptionBytes+1))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		format, ok := captionFormat(fh.Filename, content)
+		if !ok || len(content) > maxCaptionBytes {
+			return nil, errBadCaption
+		}
+
+		name := uuid.Must(uuid.NewV4()).String() + "." + format
+		url, err := a.Objects.Upload(context.Background(), name, vyfe_api.CaptionContentType(format), bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		captions = append(captions, vyfe_api.Caption{Lang: lang, URL: url, Format: format})
+	}
+	return captions, nil
+}
+
+// keepCaptions adds the stored session's captions to an edited session, since
+// the edit form only carries newly uploaded ones, which replace stored ones
+// in the same language.
+func (a *App) keepCaptions(session *vyfe_api.Session) {
+	old, err := a.DB.GetSession(session.ID)
+	if err != nil {
+		return
+	}
+	uploaded := session.Captions
+	session.Captions = append([]vyfe_api.Caption(nil), old.Captions...)
+	for _, c := range uploaded {
+		session.SetCaption(c)
+	}
+}
+
+// captionURLs returns the URLs of the session's caption files.
+func captionURLs(session *vyfe_api.Session) []string {
+	var urls []string
+	for _, c := range session.Captions {
+		urls = append(urls, c.URL)
+	}
+	return urls
+}
+
+// captionHandler serves a session's caption file in the language given in the
+// URL, streaming it from the storage bucket so that it can be read from a
+// private bucket. Caption URLs outside the bucket, which API clients may have
+// set, are not followed, so the route can't be used as an open redirect.
+func (a *App) captionHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	session, err := a.DB.GetSession(id)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err != nil {
+		return appErrorf(err, "could not find session: %v", err)
+	}
+	if !a.viewer(r).CanGet(session) {
+		return sessionForbidden(vyfe_api.ErrForbidden)
+	}
+	c, ok := session.Caption(mux.Vars(r)["lang"])
+	if !ok {
+		return &appError{Message: "session has no captions in that language", Code: http.StatusNotFound}
+	}
+	name, ok := vyfe_api.ObjectName(c.URL)
+	if !ok {
+		return &appError{Message: "caption file not found", Code: http.StatusNotFound}
+	}
+	return a.serveObject(w, r, name)
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// The columnar format writes a list of sessions as
+//
+//	{"columns":["id","title",...],"rows":[[1,"...",...],...]}
+//
+// naming each field once rather than in every session. The columns are the
+// fields of vyfe_api.Session sent to clients, named and encoded as in the
+// object format, including empty ones it would omit.
+
+// columnFields holds the indices of the fields of vyfe_api.Session written in
+// the columnar format, and columnNames their JSON names, in declaration order.
+var columnFields, columnNames = sessionColumns()
+
+func sessionColumns() (fields []int, names []string) {
+	t := reflect.TypeOf(vyfe_api.Session{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, i)
+		names = append(names, name)
+	}
+	return fields, names
+}
+
+// sessionRow returns the values of the columns of s, in the order of
+// columnNames.
+func sessionRow(s *vyfe_api.Session) []interface{} {
+	v := reflect.ValueOf(s).Elem()
+	row := make([]interface{}, len(columnFields))
+	for i, f := range columnFields {
+		row[i] = v.Field(f).Interface()
+	}
+	return row
+}
@@ -0,0 +1,205 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// orphanGracePeriod is how long an object may go unreferenced before fixing
+// deletes it, so objects uploaded for sessions that haven't been saved yet,
+// e.g. by a resumable upload still in progress, are kept.
+const orphanGracePeriod = time.Hour
+
+// MissingObject is a reference from a session to an object that doesn't
+// exist.
+type MissingObject struct {
+	SessionID int64 `json:"sessionId"`
+	// Field is "video", "thumbnail" or "caption".
+	Field  string `json:"field"`
+	Object string `json:"object"`
+}
+
+// ConsistencyReport is the result of cross-checking the sessions in the
+// database against the objects in the storage bucket.
+type ConsistencyReport struct {
+	Sessions int `json:"sessions"`
+	Objects  int `json:"objects"`
+
+	// Missing lists the session URLs pointing to objects that don't exist.
+	Missing []MissingObject `json:"missing"`
+	// Orphaned lists the objects no session points to.
+	Orphaned []string `json:"orphaned"`
+
+	// Fixed is set if the report was made with fixing, in which case
+	// Cleared is the number of sessions whose missing references were
+	// cleared and Deleted the orphaned objects deleted.
+	Fixed   bool     `json:"fixed"`
+	Cleared int      `json:"cleared"`
+	Deleted []string `json:"deleted"`
+}
+
+// VerifyConsistency cross-checks the video and thumbnail URLs of every
+// session against the objects listed in the store, reporting the references
+// to missing objects and the objects no session references. URLs outside the
+// bucket aren't checked. The objects holding offloaded descriptions count as
+// referenced by their sessions.
+func (a *App) VerifyConsistency(ctx context.Context) (*ConsistencyReport, error) {
+	names, err := a.Objects.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list objects: %v", err)
+	}
+	exists := make(map[string]bool)
+	for _, name := range names {
+		exists[name] = true
+	}
+
+	report := &ConsistencyReport{
+		Objects:  len(names),
+		Missing:  []MissingObject{},
+		Orphaned: []string{},
+		Deleted:  []string{},
+	}
+	referenced := make(map[string]bool)
+	err = a.DB.IterateSessions(ctx, func(s *vyfe_api.Session) error {
+		report.Sessions++
+		if s.DescriptionRef != "" {
+			referenced[s.DescriptionRef] = true
+		}
+		refs := []struct{ field, url string }{
+			{"video", s.VideoURL},
+			{"thumbnail", s.ThumbnailURL},
+		}
+		for _, url := range captionURLs(s) {
+			refs = append(refs, struct{ field, url string }{"caption", url})
+		}
+		for _, f := range refs {
+			name, ok := vyfe_api.ObjectName(f.url)
+			if !ok {
+				continue
+			}
+			referenced[name] = true
+			if !exists[name] {
+				report.Missing = append(report.Missing, MissingObject{SessionID: s.ID, Field: f.field, Object: name})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list sessions: %v", err)
+	}
+
+	for _, name := range names {
+		if !referenced[name] {
+			report.Orphaned = append(report.Orphaned, name)
+		}
+	}
+	sort.Strings(report.Orphaned)
+	return report, nil
+}
+
+// fixConsistency clears the references to missing objects listed in report,
+// dropping captions whose file is missing, and deletes its orphaned objects,
+// recording what it did in report. Orphans changed within orphanGracePeriod
+// are kept. Each session is read
+// again before it is changed, and only URLs that still point to a missing
+// object are cleared.
+func (a *App) fixConsistency(ctx context.Context, report *ConsistencyReport) error {
+	report.Fixed = true
+
+	missing := make(map[int64][]string)
+	for _, m := range report.Missing {
+		missing[m.SessionID] = append(missing[m.SessionID], vyfe_api.ObjectURL(m.Object))
+	}
+	for id, urls := range missing {
+		session, err := a.DB.GetSession(id)
+		if err == vyfe_api.ErrSessionNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not get session %d: %v", id, err)
+		}
+		changed := false
+		for _, url := range urls {
+			for _, field := range []*string{&session.VideoURL, &session.ThumbnailURL} {
+				if *field == url {
+					*field = ""
+					changed = true
+				}
+			}
+			var captions []vyfe_api.Caption
+			for _, c := range session.Captions {
+				if c.URL != url {
+					captions = append(captions, c)
+				}
+			}
+			if len(captions) < len(session.Captions) {
+				session.Captions = captions
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		// Later uploads of the same content mustn't reuse the missing
+		// objects.
+		session.ContentHash = ""
+		if err := a.DB.UpdateSession(session); err != nil {
+			return fmt.Errorf("could not update session %d: %v", id, err)
+		}
+		report.Cleared++
+	}
+
+	for _, name := range report.Orphaned {
+		attrs, err := a.Objects.Attrs(ctx, name)
+		if err == errObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not get attributes of %s: %v", name, err)
+		}
+		if time.Since(attrs.Updated) < orphanGracePeriod {
+			continue
+		}
+		if err := a.Objects.Delete(ctx, name); err != nil {
+			return fmt.Errorf("could not delete %s: %v", name, err)
+		}
+		report.Deleted = append(report.Deleted, name)
+	}
+	return nil
+}
+
+// consistencyHandler writes a ConsistencyReport as JSON. When POSTed with
+// ?fix=true, it also clears the missing references and deletes the orphaned
+// objects; like the other admin changes, fixing isn't done for a GET.
+func (a *App) consistencyHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if a.Objects == nil {
+		return apiErrorf(errUnavailable, "no storage bucket is configured")
+	}
+	fix := r.FormValue("fix") == "true"
+	if fix && r.Method != "POST" {
+		return apiErrorf(errBadRequest, "fix=true requires a POST")
+	}
+	ctx := context.Background()
+	report, err := a.VerifyConsistency(ctx)
+	if err != nil {
+		return appErrorf(err, "could not verify consistency: %v", err)
+	}
+	if fix {
+		if err := a.fixConsistency(ctx, report); err != nil {
+			return appErrorf(err, "could not fix consistency: %v", err)
+		}
+		log.Printf("consistency: cleared %d sessions, deleted %d objects", report.Cleared, len(report.Deleted))
+	}
+	return writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// sessionDiff is the response of apiDiffHandler.
+type sessionDiff struct {
+	From    int                  `json:"from"`
+	To      int                  `json:"to"`
+	Changes []vyfe_api.FieldDiff `json:"changes"`
+}
+
+// apiDiffHandler returns the fields that changed in a session between the
+// versions given by the from and to query parameters. to defaults to the
+// latest kept version and from to the version before to.
+func (a *App) apiDiffHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	session, err := a.DB.GetSession(id)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err != nil {
+		return appErrorf(err, "could not find session: %v", err)
+	}
+	if !a.viewer(r).CanGet(session) {
+		return sessionForbidden(vyfe_api.ErrForbidden)
+	}
+
+	versions := a.History.Versions(id)
+	if len(versions) == 0 {
+		return &appError{Message: "no versions of this session are kept", Code: http.StatusNotFound}
+	}
+	to := versions[len(versions)-1].Version
+	if v := r.FormValue("to"); v != "" {
+		if to, err = strconv.Atoi(v); err != nil {
+			return badRequest(err, "bad to version: %v", err)
+		}
+	}
+	from := to - 1
+	if v := r.FormValue("from"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil {
+			return badRequest(err, "bad from version: %v", err)
+		}
+	}
+
+	old, err := a.History.Version(id, from)
+	if err != nil {
+		return versionNotFound(err, from)
+	}
+	new, err := a.History.Version(id, to)
+	if err != nil {
+		return versionNotFound(err, to)
+	}
+	return writeJSON(w, http.StatusOK, sessionDiff{
+		From:    from,
+		To:      to,
+		Changes: vyfe_api.DiffSessions(&old.Session, &new.Session),
+	})
+}
+
+// versionNotFound returns a 404 appError for a session version that isn't
+// kept.
+func versionNotFound(err error, version int) *appError {
+	e := appErrorf(err, "version %d not found", version)
+	e.Code = http.StatusNotFound
+	return e
+}
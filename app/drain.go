@@ -0,0 +1,102 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// background runs fn in a goroutine that drain waits for.
+func (a *App) background(fn func()) {
+	a.pending.Add(1)
+	go func() {
+		defer a.pending.Done()
+		fn()
+	}()
+}
+
+// publishEventAsync runs publishEvent in the background, so the request
+// that changed the session doesn't wait for Pub/Sub.
+func (a *App) publishEventAsync(typ string, sessionID int64) {
+	a.background(func() { a.publishEvent(typ, sessionID) })
+}
+
+// publishUpdateAsync runs publishUpdate in the background.
+func (a *App) publishUpdateAsync(sessionID int64, changed []string) {
+	a.background(func() { a.publishUpdate(sessionID, changed) })
+}
+
+// drain waits up to timeout for background work, such as publishes, to
+// finish, then flushes the view counts, stops running cleanup jobs and
+// flushes the messages the Pub/Sub topic still buffers. It reports whether
+// all background work finished in time.
+func (a *App) drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		a.pending.Wait()
+		close(done)
+	}()
+
+	finished := true
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		finished = false
+	}
+	if a.views != nil {
+		if err := a.views.Close(context.Background()); err != nil {
+			log.Printf("Could not flush view counts: %v", err)
+		}
+	}
+	if a.cleaner != nil {
+		a.cleaner.Close()
+	}
+	if a.topic != nil {
+		a.topic.Stop()
+	}
+	return finished
+}
+
+// shutdown stops srv accepting requests and waits for those in flight, so
+// that none of them starts background work once draining has begun, then
+// drains the App. Requests and background work each get up to timeout. It
+// reports whether both finished in time.
+func (a *App) shutdown(srv *http.Server, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	finished := true
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutting down with requests still in flight after %v: %v", timeout, err)
+		finished = false
+	}
+	return a.drain(timeout) && finished
+}
+
+// drainOnShutdown shuts srv down and drains the App when the process is asked
+// to stop, as App Engine does with SIGTERM before replacing an instance. The
+// returned channel is closed once that is done; main waits for it after
+// srv.ListenAndServe returns, before exiting.
+func (a *App) drainOnShutdown(srv *http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-c
+		if !a.shutdown(srv, vyfe_api.ShutdownDrainTimeout) {
+			log.Printf("Shutting down with work unfinished after %v", vyfe_api.ShutdownDrainTimeout)
+		}
+		close(done)
+	}()
+	return done
+}
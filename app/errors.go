@@ -0,0 +1,172 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/message"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// Machine-readable error codes used in APIError.
+const (
+	errBadRequest       = "bad_request"
+	errValidationFailed = "validation_failed"
+	errUnauthorized     = "unauthorized"
+	errForbidden        = "forbidden"
+	errNotFound         = "not_found"
+	errConflict         = "conflict"
+	errRateLimited      = "rate_limited"
+	errUnavailable      = "unavailable"
+	errNotImplemented   = "not_implemented"
+	errInternal         = "internal"
+)
+
+// errorStatus maps each error code to its HTTP status code.
+var errorStatus = map[string]int{
+	errBadRequest:       http.StatusBadRequest,
+	errValidationFailed: http.StatusBadRequest,
+	errUnauthorized:     http.StatusUnauthorized,
+	errForbidden:        http.StatusForbidden,
+	errNotFound:         http.StatusNotFound,
+	errConflict:         http.StatusConflict,
+	errRateLimited:      http.StatusTooManyRequests,
+	errUnavailable:      http.StatusServiceUnavailable,
+	errNotImplemented:   http.StatusNotImplemented,
+	errInternal:         http.StatusInternalServerError,
+}
+
+// APIError is the JSON body of error responses from /api/ routes.
+type APIError struct {
+	// Code is one of the err* constants, e.g. "not_found".
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Fields maps each invalid field to a description of the problem when
+	// Code is "validation_failed".
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+func (e *APIError) Error() string { return e.Message }
+
+// apiErrorf returns an appError carrying an APIError with the given code. Its
+// HTTP status is the one for the code.
+func apiErrorf(code string, format string, v ...interface{}) *appError {
+	msg := fmt.Sprintf(format, v...)
+	return &appError{
+		Error:   &APIError{Code: code, Message: msg},
+		Message: msg,
+		Code:    errorStatus[code],
+		format:  format,
+		args:    v,
+	}
+}
+
+// toAPIError returns the APIError to send for e, with field messages
+// translated by p. If the handler didn't return one, it is derived from the
+// underlying error and the HTTP status.
+func toAPIError(p *message.Printer, e *appError) *APIError {
+	switch err := e.Error.(type) {
+	case *APIError:
+		apiErr := *err
+		apiErr.Message = e.Message
+		return &apiErr
+	case *vyfe_api.ValidationError:
+		return &APIError{Code: errValidationFailed, Message: e.Message, Fields: localizeFields(p, err)}
+	}
+
+	code := errInternal
+	for c, status := range errorStatus {
+		if status == e.Code && c != errValidationFailed {
+			code = c
+			break
+		}
+	}
+	return &APIError{Code: code, Message: e.Message}
+}
+
+// isAPIRequest reports whether r is for an /api/ route, whose errors are
+// written as JSON.
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// wantsHTML reports whether r comes from a browser, which lists text/html in
+// its Accept header.
+func wantsHTML(r *http.Request) bool {
+	for _, t := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.SplitN(t, ";", 2)[0]) == "text/html" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeError writes e in the form the client expects: JSON for /api/
+// routes, an error page for browsers if vyfe_api.HTMLErrorPages is set, and
+// plain text otherwise.
+func writeError(w http.ResponseWriter, r *http.Request, p *message.Printer, e *appError) {
+	switch {
+	case isAPIRequest(r):
+		writeAPIError(w, p, e)
+	case vyfe_api.HTMLErrorPages && wantsHTML(r):
+		writeErrorPage(w, r, e)
+	default:
+		http.Error(w, e.Message, e.Code)
+	}
+}
+
+// errorPage is the data of the error page templates.
+type errorPage struct {
+	Code      int
+	Status    string
+	Message   string
+	RequestID string
+}
+
+// writeErrorPage writes e as an HTML page: templates/404.html for 404s,
+// templates/500.html for server errors, whose messages aren't shown as they
+// may reveal internals, and templates/error.html otherwise. The page shows
+// the request ID, so users can quote it to support.
+func writeErrorPage(w http.ResponseWriter, r *http.Request, e *appError) {
+	tmpl := errorTmpl
+	switch {
+	case e.Code == http.StatusNotFound:
+		tmpl = notFoundTmpl
+	case e.Code >= 500:
+		tmpl = serverErrorTmpl
+	}
+
+	var buf bytes.Buffer
+	page := &errorPage{Code: e.Code, Status: http.StatusText(e.Code), Message: e.Message, RequestID: requestID(r)}
+	if err := tmpl.t.Execute(&buf, tmpl.pageData(nil, r, page)); err != nil {
+		log.Printf("Could not write error page: %v", err)
+		http.Error(w, e.Message, e.Code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Code)
+	buf.WriteTo(w)
+}
+
+// notFoundHandler is the handler of requests that match no route.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return apiErrorf(errNotFound, "page not found")
+}
+
+// writeAPIError writes e as a JSON APIError.
+func writeAPIError(w http.ResponseWriter, p *message.Printer, e *appError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Code)
+	json.NewEncoder(w).Encode(toAPIError(p, e))
+}
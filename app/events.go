@@ -0,0 +1,111 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// eventKeepAlive is how often a comment is sent on idle event streams so that
+// proxies don't close them.
+const eventKeepAlive = 30 * time.Second
+
+// eventBufferSize is the number of events a slow client may fall behind by
+// before further events are dropped for it.
+const eventBufferSize = 16
+
+// errTooManyStreams is returned by subscribe when the connection cap is hit.
+var errTooManyStreams = errors.New("too many event streams")
+
+// broker fans session change events out to the connected event streams.
+type broker struct {
+	mu      sync.Mutex
+	clients map[chan int64]bool
+}
+
+// newBroker returns a broker with no clients.
+func newBroker() *broker {
+	return &broker{clients: make(map[chan int64]bool)}
+}
+
+// subscribe registers a new client and returns the channel its events are
+// delivered on. It fails once vyfe_api.MaxEventStreams clients are connected.
+func (b *broker) subscribe() (chan int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if vyfe_api.MaxEventStreams > 0 && len(b.clients) >= vyfe_api.MaxEventStreams {
+		return nil, errTooManyStreams
+	}
+	ch := make(chan int64, eventBufferSize)
+	b.clients[ch] = true
+	return ch, nil
+}
+
+// unsubscribe removes a client registered with subscribe.
+func (b *broker) unsubscribe(ch chan int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.clients, ch)
+}
+
+// publish sends the ID of a changed session to every client. It never blocks:
+// clients whose buffer is full miss the event.
+func (b *broker) publish(sessionID int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.clients {
+		select {
+		case ch <- sessionID:
+		default:
+		}
+	}
+}
+
+// eventsHandler streams "session" Server-Sent Events carrying the ID of each
+// session that is created or updated, until the client disconnects.
+func (a *App) eventsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return appErrorf(errors.New("response writer does not support flushing"),
+			"streaming is not supported")
+	}
+
+	ch, err := a.events.subscribe()
+	if err != nil {
+		w.Header().Set("Retry-After", "60")
+		return &appError{Error: err, Message: "too many event streams, try again later",
+			Code: http.StatusServiceUnavailable}
+	}
+	defer a.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case id := <-ch:
+			fmt.Fprintf(w, "event: session\ndata: %d\n\n", id)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
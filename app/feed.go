@@ -0,0 +1,93 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// rssFeed is an RSS 2.0 document.
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	Description string  `xml:"description"`
+	// PubDate is omitted for sessions without a published date.
+	PubDate string `xml:"pubDate,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// feedHandler writes the vyfe_api.FeedItems most recently added sessions as
+// an RSS 2.0 feed, newest first. Only public sessions are included, as feed
+// readers aren't logged in, so the feed may have fewer items.
+func (a *App) feedHandler(w http.ResponseWriter, r *http.Request) *appError {
+	sessions, err := a.DB.ListRecentSessions(context.Background(), vyfe_api.FeedItems)
+	if err != nil {
+		return appErrorf(err, "could not list sessions: %v", err)
+	}
+
+	base := canonicalBaseURL(r)
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         vyfe_api.ShareSiteName + " sessions",
+			Link:          base + "/sessions",
+			Description:   "The sessions most recently added to " + vyfe_api.ShareSiteName + ".",
+			LastBuildDate: time.Now().UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, s := range sessions {
+		if !(vyfe_api.Viewer{}).CanList(s) {
+			continue
+		}
+		link := base + "/sessions/" + s.URLID()
+		item := rssItem{
+			Title:       s.Title,
+			Link:        link,
+			GUID:        rssGUID{IsPermaLink: true, Value: link},
+			Description: s.Description,
+		}
+		if !s.PublishedAt.IsZero() {
+			item.PubDate = s.PublishedAt.UTC().Format(time.RFC1123Z)
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		return appErrorf(err, "could not write feed: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write(buf.Bytes())
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// sessionFile describes an object uploaded for a session, as returned by
+// apiFilesHandler.
+type sessionFile struct {
+	// Field is the session field whose URL points to the object: "video"
+	// or "thumbnail".
+	Field       string    `json:"field"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	Updated     time.Time `json:"updated,omitempty"`
+	Public      bool      `json:"public"`
+
+	// Missing is set if the session refers to an object that no longer
+	// exists, in which case the other metadata is empty.
+	Missing bool `json:"missing,omitempty"`
+}
+
+// apiFilesHandler lists the storage objects uploaded for a session, with
+// their metadata. Only the session's creator and admins may see them.
+func (a *App) apiFilesHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	session, err := a.DB.GetSession(id)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err != nil {
+		return appErrorf(err, "could not find session: %v", err)
+	}
+	if !a.viewer(r).CanManage(session) {
+		return &appError{Message: "only the session's creator may see its files", Code: http.StatusForbidden}
+	}
+
+	files, err := a.sessionFiles(context.Background(), session)
+	if err != nil {
+		return appErrorf(err, "could not read file metadata: %v", err)
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Files []sessionFile `json:"files"`
+	}{files})
+}
+
+// sessionFiles returns the objects in the bucket that session's video and
+// thumbnail URLs point to. URLs outside the bucket are left out.
+func (a *App) sessionFiles(ctx context.Context, session *vyfe_api.Session) ([]sessionFile, error) {
+	files := []sessionFile{}
+	if a.Objects == nil {
+		return files, nil
+	}
+	seen := make(map[string]bool)
+	for _, f := range []struct{ field, url string }{
+		{"video", session.VideoURL},
+		{"thumbnail", session.ThumbnailURL},
+	} {
+		name, ok := vyfe_api.ObjectName(f.url)
+		if !ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		attrs, err := a.Objects.Attrs(ctx, name)
+		if err == errObjectNotExist {
+			files = append(files, sessionFile{Field: f.field, Name: name, Missing: true})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sessionFile{
+			Field:       f.field,
+			Name:        name,
+			Size:        attrs.Size,
+			ContentType: attrs.ContentType,
+			Updated:     attrs.Updated,
+			Public:      attrs.Public,
+		})
+	}
+	return files, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// httpsExempt lists the paths served over plain HTTP even when HTTPS is
+// enforced, so that load balancers can probe them.
+var httpsExempt = map[string]bool{
+	"/_ah/health": true,
+}
+
+// httpsMiddleware redirects plain HTTP requests to HTTPS with a 301 and sets
+// the Strict-Transport-Security header on HTTPS responses, when
+// vyfe_api.EnforceHTTPS is set.
+func httpsMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !vyfe_api.EnforceHTTPS || httpsExempt[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if requestScheme(r) != "https" {
+			http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Strict-Transport-Security", hstsValue())
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestScheme returns the scheme the client used, as reported by a proxy in
+// X-Forwarded-Proto, or else by the connection itself.
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		// Chained proxies append their own value; the first is the client's.
+		return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// hstsValue returns the Strict-Transport-Security header value for the
+// configured max-age and includeSubDomains setting.
+func hstsValue() string {
+	v := fmt.Sprintf("max-age=%d", vyfe_api.HSTSMaxAge)
+	if vyfe_api.HSTSIncludeSubDomains {
+		v += "; includeSubDomains"
+	}
+	return v
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// supportedLanguages are the languages error messages are served in. The
+// first is used when none of the languages a client accepts is supported.
+var supportedLanguages = []language.Tag{
+	language.English,
+	language.German,
+}
+
+var languageMatcher = language.NewMatcher(supportedLanguages)
+
+// germanMessages translates messages to German. Messages are keyed by their
+// English format string; those without a translation are served in English.
+var germanMessages = map[string]string{
+	vyfe_api.MsgRequired:         "ist erforderlich",
+	vyfe_api.MsgTooLong:          "darf höchstens %d Zeichen lang sein",
+	vyfe_api.MsgUnrecognizedDate: "unbekanntes Datum %q, verwenden Sie ein Format wie 2006-01-02",
+	vyfe_api.MsgBadVisibility:    "muss public, unlisted oder private sein",
+	vyfe_api.MsgBlockedTerm:      "darf %q nicht enthalten",
+	vyfe_api.MsgOutOfRange:       "muss zwischen %v und %v liegen",
+	vyfe_api.MsgBadCaptions:      "müssen je ein einmal verwendetes Sprach-Tag und das Format vtt oder srt haben",
+	vyfe_api.MsgHostNotAllowed:   "muss auf einem dieser Hosts liegen: %s",
+
+	"invalid session: %s":                   "ungültige Session: %s",
+	"session not found":                     "Session nicht gefunden",
+	"you may not view this session":         "Sie dürfen diese Session nicht sehen",
+	"bad session id: %v":                    "ungültige Session-ID: %v",
+	"could not find session: %v":            "Session konnte nicht gefunden werden: %v",
+	"could not save session: %v":            "Session konnte nicht gespeichert werden: %v",
+	"could not list sessions: %v":           "Sessions konnten nicht aufgelistet werden: %v",
+	"could not delete session: %v":          "Session konnte nicht gelöscht werden: %v",
+	"could not parse session: %v":           "Session konnte nicht gelesen werden: %v",
+	"could not parse session from form: %v": "Session konnte nicht aus dem Formular gelesen werden: %v",
+	"internal server error":                 "interner Serverfehler",
+}
+
+func init() {
+	for key, msg := range germanMessages {
+		message.SetString(language.German, key, msg)
+	}
+}
+
+// printerFor returns a printer for the supported language that best matches
+// r's Accept-Language header.
+func printerFor(r *http.Request) *message.Printer {
+	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	_, i, _ := languageMatcher.Match(tags...)
+	return message.NewPrinter(supportedLanguages[i])
+}
+
+// localize returns a copy of e with its message translated by p. Errors built
+// without a format string keep their message.
+func localize(p *message.Printer, e *appError) *appError {
+	l := *e
+	if verr, ok := e.Error.(*vyfe_api.ValidationError); ok {
+		fields := localizeFields(p, verr)
+		var names []string
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		msgs := make([]string, len(names))
+		for i, name := range names {
+			msgs[i] = name + ": " + fields[name]
+		}
+		l.Message = p.Sprintf("invalid session: %s", strings.Join(msgs, "; "))
+	} else if e.format != "" {
+		l.Message = p.Sprintf(e.format, e.args...)
+	}
+	return &l
+}
+
+// localizeFields returns the messages for the invalid fields of verr,
+// translated by p.
+func localizeFields(p *message.Printer, verr *vyfe_api.ValidationError) map[string]string {
+	fields := make(map[string]string, len(verr.Fields))
+	for name, msg := range verr.Fields {
+		fields[name] = p.Sprintf(msg.Key, msg.Args...)
+	}
+	return fields
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// editForm is the data of the edit form of an existing session (see
+// templates/edit.html).
+type editForm struct {
+	*vyfe_api.Session
+
+	// LockedBy is the name of the other user editing the session, if any.
+	LockedBy string
+	// HoldsLock is set if the viewer holds the edit lock, which the form
+	// then renews every RenewMillis milliseconds.
+	HoldsLock   bool
+	RenewMillis int64
+}
+
+// lockForEditing takes the edit lock on session for the logged in user and
+// returns the data of its edit form. Locks are only taken for logged in
+// users, as they are held by user ID.
+func (a *App) lockForEditing(r *http.Request, session *vyfe_api.Session) (*editForm, error) {
+	form := &editForm{Session: session}
+	p := a.profileFromSession(r)
+	if p == nil {
+		if session.LockedByOther("", time.Now()) {
+			form.LockedBy = session.LockedByName
+		}
+		return form, nil
+	}
+
+	err := a.DB.LockSession(context.Background(), session.ID, p.ID, p.DisplayName, vyfe_api.EditLockDuration)
+	if err == vyfe_api.ErrSessionLocked {
+		// Read the session again, as the lock may have been taken since.
+		locked, err := a.DB.GetSession(session.ID)
+		if err != nil {
+			return nil, err
+		}
+		form.LockedBy = locked.LockedByName
+		return form, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	form.HoldsLock = true
+	form.RenewMillis = int64(vyfe_api.EditLockDuration/time.Millisecond) / 2
+	return form, nil
+}
+
+// releaseEditLock releases the edit lock of the logged in user on a session,
+// if they hold it. Failures are only logged, as the lock expires anyway.
+func (a *App) releaseEditLock(r *http.Request, id int64) {
+	p := a.profileFromSession(r)
+	if p == nil {
+		return
+	}
+	if err := a.DB.UnlockSession(context.Background(), id, p.ID); err != nil {
+		log.Printf("Could not release edit lock on session %d: %v", id, err)
+	}
+}
+
+// editLock is the response of lockHandler.
+type editLock struct {
+	Expires time.Time `json:"expires"`
+}
+
+// lockHandler acquires or renews the edit lock on a session for the logged in
+// user, for vyfe_api.EditLockDuration. It fails with a conflict if someone
+// else holds the lock.
+func (a *App) lockHandler(w http.ResponseWriter, r *http.Request) *appError {
+	p := a.profileFromSession(r)
+	if p == nil {
+		return apiErrorf(errUnauthorized, "you must be logged in to lock sessions")
+	}
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	expires := time.Now().Add(vyfe_api.EditLockDuration)
+	err := a.DB.LockSession(context.Background(), id, p.ID, p.DisplayName, vyfe_api.EditLockDuration)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err == vyfe_api.ErrSessionLocked {
+		name := "someone else"
+		if s, err := a.DB.GetSession(id); err == nil && s.LockedByName != "" {
+			name = s.LockedByName
+		}
+		return apiErrorf(errConflict, "session is currently being edited by %s", name)
+	}
+	if err != nil {
+		return appErrorf(err, "could not lock session: %v", err)
+	}
+	return writeJSON(w, http.StatusOK, editLock{Expires: expires})
+}
+
+// unlockHandler releases the edit lock of the logged in user on a session,
+// when they cancel editing it, and returns to the session.
+func (a *App) unlockHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	a.releaseEditLock(r, id)
+	http.Redirect(w, r, "/sessions/"+mux.Vars(r)["id"], http.StatusFound)
+	return nil
+}
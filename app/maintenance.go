@@ -0,0 +1,77 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// maintenanceRetryAfter is the Retry-After value, in seconds, sent with
+// requests rejected during maintenance.
+const maintenanceRetryAfter = "300"
+
+// maintenance is 1 while the app is in maintenance mode. It is accessed
+// atomically so it can be flipped at runtime while requests are served.
+var maintenance int32
+
+// setMaintenance turns maintenance mode on or off.
+func setMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&maintenance, v)
+}
+
+// inMaintenance reports whether the app is in maintenance mode.
+func inMaintenance() bool {
+	return atomic.LoadInt32(&maintenance) == 1
+}
+
+// maintenanceExempt lists the paths that accept writes during maintenance, so
+// that users can still log out and admins can end maintenance, and the POST
+// routes that don't write.
+var maintenanceExempt = map[string]bool{
+	"/logout":                true,
+	"/admin/maintenance":     true,
+	"/api/sessions/validate": true,
+	"/sessions/preview":      true,
+}
+
+// maintenanceMiddleware rejects requests that may change data with 503 while
+// the app is in maintenance mode. Reads are always served.
+func maintenanceMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inMaintenance() && !isSafeMethod(r.Method) && !maintenanceExempt[r.URL.Path] {
+			w.Header().Set("Retry-After", maintenanceRetryAfter)
+			http.Error(w, "the site is in maintenance mode and is read-only, try again later",
+				http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isSafeMethod reports whether method is one that doesn't change data.
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// maintenanceHandler turns maintenance mode on or off according to the
+// "enabled" form value and responds with the resulting state.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) *appError {
+	on, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		return badRequest(err, "bad enabled value: %q", r.FormValue("enabled"))
+	}
+	setMaintenance(on)
+	return writeJSON(w, http.StatusOK, map[string]bool{"maintenance": inMaintenance()})
+}
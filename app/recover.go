@@ -0,0 +1,55 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// recoverMiddleware turns a panic in h into a 500 response, so that a bug in
+// one handler doesn't crash the instance or leave the client hanging. The
+// panic and its stack trace are logged with the request ID.
+func recoverMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate aborts are handled quietly by net/http.
+				panic(v)
+			}
+			log.Printf("Handler panic: request %s: %s %s: %v\n%s",
+				requestID(r), r.Method, r.URL.Path, v, debug.Stack())
+
+			p := printerFor(r)
+			e := &appError{
+				Error:   fmt.Errorf("panic: %v", v),
+				Message: p.Sprintf("internal server error"),
+				Code:    http.StatusInternalServerError,
+			}
+			writeError(w, r, p, e)
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestID returns an identifier for r to correlate log lines: the
+// X-Request-Id header if set, otherwise the trace ID App Engine puts in
+// X-Cloud-Trace-Context, otherwise "-".
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	if trace := r.Header.Get("X-Cloud-Trace-Context"); trace != "" {
+		return strings.SplitN(trace, "/", 2)[0]
+	}
+	return "-"
+}
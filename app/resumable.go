@@ -0,0 +1,267 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+
+	"cloud.google.com/go/storage"
+
+	uuid "github.com/satori/go.uuid"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// Large videos are uploaded straight to Cloud Storage with resumable uploads
+// rather than through a session form, so that clients can show progress and
+// resume after a dropped connection:
+//
+//   1. POST /api/uploads with {"filename": ..., "contentType": ...} returns
+//      the upload's session URI, the object it will create and a token
+//      tying the object to the user who started the upload.
+//   2. The client PUTs the file to the session URI in chunks of chunkSize
+//      bytes, asking the URI for the received range to resume.
+//      https://cloud.google.com/storage/docs/resumable-uploads
+//   3. POST /api/sessions/{id}/upload with {"object": ..., "token": ...}
+//      scans the finished object, makes it public unless
+//      vyfe_api.PrivateObjects is set, and records it as the session's
+//      video.
+//
+// Objects are created private, so nothing is served before it is scanned.
+
+// resumableUpload is the response to POST /api/uploads.
+type resumableUpload struct {
+	// UploadURL is the resumable session URI the file is sent to.
+	UploadURL string `json:"uploadUrl"`
+	// Object is the name of the object the upload creates.
+	Object string `json:"object"`
+	// ChunkSize is the size of the chunks the client should send.
+	ChunkSize int `json:"chunkSize"`
+	// Token is sent back to finish the upload. Only the user who started
+	// the upload can use it.
+	Token string `json:"token"`
+}
+
+// uploaderID returns the ID of the user starting or finishing an upload:
+// the logged in user's profile ID, or "anonymous".
+func (a *App) uploaderID(r *http.Request) string {
+	if p := a.profileFromSession(r); p != nil {
+		return p.ID
+	}
+	return "anonymous"
+}
+
+// uploadToken returns the token that lets the user with the given ID finish
+// the upload of the named object: an HMAC of both, keyed with
+// vyfe_api.UploadTokenKey.
+func uploadToken(object, userID string) string {
+	mac := hmac.New(sha256.New, vyfe_api.UploadTokenKey)
+	io.WriteString(mac, object+"\x00"+userID)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// apiStartUploadHandler starts a resumable upload of the file described in the
+// JSON request body and writes a resumableUpload.
+func (a *App) apiStartUploadHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if !vyfe_api.UploadsEnabled {
+		return apiErrorf(errNotImplemented, "%v", errUploadsDisabled)
+	}
+	var req struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"contentType"`
+	}
+	if appErr := decodeJSON(w, r, &req); appErr != nil {
+		return appErr
+	}
+	if req.ContentType == "" {
+		return badRequest(nil, "contentType is required")
+	}
+
+	// random filename, retaining existing extension.
+	name := uuid.Must(uuid.NewV4()).String() + path.Ext(req.Filename)
+	uploadURL, err := a.startResumable(context.Background(), name, req.ContentType, r.Header.Get("Origin"))
+	if err != nil {
+		return appErrorf(err, "could not start upload: %v", err)
+	}
+	return writeJSON(w, http.StatusOK, &resumableUpload{
+		UploadURL: uploadURL,
+		Object:    name,
+		ChunkSize: vyfe_api.ResumableChunkSize,
+		Token:     uploadToken(name, a.uploaderID(r)),
+	})
+}
+
+// startBucketResumable starts a resumable upload of an object with the given
+// name to the app's storage bucket and returns its session URI. Browsers may
+// only use the URI from origin, if set. The object gets the same
+// Cache-Control as uploads through bucketStore, but stays private until
+// apiFinishUploadHandler has scanned it.
+func (a *App) startBucketResumable(ctx context.Context, name, contentType, origin string) (string, error) {
+	if a.StorageBucket == nil {
+		return "", errors.New("storage bucket is missing - check config.go")
+	}
+	client, err := google.DefaultClient(ctx, storage.ScopeReadWrite)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{"uploadType": {"resumable"}, "name": {name}}
+	if vyfe_api.ObjectWrites.PreventOverwrite {
+		// Only create the object if no object has the name yet.
+		q.Set("ifGenerationMatch", "0")
+	}
+	u := fmt.Sprintf("https://www.googleapis.com/upload/storage/v1/b/%s/o?%s",
+		url.PathEscape(vyfe_api.StorageBucketName), q.Encode())
+	body, err := json.Marshal(map[string]string{
+		"name":         name,
+		"contentType":  contentType,
+		"cacheControl": cacheControlFor(contentType),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", contentType)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("starting resumable upload: %s", resp.Status)
+	}
+	return resp.Header.Get("Location"), nil
+}
+
+// apiFinishUploadHandler records the object of a finished resumable upload,
+// given as {"object": ..., "token": ...} in the JSON request body, as the
+// video of a session, and writes the updated session. The token must be the
+// one apiStartUploadHandler gave the same user, and the change is checked as
+// any other update. The object is scanned before it is made public; a flagged
+// object is deleted.
+func (a *App) apiFinishUploadHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if !vyfe_api.UploadsEnabled {
+		return apiErrorf(errNotImplemented, "%v", errUploadsDisabled)
+	}
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	var req struct {
+		Object string `json:"object"`
+		Token  string `json:"token"`
+	}
+	if appErr := decodeJSON(w, r, &req); appErr != nil {
+		return appErr
+	}
+	if req.Object == "" {
+		return badRequest(nil, "object is required")
+	}
+	want := uploadToken(req.Object, a.uploaderID(r))
+	if !hmac.Equal([]byte(req.Token), []byte(want)) {
+		return apiErrorf(errForbidden, "the upload token isn't valid for %s", req.Object)
+	}
+
+	ctx := context.Background()
+	// The object only exists once the upload has finished.
+	size, _, err := a.objectAttrs(ctx, req.Object)
+	if err == errObjectNotExist {
+		return badRequest(err, "upload of %s is not finished", req.Object)
+	} else if err != nil {
+		return appErrorf(err, "could not check upload: %v", err)
+	}
+
+	baseline, err := a.writeBaseline(r, id)
+	if err != nil {
+		return appErrorf(err, "could not get session: %v", err)
+	}
+	if baseline.ID == 0 {
+		return sessionNotFound(vyfe_api.ErrSessionNotFound)
+	}
+	session := *baseline
+	session.VideoURL = vyfe_api.ObjectURL(req.Object)
+	// The content wasn't hashed on the way in, so it can't be deduplicated.
+	session.ContentHash = ""
+	session.SizeBytes = size
+	// saveSession adds the stored session's objects to this one.
+	session.Objects = []string{req.Object}
+	if appErr := a.protectFields(r, &session, baseline); appErr != nil {
+		return appErr
+	}
+	if appErr := validateSession(&session); appErr != nil {
+		return appErr
+	}
+
+	if appErr := a.scanUploadedObject(ctx, req.Object); appErr != nil {
+		return appErr
+	}
+	if !vyfe_api.PrivateObjects {
+		if err := a.publishObject(ctx, req.Object); err != nil {
+			return appErrorf(err, "could not publish upload: %v", err)
+		}
+	}
+	if err := a.saveSession(ctx, &session); err != nil {
+		return appErrorf(err, "could not save session: %v", err)
+	}
+	a.publishUpdateAsync(id, session.ChangedFields)
+	return writeJSON(w, http.StatusOK, &session)
+}
+
+// scanUploadedObject runs the App's Scanner over a stored object, deleting it
+// and returning a 422 appError if it is flagged.
+func (a *App) scanUploadedObject(ctx context.Context, name string) *appError {
+	if a.Scanner == nil {
+		return nil
+	}
+	rc, err := a.readObject(ctx, name, 0, -1)
+	if err != nil {
+		return appErrorf(err, "could not read upload: %v", err)
+	}
+	clean, err := a.Scanner.Scan(ctx, rc)
+	rc.Close()
+	if err != nil {
+		return appErrorf(err, "could not scan file: %v", err)
+	}
+	if clean {
+		return nil
+	}
+	if a.Objects != nil {
+		if err := a.Objects.Delete(ctx, name); err != nil {
+			log.Printf("Could not delete flagged upload %s: %v", name, err)
+		}
+	}
+	return &appError{Error: errUnsafeUpload, Message: errUnsafeUpload.Error(), Code: http.StatusUnprocessableEntity}
+}
+
+// publishBucketObject makes an object in the app's storage bucket readable
+// by anyone.
+func (a *App) publishBucketObject(ctx context.Context, name string) error {
+	if a.StorageBucket == nil {
+		return errors.New("storage bucket is missing - check config.go")
+	}
+	return a.StorageBucket.Object(name).ACL().Set(ctx, storage.AllUsers, storage.RoleReader)
+}
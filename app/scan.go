@@ -0,0 +1,36 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// errUnsafeUpload is returned by uploadFileFromForm when the App's Scanner
+// flags an uploaded file. Handlers report it as 422 Unprocessable Entity.
+var errUnsafeUpload = errors.New("the uploaded file was rejected by the malware scanner")
+
+// Scanner checks uploaded files for viruses or other malware before they are
+// stored. Scan reads the file from r and reports whether it is clean; a
+// non-nil error means the file could not be scanned, and the upload fails.
+//
+// To use an external service, set App.Scanner in newApp to a type that
+// streams r to it. For example, a ClamAV scanner would dial clamd's socket,
+// send "zINSTREAM\x00" followed by the file as length-prefixed chunks and a
+// zero-length chunk, and treat a reply ending in "OK" as clean.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (clean bool, err error)
+}
+
+// noopScanner is the default Scanner. It reports every file as clean without
+// reading it.
+type noopScanner struct{}
+
+func (noopScanner) Scan(ctx context.Context, r io.Reader) (bool, error) {
+	return true, nil
+}
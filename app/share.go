@@ -0,0 +1,74 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// maxShareDescription is the number of characters of a session's
+// description shown in link previews.
+const maxShareDescription = 200
+
+// shareMeta is the Open Graph and Twitter Card metadata rendered into the head
+// of a session's detail page, so that shared links get a rich preview. The
+// template escapes its values.
+type shareMeta struct {
+	SiteName    string
+	Title       string
+	Description string
+	// Image is the URL of the preview image, or empty if there is none
+	// crawlers can fetch.
+	Image string
+	// URL is the canonical URL of the page.
+	URL string
+}
+
+// TwitterCard returns the Twitter Card type: a large image if there is one.
+func (m *shareMeta) TwitterCard() string {
+	if m.Image != "" {
+		return "summary_large_image"
+	}
+	return "summary"
+}
+
+// shareMetaFor returns the link preview metadata of session's detail page.
+// Thumbnails of private objects are left out, as crawlers can't fetch them
+// and signed URLs would expire in their caches.
+func shareMetaFor(r *http.Request, session *vyfe_api.Session) *shareMeta {
+	m := &shareMeta{
+		SiteName:    vyfe_api.ShareSiteName,
+		Title:       session.Title,
+		Description: truncateRunes(strings.Join(strings.Fields(session.Description), " "), maxShareDescription),
+		URL:         canonicalBaseURL(r) + "/sessions/" + session.URLID(),
+	}
+	if !vyfe_api.PrivateObjects {
+		m.Image = session.ThumbnailURL
+	}
+	return m
+}
+
+// canonicalBaseURL returns vyfe_api.CanonicalBaseURL, or if it isn't set, the
+// scheme and host the client used.
+func canonicalBaseURL(r *http.Request) string {
+	if vyfe_api.CanonicalBaseURL != "" {
+		return strings.TrimSuffix(vyfe_api.CanonicalBaseURL, "/")
+	}
+	return requestScheme(r) + "://" + r.Host
+}
+
+// truncateRunes returns s cut to at most n characters, ending in "…" if it
+// was cut.
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:n-1])) + "…"
+}
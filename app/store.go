@@ -0,0 +1,167 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// errObjectNotExist is returned by ObjectStore.Attrs, and so by
+// App.objectAttrs, for an object that doesn't exist.
+var errObjectNotExist = storage.ErrObjectNotExist
+
+// errUploadsDisabled is returned by uploadFileFromForm for an uploaded file
+// when vyfe_api.UploadsEnabled isn't set. Handlers report it as 501 Not
+// Implemented.
+var errUploadsDisabled = errors.New("file uploads are disabled")
+
+// ObjectAttrs is the metadata of a stored object.
+type ObjectAttrs struct {
+	Size        int64
+	ContentType string
+	Updated     time.Time
+
+	// Public reports whether anyone may read the object.
+	Public bool
+}
+
+// ObjectStore stores the files uploaded with sessions. The App uses a
+// bucketStore; tests substitute an in-memory store.
+type ObjectStore interface {
+	// Upload writes the contents of r to an object with the given name and
+	// returns the URL stored for it in the session. If
+	// vyfe_api.ObjectWrites.PreventOverwrite is set and the name is taken,
+	// it returns vyfe_api.ErrObjectExists.
+	Upload(ctx context.Context, name, contentType string, r io.Reader) (url string, err error)
+
+	// Delete removes the object with the given name. Deleting an object
+	// that doesn't exist is not an error.
+	Delete(ctx context.Context, name string) error
+
+	// Attrs returns the metadata of the object with the given name, or
+	// errObjectNotExist if there is none.
+	Attrs(ctx context.Context, name string) (*ObjectAttrs, error)
+
+	// List returns the names of all stored objects.
+	List(ctx context.Context) ([]string, error)
+}
+
+// bucketStore is an ObjectStore backed by a Cloud Storage bucket.
+type bucketStore struct {
+	bucket *storage.BucketHandle
+}
+
+// Upload writes the contents of r to an object in the bucket and returns its
+// URL. The object is publicly readable unless vyfe_api.PrivateObjects is set.
+// Overwrites are prevented with a DoesNotExist precondition, which Cloud
+// Storage checks when the write completes.
+func (s bucketStore) Upload(ctx context.Context, name, contentType string, r io.Reader) (string, error) {
+	obj := s.bucket.Object(name)
+	if vyfe_api.ObjectWrites.PreventOverwrite {
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	}
+	w := obj.NewWriter(ctx)
+	if !vyfe_api.PrivateObjects {
+		w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
+	}
+	w.ContentType = contentType
+	w.CacheControl = cacheControlFor(contentType)
+
+	if _, err := io.Copy(w, r); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", objectWriteError(err)
+	}
+
+	return vyfe_api.ObjectURL(name), nil
+}
+
+// objectWriteError returns the error to report for a failed object write:
+// vyfe_api.ErrObjectExists if a DoesNotExist precondition failed, or else err.
+func objectWriteError(err error) error {
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed {
+		return vyfe_api.ErrObjectExists
+	}
+	return err
+}
+
+// Delete removes an object from the bucket.
+func (s bucketStore) Delete(ctx context.Context, name string) error {
+	err := s.bucket.Object(name).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return err
+}
+
+// Attrs returns the metadata of an object in the bucket.
+func (s bucketStore) Attrs(ctx context.Context, name string) (*ObjectAttrs, error) {
+	attrs, err := s.bucket.Object(name).Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	oa := &ObjectAttrs{Size: attrs.Size, ContentType: attrs.ContentType, Updated: attrs.Updated}
+	for _, rule := range attrs.ACL {
+		if rule.Entity == storage.AllUsers {
+			oa.Public = true
+		}
+	}
+	return oa, nil
+}
+
+// List returns the names of the objects in the bucket.
+func (s bucketStore) List(ctx context.Context) ([]string, error) {
+	var names []string
+	it := s.bucket.Objects(ctx, nil)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+}
+
+// checkStorage returns an error if vyfe_api.UploadsEnabled is set but no
+// storage bucket is configured or it can't be reached. main calls it at
+// startup, so a misconfigured deployment fails at once rather than on the
+// first upload.
+func (a *App) checkStorage(ctx context.Context) error {
+	if !vyfe_api.UploadsEnabled {
+		return nil
+	}
+	if a.Objects == nil {
+		return errors.New("uploads are enabled, but the storage bucket is missing - " +
+			"configure it in vyfe-api/config.go, or set UploadsEnabled to false")
+	}
+	if err := a.checkBucket(ctx); err != nil {
+		return fmt.Errorf("uploads are enabled, but storage bucket %q can't be reached: %v", vyfe_api.StorageBucketName, err)
+	}
+	return nil
+}
+
+// checkBucketAttrs checks that the app's storage bucket exists and can be
+// read by getting its attributes.
+func (a *App) checkBucketAttrs(ctx context.Context) error {
+	_, err := a.StorageBucket.Attrs(ctx)
+	return err
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// compressWriter writes a streamed response body, gzipped if the client
+// accepts it and the body reaches vyfe_api.CompressMinBytes. Up to that many
+// bytes are buffered, so the status code and Content-Encoding are only sent
+// once the body is known to reach the threshold or is complete.
+type compressWriter struct {
+	w      http.ResponseWriter
+	accept bool // whether the client accepts gzip
+	buf    bytes.Buffer
+	gz     *gzip.Writer
+	sent   bool // whether the header has been written
+}
+
+func newCompressWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &compressWriter{
+		w:      w,
+		accept: vyfe_api.CompressMinBytes >= 0 && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip"),
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.sent {
+		if cw.gz != nil {
+			return cw.gz.Write(p)
+		}
+		return cw.w.Write(p)
+	}
+	cw.buf.Write(p)
+	if cw.buf.Len() < vyfe_api.CompressMinBytes {
+		return len(p), nil
+	}
+	return len(p), cw.flush()
+}
+
+// flush writes the header and any buffered body, switching to gzip if the
+// client accepts it.
+func (cw *compressWriter) flush() error {
+	if cw.accept && cw.buf.Len() >= vyfe_api.CompressMinBytes {
+		cw.w.Header().Set("Content-Encoding", "gzip")
+		cw.w.Header().Del("Content-Length")
+		cw.gz = gzip.NewWriter(cw.w)
+	}
+	cw.w.WriteHeader(http.StatusOK)
+	cw.sent = true
+	_, err := cw.Write(cw.buf.Bytes())
+	cw.buf.Reset()
+	return err
+}
+
+// Close writes the rest of the body.
+func (cw *compressWriter) Close() error {
+	if !cw.sent {
+		return cw.flush()
+	}
+	if cw.gz != nil {
+		return cw.gz.Close()
+	}
+	return nil
+}
+
+// apiListAllHandler writes every session the viewer may see listed as a JSON
+// array, ordered by title, or, with ?format=columnar, in the columnar format
+// described in columnar.go. Sessions are encoded as they're read from the
+// database, so neither side holds the whole list in memory.
+func (a *App) apiListAllHandler(w http.ResponseWriter, r *http.Request) *appError {
+	format := r.FormValue("format")
+	if format != "" && format != "columnar" {
+		return badRequest(nil, "unknown format %q", format)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	cw := newCompressWriter(w, r)
+	enc := json.NewEncoder(cw)
+	v := a.viewer(r)
+
+	start, end := "[", "]\n"
+	encode := func(s *vyfe_api.Session) error { return enc.Encode(s) }
+	if format == "columnar" {
+		columns, err := json.Marshal(columnNames)
+		if err != nil {
+			return appErrorf(err, "could not encode columns: %v", err)
+		}
+		start, end = `{"columns":`+string(columns)+`,"rows":[`, "]}\n"
+		encode = func(s *vyfe_api.Session) error { return enc.Encode(sessionRow(s)) }
+	}
+
+	io.WriteString(cw, start)
+	n := 0
+	err := a.DB.IterateSessions(context.Background(), func(s *vyfe_api.Session) error {
+		if !v.CanList(s) {
+			return nil
+		}
+		if n > 0 {
+			if _, err := io.WriteString(cw, ","); err != nil {
+				return err
+			}
+		}
+		n++
+		return encode(s)
+	})
+	if err == nil {
+		_, err = io.WriteString(cw, end)
+	}
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil && !cw.sent {
+		w.Header().Del("Content-Type")
+		return appErrorf(err, "could not list sessions: %v", err)
+	}
+	if err != nil {
+		// Part of the list has been sent, so it's too late for an error
+		// response. Abort it so the client sees a truncated body rather
+		// than a list that looks complete.
+		log.Printf("could not stream sessions after %d: %v", n, err)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
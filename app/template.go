@@ -14,9 +14,15 @@ import (
 	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
 )
 
+// templateFuncs are the functions available to all templates.
+var templateFuncs = template.FuncMap{
+	// uploadsEnabled reports whether forms should offer file uploads.
+	"uploadsEnabled": func() bool { return vyfe_api.UploadsEnabled },
+}
+
 // parseTemplate applies a given file to the body of the base template.
 func parseTemplate(filename string) *appTemplate {
-	tmpl := template.Must(template.ParseFiles("templates/base.html"))
+	tmpl := template.Must(template.New("base.html").Funcs(templateFuncs).ParseFiles("templates/base.html"))
 
 	// Put the named file into a template called "body"
 	path := filepath.Join("templates", filename)
@@ -36,27 +42,36 @@ type appTemplate struct {
 
 // Execute writes the template using the provided data, adding login and user
 // information to the base template.
-func (tmpl *appTemplate) Execute(w http.ResponseWriter, r *http.Request, data interface{}) *appError {
-	d := struct {
-		Data        interface{}
-		AuthEnabled bool
-		Profile     *Profile
-		LoginURL    string
-		LogoutURL   string
-	}{
+func (tmpl *appTemplate) Execute(a *App, w http.ResponseWriter, r *http.Request, data interface{}) *appError {
+	if err := tmpl.t.Execute(w, tmpl.pageData(a, r, data)); err != nil {
+		return appErrorf(err, "could not write template: %v", err)
+	}
+	return nil
+}
+
+// basePage is the data of the base template.
+type basePage struct {
+	Data        interface{}
+	AuthEnabled bool
+	Profile     *Profile
+	LoginURL    string
+	LogoutURL   string
+}
+
+// pageData returns the data of the base template around data. a may be nil
+// for pages written outside of an App's handlers, such as error pages, which
+// then show no login state.
+func (tmpl *appTemplate) pageData(a *App, r *http.Request, data interface{}) *basePage {
+	d := &basePage{
 		Data:        data,
-		AuthEnabled: vyfe_api.OAuthConfig != nil,
+		AuthEnabled: a != nil && a.OAuthConfig != nil,
 		LoginURL:    "/login?redirect=" + r.URL.RequestURI(),
 		LogoutURL:   "/logout?redirect=" + r.URL.RequestURI(),
 	}
 
 	if d.AuthEnabled {
 		// Ignore any errors.
-		d.Profile = profileFromSession(r)
-	}
-
-	if err := tmpl.t.Execute(w, d); err != nil {
-		return appErrorf(err, "could not write template: %v", err)
+		d.Profile = a.profileFromSession(r)
 	}
-	return nil
+	return d
 }
@@ -0,0 +1,153 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// videoHandler streams a session's uploaded video from the storage bucket,
+// so that it can be played from a private bucket. It honours a single byte
+// range in the Range header, letting players seek, and answers 416 for
+// ranges it can't satisfy, including requests for several ranges.
+func (a *App) videoHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, appErr := a.sessionIDFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	session, err := a.DB.GetSession(id)
+	if err == vyfe_api.ErrSessionNotFound {
+		return sessionNotFound(err)
+	}
+	if err != nil {
+		return appErrorf(err, "could not find session: %v", err)
+	}
+	if !a.viewer(r).CanGet(session) {
+		return sessionForbidden(vyfe_api.ErrForbidden)
+	}
+	name, ok := vyfe_api.ObjectName(session.VideoURL)
+	if !ok {
+		return &appError{Message: "session has no uploaded video", Code: http.StatusNotFound}
+	}
+	return a.serveObject(w, r, name)
+}
+
+// serveObject writes a stored object, or the byte range of it given in the
+// Range header of r.
+func (a *App) serveObject(w http.ResponseWriter, r *http.Request, name string) *appError {
+	ctx := context.Background()
+	size, contentType, err := a.objectAttrs(ctx, name)
+	if err == errObjectNotExist {
+		return &appError{Error: err, Message: "object not found", Code: http.StatusNotFound}
+	}
+	if err != nil {
+		return appErrorf(err, "could not read object: %v", err)
+	}
+
+	start, length, status := int64(0), size, http.StatusOK
+	if h := r.Header.Get("Range"); h != "" {
+		var ok bool
+		if start, length, ok = parseRange(h, size); !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return &appError{Message: "requested range not satisfiable", Code: http.StatusRequestedRangeNotSatisfiable}
+		}
+		status = http.StatusPartialContent
+	}
+
+	rc, err := a.readObject(ctx, name, start, length)
+	if err != nil {
+		return appErrorf(err, "could not read object: %v", err)
+	}
+	defer rc.Close()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if status == http.StatusPartialContent {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	}
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, rc); err != nil {
+		// The status has been sent; this is usually the player hanging up
+		// to seek elsewhere.
+		log.Printf("could not stream object %s: %v", name, err)
+	}
+	return nil
+}
+
+// parseRange parses a Range header for a single byte range of an object of
+// the given size, returning the range's start and length. It reports false if
+// the header is malformed, asks for several ranges or starts past the end.
+func parseRange(h string, size int64) (start, length int64, ok bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(h, prefix) || strings.Contains(h, ",") {
+		return 0, 0, false
+	}
+	spec := strings.SplitN(strings.TrimSpace(h[len(prefix):]), "-", 2)
+	if len(spec) != 2 {
+		return 0, 0, false
+	}
+	first, last := strings.TrimSpace(spec[0]), strings.TrimSpace(spec[1])
+
+	if first == "" {
+		// A suffix range: the last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		e, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || e < start {
+			return 0, 0, false
+		}
+		if e < end {
+			end = e
+		}
+	}
+	return start, end - start + 1, true
+}
+
+// bucketObjectAttrs returns the size and content type of an object in the
+// app's object store.
+func (a *App) bucketObjectAttrs(ctx context.Context, name string) (size int64, contentType string, err error) {
+	if a.Objects == nil {
+		return 0, "", errors.New("storage bucket is missing - check config.go")
+	}
+	attrs, err := a.Objects.Attrs(ctx, name)
+	if err != nil {
+		return 0, "", err
+	}
+	return attrs.Size, attrs.ContentType, nil
+}
+
+// readBucketObject opens length bytes of an object in the app's storage
+// bucket, starting at offset.
+func (a *App) readBucketObject(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if a.StorageBucket == nil {
+		return nil, errors.New("storage bucket is missing - check config.go")
+	}
+	return a.StorageBucket.Object(name).NewRangeReader(ctx, offset, length)
+}
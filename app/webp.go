@@ -0,0 +1,57 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// isWebPConvertible reports whether uploads with the given content type are
+// converted to WebP.
+func isWebPConvertible(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png"
+}
+
+// transcodeToWebP converts a JPEG or PNG image to WebP with the external
+// vyfe_api.WebPEncoder (cwebp), as there is no WebP encoder in the standard
+// library or golang.org/x/image. The image is decoded first so that
+// corrupt uploads are rejected before running the encoder.
+func transcodeToWebP(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, _, err := image.Decode(io.TeeReader(r, &buf)); err != nil {
+		return nil, fmt.Errorf("could not decode image: %v", err)
+	}
+
+	in, err := ioutil.TempFile("", "upload")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(in.Name())
+	if _, err := io.Copy(in, io.MultiReader(&buf, r)); err != nil {
+		in.Close()
+		return nil, err
+	}
+	if err := in.Close(); err != nil {
+		return nil, err
+	}
+
+	out := in.Name() + ".webp"
+	defer os.Remove(out)
+	cmd := exec.Command(vyfe_api.WebPEncoder, "-quiet", in.Name(), "-o", out)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s failed: %v: %s", vyfe_api.WebPEncoder, err, msg)
+	}
+	return ioutil.ReadFile(out)
+}
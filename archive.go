@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ArchiveBucket counts the sessions published in a month. Sessions without a
+// valid published date are counted in the undated bucket, which has a zero
+// Year and Month.
+type ArchiveBucket struct {
+	Year  int        `json:"year"`
+	Month time.Month `json:"month"`
+	Count int        `json:"count"`
+}
+
+// Undated reports whether b is the bucket of sessions without a published
+// date.
+func (b ArchiveBucket) Undated() bool {
+	return b.Year == 0 && b.Month == 0
+}
+
+// ArchiveBuckets groups sessions by the month of PublishedAt, newest first,
+// with the undated bucket last.
+func ArchiveBuckets(sessions []*Session) []ArchiveBucket {
+	counts := make(map[ArchiveBucket]int)
+	for _, s := range sessions {
+		var b ArchiveBucket
+		if !s.PublishedAt.IsZero() {
+			b.Year, b.Month = s.PublishedAt.Year(), s.PublishedAt.Month()
+		}
+		counts[b]++
+	}
+
+	buckets := make([]ArchiveBucket, 0, len(counts))
+	for b, n := range counts {
+		b.Count = n
+		buckets = append(buckets, b)
+	}
+	sort.Sort(bucketsByDate(buckets))
+	return buckets
+}
+
+// bucketsByDate implements sort.Interface, ordering archive buckets newest
+// first, with the undated bucket last.
+type bucketsByDate []ArchiveBucket
+
+func (b bucketsByDate) Less(i, j int) bool {
+	if b[i].Undated() != b[j].Undated() {
+		return b[j].Undated()
+	}
+	if b[i].Year != b[j].Year {
+		return b[i].Year > b[j].Year
+	}
+	return b[i].Month > b[j].Month
+}
+func (b bucketsByDate) Len() int      { return len(b) }
+func (b bucketsByDate) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// monthRange returns the start of the given month and of the month after it,
+// in UTC. Year and month 0 select the undated bucket, for which both times
+// are zero.
+func monthRange(year, month int) (start, end time.Time, err error) {
+	if year == 0 && month == 0 {
+		return time.Time{}, time.Time{}, nil
+	}
+	if year < 1 || month < 1 || month > 12 {
+		return time.Time{}, time.Time{}, fmt.Errorf("bad archive month %d/%d", year, month)
+	}
+	start = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// monthDay returns the month and day of t as a single number, 100 times the
+// month plus the day, e.g. 704 for July 4. It is 0 for the zero time.
+func monthDay(t time.Time) int {
+	if t.IsZero() {
+		return 0
+	}
+	return int(t.Month())*100 + t.Day()
+}
+
+// setMonthDay sets the MonthDay of s from its PublishedAt, reporting whether
+// it changed.
+func setMonthDay(s *Session) bool {
+	md := monthDay(s.PublishedAt)
+	if s.MonthDay == md {
+		return false
+	}
+	s.MonthDay = md
+	return true
+}
+
+// onThisDayRange returns the range of MonthDay values, inclusive, of the
+// sessions published on the month and day of ref. On February 28 of a year
+// without a leap day, it includes sessions published on February 29, so
+// that they still come up once a year.
+func onThisDayRange(ref time.Time) (lo, hi int) {
+	lo = monthDay(ref)
+	hi = lo
+	if ref.Month() == time.February && ref.Day() == 28 && !isLeapYear(ref.Year()) {
+		hi = 229
+	}
+	return lo, hi
+}
+
+// isLeapYear reports whether year has a February 29.
+func isLeapYear(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
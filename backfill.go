@@ -0,0 +1,35 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import "math/rand"
+
+// fillDerivedFields sets those derived fields of s that are missing and
+// don't depend on other sessions: Random, PublicID if StringIDs is set,
+// PublishedAt if PublishedDate parses, MonthDay and GeoHash. It reports
+// whether it changed s. Slugs must be unique, so backends assign them separately.
+func fillDerivedFields(s *Session) bool {
+	changed := false
+	if s.Random == 0 {
+		s.Random = rand.Float64()
+		changed = true
+	}
+	if setPublicID(s) {
+		changed = true
+	}
+	if s.PublishedAt.IsZero() && s.PublishedDate != "" {
+		if t, err := ParsePublishedDate(s.PublishedDate); err == nil {
+			s.PublishedAt = t
+			changed = true
+		}
+	}
+	if setMonthDay(s) {
+		changed = true
+	}
+	if setGeoHash(s) {
+		changed = true
+	}
+	return changed
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// LoadBlockedTerms reads a blocklist for BlockedTerms from a file with one
+// term per line. Blank lines and lines starting with # are skipped.
+func LoadBlockedTerms(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var terms []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		terms = append(terms, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return terms, nil
+}
+
+// words splits s into lower-cased words: runs of letters and digits.
+func words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// blockedTerm returns the first term of BlockedTerms found in s. Terms match
+// whole words only, ignoring case and punctuation, so "ass" matches "Ass!" but
+// not "class". A term of several words matches them in sequence.
+func blockedTerm(s string) (string, bool) {
+	if len(BlockedTerms) == 0 {
+		return "", false
+	}
+	text := words(s)
+	for _, term := range BlockedTerms {
+		tw := words(term)
+		if len(tw) == 0 {
+			continue
+		}
+	search:
+		for i := 0; i+len(tw) <= len(text); i++ {
+			for j, w := range tw {
+				if text[i+j] != w {
+					continue search
+				}
+			}
+			return term, true
+		}
+	}
+	return "", false
+}
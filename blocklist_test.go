@@ -0,0 +1,71 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestValidateBlockedTerms(t *testing.T) {
+	defer func(terms []string) { BlockedTerms = terms }(BlockedTerms)
+	BlockedTerms = []string{"ass", "bad word"}
+
+	for _, s := range []*Session{
+		{Title: "Ass!"},
+		{Title: "t", Description: "A talk full of BAD  words? No, one bad word."},
+		{Title: "t", Tags: []string{"go", "ass"}},
+	} {
+		err, ok := s.Validate().(*ValidationError)
+		if !ok {
+			t.Errorf("%+v: got err %v, want a *ValidationError", s, err)
+			continue
+		}
+		if len(err.Fields) != 1 {
+			t.Errorf("%+v: got fields %v, want one", s, err.Fields)
+		}
+		for _, m := range err.Fields {
+			if m.Key != MsgBlockedTerm {
+				t.Errorf("%+v: got %v, want %q", s, m, MsgBlockedTerm)
+			}
+		}
+	}
+
+	for _, s := range []*Session{
+		{Title: "Classic assembly", Description: "Scunthorpe bass, a badword"},
+		{Title: "t", Tags: []string{"bad", "word"}},
+	} {
+		if err := s.Validate(); err != nil {
+			t.Errorf("%+v: got err %v, want nil", s, err)
+		}
+	}
+
+	BlockedTerms = nil
+	if err := (&Session{Title: "Ass!"}).Validate(); err != nil {
+		t.Errorf("empty blocklist: got err %v, want nil", err)
+	}
+}
+
+func TestLoadBlockedTerms(t *testing.T) {
+	f, err := ioutil.TempFile("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("# comment\nfoo\n\n  bar baz \n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	got, err := LoadBlockedTerms(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"foo", "bar baz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
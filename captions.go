@@ -0,0 +1,65 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import "regexp"
+
+// Formats of caption files.
+const (
+	// CaptionVTT is WebVTT, which browsers play in <track> elements.
+	CaptionVTT = "vtt"
+	// CaptionSRT is SubRip.
+	CaptionSRT = "srt"
+)
+
+// Caption is a captions or transcript file for a session's video in one
+// language.
+type Caption struct {
+	// Lang is a BCP 47 language tag, such as "en" or "pt-BR".
+	Lang string `json:"lang"`
+	URL  string `json:"url"`
+	// Format is CaptionVTT or CaptionSRT.
+	Format string `json:"format"`
+}
+
+// CaptionContentType returns the content type of caption files in the given
+// format.
+func CaptionContentType(format string) string {
+	if format == CaptionSRT {
+		return "application/x-subrip"
+	}
+	return "text/vtt; charset=utf-8"
+}
+
+// langTagPattern matches the shape of a BCP 47 language tag: a language and
+// optional subtags, such as "en", "pt-BR" or "zh-Hant".
+var langTagPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// ValidLang reports whether lang looks like a BCP 47 language tag.
+func ValidLang(lang string) bool {
+	return langTagPattern.MatchString(lang)
+}
+
+// Caption returns the session's caption in the given language.
+func (b *Session) Caption(lang string) (Caption, bool) {
+	for _, c := range b.Captions {
+		if c.Lang == lang {
+			return c, true
+		}
+	}
+	return Caption{}, false
+}
+
+// SetCaption adds c to the session's captions, replacing any in the same
+// language.
+func (b *Session) SetCaption(c Caption) {
+	for i := range b.Captions {
+		if b.Captions[i].Lang == c.Lang {
+			b.Captions[i] = c
+			return
+		}
+	}
+	b.Captions = append(b.Captions, c)
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNothingToClaim is returned by ClaimNextUnprocessed when every session is
+// processed or claimed by a worker whose lease hasn't expired.
+var ErrNothingToClaim = errors.New("no session to claim")
+
+// ErrClaimNotHeld is returned by ReleaseClaim when the worker doesn't hold the
+// claim on the session, e.g. because its lease expired and another worker
+// claimed it.
+var ErrClaimNotHeld = errors.New("claim not held")
+
+// claimable reports whether a worker may claim s at now: it isn't processed,
+// and it is unclaimed or its claim has expired.
+func claimable(s *Session, now time.Time) bool {
+	return s.ProcessedAt.IsZero() && !s.ClaimExpiry.After(now)
+}
+
+// validClaim reports whether the arguments of ClaimNextUnprocessed are
+// usable.
+func validClaim(workerID string, lease time.Duration) bool {
+	return workerID != "" && lease > 0
+}
+
+// keepClaim copies the claim and processing state of old to b, as edits
+// don't carry them. A new video hasn't been processed, so b is left
+// unprocessed if its video differs from old's.
+func keepClaim(b, old *Session) {
+	b.ClaimedBy, b.ClaimExpiry = old.ClaimedBy, old.ClaimExpiry
+	b.ProcessedAt = time.Time{}
+	if b.VideoURL == old.VideoURL {
+		b.ProcessedAt = old.ProcessedAt
+	}
+}
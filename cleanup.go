@@ -0,0 +1,315 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// CleanupJob is a pending deletion of an object in StorageBucket.
+type CleanupJob struct {
+	ID     int64 `datastore:"-"`
+	Object string
+
+	CreatedAt time.Time
+	// Attempts is the number of times deleting the object failed.
+	Attempts int
+	// NextAttempt is when the job is next due, or for a dead job, when it
+	// was given up on.
+	NextAttempt time.Time
+	LastError   string `datastore:",noindex"`
+	// Dead is set once the job has failed CleanupMaxAttempts times. Dead
+	// jobs are kept, but never attempted again.
+	Dead bool
+}
+
+// CleanupQueue persists CleanupJobs, so that objects are deleted outside of
+// the requests that replace or delete them, and retried until they are.
+type CleanupQueue interface {
+	// Enqueue adds a job deleting the named object, due now.
+	Enqueue(ctx context.Context, object string) error
+
+	// Due returns up to limit jobs that aren't dead and are due at now,
+	// earliest due first.
+	Due(ctx context.Context, now time.Time, limit int) ([]*CleanupJob, error)
+
+	// Complete removes a job that succeeded.
+	Complete(ctx context.Context, id int64) error
+
+	// Update saves the Attempts, NextAttempt, LastError and Dead fields of
+	// a job that failed.
+	Update(ctx context.Context, job *CleanupJob) error
+
+	// Dead returns the dead jobs, in the order they were given up on.
+	Dead(ctx context.Context) ([]*CleanupJob, error)
+}
+
+// cleanupBatchSize is the number of jobs CleanupWorker.Drain attempts.
+const cleanupBatchSize = 100
+
+// CleanupWorker runs the jobs of a CleanupQueue every interval, retrying
+// failed ones with exponential backoff from CleanupBackoff up to
+// CleanupMaxBackoff, and marking them dead after CleanupMaxAttempts.
+type CleanupWorker struct {
+	queue  CleanupQueue
+	delete func(ctx context.Context, object string) error
+
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewCleanupWorker returns a CleanupWorker running the jobs of queue with
+// deleteObject and starts its loop. Call Close to stop it. deleteObject
+// should succeed for objects that don't exist.
+func NewCleanupWorker(queue CleanupQueue, deleteObject func(ctx context.Context, object string) error, interval time.Duration) *CleanupWorker {
+	w := &CleanupWorker{
+		queue:   queue,
+		delete:  deleteObject,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.loop(interval)
+	return w
+}
+
+// loop drains the queue every interval, until Close.
+func (w *CleanupWorker) loop(interval time.Duration) {
+	defer close(w.stopped)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-w.stop:
+			return
+		}
+		if _, err := w.Drain(context.Background()); err != nil {
+			log.Printf("Could not run cleanup jobs: %v", err)
+		}
+	}
+}
+
+// Drain attempts each job due now once, up to cleanupBatchSize of them, and
+// returns the number that succeeded. Jobs that fail are rescheduled, or
+// marked dead after CleanupMaxAttempts.
+func (w *CleanupWorker) Drain(ctx context.Context) (int, error) {
+	now := time.Now()
+	jobs, err := w.queue.Due(ctx, now, cleanupBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	done := 0
+	for _, job := range jobs {
+		err := w.delete(ctx, job.Object)
+		if err == nil {
+			if err := w.queue.Complete(ctx, job.ID); err != nil {
+				return done, err
+			}
+			done++
+			continue
+		}
+
+		job.Attempts++
+		job.LastError = err.Error()
+		job.NextAttempt = now.Add(cleanupBackoff(job.Attempts))
+		if job.Attempts >= CleanupMaxAttempts {
+			job.Dead = true
+			job.NextAttempt = now
+			log.Printf("Giving up deleting %s after %d attempts: %v", job.Object, job.Attempts, err)
+		}
+		if err := w.queue.Update(ctx, job); err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// Close stops the loop. Jobs left in the queue are run by the next worker.
+func (w *CleanupWorker) Close() {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		<-w.stopped
+	})
+}
+
+// cleanupBackoff returns the delay before retrying a job that failed the
+// given number of times.
+func cleanupBackoff(attempts int) time.Duration {
+	d := CleanupBackoff
+	for i := 1; i < attempts && d < CleanupMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > CleanupMaxBackoff {
+		d = CleanupMaxBackoff
+	}
+	return d
+}
+
+// memoryCleanupQueue is a CleanupQueue kept in the memory of one instance, so
+// its jobs are lost on restart.
+type memoryCleanupQueue struct {
+	mu     sync.Mutex
+	nextID int64
+	jobs   map[int64]*CleanupJob
+}
+
+// NewMemoryCleanupQueue returns an empty in-memory CleanupQueue.
+func NewMemoryCleanupQueue() CleanupQueue {
+	return &memoryCleanupQueue{nextID: 1, jobs: make(map[int64]*CleanupJob)}
+}
+
+// Enqueue adds a job deleting the named object, due now.
+func (q *memoryCleanupQueue) Enqueue(ctx context.Context, object string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	q.jobs[q.nextID] = &CleanupJob{ID: q.nextID, Object: object, CreatedAt: now, NextAttempt: now}
+	q.nextID++
+	return nil
+}
+
+// Due returns up to limit live jobs due at now, earliest due first.
+func (q *memoryCleanupQueue) Due(ctx context.Context, now time.Time, limit int) ([]*CleanupJob, error) {
+	return q.list(func(j *CleanupJob) bool { return !j.Dead && !j.NextAttempt.After(now) }, limit), nil
+}
+
+// Complete removes a job.
+func (q *memoryCleanupQueue) Complete(ctx context.Context, id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.jobs, id)
+	return nil
+}
+
+// Update saves the state of a failed job.
+func (q *memoryCleanupQueue) Update(ctx context.Context, job *CleanupJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.jobs[job.ID]; !ok {
+		return fmt.Errorf("memorycleanup: no job %d", job.ID)
+	}
+	c := *job
+	q.jobs[job.ID] = &c
+	return nil
+}
+
+// Dead returns the dead jobs, in the order they were given up on.
+func (q *memoryCleanupQueue) Dead(ctx context.Context) ([]*CleanupJob, error) {
+	return q.list(func(j *CleanupJob) bool { return j.Dead }, 0), nil
+}
+
+// list returns copies of up to limit jobs matching keep, or all of them if
+// limit is 0, ordered by NextAttempt, then ID.
+func (q *memoryCleanupQueue) list(keep func(*CleanupJob) bool, limit int) []*CleanupJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var jobs []*CleanupJob
+	for _, j := range q.jobs {
+		if keep(j) {
+			c := *j
+			jobs = append(jobs, &c)
+		}
+	}
+	sort.Sort(jobsByNextAttempt(jobs))
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs
+}
+
+// jobsByNextAttempt implements sort.Interface, ordering jobs by NextAttempt,
+// then by ID.
+type jobsByNextAttempt []*CleanupJob
+
+func (s jobsByNextAttempt) Less(i, j int) bool {
+	if !s[i].NextAttempt.Equal(s[j].NextAttempt) {
+		return s[i].NextAttempt.Before(s[j].NextAttempt)
+	}
+	return s[i].ID < s[j].ID
+}
+func (s jobsByNextAttempt) Len() int      { return len(s) }
+func (s jobsByNextAttempt) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// datastoreCleanupQueue is a CleanupQueue of CleanupJob entities in Cloud
+// Datastore, shared by all instances.
+type datastoreCleanupQueue struct {
+	client *datastore.Client
+}
+
+// NewDatastoreCleanupQueue returns a CleanupQueue stored with client.
+func NewDatastoreCleanupQueue(client *datastore.Client) CleanupQueue {
+	return &datastoreCleanupQueue{client: client}
+}
+
+// Enqueue adds a job deleting the named object, due now.
+func (q *datastoreCleanupQueue) Enqueue(ctx context.Context, object string) error {
+	now := time.Now()
+	job := &CleanupJob{Object: object, CreatedAt: now, NextAttempt: now}
+	if _, err := q.client.Put(ctx, datastore.IncompleteKey("CleanupJob", nil), job); err != nil {
+		return fmt.Errorf("datastorecleanup: could not enqueue %s: %v", object, err)
+	}
+	return nil
+}
+
+// Due returns up to limit live jobs due at now, earliest due first.
+func (q *datastoreCleanupQueue) Due(ctx context.Context, now time.Time, limit int) ([]*CleanupJob, error) {
+	query := datastore.NewQuery("CleanupJob").
+		Filter("Dead =", false).
+		Filter("NextAttempt <=", now).
+		Order("NextAttempt").
+		Limit(limit)
+	return q.getAll(ctx, query)
+}
+
+// Complete removes a job.
+func (q *datastoreCleanupQueue) Complete(ctx context.Context, id int64) error {
+	if err := q.client.Delete(ctx, datastore.IDKey("CleanupJob", id, nil)); err != nil {
+		return fmt.Errorf("datastorecleanup: could not complete job %d: %v", id, err)
+	}
+	return nil
+}
+
+// Update saves the state of a failed job.
+func (q *datastoreCleanupQueue) Update(ctx context.Context, job *CleanupJob) error {
+	if _, err := q.client.Put(ctx, datastore.IDKey("CleanupJob", job.ID, nil), job); err != nil {
+		return fmt.Errorf("datastorecleanup: could not update job %d: %v", job.ID, err)
+	}
+	return nil
+}
+
+// Dead returns the dead jobs, in the order they were given up on.
+func (q *datastoreCleanupQueue) Dead(ctx context.Context) ([]*CleanupJob, error) {
+	query := datastore.NewQuery("CleanupJob").
+		Filter("Dead =", true).
+		Order("NextAttempt")
+	return q.getAll(ctx, query)
+}
+
+// getAll runs query, setting the IDs of the jobs it returns.
+func (q *datastoreCleanupQueue) getAll(ctx context.Context, query *datastore.Query) ([]*CleanupJob, error) {
+	var jobs []*CleanupJob
+	keys, err := q.client.GetAll(ctx, query, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("datastorecleanup: could not list jobs: %v", err)
+	}
+	for i, k := range keys {
+		jobs[i].ID = k.ID
+	}
+	return jobs, nil
+}
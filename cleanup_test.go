@@ -0,0 +1,89 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestCleanupWorker(t *testing.T) {
+	defer func(backoff time.Duration, attempts int) {
+		CleanupBackoff, CleanupMaxAttempts = backoff, attempts
+	}(CleanupBackoff, CleanupMaxAttempts)
+	CleanupBackoff, CleanupMaxAttempts = 0, 3
+
+	ctx := context.Background()
+	q := NewMemoryCleanupQueue()
+	var deleted []string
+	w := NewCleanupWorker(q, func(ctx context.Context, object string) error {
+		if object == "stuck.mp4" {
+			return errors.New("permission denied")
+		}
+		deleted = append(deleted, object)
+		return nil
+	}, time.Hour)
+	defer w.Close()
+
+	for _, name := range []string{"talk.mp4", "thumb.jpg", "stuck.mp4"} {
+		if err := q.Enqueue(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if jobs, err := q.Due(ctx, time.Now(), 10); err != nil || len(jobs) != 3 {
+		t.Fatalf("Due after Enqueue: got %d jobs, %v; want 3", len(jobs), err)
+	}
+
+	n, err := w.Drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(deleted) != 2 || deleted[0] != "talk.mp4" || deleted[1] != "thumb.jpg" {
+		t.Errorf("first Drain: got %d done, deleted %v; want talk.mp4 and thumb.jpg", n, deleted)
+	}
+	jobs, err := q.Due(ctx, time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Object != "stuck.mp4" || jobs[0].Attempts != 1 || jobs[0].LastError != "permission denied" {
+		t.Fatalf("Due after first Drain: got %+v, want stuck.mp4 failed once", jobs)
+	}
+
+	// The failing job is retried until CleanupMaxAttempts, then dead.
+	for i := 0; i < 2; i++ {
+		if _, err := w.Drain(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if jobs, err := q.Due(ctx, time.Now(), 10); err != nil || len(jobs) != 0 {
+		t.Errorf("Due after %d attempts: got %+v, %v; want none", CleanupMaxAttempts, jobs, err)
+	}
+	dead, err := q.Dead(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Object != "stuck.mp4" || dead[0].Attempts != 3 || !dead[0].Dead {
+		t.Errorf("Dead: got %+v, want stuck.mp4 after 3 attempts", dead)
+	}
+	if n, err := w.Drain(ctx); n != 0 || err != nil {
+		t.Errorf("Drain after dead letter: got %d, %v; want nothing run", n, err)
+	}
+}
+
+func TestCleanupBackoff(t *testing.T) {
+	defer func(backoff, max time.Duration) {
+		CleanupBackoff, CleanupMaxBackoff = backoff, max
+	}(CleanupBackoff, CleanupMaxBackoff)
+	CleanupBackoff, CleanupMaxBackoff = time.Second, 5*time.Second
+
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if got := cleanupBackoff(attempts); got != want {
+			t.Errorf("cleanupBackoff(%d): got %v, want %v", attempts, got, want)
+		}
+	}
+}
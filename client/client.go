@@ -0,0 +1,169 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package client provides a Go client for the sessions JSON API served by the
+// app module under /api/sessions.
+//
+// Note that importing this package imports the vyfe_api package for its
+// Session type, which runs the configuration in its config.go.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+// ErrSessionNotFound is returned when the API responds with 404 Not Found.
+var ErrSessionNotFound = vyfe_api.ErrSessionNotFound
+
+// Client calls the sessions JSON API. Its methods mirror those of
+// vyfe_api.SessionDatabase.
+type Client struct {
+	// BaseURL is the URL of the app, e.g. "https://vife-app.appspot.com".
+	BaseURL string
+
+	// HTTPClient is used to make requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// AuthToken, if set, is sent as a bearer token in the Authorization header
+	// of every request.
+	AuthToken string
+}
+
+// New returns a Client for the app served at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: baseURL}
+}
+
+// Error is returned for API responses with an unexpected status code.
+type Error struct {
+	StatusCode int
+	// Code is the machine-readable error code sent by the server, e.g.
+	// "validation_failed". It is empty if the response wasn't JSON.
+	Code    string
+	Message string
+	// Fields describes the invalid fields of a "validation_failed" error.
+	Fields map[string]string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("client: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// ListSessions returns all sessions, ordered by title, following page tokens
+// until the last page.
+func (c *Client) ListSessions(ctx context.Context) ([]*vyfe_api.Session, error) {
+	var sessions []*vyfe_api.Session
+	token := ""
+	for {
+		path := "/api/sessions"
+		if token != "" {
+			path += "?pageToken=" + url.QueryEscape(token)
+		}
+		var list vyfe_api.ListResponse
+		if err := c.do(ctx, "GET", path, nil, &list); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, list.Data...)
+		if !list.PageInfo.HasNextPage {
+			return sessions, nil
+		}
+		token = list.PageInfo.NextCursor
+	}
+}
+
+// GetSession retrieves a session by its ID.
+func (c *Client) GetSession(ctx context.Context, id int64) (*vyfe_api.Session, error) {
+	session := &vyfe_api.Session{}
+	if err := c.do(ctx, "GET", fmt.Sprintf("/api/sessions/%d", id), nil, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// CreateSession saves a new session and returns the ID assigned to it, which
+// is also set on s.
+func (c *Client) CreateSession(ctx context.Context, s *vyfe_api.Session) (int64, error) {
+	created := &vyfe_api.Session{}
+	if err := c.do(ctx, "POST", "/api/sessions", s, created); err != nil {
+		return 0, err
+	}
+	s.ID = created.ID
+	return created.ID, nil
+}
+
+// UpdateSession updates the entry for a given session.
+func (c *Client) UpdateSession(ctx context.Context, s *vyfe_api.Session) error {
+	return c.do(ctx, "PUT", fmt.Sprintf("/api/sessions/%d", s.ID), s, nil)
+}
+
+// DeleteSession removes a given session by its ID.
+func (c *Client) DeleteSession(ctx context.Context, id int64) error {
+	return c.do(ctx, "DELETE", fmt.Sprintf("/api/sessions/%d", id), nil, nil)
+}
+
+// do sends a request with in encoded as the JSON body, if non-nil, and decodes
+// the JSON response into out, if non-nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("client: could not encode request: %v", err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(c.BaseURL, "/")+path, body)
+	if err != nil {
+		return fmt.Errorf("client: could not create request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.AuthToken)
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("client: %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrSessionNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		if err := json.Unmarshal(msg, apiErr); err != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(msg))
+		}
+		return apiErr
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("client: could not decode response: %v", err)
+	}
+	return nil
+}
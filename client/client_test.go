@@ -0,0 +1,92 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/vyfe-api"
+)
+
+func TestClient(t *testing.T) {
+	const token = "secret"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "Bearer "+token; got != want {
+			t.Errorf("Authorization: got %q, want %q", got, want)
+		}
+		switch r.Method {
+		case "GET":
+			list := vyfe_api.NewListResponse([]*vyfe_api.Session{{ID: 1, Title: "a"}}, "1")
+			if r.FormValue("pageToken") == "1" {
+				list = vyfe_api.NewListResponse([]*vyfe_api.Session{{ID: 2, Title: "b"}}, "")
+			}
+			json.NewEncoder(w).Encode(list)
+		case "POST":
+			var s vyfe_api.Session
+			json.NewDecoder(r.Body).Decode(&s)
+			s.ID = 3
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(s)
+		}
+	})
+	mux.HandleFunc("/api/sessions/1", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(vyfe_api.Session{ID: 1, Title: "a"})
+	})
+	mux.HandleFunc("/api/sessions/4", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code":"validation_failed","message":"invalid","fields":{"publishedDate":"bad date"}}`))
+	})
+	serv := httptest.NewServer(mux)
+	defer serv.Close()
+
+	c := New(serv.URL)
+	c.AuthToken = token
+	ctx := context.Background()
+
+	sessions, err := c.ListSessions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].Title != "a" || sessions[1].Title != "b" {
+		t.Errorf("ListSessions: got %v, want sessions a and b", sessions)
+	}
+
+	s, err := c.GetSession(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Title != "a" {
+		t.Errorf("GetSession: got title %q, want %q", s.Title, "a")
+	}
+
+	if _, err := c.GetSession(ctx, 2); err != ErrSessionNotFound {
+		t.Errorf("GetSession(missing): got err %v, want ErrSessionNotFound", err)
+	}
+
+	created := &vyfe_api.Session{Title: "c"}
+	id, err := c.CreateSession(ctx, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 3 || created.ID != 3 {
+		t.Errorf("CreateSession: got id %d (struct %d), want 3", id, created.ID)
+	}
+
+	err = c.UpdateSession(ctx, &vyfe_api.Session{ID: 4})
+	apiErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("UpdateSession(invalid): got err %v, want *Error", err)
+	}
+	if apiErr.Code != "validation_failed" || apiErr.Fields["publishedDate"] == "" {
+		t.Errorf("UpdateSession(invalid): got %+v, want validation_failed with publishedDate", apiErr)
+	}
+}
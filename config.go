@@ -8,6 +8,7 @@ import (
 	"errors"
 	"log"
 	"os"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/pubsub"
@@ -31,8 +32,286 @@ var (
 
 	SessionStore sessions.Store
 
+	// SessionHistory keeps recent versions of the sessions saved through DB,
+	// so editors can see what changed.
+	SessionHistory = NewHistory(SessionHistoryVersions)
+
 	PubsubClient *pubsub.Client
 
+	// AdminUserIDs lists the IDs of users (see the app's Profile.ID) allowed to
+	// use admin features. Admins are not subject to SessionQuota.
+	AdminUserIDs []string
+
+	// ProtectedFields names the fields of Session, such as "CreatedByID",
+	// that only admins may set. Other users' changes to them are ignored,
+	// or rejected with 403 Forbidden if RejectProtectedFieldChanges is set.
+	// Add "Visibility" to keep users from hiding their own sessions.
+	ProtectedFields = []string{"CreatedBy", "CreatedByID"}
+
+	// RejectProtectedFieldChanges makes writes by users other than admins
+	// that change ProtectedFields fail, rather than have the changes
+	// ignored.
+	RejectProtectedFieldChanges = false
+
+	// SessionQuota is the maximum number of sessions a single user may create.
+	// Anonymous users share a single quota. Zero means no limit.
+	SessionQuota = 100
+
+	// AbuseCreateLimit is the number of sessions a user, or clients from a
+	// single IP address, may create within AbuseWindow before further
+	// creates are blocked for AbuseBlockDuration. Zero means no limit.
+	AbuseCreateLimit   = 20
+	AbuseWindow        = 10 * time.Minute
+	AbuseBlockDuration = time.Hour
+
+	// APIKeys maps the keys clients may send in the X-API-Key header to
+	// their holders. Requests with a key are rate-limited per key, however
+	// many addresses they come from, and read-only keys can't change data.
+	// Requests with an unknown key are rejected. For example:
+	//
+	//	APIKeys = map[string]APIKey{
+	//		"k3y-for-the-public-feed": {Name: "feed", Scope: ScopeRead, RateLimit: 600},
+	//		"k3y-for-the-importer":    {Name: "importer", Scope: ScopeReadWrite, RateLimit: 60},
+	//	}
+	APIKeys map[string]APIKey
+
+	// RequireAPIKey makes requests to /api/ routes without an API key fail
+	// with 401, so that every API client is named and rate-limited. It is
+	// off by default, as the pages of the app itself call the API without
+	// a key.
+	RequireAPIKey = false
+
+	// APIKeyRateWindow is the window each APIKey's RateLimit applies to.
+	APIKeyRateWindow = time.Minute
+
+	// ListSoftDeadline, if set, makes the session list read sessions one by
+	// one, instead of with the summaries projection, and show those read so
+	// far when reading all of them takes longer than this.
+	ListSoftDeadline time.Duration
+
+	// FingerprintCounters makes Session.Fingerprint cover Favorites and
+	// ViewCount, so that fingerprints change whenever the session is viewed
+	// or favorited.
+	FingerprintCounters = false
+
+	// SlowQueryThreshold is how long a DB call may take before it is logged
+	// as slow. Zero or negative logs every call.
+	SlowQueryThreshold = 250 * time.Millisecond
+
+	// DescriptionOffloadThreshold is the length in bytes above which the
+	// Cloud Datastore backend stores a session's description, gzipped, in
+	// DescriptionStore rather than in the entity, which keeps entities small.
+	// Zero keeps all descriptions inline.
+	DescriptionOffloadThreshold = 1500
+
+	// DescriptionStore holds offloaded descriptions. It is set to use
+	// StorageBucket once that is configured.
+	DescriptionStore BlobStore
+
+	// StringIDs gives sessions a PublicID, a ULID used in their URLs in
+	// place of the sequential numeric ID, which reveals how many sessions
+	// there are and lets others be guessed. Existing sessions get one when
+	// they are next saved or from /admin/backfill.
+	StringIDs = false
+
+	// NumericIDs keeps sessions reachable by their numeric IDs, as links
+	// made before StringIDs was set use them. Turn it off once they don't
+	// matter.
+	NumericIDs = true
+
+	// ThumbnailPreloadCount is the number of sessions at the top of a list
+	// page whose thumbnails are sent as preload hints.
+	ThumbnailPreloadCount = 6
+
+	// HTMLErrorPages renders errors of requests from browsers, which accept
+	// text/html, with the error page templates. Otherwise they get the
+	// message as plain text. Errors of /api/ routes are always JSON.
+	HTMLErrorPages = true
+
+	// MaintenanceMode makes the app start read-only: requests that would
+	// change data are answered with 503 until an admin turns it off via
+	// /admin/maintenance.
+	MaintenanceMode = false
+
+	// ConvertImagesToWebP makes image uploads also be stored as WebP, which
+	// is then used as the session's thumbnail. It needs WebPEncoder to be
+	// installed.
+	ConvertImagesToWebP = false
+
+	// WebPEncoder is the path of the cwebp binary used to encode WebP images.
+	WebPEncoder = "cwebp"
+
+	// MaxEventStreams is the maximum number of clients that may be connected
+	// to /events at once. Zero means no limit.
+	MaxEventStreams = 500
+
+	// LegacyPubsubPayload makes the app publish the bare session ID as
+	// each Pub/Sub message, as it used to, instead of a SessionEvent, and
+	// not publish deletes. Set it until all subscribers handle SessionEvent.
+	LegacyPubsubPayload = false
+
+	// RequireAuthForReads makes the app serve the session lists, details
+	// and search only to logged in users, for private deployments. Others
+	// are sent to /login, or get 401 from the JSON API. Login and health
+	// checks stay public.
+	RequireAuthForReads = false
+
+	// EnforceHTTPS makes the app redirect plain HTTP requests to HTTPS and
+	// send the Strict-Transport-Security header. Behind a proxy, the scheme
+	// is taken from X-Forwarded-Proto. Health checks are exempt.
+	EnforceHTTPS = false
+
+	// HSTSMaxAge is the max-age, in seconds, of the Strict-Transport-Security
+	// header sent when EnforceHTTPS is set.
+	HSTSMaxAge = 365 * 24 * 60 * 60
+
+	// HSTSIncludeSubDomains adds includeSubDomains to the
+	// Strict-Transport-Security header.
+	HSTSIncludeSubDomains = false
+
+	// CanonicalBaseURL is the scheme and host, e.g. "https://vyfe.example",
+	// of the canonical URLs in link preview metadata. If empty, they use the
+	// scheme and host of the request.
+	CanonicalBaseURL = ""
+
+	// ShareSiteName is the og:site_name of link previews of sessions.
+	ShareSiteName = "Vyfe"
+
+	// PageSize is the number of sessions per page of paginated API lists
+	// when the request gives no limit. MaxPageSize is the most a request may
+	// ask for; larger limits are reduced to it.
+	PageSize    = 50
+	MaxPageSize = 100
+
+	// FeedItems is the number of recently added sessions in the RSS feed at
+	// /sessions/feed.xml.
+	FeedItems = 20
+
+	// NewSessionDefaults prefills the form for adding a session, and fills
+	// in the fields left blank when it is submitted. For example:
+	//
+	//	NewSessionDefaults = SessionDefaults{
+	//		Tags:           []string{"meetup"},
+	//		Description:    "Recorded at the monthly meetup.",
+	//		PublishedToday: true,
+	//	}
+	NewSessionDefaults SessionDefaults
+
+	// UploadsEnabled makes the app accept uploaded files, which are stored
+	// in StorageBucket. The app then checks at startup that the bucket is
+	// configured and reachable, and exits if it isn't. Turn it off for
+	// deployments without a bucket: forms then have no upload field, and
+	// uploads are rejected with 501 Not Implemented.
+	UploadsEnabled = true
+
+	// PrivateObjects stores uploaded files without a public ACL. The API then
+	// returns URLs signed with SignedURLGoogleAccessID and
+	// SignedURLPrivateKey instead of the stored public URLs.
+	PrivateObjects = false
+
+	// SignedURLExpiry is how long signed URLs returned by the API stay valid.
+	SignedURLExpiry = 15 * time.Minute
+
+	// EditLockDuration is how long the advisory edit lock taken when a user
+	// opens the edit form of a session lasts. The form renews it while it is
+	// open.
+	EditLockDuration = 2 * time.Minute
+
+	// EncryptedFields are the fields of Session encrypted at rest when DB
+	// is wrapped with newEncryptingDB (see init). They can be string or
+	// string list fields the database doesn't set or look sessions up by,
+	// and can't be searched or queried once encrypted.
+	EncryptedFields = []string{"Description"}
+
+	// SignedURLGoogleAccessID is the email address of the service account
+	// used to sign URLs when PrivateObjects is set.
+	SignedURLGoogleAccessID string
+
+	// SignedURLPrivateKey is the PEM-encoded private key of that service
+	// account.
+	SignedURLPrivateKey []byte
+
+	// UploadCacheControl maps the content type of uploaded files to the
+	// Cache-Control of their objects. Keys are a full type, such as
+	// "image/webp", or a type with any subtype, such as "video/*"; a full
+	// type takes precedence. Other uploads use DefaultUploadCacheControl.
+	UploadCacheControl = map[string]string{
+		// Uploaded videos are never replaced in place.
+		"video/*": "public, max-age=31536000, immutable",
+		// Thumbnails are replaced more often.
+		"image/*": "public, max-age=86400",
+	}
+
+	// DefaultUploadCacheControl is the Cache-Control of uploaded files whose
+	// type isn't in UploadCacheControl.
+	DefaultUploadCacheControl = "public, max-age=86400"
+
+	// CompressMinBytes is the size from which streamed JSON responses, such
+	// as /api/sessions/all, are gzipped for clients that accept it. Smaller
+	// responses aren't worth compressing. A negative value disables
+	// compression.
+	CompressMinBytes = 1400
+
+	// ResumableChunkSize is the chunk size, in bytes, clients are asked to
+	// use for resumable uploads. Cloud Storage requires a multiple of 256 KiB.
+	ResumableChunkSize = 8 << 20
+
+	// UploadTokenKey signs the tokens that tie a resumable upload to the
+	// user who started it, so only they can attach it to a session.
+	// Update it with a hard to guess byte sequence.
+	UploadTokenKey = []byte("something-very-secret")
+
+	// BlockedTerms are words and phrases that session titles, descriptions
+	// and tags may not contain. Terms match whole words, ignoring case. An
+	// empty list disables the check. See LoadBlockedTerms to read them from a
+	// file.
+	BlockedTerms []string
+
+	// AllowedVideoHosts are the hosts a session's VideoURL may point to,
+	// each also allowing its subdomains, so "youtube.com" allows
+	// "www.youtube.com". An empty list allows any host. When uploads are
+	// enabled, list the host of uploaded videos too, storage.googleapis.com
+	// unless the bucket is served from a domain of its own. For example:
+	//
+	//	AllowedVideoHosts = []string{"youtube.com", "vimeo.com", "storage.googleapis.com"}
+	AllowedVideoHosts []string
+
+	// ObjectWrites configures overwrite protection and the clean-up of
+	// replaced uploads.
+	ObjectWrites = ObjectWriteConfig{PreventOverwrite: true, DeleteReplaced: true}
+
+	// SessionHistoryVersions is the number of versions of each session kept
+	// in SessionHistory.
+	SessionHistoryVersions = 10
+
+	// BufferViews makes session views be counted in memory and written to DB
+	// every ViewFlushInterval, or once ViewFlushThreshold views are pending,
+	// rather than on every view.
+	BufferViews        = true
+	ViewFlushInterval  = 30 * time.Second
+	ViewFlushThreshold = int64(500)
+
+	// CleanupJobs queues the deletion of replaced and deleted uploads, so
+	// that it happens in the background and is retried, rather than once
+	// during the request. If nil, objects are deleted during the request.
+	CleanupJobs CleanupQueue
+
+	// CleanupInterval is how often the app runs the due CleanupJobs. A job
+	// failing is retried after CleanupBackoff, doubling after each attempt
+	// up to CleanupMaxBackoff, and given up on after CleanupMaxAttempts.
+	CleanupInterval    = time.Minute
+	CleanupBackoff     = 30 * time.Second
+	CleanupMaxBackoff  = time.Hour
+	CleanupMaxAttempts = 8
+
+	// ShutdownDrainTimeout is how long the app waits on shutdown for
+	// in-flight Pub/Sub publishes to finish.
+	ShutdownDrainTimeout = 10 * time.Second
+
+	// StartupRetryTimeout is how long database backends keep retrying their
+	// connection check at startup before giving up.
+	StartupRetryTimeout = 30 * time.Second
+
 	// Force import of mgo library.
 	_ mgo.Session
 )
@@ -80,6 +359,41 @@ func init() {
 		log.Fatal(err)
 	}
 
+	// To migrate to another database, configure it as newDB and uncomment the
+	// next line. Writes then go to both databases and reads can be shifted to
+	// newDB with the /admin/migration endpoint.
+	// DB = newMigratingDB(DB, newDB)
+
+	// To encrypt EncryptedFields before they are stored, uncomment the
+	// following lines and set VYFE_ENCRYPTION_KEY to a base64-encoded
+	// 32-byte key, e.g. one decrypted with Cloud KMS at deployment.
+	// var key []byte
+	// key, err = LoadEncryptionKey("VYFE_ENCRYPTION_KEY")
+	// if err != nil {
+	// 	log.Fatal(err)
+	// }
+	// DB, err = newEncryptingDB(DB, key, EncryptedFields)
+	// if err != nil {
+	// 	log.Fatal(err)
+	// }
+
+	// To have concurrent reads of the same session share one database
+	// call, uncomment the following line.
+	// DB = newSingleflightDB(DB)
+
+	// Record the versions of sessions saved, for /sessions/{id}/diff.
+	DB = newHistoryDB(DB, SessionHistory)
+
+	// Log DB calls slower than SlowQueryThreshold.
+	DB = newSlowlogDB(DB, SlowQueryThreshold)
+
+	// To reject sessions containing blocked terms, uncomment the following
+	// lines and list one term per line in blocklist.txt.
+	// BlockedTerms, err = LoadBlockedTerms("blocklist.txt")
+	// if err != nil {
+	// 	log.Fatal(err)
+	// }
+
 	// [START storage]
 	// To configure Cloud Storage, uncomment the following lines and update the
 	// bucket name.
@@ -91,6 +405,14 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	DescriptionStore = NewBucketBlobStore(StorageBucket)
+
+	// To delete uploads in the background with retries, uncomment the
+	// following lines and update the project ID.
+	// CleanupJobs, err = configureDatastoreCleanupQueue("vyfe-api")
+	// if err != nil {
+	// 	log.Fatal(err)
+	// }
 
 	// [START auth]
 	// To enable user sign-in, uncomment the following lines and update the
@@ -131,6 +453,15 @@ func configureDatastoreDB(projectID string) (SessionDatabase, error) {
 	return newDatastoreDB(client)
 }
 
+func configureDatastoreCleanupQueue(projectID string) (CleanupQueue, error) {
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return NewDatastoreCleanupQueue(client), nil
+}
+
 func configureStorage(bucketID string) (*storage.BucketHandle, error) {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
@@ -141,7 +472,17 @@ func configureStorage(bucketID string) (*storage.BucketHandle, error) {
 }
 
 func configurePubsub(projectID string) (*pubsub.Client, error) {
-	if _, ok := DB.(*memoryDB); ok {
+	db := DB
+	for {
+		w, ok := db.(interface {
+			unwrap() SessionDatabase
+		})
+		if !ok {
+			break
+		}
+		db = w.unwrap()
+	}
+	if _, ok := db.(*memoryDB); ok {
 		return nil, errors.New("Pub/Sub worker doesn't work with the in-memory DB " +
 			"(worker does not share its memory as the main app). Configure another " +
 			"database in vyfe-api/config.go first (e.g. MySQL, Cloud Datastore, etc)")
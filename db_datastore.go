@@ -1,12 +1,17 @@
-
 package vyfe_api
 
 import (
 	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
 
 	"cloud.google.com/go/datastore"
 
 	"golang.org/x/net/context"
+
+	"google.golang.org/api/iterator"
 )
 
 // datastoreDB persists sessions to Cloud Datastore.
@@ -23,17 +28,20 @@ var _ SessionDatabase = &datastoreDB{}
 // https://godoc.org/cloud.google.com/go/datastore
 func newDatastoreDB(client *datastore.Client) (SessionDatabase, error) {
 	ctx := context.Background()
-	// Verify that we can communicate and authenticate with the datastore service.
-	t, err := client.NewTransaction(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("datastoredb: could not connect: %v", err)
-	}
-	if err := t.Rollback(); err != nil {
-		return nil, fmt.Errorf("datastoredb: could not connect: %v", err)
+	// Verify that we can communicate and authenticate with the datastore
+	// service, which may not be reachable yet during a cold start.
+	check := func() error {
+		t, err := client.NewTransaction(ctx)
+		if err != nil {
+			return err
+		}
+		return t.Rollback()
 	}
-	return &datastoreDB{
-		client: client,
-	}, nil
+	return openCheckedDB("datastoredb", check, func() SessionDatabase {
+		return &datastoreDB{
+			client: client,
+		}
+	})
 }
 
 // Close closes the database.
@@ -50,52 +58,855 @@ func (db *datastoreDB) GetSession(id int64) (*Session, error) {
 	ctx := context.Background()
 	k := db.datastoreKey(id)
 	session := &Session{}
-	if err := db.client.Get(ctx, k, session); err != nil {
+	if err := ignoreFieldMismatch(db.client.Get(ctx, k, session)); err == datastore.ErrNoSuchEntity {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
 		return nil, fmt.Errorf("datastoredb: could not get Session: %v", err)
 	}
 	session.ID = id
+	if err := db.inflateDescription(ctx, session); err != nil {
+		return nil, err
+	}
 	return session, nil
 }
 
+// ignoreFieldMismatch logs and drops err if it is a
+// *datastore.ErrFieldMismatch, and returns it otherwise. Datastore returns one
+// when an entity has a property Session has no field for, as entities saved
+// by another version of the app can during schema rollouts, but still loads
+// the other properties, so the session can be used. It is only ignored on
+// reads: saving a session read this way would drop the property.
+func ignoreFieldMismatch(err error) error {
+	if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+		log.Printf("datastoredb: ignoring %v", err)
+		return nil
+	}
+	return err
+}
+
+// storeDescription offloads b's description to DescriptionStore if it is
+// longer than DescriptionOffloadThreshold, returning the object name to save
+// with descriptionEntity, or "" to keep it inline.
+func (db *datastoreDB) storeDescription(ctx context.Context, b *Session) (string, error) {
+	ref, err := storeDescription(ctx, DescriptionStore, DescriptionOffloadThreshold, b.Description)
+	if err != nil {
+		return "", fmt.Errorf("datastoredb: %v", err)
+	}
+	return ref, nil
+}
+
+// inflateDescription reads back b's description if it was offloaded.
+func (db *datastoreDB) inflateDescription(ctx context.Context, b *Session) error {
+	if err := inflateDescription(ctx, DescriptionStore, b); err != nil {
+		return fmt.Errorf("datastoredb: %v", err)
+	}
+	return nil
+}
+
+// inflateDescriptions reads back the offloaded descriptions of sessions, so
+// that lists and searches return them in full, as GetSession does.
+func (db *datastoreDB) inflateDescriptions(ctx context.Context, sessions []*Session) error {
+	for _, b := range sessions {
+		if err := db.inflateDescription(ctx, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getBatchSize is the number of sessions fetched per GetMulti call by
+// GetSessionsOrdered, the most Datastore accepts at once.
+const getBatchSize = 1000
+
+// GetSessionsOrdered retrieves the sessions with the given IDs, in the same
+// order as ids, skipping IDs with no session. GetMulti returns entities in
+// key order, so no reordering is needed beyond dropping the missing ones.
+func (db *datastoreDB) GetSessionsOrdered(ctx context.Context, ids []int64) ([]*Session, error) {
+	sessions := make([]*Session, 0, len(ids))
+	for start := 0; start < len(ids); start += getBatchSize {
+		end := start + getBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+
+		keys := make([]*datastore.Key, len(batch))
+		for i, id := range batch {
+			keys[i] = db.datastoreKey(id)
+		}
+		found := make([]*Session, len(batch))
+		for i := range found {
+			found[i] = &Session{}
+		}
+		err := db.client.GetMulti(ctx, keys, found)
+		multiErr, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
+			return nil, fmt.Errorf("datastoredb: could not get sessions: %v", err)
+		}
+		for i, s := range found {
+			if multiErr != nil && multiErr[i] != nil {
+				if multiErr[i] == datastore.ErrNoSuchEntity {
+					continue
+				}
+				return nil, fmt.Errorf("datastoredb: could not get Session %d: %v", batch[i], multiErr[i])
+			}
+			s.ID = batch[i]
+			sessions = append(sessions, s)
+		}
+	}
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// GetSessionBySlug retrieves a session by its slug, using the built-in index
+// on the Slug property.
+func (db *datastoreDB) GetSessionBySlug(ctx context.Context, slug string) (*Session, error) {
+	var sessions []*Session
+	q := datastore.NewQuery("Session").
+		Filter("Slug =", slug).
+		Limit(1)
+	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not get Session by slug: %v", err)
+	}
+	if len(sessions) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	sessions[0].ID = keys[0].ID
+	if err := db.inflateDescription(ctx, sessions[0]); err != nil {
+		return nil, err
+	}
+	return sessions[0], nil
+}
+
+// GetSessionByPublicID retrieves a session by its public ID, using the
+// built-in index on the PublicID property.
+func (db *datastoreDB) GetSessionByPublicID(ctx context.Context, publicID string) (*Session, error) {
+	if publicID == "" {
+		return nil, ErrSessionNotFound
+	}
+	var sessions []*Session
+	q := datastore.NewQuery("Session").
+		Filter("PublicID =", publicID).
+		Limit(1)
+	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not get Session by public ID: %v", err)
+	}
+	if len(sessions) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	sessions[0].ID = keys[0].ID
+	if err := db.inflateDescription(ctx, sessions[0]); err != nil {
+		return nil, err
+	}
+	return sessions[0], nil
+}
+
+// LookupByContentHash returns a session whose uploaded file has the given
+// content hash, using the built-in index on the ContentHash property.
+func (db *datastoreDB) LookupByContentHash(ctx context.Context, hash string) (*Session, error) {
+	if hash == "" {
+		return nil, ErrSessionNotFound
+	}
+	var sessions []*Session
+	q := datastore.NewQuery("Session").
+		Filter("ContentHash =", hash).
+		Limit(1)
+	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not look up content hash: %v", err)
+	}
+	if len(sessions) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	sessions[0].ID = keys[0].ID
+	if err := db.inflateDescription(ctx, sessions[0]); err != nil {
+		return nil, err
+	}
+	return sessions[0], nil
+}
+
+// SessionExists reports whether a session with the given ID exists, using a
+// keys-only query so the entity itself is never fetched.
+func (db *datastoreDB) SessionExists(ctx context.Context, id int64) (bool, error) {
+	q := datastore.NewQuery("Session").
+		Filter("__key__ =", db.datastoreKey(id)).
+		KeysOnly()
+	n, err := db.client.Count(ctx, q)
+	if err != nil {
+		return false, fmt.Errorf("datastoredb: could not check Session: %v", err)
+	}
+	return n > 0, nil
+}
+
 // AddSession saves a given session, assigning it a new ID.
 func (db *datastoreDB) AddSession(b *Session) (id int64, err error) {
 	ctx := context.Background()
-	k := datastore.IncompleteKey("Session", nil)
-	k, err = db.client.Put(ctx, k, b)
+
+	end, err := db.endPosition(ctx)
+	if err != nil {
+		return 0, err
+	}
+	b.CreatedAt = time.Now()
+	b.UpdatedAt = b.CreatedAt
+	b.Random = rand.Float64()
+	setPublicID(b)
+	setMonthDay(b)
+	setGeoHash(b)
+	if err := db.setSlug(ctx, b); err != nil {
+		return 0, err
+	}
+	ref, err := db.storeDescription(ctx, b)
+	if err != nil {
+		return 0, err
+	}
+	keys, err := db.client.AllocateIDs(ctx, []*datastore.Key{datastore.IncompleteKey("Session", nil)})
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not allocate Session ID: %v", err)
+	}
+	// A zero ID would make the session unreachable through GetSession.
+	if keys[0].ID == 0 {
+		return 0, fmt.Errorf("datastoredb: allocated key %v without a numeric ID", keys[0])
+	}
+	b.ID = keys[0].ID
+	// New sessions go to the end of the playlist order, which is taken in
+	// the same transaction as the put so that concurrent adds don't share a
+	// position.
+	_, err = db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := takePosition(tx, b, end); err != nil {
+			return err
+		}
+		if _, err := tx.Put(keys[0], descriptionEntity(b, ref)); err != nil {
+			return err
+		}
+		return db.indexExternalID(tx, nil, b)
+	})
 	if err != nil {
+		b.ID = 0
 		return 0, fmt.Errorf("datastoredb: could not put Session: %v", err)
 	}
-	return k.ID, nil
+	return keys[0].ID, nil
+}
+
+// positionKind is the kind of the single entity recording the position the
+// next added session gets. Datastore transactions can't query for the last
+// position, so adds read and advance this by key instead, which makes
+// concurrent adds conflict and retry rather than take the same position.
+const positionKind = "SessionPosition"
+
+// positionEntry is the entity of positionKind.
+type positionEntry struct {
+	Next int
+}
+
+var positionKey = datastore.NameKey(positionKind, "next", nil)
+
+// endPosition returns the position after that of the last session. It is
+// found by a query, so it can't be read in a transaction; takePosition only
+// uses it for sessions added before the positionKind entity existed.
+func (db *datastoreDB) endPosition(ctx context.Context) (int, error) {
+	var last []*Session
+	q := datastore.NewQuery("Session").Order("-Position").Limit(1)
+	if _, err := db.client.GetAll(ctx, q, &last); ignoreFieldMismatch(err) != nil {
+		return 0, fmt.Errorf("datastoredb: could not find last position: %v", err)
+	}
+	if len(last) == 0 {
+		return 0, nil
+	}
+	return last[0].Position + 1, nil
+}
+
+// takePosition gives b the next position in tx, or end if that is later, and
+// advances the positionKind entity past it.
+func takePosition(tx *datastore.Transaction, b *Session, end int) error {
+	var p positionEntry
+	if err := tx.Get(positionKey, &p); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if p.Next < end {
+		p.Next = end
+	}
+	b.Position = p.Next
+	p.Next++
+	_, err := tx.Put(positionKey, &p)
+	return err
 }
 
-// DeleteSession removes a given session by its ID.
+// externalIDKind is the kind of the entities recording which session has
+// each external ID, keyed by the external ID. Datastore transactions can't
+// query on ExternalID, so UpsertSessionByExternalID reads and writes these
+// by key instead, which makes the check and the write atomic. Every write
+// that adds, changes or removes an ExternalID updates them in the same
+// transaction, as memoryDB does its index.
+const externalIDKind = "SessionExternalID"
+
+// externalIDEntry is an entity of externalIDKind.
+type externalIDEntry struct {
+	SessionID int64
+}
+
+// indexExternalID updates the externalIDKind entries in tx for b replacing
+// old, as memoryDB.indexExternalID does; either may be nil. The entry of
+// old's external ID is only removed if it still points to old.
+func (db *datastoreDB) indexExternalID(tx *datastore.Transaction, old, b *Session) error {
+	if old != nil && old.ExternalID != "" && (b == nil || b.ExternalID != old.ExternalID) {
+		k := datastore.NameKey(externalIDKind, old.ExternalID, nil)
+		var entry externalIDEntry
+		err := tx.Get(k, &entry)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && entry.SessionID == old.ID {
+			if err := tx.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	if b != nil && b.ExternalID != "" {
+		k := datastore.NameKey(externalIDKind, b.ExternalID, nil)
+		if _, err := tx.Put(k, &externalIDEntry{SessionID: b.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpsertSessionByExternalID adds b, or replaces the session with the same
+// ExternalID, in one transaction.
+func (db *datastoreDB) UpsertSessionByExternalID(ctx context.Context, b *Session) (int64, bool, error) {
+	if b.ExternalID == "" {
+		return 0, false, ErrNoExternalID
+	}
+
+	// Prepare b for being added, in case it's new: queries can't run in
+	// the transaction, and neither can allocating an ID.
+	end, err := db.endPosition(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	keys, err := db.client.AllocateIDs(ctx, []*datastore.Key{datastore.IncompleteKey("Session", nil)})
+	if err != nil {
+		return 0, false, fmt.Errorf("datastoredb: could not allocate Session ID: %v", err)
+	}
+	newKey := keys[0]
+	entryKey := datastore.NameKey(externalIDKind, b.ExternalID, nil)
+	ref, err := db.storeDescription(ctx, b)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var created bool
+	_, err = db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		created = false
+		var entry externalIDEntry
+		if err := tx.Get(entryKey, &entry); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		} else if err == nil {
+			k := db.datastoreKey(entry.SessionID)
+			old := &Session{}
+			err := tx.Get(k, old)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			// A missing session was deleted since it was imported, so it
+			// is added again below.
+			if err == nil {
+				b.ID = entry.SessionID
+				b.CreatedAt, b.Position, b.Random = old.CreatedAt, old.Position, old.Random
+				b.Favorites, b.ViewCount = old.Favorites, old.ViewCount
+				b.PublicID = old.PublicID
+				setPublicID(b)
+				setMonthDay(b)
+				setGeoHash(b)
+				if old.Title == b.Title && old.Slug != "" {
+					b.Slug = old.Slug
+				} else if err := db.setSlug(ctx, b); err != nil {
+					return err
+				}
+				b.UpdatedAt = time.Now()
+				_, err := tx.Put(k, descriptionEntity(b, ref))
+				return err
+			}
+		}
+
+		created = true
+		b.ID = newKey.ID
+		if err := takePosition(tx, b, end); err != nil {
+			return err
+		}
+		b.CreatedAt = time.Now()
+		b.UpdatedAt = b.CreatedAt
+		b.Random = rand.Float64()
+		setPublicID(b)
+		setMonthDay(b)
+		setGeoHash(b)
+		if err := db.setSlug(ctx, b); err != nil {
+			return err
+		}
+		if _, err := tx.Put(newKey, descriptionEntity(b, ref)); err != nil {
+			return err
+		}
+		_, err := tx.Put(entryKey, &externalIDEntry{SessionID: newKey.ID})
+		return err
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("datastoredb: could not upsert Session %q: %v", b.ExternalID, err)
+	}
+	return b.ID, created, nil
+}
+
+// DeleteSession removes a given session by its ID, and the record of its
+// external ID, in one transaction.
 func (db *datastoreDB) DeleteSession(id int64) error {
 	ctx := context.Background()
 	k := db.datastoreKey(id)
-	if err := db.client.Delete(ctx, k); err != nil {
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		old := &Session{}
+		err := ignoreFieldMismatch(tx.Get(k, old))
+		if err == datastore.ErrNoSuchEntity {
+			// Deleting a missing session is not an error.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		old.ID = id
+		if err := db.indexExternalID(tx, old, nil); err != nil {
+			return err
+		}
+		return tx.Delete(k)
+	})
+	if err != nil {
 		return fmt.Errorf("datastoredb: could not delete Session: %v", err)
 	}
 	return nil
 }
 
-// UpdateSession updates the entry for a given session.
+// deleteBatchSize is the number of sessions removed per DeleteMulti call by
+// DeleteSessions, the most Datastore accepts at once.
+const deleteBatchSize = 500
+
+// DeleteSessions removes the sessions with the given IDs in batches. Sessions
+// are looked up first, since Datastore silently ignores deletes of missing
+// entities.
+func (db *datastoreDB) DeleteSessions(ctx context.Context, ids []int64) (deleted int, errs map[int64]error) {
+	errs = make(map[int64]error)
+	for start := 0; start < len(ids); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+
+		keys := make([]*datastore.Key, len(batch))
+		for i, id := range batch {
+			keys[i] = db.datastoreKey(id)
+		}
+		sessions := make([]Session, len(batch))
+		err := db.client.GetMulti(ctx, keys, sessions)
+		multiErr, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
+			for _, id := range batch {
+				errs[id] = fmt.Errorf("datastoredb: could not get Session: %v", err)
+			}
+			continue
+		}
+
+		var existing []*datastore.Key
+		var indexed []*Session
+		for i, id := range batch {
+			switch {
+			case multiErr == nil || multiErr[i] == nil:
+				existing = append(existing, keys[i])
+				if sessions[i].ExternalID != "" {
+					sessions[i].ID = id
+					indexed = append(indexed, &sessions[i])
+				}
+			case multiErr[i] == datastore.ErrNoSuchEntity:
+				errs[id] = ErrSessionNotFound
+			default:
+				errs[id] = fmt.Errorf("datastoredb: could not get Session: %v", multiErr[i])
+			}
+		}
+		if len(existing) == 0 {
+			continue
+		}
+		if err := db.client.DeleteMulti(ctx, existing); err != nil {
+			for _, k := range existing {
+				errs[k.ID] = fmt.Errorf("datastoredb: could not delete Session: %v", err)
+			}
+			continue
+		}
+		deleted += len(existing)
+		for _, s := range indexed {
+			_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+				return db.indexExternalID(tx, s, nil)
+			})
+			if err != nil {
+				log.Printf("datastoredb: could not remove external ID %q of deleted Session %d: %v", s.ExternalID, s.ID, err)
+			}
+		}
+	}
+	if len(errs) == 0 {
+		errs = nil
+	}
+	return deleted, errs
+}
+
+// UpdateSession updates the entry for a given session. The stored session
+// is read and written in one transaction, so the counters, claim and lock
+// kept from it aren't lost to concurrent writes.
 func (db *datastoreDB) UpdateSession(b *Session) error {
 	ctx := context.Background()
 	k := db.datastoreKey(b.ID)
-	if _, err := db.client.Put(ctx, k, b); err != nil {
+
+	ref, err := db.storeDescription(ctx, b)
+	if err != nil {
+		return err
+	}
+	edit := *b
+	_, err = db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		// The transaction may be retried, so start each attempt from the
+		// edit as given.
+		*b = edit
+		old := &Session{}
+		err := tx.Get(k, old)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil {
+			// An offloaded description is stored under the hash of its
+			// text, so it is unchanged if b's description hashes to the
+			// same name.
+			if old.DescriptionRef != "" && old.DescriptionRef == descriptionObjectName(b.Description) {
+				old.Description = b.Description
+			}
+			keepSize(b, old)
+			b.ChangedFields = ChangedFields(old, b)
+		}
+		// Keep the slug unless the title changed, so that shared links
+		// still work after other edits.
+		if err == nil && old.Title == b.Title && old.Slug != "" {
+			b.Slug = old.Slug
+		} else if err := db.setSlug(ctx, b); err != nil {
+			return err
+		}
+		// Edits don't carry Random; sessions added before it existed get
+		// one on their first edit.
+		if b.Random == 0 {
+			b.Random = old.Random
+		}
+		if b.Random == 0 {
+			b.Random = rand.Float64()
+		}
+		// Edits don't carry the counters, the creation time or the
+		// playlist position, which are kept from the stored session;
+		// positions only change through MoveSession and ReorderSessions.
+		b.Favorites, b.ViewCount = old.Favorites, old.ViewCount
+		b.CreatedAt, b.Position = old.CreatedAt, old.Position
+		// Nor do they carry the public ID, which never changes once set,
+		// or the claim of a worker processing the session, or the edit
+		// lock.
+		b.PublicID = old.PublicID
+		keepClaim(b, old)
+		keepLock(b, old)
+		setPublicID(b)
+		setMonthDay(b)
+		setGeoHash(b)
+		b.UpdatedAt = time.Now()
+
+		if _, err := tx.Put(k, descriptionEntity(b, ref)); err != nil {
+			return err
+		}
+		old.ID = b.ID
+		return db.indexExternalID(tx, old, b)
+	})
+	if err != nil {
 		return fmt.Errorf("datastoredb: could not update Session: %v", err)
 	}
 	return nil
 }
 
+// TouchSession sets the UpdatedAt time of a session to now, reading and
+// writing it in one transaction so concurrent edits aren't lost.
+func (db *datastoreDB) TouchSession(ctx context.Context, id int64) error {
+	k := db.datastoreKey(id)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		b := &Session{}
+		if err := tx.Get(k, b); err == datastore.ErrNoSuchEntity {
+			return ErrSessionNotFound
+		} else if err != nil {
+			return err
+		}
+		b.UpdatedAt = time.Now()
+		_, err := tx.Put(k, b)
+		return err
+	})
+	if err == ErrSessionNotFound {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not touch Session %d: %v", id, err)
+	}
+	return nil
+}
+
+// IncrementViewCount adds n to the ViewCount of a session in a transaction.
+func (db *datastoreDB) IncrementViewCount(ctx context.Context, id int64, n int64) error {
+	k := db.datastoreKey(id)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		b := &Session{}
+		if err := tx.Get(k, b); err == datastore.ErrNoSuchEntity {
+			return ErrSessionNotFound
+		} else if err != nil {
+			return err
+		}
+		b.ViewCount += n
+		_, err := tx.Put(k, b)
+		return err
+	})
+	if err == ErrSessionNotFound {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not count views of Session %d: %v", id, err)
+	}
+	return nil
+}
+
+// claimCandidates is the number of claimable sessions ClaimNextUnprocessed
+// looks up before trying to claim them one by one.
+const claimCandidates = 10
+
+// ClaimNextUnprocessed claims a claimable session for workerID, trying those
+// whose claims expired longest ago first. Queries without an ancestor can't
+// run inside a transaction, so candidates are looked up first and each is
+// re-read and claimed in a transaction, skipping those another worker
+// claimed in the meantime.
+//
+// Sessions stored before claims existed lack the ClaimExpiry and ProcessedAt
+// properties, so aren't found until they are next saved.
+func (db *datastoreDB) ClaimNextUnprocessed(ctx context.Context, workerID string, lease time.Duration) (*Session, error) {
+	if !validClaim(workerID, lease) {
+		return nil, fmt.Errorf("datastoredb: bad claim by %q for %v", workerID, lease)
+	}
+
+	q := datastore.NewQuery("Session").
+		Filter("ProcessedAt =", time.Time{}).
+		Filter("ClaimExpiry <=", time.Now()).
+		Order("ClaimExpiry").
+		KeysOnly().
+		Limit(claimCandidates)
+	keys, err := db.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list unprocessed sessions: %v", err)
+	}
+
+	for _, k := range keys {
+		var claimed *Session
+		_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			claimed = nil
+			b := &Session{}
+			if err := tx.Get(k, b); err == datastore.ErrNoSuchEntity {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			now := time.Now()
+			if !claimable(b, now) {
+				return nil
+			}
+			b.ClaimedBy, b.ClaimExpiry = workerID, now.Add(lease)
+			if _, err := tx.Put(k, b); err != nil {
+				return err
+			}
+			claimed = b
+			return nil
+		})
+		if err == datastore.ErrConcurrentTransaction {
+			// Another worker is claiming it.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not claim Session %d: %v", k.ID, err)
+		}
+		if claimed == nil {
+			continue
+		}
+		claimed.ID = k.ID
+		if err := db.inflateDescription(ctx, claimed); err != nil {
+			return nil, err
+		}
+		return claimed, nil
+	}
+	return nil, ErrNothingToClaim
+}
+
+// ReleaseClaim clears the claim of workerID on a session in a transaction.
+func (db *datastoreDB) ReleaseClaim(ctx context.Context, id int64, workerID string) error {
+	k := db.datastoreKey(id)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		b := &Session{}
+		if err := tx.Get(k, b); err == datastore.ErrNoSuchEntity {
+			return ErrSessionNotFound
+		} else if err != nil {
+			return err
+		}
+		if b.ClaimedBy != workerID || !b.ClaimExpiry.After(time.Now()) {
+			return ErrClaimNotHeld
+		}
+		b.ClaimedBy, b.ClaimExpiry = "", time.Time{}
+		_, err := tx.Put(k, b)
+		return err
+	})
+	if err == ErrSessionNotFound || err == ErrClaimNotHeld {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not release Session %d: %v", id, err)
+	}
+	return nil
+}
+
+// MarkProcessed sets the ProcessedAt time of a session to now and clears its
+// claim in a transaction.
+func (db *datastoreDB) MarkProcessed(ctx context.Context, id int64) error {
+	k := db.datastoreKey(id)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		b := &Session{}
+		if err := tx.Get(k, b); err == datastore.ErrNoSuchEntity {
+			return ErrSessionNotFound
+		} else if err != nil {
+			return err
+		}
+		b.ProcessedAt = time.Now()
+		b.ClaimedBy, b.ClaimExpiry = "", time.Time{}
+		_, err := tx.Put(k, b)
+		return err
+	})
+	if err == ErrSessionNotFound {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not mark Session %d processed: %v", id, err)
+	}
+	return nil
+}
+
+// LockSession acquires or renews the edit lock of userID on a session in a
+// transaction.
+func (db *datastoreDB) LockSession(ctx context.Context, id int64, userID, name string, ttl time.Duration) error {
+	if !validLock(userID, ttl) {
+		return fmt.Errorf("datastoredb: bad lock by %q for %v", userID, ttl)
+	}
+
+	k := db.datastoreKey(id)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		b := &Session{}
+		if err := tx.Get(k, b); err == datastore.ErrNoSuchEntity {
+			return ErrSessionNotFound
+		} else if err != nil {
+			return err
+		}
+		now := time.Now()
+		if b.LockedByOther(userID, now) {
+			return ErrSessionLocked
+		}
+		b.LockedBy, b.LockedByName, b.LockExpiry = userID, name, now.Add(ttl)
+		_, err := tx.Put(k, b)
+		return err
+	})
+	if err == ErrSessionNotFound || err == ErrSessionLocked {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not lock Session %d: %v", id, err)
+	}
+	return nil
+}
+
+// UnlockSession releases the edit lock of userID on a session in a
+// transaction.
+func (db *datastoreDB) UnlockSession(ctx context.Context, id int64, userID string) error {
+	k := db.datastoreKey(id)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		b := &Session{}
+		if err := tx.Get(k, b); err == datastore.ErrNoSuchEntity {
+			return ErrSessionNotFound
+		} else if err != nil {
+			return err
+		}
+		if b.LockedBy != userID {
+			return nil
+		}
+		b.LockedBy, b.LockedByName, b.LockExpiry = "", "", time.Time{}
+		_, err := tx.Put(k, b)
+		return err
+	})
+	if err == ErrSessionNotFound {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not unlock Session %d: %v", id, err)
+	}
+	return nil
+}
+
+// setSlug assigns b a slug derived from its title that no other session uses.
+// Two sessions with the same title saved concurrently may still end up with
+// the same slug; GetSessionBySlug then returns one of them.
+func (db *datastoreDB) setSlug(ctx context.Context, b *Session) error {
+	return db.setSlugAvoiding(ctx, b, nil)
+}
+
+// setSlugAvoiding is setSlug, also avoiding the slugs in assigned, which
+// writes that aren't committed yet are about to give other sessions. The
+// slug chosen is added to assigned if it isn't nil.
+func (db *datastoreDB) setSlugAvoiding(ctx context.Context, b *Session, assigned map[string]bool) error {
+	slug, err := uniqueSlug(b.Title, func(slug string) (bool, error) {
+		if assigned[slug] {
+			return true, nil
+		}
+		q := datastore.NewQuery("Session").
+			Filter("Slug =", slug).
+			KeysOnly()
+		keys, err := db.client.GetAll(ctx, q, nil)
+		if err != nil {
+			return false, err
+		}
+		for _, k := range keys {
+			if k.ID != b.ID {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not check slug: %v", err)
+	}
+	b.Slug = slug
+	if assigned != nil {
+		assigned[slug] = true
+	}
+	return nil
+}
+
 // ListSessions returns a list of sessions, ordered by title.
 func (db *datastoreDB) ListSessions() ([]*Session, error) {
 	ctx := context.Background()
 	sessions := make([]*Session, 0)
 	q := datastore.NewQuery("Session").
-		Order("Title")
+		Order("Title").
+		Order("__key__")
 
 	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
 
 	if err != nil {
 		return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
@@ -105,23 +916,491 @@ func (db *datastoreDB) ListSessions() ([]*Session, error) {
 		sessions[i].ID = k.ID
 	}
 
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
 	return sessions, nil
 }
 
-// ListSessionsCreatedBy returns a list of sessions, ordered by title, filtered by
-// the user who created the session entry.
-func (db *datastoreDB) ListSessionsCreatedBy(userID string) ([]*Session, error) {
-	ctx := context.Background()
-	if userID == "" {
+// snapshotMaxSessions is the most sessions ListSessionsAtSnapshot reads.
+// Snapshots are read in one transaction, which Datastore expires after 270
+// seconds (or 60 seconds idle), so larger databases must be streamed instead.
+const snapshotMaxSessions = 20000
+
+// ListSessionsAtSnapshot returns all sessions, ordered by title, as they were
+// when the snapshot was taken. Datastore only allows ancestor queries in
+// transactions, so the keys are listed first, then the sessions are read in a
+// read-only transaction, which sees them all at the same point in time.
+// Sessions added between the two steps are not included.
+func (db *datastoreDB) ListSessionsAtSnapshot(ctx context.Context) ([]*Session, error) {
+	keys, err := db.client.GetAll(ctx, datastore.NewQuery("Session").KeysOnly(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+	}
+	if len(keys) > snapshotMaxSessions {
+		return nil, ErrSnapshotTooLarge
+	}
+
+	tx, err := db.client.NewTransaction(ctx, datastore.ReadOnly)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not start snapshot: %v", err)
+	}
+	defer tx.Rollback()
+
+	sessions := make([]*Session, 0, len(keys))
+	for start := 0; start < len(keys); start += getBatchSize {
+		end := start + getBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+
+		found := make([]*Session, len(batch))
+		for i := range found {
+			found[i] = &Session{}
+		}
+		err := tx.GetMulti(batch, found)
+		multiErr, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
+			return nil, fmt.Errorf("datastoredb: could not read snapshot: %v", err)
+		}
+		for i, s := range found {
+			if multiErr != nil && multiErr[i] != nil {
+				if multiErr[i] == datastore.ErrNoSuchEntity {
+					// Deleted before the snapshot was taken.
+					continue
+				}
+				return nil, fmt.Errorf("datastoredb: could not read Session %d: %v", batch[i].ID, multiErr[i])
+			}
+			s.ID = batch[i].ID
+			sessions = append(sessions, s)
+		}
+	}
+
+	sort.Sort(sessionsByTitle(sessions))
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// SearchSessions returns a page of the sessions matching query. Datastore has
+// no full-text search, so every session is read and filtered here: each
+// search costs a scan of the whole kind, however few sessions match.
+func (db *datastoreDB) SearchSessions(ctx context.Context, query string, limit, offset int) ([]*Session, error) {
+	if limit <= 0 || offset < 0 {
+		return nil, fmt.Errorf("datastoredb: bad page size %d or offset %d", limit, offset)
+	}
+	if len(searchTerms(query)) == 0 {
+		return []*Session{}, nil
+	}
+	sessions, err := db.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	return pageOf(filterSessions(sessions, query), limit, offset), nil
+}
+
+// SearchWithFacets returns the sessions matching query and tags, with the
+// counts of their other tags. The tags are matched by the query, so only
+// the sessions carrying them are read; the query terms are matched and
+// facets counted here, as in SearchSessions.
+func (db *datastoreDB) SearchWithFacets(ctx context.Context, query string, tags []string) ([]*Session, map[string]int, error) {
+	if len(searchTerms(query)) == 0 && len(tags) == 0 {
+		return []*Session{}, map[string]int{}, nil
+	}
+	q := datastore.NewQuery("Session")
+	for _, t := range tags {
+		q = q.Filter("Tags =", t)
+	}
+	sessions := make([]*Session, 0)
+	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("datastoredb: could not search sessions: %v", err)
+	}
+	for i, k := range keys {
+		sessions[i].ID = k.ID
+	}
+	// Ordering by title in the query would need an index for each number
+	// of tags.
+	sort.Sort(sessionsByTitle(sessions))
+
+	results, facets := facetSessions(sessions, query, tags)
+	if err := db.inflateDescriptions(ctx, results); err != nil {
+		return nil, nil, err
+	}
+	return results, facets, nil
+}
+
+// CountSearchSessions returns the number of sessions matching query. Like
+// SearchSessions, it scans every session.
+func (db *datastoreDB) CountSearchSessions(ctx context.Context, query string) (int, error) {
+	if len(searchTerms(query)) == 0 {
+		return 0, nil
+	}
+	sessions, err := db.ListSessions()
+	if err != nil {
+		return 0, err
+	}
+	return len(filterSessions(sessions, query)), nil
+}
+
+// ListSessionsPage returns up to limit sessions, ordered by title, following
+// the page that returned pageToken. Page tokens are Datastore query cursors.
+func (db *datastoreDB) ListSessionsPage(ctx context.Context, pageToken string, limit int) (*SessionList, error) {
+	q := datastore.NewQuery("Session").
+		Order("Title").
+		Order("__key__")
+	return db.runPage(ctx, q, pageToken, limit)
+}
+
+// ListSessionsByTagPage returns up to limit sessions carrying tag, ordered by
+// title, following the page that returned pageToken. It needs the composite
+// index on Tags, Title and __key__ in index.yaml.
+func (db *datastoreDB) ListSessionsByTagPage(ctx context.Context, tag string, limit int, pageToken string) ([]*Session, string, error) {
+	q := datastore.NewQuery("Session").
+		Filter("Tags =", tag).
+		Order("Title").
+		Order("__key__")
+	list, err := db.runPage(ctx, q, pageToken, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return list.Sessions, list.NextPageToken, nil
+}
+
+// runPage runs q for up to limit sessions, starting at the cursor pageToken,
+// and returns them with the cursor of the next page.
+func (db *datastoreDB) runPage(ctx context.Context, q *datastore.Query, pageToken string, limit int) (*SessionList, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("datastoredb: bad page size %d", limit)
+	}
+	if pageToken != "" {
+		cursor, err := datastore.DecodeCursor(pageToken)
+		if err != nil {
+			return nil, ErrBadPageToken
+		}
+		q = q.Start(cursor)
+	}
+
+	list := &SessionList{Sessions: []*Session{}}
+	it := db.client.Run(ctx, q.Limit(limit+1))
+	var next datastore.Cursor
+	for {
+		s := &Session{}
+		k, err := it.Next(s)
+		err = ignoreFieldMismatch(err)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+		}
+		if len(list.Sessions) == limit {
+			// There are more sessions, so the next page starts after the
+			// last one on this page.
+			list.NextPageToken = next.String()
+			break
+		}
+		s.ID = k.ID
+		list.Sessions = append(list.Sessions, s)
+		if next, err = it.Cursor(); err != nil {
+			return nil, fmt.Errorf("datastoredb: could not get cursor: %v", err)
+		}
+	}
+	if err := db.inflateDescriptions(ctx, list.Sessions); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// IterateSessions calls fn for each session in title order, fetching them in
+// batches as the query runs.
+func (db *datastoreDB) IterateSessions(ctx context.Context, fn func(*Session) error) error {
+	q := datastore.NewQuery("Session").
+		Order("Title").
+		Order("__key__")
+	it := db.client.Run(ctx, q)
+	for {
+		s := &Session{}
+		k, err := it.Next(s)
+		err = ignoreFieldMismatch(err)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("datastoredb: could not list sessions: %v", err)
+		}
+		s.ID = k.ID
+		if err := db.inflateDescription(ctx, s); err != nil {
+			return err
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+}
+
+// ListSessionsFor returns the sessions v may see listed, ordered by title.
+// Sessions saved before Visibility was added have no such property, so they
+// can't be matched by a query filter; the sessions are filtered here instead,
+// which reads no more than ListSessions.
+func (db *datastoreDB) ListSessionsFor(ctx context.Context, v Viewer) ([]*Session, error) {
+	sessions, err := db.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	visible := sessions[:0]
+	for _, b := range sessions {
+		if v.CanList(b) {
+			visible = append(visible, b)
+		}
+	}
+	return visible, nil
+}
+
+// ListSessionSummaries returns the summaries of all sessions, ordered by
+// title. It reads them with a projection query, which only returns entities
+// with every projected property indexed, so Title, Author, ThumbnailURL and
+// CreatedByID must not be made noindex, and needs the composite index in
+// index.yaml. Visibility isn't projected, as sessions saved before it was
+// added lack the property and would be left out; the few sessions that
+// aren't public are found with keys-only queries instead. PublicID isn't
+// projected for the same reason, and is read with a projection of its own.
+func (db *datastoreDB) ListSessionSummaries(ctx context.Context) ([]*SessionSummary, error) {
+	q := datastore.NewQuery("Session").
+		Project("Title", "Author", "ThumbnailURL", "CreatedByID").
+		Order("Title").
+		Order("__key__")
+	summaries := make([]*SessionSummary, 0)
+	keys, err := db.client.GetAll(ctx, q, &summaries)
+	err = ignoreFieldMismatch(err)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list session summaries: %v", err)
+	}
+
+	visibility := make(map[int64]string)
+	for _, v := range []string{VisibilityUnlisted, VisibilityPrivate} {
+		q := datastore.NewQuery("Session").
+			Filter("Visibility =", v).
+			KeysOnly()
+		hidden, err := db.client.GetAll(ctx, q, nil)
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not list %s sessions: %v", v, err)
+		}
+		for _, k := range hidden {
+			visibility[k.ID] = v
+		}
+	}
+
+	publicIDs := make(map[int64]string)
+	var withIDs []*Session
+	q = datastore.NewQuery("Session").
+		Project("PublicID").
+		Filter("PublicID >", "")
+	idKeys, err := db.client.GetAll(ctx, q, &withIDs)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list session public IDs: %v", err)
+	}
+	for i, k := range idKeys {
+		publicIDs[k.ID] = withIDs[i].PublicID
+	}
+
+	for i, k := range keys {
+		summaries[i].ID = k.ID
+		summaries[i].PublicID = publicIDs[k.ID]
+		summaries[i].Visibility = visibility[k.ID]
+	}
+	return summaries, nil
+}
+
+// ListSessionsSorted returns all sessions in the given order. Datastore
+// leaves entities without the sorted property out of ordered queries, so
+// sessions saved before Favorites and ViewCount existed aren't listed by
+// popularity until they are next saved.
+func (db *datastoreDB) ListSessionsSorted(ctx context.Context, order string) ([]*Session, error) {
+	q := datastore.NewQuery("Session")
+	switch order {
+	case SortByTitle:
 		return db.ListSessions()
+	case SortByFavorites:
+		q = q.Order("-Favorites")
+	case SortByViews:
+		q = q.Order("-ViewCount")
+	default:
+		return nil, ErrBadSortOrder
+	}
+	q = q.Order("Title").Order("__key__")
+
+	sessions := make([]*Session, 0)
+	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+	}
+	for i, k := range keys {
+		sessions[i].ID = k.ID
+	}
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// createdByOrders maps the orders accepted by ListSessionsCreatedBy to the
+// properties sorted on.
+var createdByOrders = map[string]string{
+	SortByTitle:   "Title",
+	SortByCreated: "CreatedAt",
+	SortByUpdated: "UpdatedAt",
+}
+
+// ListSessionsCreatedBy returns a list of sessions, filtered by the user who
+// created the session entry, in the given order. The key is the tie-breaker,
+// so each order needs a composite index in index.yaml.
+func (db *datastoreDB) ListSessionsCreatedBy(ctx context.Context, userID, order string, desc bool) ([]*Session, error) {
+	prop, ok := createdByOrders[order]
+	if !ok {
+		return nil, ErrBadSortOrder
+	}
+	dir := ""
+	if desc {
+		dir = "-"
+	}
+
+	sessions := make([]*Session, 0)
+	q := datastore.NewQuery("Session")
+	if userID != "" {
+		q = q.Filter("CreatedByID =", userID)
+	}
+	q = q.Order(dir + prop).Order(dir + "__key__")
+
+	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
+
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+	}
+
+	for i, k := range keys {
+		sessions[i].ID = k.ID
+	}
+
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// CountSessionsCreatedBy returns the number of sessions created by the given
+// user.
+func (db *datastoreDB) CountSessionsCreatedBy(ctx context.Context, userID string) (int, error) {
+	q := datastore.NewQuery("Session").KeysOnly()
+	if userID != "" {
+		q = q.Filter("CreatedByID =", userID)
+	}
+	n, err := db.client.Count(ctx, q)
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not count sessions: %v", err)
+	}
+	return n, nil
+}
+
+// StorageUsageByUser returns the total SizeBytes of the sessions created by
+// each user, keyed by CreatedByID. It reads every session, as Datastore has
+// no aggregation queries.
+func (db *datastoreDB) StorageUsageByUser(ctx context.Context) (map[string]int64, error) {
+	usage := make(map[string]int64)
+	it := db.client.Run(ctx, datastore.NewQuery("Session"))
+	for {
+		var s Session
+		_, err := it.Next(&s)
+		err = ignoreFieldMismatch(err)
+		if err == iterator.Done {
+			return usage, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+		}
+		usage[s.CreatedByID] += s.SizeBytes
+	}
+}
+
+// ListSessionsByPosition returns a list of sessions, ordered by position.
+func (db *datastoreDB) ListSessionsByPosition(ctx context.Context) ([]*Session, error) {
+	sessions := make([]*Session, 0)
+	q := datastore.NewQuery("Session").
+		Order("Position").
+		Order("__key__")
+
+	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
+
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+	}
+
+	for i, k := range keys {
+		sessions[i].ID = k.ID
+	}
+
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// ListSessionsByPresenter returns the sessions the named person presents,
+// ordered by title. Datastore can't query for either of two properties, so
+// the sessions they are the Author of and those listing them in Presenters,
+// an equality filter on the repeated property, are fetched separately and
+// merged.
+func (db *datastoreDB) ListSessionsByPresenter(ctx context.Context, presenter string) ([]*Session, error) {
+	if presenter == "" {
+		return []*Session{}, nil
+	}
+
+	seen := make(map[int64]bool)
+	sessions := make([]*Session, 0)
+	for _, property := range []string{"Author =", "Presenters ="} {
+		var found []*Session
+		keys, err := db.client.GetAll(ctx, datastore.NewQuery("Session").Filter(property, presenter), &found)
+		err = ignoreFieldMismatch(err)
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not list sessions by presenter: %v", err)
+		}
+		for i, k := range keys {
+			if seen[k.ID] {
+				continue
+			}
+			seen[k.ID] = true
+			found[i].ID = k.ID
+			sessions = append(sessions, found[i])
+		}
+	}
+
+	sort.Sort(sessionsByTitle(sessions))
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
 	}
+	return sessions, nil
+}
 
+// ListSessionsCreatedBetween returns the sessions added between from and to,
+// inclusive, ordered by creation time. Datastore requires the first sort
+// order to be on the property used in inequality filters, so ordering by
+// CreatedAt needs no composite index.
+func (db *datastoreDB) ListSessionsCreatedBetween(ctx context.Context, from, to time.Time) ([]*Session, error) {
 	sessions := make([]*Session, 0)
 	q := datastore.NewQuery("Session").
-		Filter("CreatedByID =", userID).
-		Order("Title")
+		Filter("CreatedAt >=", from).
+		Filter("CreatedAt <=", to).
+		Order("CreatedAt").
+		Order("__key__")
 
 	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
 
 	if err != nil {
 		return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
@@ -131,5 +1410,681 @@ func (db *datastoreDB) ListSessionsCreatedBy(userID string) ([]*Session, error)
 		sessions[i].ID = k.ID
 	}
 
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// ListRecentSessions returns the limit most recently added sessions, newest
+// first.
+func (db *datastoreDB) ListRecentSessions(ctx context.Context, limit int) ([]*Session, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("datastoredb: bad limit %d", limit)
+	}
+
+	sessions := make([]*Session, 0)
+	q := datastore.NewQuery("Session").
+		Order("-CreatedAt").
+		Order("-__key__").
+		Limit(limit)
+
+	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list recent sessions: %v", err)
+	}
+
+	for i, k := range keys {
+		sessions[i].ID = k.ID
+	}
+
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
 	return sessions, nil
 }
+
+// ListSessionsWithoutThumbnail returns up to limit sessions with a video but
+// no thumbnail, ordered by video URL, then by key. The filters need
+// ThumbnailURL and VideoURL indexed, and the composite index in index.yaml.
+func (db *datastoreDB) ListSessionsWithoutThumbnail(ctx context.Context, limit int) ([]*Session, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("datastoredb: bad limit %d", limit)
+	}
+
+	sessions := make([]*Session, 0)
+	q := datastore.NewQuery("Session").
+		Filter("ThumbnailURL =", "").
+		Filter("VideoURL >", "").
+		Order("VideoURL").
+		Order("__key__").
+		Limit(limit)
+
+	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list sessions without thumbnails: %v", err)
+	}
+
+	for i, k := range keys {
+		sessions[i].ID = k.ID
+	}
+
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// ListArchiveCounts returns the number of sessions published in each month.
+// Datastore has no grouping queries, so the months are counted here from a
+// projection of PublishedAt.
+func (db *datastoreDB) ListArchiveCounts(ctx context.Context) ([]ArchiveBucket, error) {
+	var sessions []*Session
+	q := datastore.NewQuery("Session").Project("PublishedAt")
+	if _, err := db.client.GetAll(ctx, q, &sessions); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+	}
+	return ArchiveBuckets(sessions), nil
+}
+
+// ListSessionsByMonth returns the sessions published in the given month,
+// ordered by publication time.
+func (db *datastoreDB) ListSessionsByMonth(ctx context.Context, year, month int) ([]*Session, error) {
+	start, end, err := monthRange(year, month)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: %v", err)
+	}
+
+	sessions := make([]*Session, 0)
+	q := datastore.NewQuery("Session")
+	if start.IsZero() {
+		q = q.Filter("PublishedAt =", time.Time{})
+	} else {
+		q = q.Filter("PublishedAt >=", start).
+			Filter("PublishedAt <", end)
+	}
+	q = q.Order("PublishedAt").
+		Order("__key__")
+
+	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
+
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+	}
+
+	for i, k := range keys {
+		sessions[i].ID = k.ID
+	}
+
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// ListSessionsNear returns up to limit sessions held within radiusKm of the
+// given point, nearest first. Datastore has no geographic queries, so it reads
+// the sessions whose stored GeoHash falls in the cells around the point and
+// checks their distance here. Sessions saved before GeoHash existed get it
+// from BackfillDerivedFields.
+func (db *datastoreDB) ListSessionsNear(ctx context.Context, lat, lng, radiusKm float64, limit int) ([]*Session, error) {
+	if !validNearQuery(lat, lng, radiusKm, limit) {
+		return nil, ErrBadLocation
+	}
+
+	var queries []*datastore.Query
+	prefixes := geoHashPrefixes(lat, lng, radiusKm)
+	for _, p := range prefixes {
+		// "{" sorts just after the last geohash character, "z".
+		queries = append(queries, datastore.NewQuery("Session").
+			Filter("GeoHash >=", p).
+			Filter("GeoHash <", p+"{"))
+	}
+	if prefixes == nil {
+		queries = append(queries, datastore.NewQuery("Session").Filter("GeoHash >", ""))
+	}
+
+	var candidates []*Session
+	for _, q := range queries {
+		var sessions []*Session
+		keys, err := db.client.GetAll(ctx, q, &sessions)
+		err = ignoreFieldMismatch(err)
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not list sessions near %v,%v: %v", lat, lng, err)
+		}
+		for i, k := range keys {
+			sessions[i].ID = k.ID
+		}
+		candidates = append(candidates, sessions...)
+	}
+
+	sessions := nearest(candidates, lat, lng, radiusKm, limit)
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// ListSessionsOnThisDay returns the sessions published on the month and day
+// of ref, in any year, most recently published first. It queries the stored
+// MonthDay, which sessions saved before it existed get from
+// BackfillDerivedFields.
+func (db *datastoreDB) ListSessionsOnThisDay(ctx context.Context, ref time.Time) ([]*Session, error) {
+	lo, hi := onThisDayRange(ref)
+
+	sessions := make([]*Session, 0)
+	q := datastore.NewQuery("Session").
+		Filter("MonthDay >=", lo).
+		Filter("MonthDay <=", hi)
+
+	keys, err := db.client.GetAll(ctx, q, &sessions)
+	err = ignoreFieldMismatch(err)
+
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+	}
+
+	for i, k := range keys {
+		sessions[i].ID = k.ID
+	}
+
+	sort.Sort(sort.Reverse(sessionsByPublishedAt(sessions)))
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// MoveSession moves a session to a new position, renumbering the other
+// sessions so that positions stay contiguous and unique.
+//
+// The renumbering is done in a single transaction, so it is subject to the
+// Datastore limit on the number of entities written per transaction.
+func (db *datastoreDB) MoveSession(ctx context.Context, id int64, newPosition int) error {
+	// Queries without an ancestor can't run inside a transaction, so look up
+	// the keys first and re-read the entities transactionally.
+	keys, err := db.client.GetAll(ctx, datastore.NewQuery("Session").KeysOnly(), nil)
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not list sessions: %v", err)
+	}
+
+	_, err = db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		sessions := make([]*Session, len(keys))
+		for i := range sessions {
+			sessions[i] = &Session{}
+		}
+		if err := tx.GetMulti(keys, sessions); err != nil {
+			return err
+		}
+		for i, k := range keys {
+			sessions[i].ID = k.ID
+		}
+
+		changed, err := moveSession(sessions, id, newPosition)
+		if err != nil {
+			return err
+		}
+		changedKeys := make([]*datastore.Key, len(changed))
+		for i, s := range changed {
+			changedKeys[i] = db.datastoreKey(s.ID)
+		}
+		_, err = tx.PutMulti(changedKeys, changed)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not move session: %v", err)
+	}
+	return nil
+}
+
+// ReorderSessions puts the sessions with the given IDs in that order,
+// renumbering the other sessions around them, in one transaction.
+//
+// Like MoveSession, it is subject to the Datastore limit on the number of
+// entities written per transaction.
+func (db *datastoreDB) ReorderSessions(ctx context.Context, ids []int64) error {
+	if len(ids) > MaxReorderSessions {
+		return fmt.Errorf("datastoredb: at most %d sessions can be reordered at once", MaxReorderSessions)
+	}
+	// Queries without an ancestor can't run inside a transaction, so look up
+	// the keys first and re-read the entities transactionally.
+	keys, err := db.client.GetAll(ctx, datastore.NewQuery("Session").KeysOnly(), nil)
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not list sessions: %v", err)
+	}
+
+	_, err = db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		sessions := make([]*Session, len(keys))
+		for i := range sessions {
+			sessions[i] = &Session{}
+		}
+		if err := tx.GetMulti(keys, sessions); err != nil {
+			return err
+		}
+		for i, k := range keys {
+			sessions[i].ID = k.ID
+		}
+
+		changed, err := reorderSessions(sessions, ids)
+		if err != nil {
+			return err
+		}
+		changedKeys := make([]*datastore.Key, len(changed))
+		for i, s := range changed {
+			changedKeys[i] = db.datastoreKey(s.ID)
+		}
+		_, err = tx.PutMulti(changedKeys, changed)
+		return err
+	})
+	if err == ErrSessionNotFound {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not reorder sessions: %v", err)
+	}
+	return nil
+}
+
+// backfillBatchSize is the number of sessions checked per transaction by
+// BackfillDerivedFields.
+const backfillBatchSize = 500
+
+// BackfillDerivedFields fills in missing derived fields of all sessions, a
+// batch of sessions per transaction, logging progress after each batch.
+// Queries don't see the slugs given earlier in the same batch, so the slugs
+// given during the run are tracked to keep same-titled sessions apart.
+func (db *datastoreDB) BackfillDerivedFields(ctx context.Context) (int, error) {
+	keys, err := db.client.GetAll(ctx, datastore.NewQuery("Session").KeysOnly(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+	}
+
+	assigned := make(map[string]bool)
+	updated := 0
+	for start := 0; start < len(keys); start += backfillBatchSize {
+		end := start + backfillBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+
+		n := 0
+		var batchSlugs map[string]bool
+		_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			n = 0
+			// Start from the committed slugs again if the transaction
+			// is retried.
+			batchSlugs = make(map[string]bool, len(assigned))
+			for slug := range assigned {
+				batchSlugs[slug] = true
+			}
+			sessions := make([]*Session, len(batch))
+			for i := range sessions {
+				sessions[i] = &Session{}
+			}
+			if err := tx.GetMulti(batch, sessions); err != nil {
+				return err
+			}
+
+			var changedKeys []*datastore.Key
+			var changed []*Session
+			for i, b := range sessions {
+				b.ID = batch[i].ID
+				c := fillDerivedFields(b)
+				if b.Slug == "" {
+					if err := db.setSlugAvoiding(ctx, b, batchSlugs); err != nil {
+						return err
+					}
+					c = true
+				}
+				if c {
+					changedKeys = append(changedKeys, batch[i])
+					changed = append(changed, b)
+				}
+			}
+			n = len(changed)
+			_, err := tx.PutMulti(changedKeys, changed)
+			return err
+		})
+		if err != nil {
+			return updated, fmt.Errorf("datastoredb: could not backfill sessions: %v", err)
+		}
+		assigned = batchSlugs
+		updated += n
+		log.Printf("datastoredb: backfill: checked %d of %d sessions, updated %d", end, len(keys), updated)
+	}
+	return updated, nil
+}
+
+// tagBatchSize is the number of sessions updated per transaction by
+// RenameTag, RemoveTag and AddTagToSessions.
+const tagBatchSize = 500
+
+// RenameTag replaces oldTag with newTag on every session carrying it.
+func (db *datastoreDB) RenameTag(ctx context.Context, oldTag, newTag string) (int, error) {
+	if oldTag == newTag {
+		return 0, nil
+	}
+	return db.replaceTag(ctx, oldTag, newTag)
+}
+
+// RemoveTag removes tag from every session carrying it.
+func (db *datastoreDB) RemoveTag(ctx context.Context, tag string) (int, error) {
+	return db.replaceTag(ctx, tag, "")
+}
+
+// AddTagToSessions appends tag to the sessions with the given IDs that don't
+// carry it, one transaction per batch of IDs.
+func (db *datastoreDB) AddTagToSessions(ctx context.Context, ids []int64, tag string) (updated, missing int, err error) {
+	if tag == "" {
+		return 0, 0, fmt.Errorf("datastoredb: empty tag")
+	}
+
+	ids = uniqueIDs(ids)
+	for start := 0; start < len(ids); start += tagBatchSize {
+		end := start + tagBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]*datastore.Key, end-start)
+		for i, id := range ids[start:end] {
+			keys[i] = db.datastoreKey(id)
+		}
+
+		n, m := 0, 0
+		_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			n, m = 0, 0
+			sessions := make([]*Session, len(keys))
+			for i := range sessions {
+				sessions[i] = &Session{}
+			}
+			found := make([]bool, len(keys))
+			if err := tx.GetMulti(keys, sessions); err != nil {
+				multiErr, ok := err.(datastore.MultiError)
+				if !ok {
+					return err
+				}
+				for i, err := range multiErr {
+					switch err {
+					case nil:
+						found[i] = true
+					case datastore.ErrNoSuchEntity:
+						m++
+					default:
+						return err
+					}
+				}
+			} else {
+				for i := range found {
+					found[i] = true
+				}
+			}
+
+			var changedKeys []*datastore.Key
+			var changed []*Session
+			for i, b := range sessions {
+				if !found[i] {
+					continue
+				}
+				if tags, ok := addTag(b.Tags, tag); ok {
+					b.Tags = tags
+					changedKeys = append(changedKeys, keys[i])
+					changed = append(changed, b)
+				}
+			}
+			n = len(changed)
+			_, err := tx.PutMulti(changedKeys, changed)
+			return err
+		})
+		if err != nil {
+			return updated, missing, fmt.Errorf("datastoredb: could not add tag: %v", err)
+		}
+		updated += n
+		missing += m
+	}
+	return updated, missing, nil
+}
+
+// MergeSessions adds the tags of mergeID to keepID and deletes mergeID in a
+// single transaction.
+func (db *datastoreDB) MergeSessions(ctx context.Context, keepID, mergeID int64) error {
+	if keepID == mergeID {
+		return ErrMergeIntoSelf
+	}
+	keys := []*datastore.Key{db.datastoreKey(keepID), db.datastoreKey(mergeID)}
+
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		sessions := []*Session{{}, {}}
+		if err := tx.GetMulti(keys, sessions); err != nil {
+			if multiErr, ok := err.(datastore.MultiError); ok {
+				for _, err := range multiErr {
+					if err == datastore.ErrNoSuchEntity {
+						return ErrSessionNotFound
+					}
+				}
+			}
+			return err
+		}
+		keep, merge := sessions[0], sessions[1]
+		keep.Tags = mergeTags(keep.Tags, merge.Tags)
+		keep.Favorites += merge.Favorites
+		keep.ViewCount += merge.ViewCount
+		if _, err := tx.Put(keys[0], keep); err != nil {
+			return err
+		}
+		merge.ID = mergeID
+		if err := db.indexExternalID(tx, merge, nil); err != nil {
+			return err
+		}
+		return tx.Delete(keys[1])
+	})
+	if err == ErrSessionNotFound {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not merge Session %d into %d: %v", mergeID, keepID, err)
+	}
+	return nil
+}
+
+// replaceTag finds the sessions carrying oldTag and updates them in batches,
+// one transaction per batch.
+func (db *datastoreDB) replaceTag(ctx context.Context, oldTag, newTag string) (int, error) {
+	q := datastore.NewQuery("Session").
+		Filter("Tags =", oldTag).
+		KeysOnly()
+	keys, err := db.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+	}
+
+	affected := 0
+	for start := 0; start < len(keys); start += tagBatchSize {
+		end := start + tagBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+
+		n := 0
+		_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			n = 0
+			sessions := make([]*Session, len(batch))
+			for i := range sessions {
+				sessions[i] = &Session{}
+			}
+			if err := tx.GetMulti(batch, sessions); err != nil {
+				return err
+			}
+
+			var changedKeys []*datastore.Key
+			var changed []*Session
+			for i, b := range sessions {
+				if tags, ok := replaceTag(b.Tags, oldTag, newTag); ok {
+					b.Tags = tags
+					changedKeys = append(changedKeys, batch[i])
+					changed = append(changed, b)
+				}
+			}
+			n = len(changed)
+			_, err := tx.PutMulti(changedKeys, changed)
+			return err
+		})
+		if err != nil {
+			return affected, fmt.Errorf("datastoredb: could not update tags: %v", err)
+		}
+		affected += n
+	}
+	return affected, nil
+}
+
+// relatedCandidateLimit caps the number of candidates fetched per query by
+// RelatedSessions before scoring.
+const relatedCandidateLimit = 100
+
+// RelatedSessions returns up to limit other sessions by the same author or
+// sharing tags with the given session, most related first. Candidates are
+// fetched with one query for the author and one per tag, then scored in
+// process.
+func (db *datastoreDB) RelatedSessions(ctx context.Context, id int64, limit int) ([]*Session, error) {
+	session, err := db.GetSession(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasRelatedFields(session) {
+		var recent []*Session
+		q := datastore.NewQuery("Session").
+			Order("-CreatedAt").
+			Limit(limit + 1)
+		keys, err := db.client.GetAll(ctx, q, &recent)
+		err = ignoreFieldMismatch(err)
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not list sessions: %v", err)
+		}
+		for i, k := range keys {
+			recent[i].ID = k.ID
+		}
+		recent = recentSessions(recent, id, limit)
+		if err := db.inflateDescriptions(ctx, recent); err != nil {
+			return nil, err
+		}
+		return recent, nil
+	}
+
+	var queries []*datastore.Query
+	if session.Author != "" {
+		queries = append(queries, datastore.NewQuery("Session").Filter("Author =", session.Author))
+	}
+	for _, t := range session.Tags {
+		queries = append(queries, datastore.NewQuery("Session").Filter("Tags =", t))
+	}
+
+	seen := make(map[int64]bool)
+	var candidates []*Session
+	for _, q := range queries {
+		var sessions []*Session
+		keys, err := db.client.GetAll(ctx, q.Limit(relatedCandidateLimit), &sessions)
+		err = ignoreFieldMismatch(err)
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not list related sessions: %v", err)
+		}
+		for i, k := range keys {
+			if seen[k.ID] {
+				continue
+			}
+			seen[k.ID] = true
+			sessions[i].ID = k.ID
+			candidates = append(candidates, sessions[i])
+		}
+	}
+	related := rankRelated(session, candidates, limit)
+	if err := db.inflateDescriptions(ctx, related); err != nil {
+		return nil, err
+	}
+	return related, nil
+}
+
+// RandomSessions returns up to n distinct sessions chosen at random: the n
+// sessions whose Random value follows a random point, wrapping around to the
+// lowest values if there are too few after it. Sessions added before Random
+// existed have none and are only found once they are edited.
+func (db *datastoreDB) RandomSessions(ctx context.Context, n int) ([]*Session, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	r := rand.Float64()
+	var sessions []*Session
+	for _, q := range []*datastore.Query{
+		datastore.NewQuery("Session").Filter("Random >=", r).Order("Random"),
+		datastore.NewQuery("Session").Filter("Random <", r).Order("Random"),
+	} {
+		var page []*Session
+		keys, err := db.client.GetAll(ctx, q.Limit(n-len(sessions)), &page)
+		err = ignoreFieldMismatch(err)
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not list random sessions: %v", err)
+		}
+		for i, k := range keys {
+			page[i].ID = k.ID
+		}
+		sessions = append(sessions, page...)
+		if len(sessions) == n {
+			break
+		}
+	}
+	if err := db.inflateDescriptions(ctx, sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// AdjacentSessions returns the sessions immediately before and after the
+// given one in title order, ties broken by key as in ListSessions, or nil at
+// either end. Each side is a query for a session with the same title and a
+// nearer key, then one for the nearest title. The previous session's query
+// needs the descending Title and key index in index.yaml.
+func (db *datastoreDB) AdjacentSessions(ctx context.Context, id int64) (prev, next *Session, err error) {
+	session, err := db.GetSession(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	k := db.datastoreKey(id)
+	prev, err = db.firstSession(ctx,
+		datastore.NewQuery("Session").Filter("Title =", session.Title).Filter("__key__ <", k).Order("-__key__"),
+		datastore.NewQuery("Session").Filter("Title <", session.Title).Order("-Title").Order("-__key__"))
+	if err != nil {
+		return nil, nil, err
+	}
+	next, err = db.firstSession(ctx,
+		datastore.NewQuery("Session").Filter("Title =", session.Title).Filter("__key__ >", k).Order("__key__"),
+		datastore.NewQuery("Session").Filter("Title >", session.Title).Order("Title").Order("__key__"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return prev, next, nil
+}
+
+// firstSession returns the first result of the first query that has one, or
+// nil if none do.
+func (db *datastoreDB) firstSession(ctx context.Context, queries ...*datastore.Query) (*Session, error) {
+	for _, q := range queries {
+		var sessions []*Session
+		keys, err := db.client.GetAll(ctx, q.Limit(1), &sessions)
+		err = ignoreFieldMismatch(err)
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not list adjacent sessions: %v", err)
+		}
+		if len(keys) > 0 {
+			sessions[0].ID = keys[0].ID
+			if err := db.inflateDescription(ctx, sessions[0]); err != nil {
+				return nil, err
+			}
+			return sessions[0], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,660 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Ensure encryptingDB conforms to the SessionDatabase interface.
+var _ SessionDatabase = &encryptingDB{}
+
+// ciphertextPrefix marks the values encryptingDB encrypted. Values without
+// it were stored before encryption was turned on, and are read as they are.
+const ciphertextPrefix = "enc:v1:"
+
+// unencryptableFields are the fields of Session the databases set
+// themselves or look sessions up by, which therefore can't be encrypted.
+var unencryptableFields = map[string]bool{
+	"Slug":           true,
+	"PublicID":       true,
+	"ContentHash":    true,
+	"Visibility":     true,
+	"ExternalID":     true,
+	"CreatedByID":    true,
+	"DescriptionRef": true,
+	"GeoHash":        true,
+	"ClaimedBy":      true,
+	"LockedBy":       true,
+	"LockedByName":   true,
+	"Tags":           true,
+}
+
+// encryptingDB wraps a SessionDatabase, encrypting a set of string and
+// string list fields of sessions with AES-GCM before they are written and
+// decrypting them when they are read, so handlers only see plaintext.
+//
+// The wrapped database only sees the ciphertext of those fields, so they
+// can't be queried: searches, lookups and orderings on them, such as
+// ListSessionsByPresenter for encrypted Presenters or title order for an
+// encrypted Title, don't work. The other fields behave as without it.
+// Sessions read are copies, so changing them doesn't change those the
+// wrapped database holds.
+type encryptingDB struct {
+	db     SessionDatabase
+	aead   cipher.AEAD
+	fields []string
+}
+
+// LoadEncryptionKey returns the key for newEncryptingDB from the
+// base64-encoded value of the environment variable name.
+func LoadEncryptionKey(name string) ([]byte, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil, fmt.Errorf("%s is not set", name)
+	}
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not valid base64: %v", name, err)
+	}
+	return key, nil
+}
+
+// newEncryptingDB creates a SessionDatabase that encrypts the named fields
+// of sessions written to db with key, which must be 16, 24 or 32 bytes long
+// to select AES-128, AES-192 or AES-256.
+func newEncryptingDB(db SessionDatabase, key []byte, fields []string) (*encryptingDB, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryptingdb: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("encryptingdb: %v", err)
+	}
+	t := reflect.TypeOf(Session{})
+	for _, name := range fields {
+		f, ok := t.FieldByName(name)
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("encryptingdb: Session has no field %s", name)
+		case unencryptableFields[name]:
+			return nil, fmt.Errorf("encryptingdb: %s is used by the database, so it can't be encrypted", name)
+		case f.Type.Kind() != reflect.String && f.Type != reflect.TypeOf([]string(nil)):
+			return nil, fmt.Errorf("encryptingdb: %s is not a string or a list of strings", name)
+		}
+	}
+	return &encryptingDB{db: db, aead: aead, fields: fields}, nil
+}
+
+// unwrap returns the wrapped database.
+func (db *encryptingDB) unwrap() SessionDatabase { return db.db }
+
+// seal returns the ciphertext of the value of the named field, with the
+// field name as additional data, so it can't be moved to another field.
+// Empty values are left empty.
+func (db *encryptingDB) seal(field, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	nonce := make([]byte, db.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("encryptingdb: could not make nonce: %v", err)
+	}
+	sealed := db.aead.Seal(nonce, nonce, []byte(plaintext), []byte(field))
+	return ciphertextPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// open returns the plaintext of a value of the named field returned by seal.
+func (db *encryptingDB) open(field, value string) (string, error) {
+	if !strings.HasPrefix(value, ciphertextPrefix) {
+		return value, nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, ciphertextPrefix))
+	if err != nil {
+		return "", fmt.Errorf("encryptingdb: could not decode %s: %v", field, err)
+	}
+	n := db.aead.NonceSize()
+	if len(sealed) < n {
+		return "", fmt.Errorf("encryptingdb: could not decrypt %s: ciphertext too short", field)
+	}
+	plaintext, err := db.aead.Open(nil, sealed[:n], sealed[n:], []byte(field))
+	if err != nil {
+		return "", fmt.Errorf("encryptingdb: could not decrypt %s: %v", field, err)
+	}
+	return string(plaintext), nil
+}
+
+// openFields decrypts the encrypted fields of the struct v in place. Fields
+// v doesn't have, such as those left out of a SessionSummary, are skipped.
+// Lists are replaced rather than changed, as they may be shared with the
+// wrapped database.
+func (db *encryptingDB) openFields(v reflect.Value) error {
+	for _, name := range db.fields {
+		f := v.FieldByName(name)
+		if !f.IsValid() {
+			continue
+		}
+		if f.Kind() == reflect.String {
+			s, err := db.open(name, f.String())
+			if err != nil {
+				return err
+			}
+			f.SetString(s)
+			continue
+		}
+		list := f.Interface().([]string)
+		if list == nil {
+			continue
+		}
+		opened := make([]string, len(list))
+		for i, s := range list {
+			var err error
+			if opened[i], err = db.open(name, s); err != nil {
+				return err
+			}
+		}
+		f.Set(reflect.ValueOf(opened))
+	}
+	return nil
+}
+
+// decrypt returns a copy of s with its encrypted fields decrypted, or nil if
+// s is nil.
+func (db *encryptingDB) decrypt(s *Session) (*Session, error) {
+	if s == nil {
+		return nil, nil
+	}
+	c := *s
+	if err := db.openFields(reflect.ValueOf(&c).Elem()); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// decryptAll decrypts each of sessions, returning copies.
+func (db *encryptingDB) decryptAll(sessions []*Session) ([]*Session, error) {
+	if sessions == nil {
+		return nil, nil
+	}
+	decrypted := make([]*Session, len(sessions))
+	for i, s := range sessions {
+		var err error
+		if decrypted[i], err = db.decrypt(s); err != nil {
+			return nil, err
+		}
+	}
+	return decrypted, nil
+}
+
+// encrypt returns a copy of b with its encrypted fields encrypted. Fields
+// whose plaintext is the same as in stored, the session as the wrapped
+// database holds it, keep their stored ciphertext, as encrypting again would
+// give a different one and they would seem changed (see ChangedFields).
+// stored may be nil.
+func (db *encryptingDB) encrypt(b, stored *Session) (*Session, error) {
+	c := *b
+	v := reflect.ValueOf(&c).Elem()
+	var old, opened reflect.Value
+	if stored != nil {
+		o, err := db.decrypt(stored)
+		if err != nil {
+			return nil, err
+		}
+		old, opened = reflect.ValueOf(stored).Elem(), reflect.ValueOf(o).Elem()
+	}
+	for _, name := range db.fields {
+		f := v.FieldByName(name)
+		if old.IsValid() && reflect.DeepEqual(f.Interface(), opened.FieldByName(name).Interface()) {
+			f.Set(old.FieldByName(name))
+			continue
+		}
+		if f.Kind() == reflect.String {
+			s, err := db.seal(name, f.String())
+			if err != nil {
+				return nil, err
+			}
+			f.SetString(s)
+			continue
+		}
+		list := f.Interface().([]string)
+		if list == nil {
+			continue
+		}
+		sealed := make([]string, len(list))
+		for i, s := range list {
+			var err error
+			if sealed[i], err = db.seal(name, s); err != nil {
+				return nil, err
+			}
+		}
+		f.Set(reflect.ValueOf(sealed))
+	}
+	return &c, nil
+}
+
+// restore sets b to enc, a session encrypt returned for it and the wrapped
+// database then filled in, with b's plaintext in place of the ciphertext.
+func (db *encryptingDB) restore(b, enc *Session) {
+	c := *enc
+	v, p := reflect.ValueOf(&c).Elem(), reflect.ValueOf(b).Elem()
+	for _, name := range db.fields {
+		v.FieldByName(name).Set(p.FieldByName(name))
+	}
+	*b = c
+}
+
+// stored returns the session with the given ID as the wrapped database holds
+// it, or nil if there is none.
+func (db *encryptingDB) stored(id int64) (*Session, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	s, err := db.db.GetSession(id)
+	if err == ErrSessionNotFound {
+		return nil, nil
+	}
+	return s, err
+}
+
+func (db *encryptingDB) ListSessions() ([]*Session, error) {
+	sessions, err := db.db.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) ListArchiveCounts(ctx context.Context) ([]ArchiveBucket, error) {
+	return db.db.ListArchiveCounts(ctx)
+}
+
+func (db *encryptingDB) ListSessionsByMonth(ctx context.Context, year, month int) ([]*Session, error) {
+	sessions, err := db.db.ListSessionsByMonth(ctx, year, month)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) ListSessionsOnThisDay(ctx context.Context, ref time.Time) ([]*Session, error) {
+	sessions, err := db.db.ListSessionsOnThisDay(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) ListSessionsNear(ctx context.Context, lat, lng, radiusKm float64, limit int) ([]*Session, error) {
+	sessions, err := db.db.ListSessionsNear(ctx, lat, lng, radiusKm, limit)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) ListSessionsAtSnapshot(ctx context.Context) ([]*Session, error) {
+	sessions, err := db.db.ListSessionsAtSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) SearchSessions(ctx context.Context, query string, limit, offset int) ([]*Session, error) {
+	sessions, err := db.db.SearchSessions(ctx, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) CountSearchSessions(ctx context.Context, query string) (int, error) {
+	return db.db.CountSearchSessions(ctx, query)
+}
+
+func (db *encryptingDB) SearchWithFacets(ctx context.Context, query string, tags []string) ([]*Session, map[string]int, error) {
+	sessions, facets, err := db.db.SearchWithFacets(ctx, query, tags)
+	if err != nil {
+		return nil, nil, err
+	}
+	sessions, err = db.decryptAll(sessions)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sessions, facets, nil
+}
+
+func (db *encryptingDB) ListSessionsPage(ctx context.Context, pageToken string, limit int) (*SessionList, error) {
+	list, err := db.db.ListSessionsPage(ctx, pageToken, limit)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := db.decryptAll(list.Sessions)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionList{Sessions: sessions, NextPageToken: list.NextPageToken}, nil
+}
+
+func (db *encryptingDB) ListSessionsByTagPage(ctx context.Context, tag string, limit int, pageToken string) ([]*Session, string, error) {
+	sessions, next, err := db.db.ListSessionsByTagPage(ctx, tag, limit, pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	sessions, err = db.decryptAll(sessions)
+	if err != nil {
+		return nil, "", err
+	}
+	return sessions, next, nil
+}
+
+func (db *encryptingDB) IterateSessions(ctx context.Context, fn func(*Session) error) error {
+	return db.db.IterateSessions(ctx, func(s *Session) error {
+		s, err := db.decrypt(s)
+		if err != nil {
+			return err
+		}
+		return fn(s)
+	})
+}
+
+func (db *encryptingDB) ListSessionsFor(ctx context.Context, v Viewer) ([]*Session, error) {
+	sessions, err := db.db.ListSessionsFor(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) ListSessionSummaries(ctx context.Context) ([]*SessionSummary, error) {
+	summaries, err := db.db.ListSessionSummaries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]*SessionSummary, len(summaries))
+	for i, s := range summaries {
+		c := *s
+		if err := db.openFields(reflect.ValueOf(&c).Elem()); err != nil {
+			return nil, err
+		}
+		decrypted[i] = &c
+	}
+	return decrypted, nil
+}
+
+func (db *encryptingDB) ListSessionsSorted(ctx context.Context, order string) ([]*Session, error) {
+	sessions, err := db.db.ListSessionsSorted(ctx, order)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) ListSessionsCreatedBy(ctx context.Context, userID, order string, desc bool) ([]*Session, error) {
+	sessions, err := db.db.ListSessionsCreatedBy(ctx, userID, order, desc)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) CountSessionsCreatedBy(ctx context.Context, userID string) (int, error) {
+	return db.db.CountSessionsCreatedBy(ctx, userID)
+}
+
+func (db *encryptingDB) StorageUsageByUser(ctx context.Context) (map[string]int64, error) {
+	return db.db.StorageUsageByUser(ctx)
+}
+
+func (db *encryptingDB) ListSessionsByPosition(ctx context.Context) ([]*Session, error) {
+	sessions, err := db.db.ListSessionsByPosition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) ListSessionsByPresenter(ctx context.Context, presenter string) ([]*Session, error) {
+	sessions, err := db.db.ListSessionsByPresenter(ctx, presenter)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) ListSessionsCreatedBetween(ctx context.Context, from, to time.Time) ([]*Session, error) {
+	sessions, err := db.db.ListSessionsCreatedBetween(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) ListRecentSessions(ctx context.Context, limit int) ([]*Session, error) {
+	sessions, err := db.db.ListRecentSessions(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) ListSessionsWithoutThumbnail(ctx context.Context, limit int) ([]*Session, error) {
+	sessions, err := db.db.ListSessionsWithoutThumbnail(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) GetSession(id int64) (*Session, error) {
+	s, err := db.db.GetSession(id)
+	if err != nil {
+		return nil, err
+	}
+	return db.decrypt(s)
+}
+
+func (db *encryptingDB) GetSessionsOrdered(ctx context.Context, ids []int64) ([]*Session, error) {
+	sessions, err := db.db.GetSessionsOrdered(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) GetSessionBySlug(ctx context.Context, slug string) (*Session, error) {
+	s, err := db.db.GetSessionBySlug(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+	return db.decrypt(s)
+}
+
+func (db *encryptingDB) GetSessionByPublicID(ctx context.Context, publicID string) (*Session, error) {
+	s, err := db.db.GetSessionByPublicID(ctx, publicID)
+	if err != nil {
+		return nil, err
+	}
+	return db.decrypt(s)
+}
+
+func (db *encryptingDB) RelatedSessions(ctx context.Context, id int64, limit int) ([]*Session, error) {
+	sessions, err := db.db.RelatedSessions(ctx, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) AdjacentSessions(ctx context.Context, id int64) (*Session, *Session, error) {
+	prev, next, err := db.db.AdjacentSessions(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if prev, err = db.decrypt(prev); err != nil {
+		return nil, nil, err
+	}
+	if next, err = db.decrypt(next); err != nil {
+		return nil, nil, err
+	}
+	return prev, next, nil
+}
+
+func (db *encryptingDB) RandomSessions(ctx context.Context, n int) ([]*Session, error) {
+	sessions, err := db.db.RandomSessions(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptAll(sessions)
+}
+
+func (db *encryptingDB) LookupByContentHash(ctx context.Context, hash string) (*Session, error) {
+	s, err := db.db.LookupByContentHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return db.decrypt(s)
+}
+
+func (db *encryptingDB) SessionExists(ctx context.Context, id int64) (bool, error) {
+	return db.db.SessionExists(ctx, id)
+}
+
+// AddSession encrypts and saves a given session. b is filled in as the
+// wrapped database fills it in, keeping its plaintext.
+func (db *encryptingDB) AddSession(b *Session) (int64, error) {
+	enc, err := db.encrypt(b, nil)
+	if err != nil {
+		return 0, err
+	}
+	id, err := db.db.AddSession(enc)
+	if err != nil {
+		return 0, err
+	}
+	db.restore(b, enc)
+	return id, nil
+}
+
+// UpsertSessionByExternalID encrypts and adds or replaces a session by its
+// ExternalID. The stored session isn't read first, so all its encrypted
+// fields are reported as changed on a replace.
+func (db *encryptingDB) UpsertSessionByExternalID(ctx context.Context, b *Session) (int64, bool, error) {
+	enc, err := db.encrypt(b, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	id, created, err := db.db.UpsertSessionByExternalID(ctx, enc)
+	if err != nil {
+		return 0, false, err
+	}
+	db.restore(b, enc)
+	return id, created, nil
+}
+
+func (db *encryptingDB) DeleteSession(id int64) error {
+	return db.db.DeleteSession(id)
+}
+
+func (db *encryptingDB) DeleteSessions(ctx context.Context, ids []int64) (int, map[int64]error) {
+	return db.db.DeleteSessions(ctx, ids)
+}
+
+// UpdateSession encrypts and updates the entry for a given session. The
+// stored session is read first, so unchanged fields keep their ciphertext.
+func (db *encryptingDB) UpdateSession(b *Session) error {
+	if b.ID == 0 {
+		return errors.New("encryptingdb: session with unassigned ID passed into UpdateSession")
+	}
+	stored, err := db.stored(b.ID)
+	if err != nil {
+		return err
+	}
+	enc, err := db.encrypt(b, stored)
+	if err != nil {
+		return err
+	}
+	if err := db.db.UpdateSession(enc); err != nil {
+		return err
+	}
+	db.restore(b, enc)
+	return nil
+}
+
+func (db *encryptingDB) MoveSession(ctx context.Context, id int64, newPosition int) error {
+	return db.db.MoveSession(ctx, id, newPosition)
+}
+
+func (db *encryptingDB) ReorderSessions(ctx context.Context, ids []int64) error {
+	return db.db.ReorderSessions(ctx, ids)
+}
+
+func (db *encryptingDB) RenameTag(ctx context.Context, oldTag, newTag string) (int, error) {
+	return db.db.RenameTag(ctx, oldTag, newTag)
+}
+
+func (db *encryptingDB) RemoveTag(ctx context.Context, tag string) (int, error) {
+	return db.db.RemoveTag(ctx, tag)
+}
+
+func (db *encryptingDB) AddTagToSessions(ctx context.Context, ids []int64, tag string) (int, int, error) {
+	return db.db.AddTagToSessions(ctx, ids, tag)
+}
+
+func (db *encryptingDB) TouchSession(ctx context.Context, id int64) error {
+	return db.db.TouchSession(ctx, id)
+}
+
+func (db *encryptingDB) IncrementViewCount(ctx context.Context, id int64, n int64) error {
+	return db.db.IncrementViewCount(ctx, id, n)
+}
+
+func (db *encryptingDB) ClaimNextUnprocessed(ctx context.Context, workerID string, lease time.Duration) (*Session, error) {
+	s, err := db.db.ClaimNextUnprocessed(ctx, workerID, lease)
+	if err != nil {
+		return nil, err
+	}
+	return db.decrypt(s)
+}
+
+func (db *encryptingDB) ReleaseClaim(ctx context.Context, id int64, workerID string) error {
+	return db.db.ReleaseClaim(ctx, id, workerID)
+}
+
+func (db *encryptingDB) MarkProcessed(ctx context.Context, id int64) error {
+	return db.db.MarkProcessed(ctx, id)
+}
+
+func (db *encryptingDB) LockSession(ctx context.Context, id int64, userID, name string, ttl time.Duration) error {
+	return db.db.LockSession(ctx, id, userID, name, ttl)
+}
+
+func (db *encryptingDB) UnlockSession(ctx context.Context, id int64, userID string) error {
+	return db.db.UnlockSession(ctx, id, userID)
+}
+
+func (db *encryptingDB) MergeSessions(ctx context.Context, keepID, mergeID int64) error {
+	return db.db.MergeSessions(ctx, keepID, mergeID)
+}
+
+func (db *encryptingDB) BackfillDerivedFields(ctx context.Context) (int, error) {
+	return db.db.BackfillDerivedFields(ctx)
+}
+
+func (db *encryptingDB) Close() {
+	db.db.Close()
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestEncryptingDB(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	mem := newMemoryDB()
+	db, err := newEncryptingDB(mem, key, []string{"Description", "Presenters"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	b := &Session{Title: "Secrets", Description: "the plan", Presenters: []string{"Ada"}}
+	id, err := db.AddSession(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ID != id || b.Description != "the plan" || b.Slug == "" {
+		t.Errorf("AddSession: got %+v, want the ID and slug filled in and plaintext kept", b)
+	}
+
+	stored, err := mem.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.Description, ciphertextPrefix) || strings.Contains(stored.Description, "plan") {
+		t.Errorf("stored description %q, want ciphertext", stored.Description)
+	}
+	if len(stored.Presenters) != 1 || !strings.HasPrefix(stored.Presenters[0], ciphertextPrefix) {
+		t.Errorf("stored presenters %q, want ciphertext", stored.Presenters)
+	}
+	if stored.Title != "Secrets" {
+		t.Errorf("stored title %q, want it unencrypted", stored.Title)
+	}
+
+	got, err := db.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Description != "the plan" || !reflect.DeepEqual(got.Presenters, []string{"Ada"}) {
+		t.Errorf("GetSession: got %q, %q; want plaintext", got.Description, got.Presenters)
+	}
+	sessions, err := db.ListSessions()
+	if err != nil || len(sessions) != 1 || sessions[0].Description != "the plan" {
+		t.Errorf("ListSessions: got %v, %v; want the plaintext session", sessions, err)
+	}
+	if stored.Description == got.Description {
+		t.Error("decrypting changed the session the wrapped database holds")
+	}
+
+	// Unchanged fields keep their ciphertext, so they aren't changes.
+	ciphertext := stored.Description
+	edit := *got
+	edit.Title = "Open secrets"
+	if err := db.UpdateSession(&edit); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Title"}; !reflect.DeepEqual(edit.ChangedFields, want) {
+		t.Errorf("UpdateSession: got changed fields %q, want %q", edit.ChangedFields, want)
+	}
+	if stored, _ := mem.GetSession(id); stored.Description != ciphertext {
+		t.Error("UpdateSession encrypted the unchanged description again")
+	}
+
+	// Ciphertext is bound to its field.
+	stored, _ = mem.GetSession(id)
+	stored.Presenters = []string{stored.Description}
+	if _, err := db.GetSession(id); err == nil {
+		t.Error("GetSession decrypted a description moved to Presenters")
+	}
+	stored.Presenters = nil
+
+	// Values stored before encryption was turned on are read as they are.
+	stored.Description = "plain"
+	if got, err := db.GetSession(id); err != nil || got.Description != "plain" {
+		t.Errorf("GetSession of a plaintext description: got %v, %v", got, err)
+	}
+
+	var n int
+	err = db.IterateSessions(context.Background(), func(s *Session) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 1 {
+		t.Errorf("IterateSessions: got %d sessions, %v; want 1", n, err)
+	}
+}
+
+func TestNewEncryptingDB(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, tt := range []struct {
+		key    []byte
+		fields []string
+	}{
+		{key[:10], []string{"Description"}},
+		{key, []string{"Nope"}},
+		{key, []string{"Slug"}},
+		{key, []string{"Tags"}},
+		{key, []string{"Latitude"}},
+	} {
+		if _, err := newEncryptingDB(newMemoryDB(), tt.key, tt.fields); err == nil {
+			t.Errorf("newEncryptingDB(%d-byte key, %q): got nil error", len(tt.key), tt.fields)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import "golang.org/x/net/context"
+
+// Ensure historyDB conforms to the SessionDatabase interface.
+var _ SessionDatabase = &historyDB{}
+
+// historyDB wraps a SessionDatabase, recording each session it adds or
+// changes in a History and forgetting the versions of sessions it deletes.
+// Writes that change many sessions at once record the new versions of the
+// sessions that already have kept versions, since only those can be
+// diffed. All other methods go straight to the wrapped database.
+type historyDB struct {
+	SessionDatabase
+
+	history *History
+}
+
+// newHistoryDB creates a SessionDatabase that records the versions of
+// sessions written to db in h.
+func newHistoryDB(db SessionDatabase, h *History) *historyDB {
+	return &historyDB{SessionDatabase: db, history: h}
+}
+
+// unwrap returns the wrapped database.
+func (db *historyDB) unwrap() SessionDatabase { return db.SessionDatabase }
+
+// AddSession saves a given session and records its first version.
+func (db *historyDB) AddSession(b *Session) (int64, error) {
+	id, err := db.SessionDatabase.AddSession(b)
+	if err == nil {
+		db.history.Record(b)
+	}
+	return id, err
+}
+
+// UpdateSession updates the entry for a given session and records the new
+// version.
+func (db *historyDB) UpdateSession(b *Session) error {
+	err := db.SessionDatabase.UpdateSession(b)
+	if err == nil {
+		db.history.Record(b)
+	}
+	return err
+}
+
+// UpsertSessionByExternalID adds or replaces a session by its ExternalID and
+// records the new version.
+func (db *historyDB) UpsertSessionByExternalID(ctx context.Context, b *Session) (int64, bool, error) {
+	id, created, err := db.SessionDatabase.UpsertSessionByExternalID(ctx, b)
+	if err == nil {
+		db.history.Record(b)
+	}
+	return id, created, err
+}
+
+// MergeSessions merges the session mergeID into keepID, records the new
+// version of keepID and forgets the versions of mergeID.
+func (db *historyDB) MergeSessions(ctx context.Context, keepID, mergeID int64) error {
+	if err := db.SessionDatabase.MergeSessions(ctx, keepID, mergeID); err != nil {
+		return err
+	}
+	if keep, err := db.SessionDatabase.GetSession(keepID); err == nil {
+		db.history.Record(keep)
+	}
+	db.history.Forget(mergeID)
+	return nil
+}
+
+// recordChanged records the current version of each of the sessions with the
+// given IDs that changed since its latest kept version.
+func (db *historyDB) recordChanged(ids []int64) {
+	for _, id := range ids {
+		if s, err := db.SessionDatabase.GetSession(id); err == nil {
+			db.history.RecordChanged(s)
+		}
+	}
+}
+
+// TouchSession marks a session as updated now and records the new version.
+func (db *historyDB) TouchSession(ctx context.Context, id int64) error {
+	if err := db.SessionDatabase.TouchSession(ctx, id); err != nil {
+		return err
+	}
+	db.recordChanged([]int64{id})
+	return nil
+}
+
+// RenameTag replaces oldTag with newTag on every session carrying it and
+// records the sessions with kept versions that changed.
+func (db *historyDB) RenameTag(ctx context.Context, oldTag, newTag string) (int, error) {
+	affected, err := db.SessionDatabase.RenameTag(ctx, oldTag, newTag)
+	if affected > 0 {
+		db.recordChanged(db.history.IDs())
+	}
+	return affected, err
+}
+
+// RemoveTag removes tag from every session carrying it and records the
+// sessions with kept versions that changed.
+func (db *historyDB) RemoveTag(ctx context.Context, tag string) (int, error) {
+	affected, err := db.SessionDatabase.RemoveTag(ctx, tag)
+	if affected > 0 {
+		db.recordChanged(db.history.IDs())
+	}
+	return affected, err
+}
+
+// AddTagToSessions adds tag to the sessions with the given IDs and records
+// those that changed.
+func (db *historyDB) AddTagToSessions(ctx context.Context, ids []int64, tag string) (int, int, error) {
+	updated, missing, err := db.SessionDatabase.AddTagToSessions(ctx, ids, tag)
+	if updated > 0 {
+		db.recordChanged(ids)
+	}
+	return updated, missing, err
+}
+
+// BackfillDerivedFields fills in missing derived fields and records the
+// sessions with kept versions that changed.
+func (db *historyDB) BackfillDerivedFields(ctx context.Context) (int, error) {
+	updated, err := db.SessionDatabase.BackfillDerivedFields(ctx)
+	if updated > 0 {
+		db.recordChanged(db.history.IDs())
+	}
+	return updated, err
+}
+
+// DeleteSession removes a session and forgets its versions.
+func (db *historyDB) DeleteSession(id int64) error {
+	if err := db.SessionDatabase.DeleteSession(id); err != nil {
+		return err
+	}
+	db.history.Forget(id)
+	return nil
+}
+
+// DeleteSessions removes the sessions with the given IDs and forgets the
+// versions of those deleted.
+func (db *historyDB) DeleteSessions(ctx context.Context, ids []int64) (int, map[int64]error) {
+	deleted, errs := db.SessionDatabase.DeleteSessions(ctx, ids)
+	for _, id := range ids {
+		if _, failed := errs[id]; !failed {
+			db.history.Forget(id)
+		}
+	}
+	return deleted, errs
+}
@@ -1,11 +1,16 @@
-
 package vyfe_api
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"sort"
 	"sync"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 // Ensure memoryDB conforms to the SessionDatabase interface.
@@ -13,15 +18,23 @@ var _ SessionDatabase = &memoryDB{}
 
 // memoryDB is a simple in-memory persistence layer for sessions.
 type memoryDB struct {
-	mu     sync.Mutex
-	nextID int64           // next ID to assign to a session.
-	sessions  map[int64]*Session // maps from Session ID to Session.
+	mu       sync.Mutex
+	nextID   int64              // next ID to assign to a session.
+	sessions map[int64]*Session // maps from Session ID to Session.
+	slugs    map[string]int64   // maps from Session slug to Session ID.
+
+	externalIDs map[string]int64 // maps from Session ExternalID to Session ID.
+	search      *searchIndex     // inverted index of the text searched.
 }
 
 func newMemoryDB() *memoryDB {
 	return &memoryDB{
-		sessions:  make(map[int64]*Session),
-		nextID: 1,
+		sessions: make(map[int64]*Session),
+		slugs:    make(map[string]int64),
+		nextID:   1,
+
+		externalIDs: make(map[string]int64),
+		search:      newSearchIndex(),
 	}
 }
 
@@ -31,6 +44,9 @@ func (db *memoryDB) Close() {
 	defer db.mu.Unlock()
 
 	db.sessions = nil
+	db.slugs = nil
+	db.search = nil
+	db.externalIDs = nil
 }
 
 // GetSession retrieves a session by its ID.
@@ -40,22 +56,144 @@ func (db *memoryDB) GetSession(id int64) (*Session, error) {
 
 	session, ok := db.sessions[id]
 	if !ok {
-		return nil, fmt.Errorf("memorydb: session not found with ID %d", id)
+		return nil, ErrSessionNotFound
 	}
 	return session, nil
 }
 
+// GetSessionsOrdered retrieves the sessions with the given IDs, in the same
+// order as ids, skipping IDs with no session.
+func (db *memoryDB) GetSessionsOrdered(ctx context.Context, ids []int64) ([]*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	sessions := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		if s, ok := db.sessions[id]; ok {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+// GetSessionBySlug retrieves a session by its slug.
+func (db *memoryDB) GetSessionBySlug(ctx context.Context, slug string) (*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	id, ok := db.slugs[slug]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return db.sessions[id], nil
+}
+
+// GetSessionByPublicID retrieves a session by its public ID.
+func (db *memoryDB) GetSessionByPublicID(ctx context.Context, publicID string) (*Session, error) {
+	if publicID == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, s := range db.sessions {
+		if s.PublicID == publicID {
+			return s, nil
+		}
+	}
+	return nil, ErrSessionNotFound
+}
+
+// LookupByContentHash returns a session whose uploaded file has the given
+// content hash.
+func (db *memoryDB) LookupByContentHash(ctx context.Context, hash string) (*Session, error) {
+	if hash == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, s := range db.sessions {
+		if s.ContentHash == hash {
+			return s, nil
+		}
+	}
+	return nil, ErrSessionNotFound
+}
+
+// SessionExists reports whether a session with the given ID exists.
+func (db *memoryDB) SessionExists(ctx context.Context, id int64) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, ok := db.sessions[id]
+	return ok, nil
+}
+
 // AddSession saves a given session, assigning it a new ID.
 func (db *memoryDB) AddSession(b *Session) (id int64, err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	return db.addSession(b), nil
+}
+
+// addSession saves b, assigning it a new ID. The caller must hold db.mu.
+func (db *memoryDB) addSession(b *Session) int64 {
+	// New sessions go to the end of the playlist order.
+	b.Position = 0
+	for _, s := range db.sessions {
+		if s.Position >= b.Position {
+			b.Position = s.Position + 1
+		}
+	}
+
 	b.ID = db.nextID
+	b.CreatedAt = time.Now()
+	b.UpdatedAt = b.CreatedAt
+	b.Random = rand.Float64()
+	setPublicID(b)
+	db.setSlug(b)
 	db.sessions[b.ID] = b
+	db.indexExternalID(nil, b)
+	db.search.set(b)
 
 	db.nextID++
 
-	return b.ID, nil
+	return b.ID
+}
+
+// UpsertSessionByExternalID adds b, or replaces the session with the same
+// ExternalID, under a single lock.
+func (db *memoryDB) UpsertSessionByExternalID(ctx context.Context, b *Session) (int64, bool, error) {
+	if b.ExternalID == "" {
+		return 0, false, ErrNoExternalID
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	id, ok := db.externalIDs[b.ExternalID]
+	if !ok {
+		return db.addSession(b), true, nil
+	}
+	b.ID = id
+	b.Random = db.sessions[id].Random
+	db.updateSession(b)
+	return id, false, nil
+}
+
+// indexExternalID updates the ExternalID index for b replacing old; either
+// may be nil. The caller must hold db.mu.
+func (db *memoryDB) indexExternalID(old, b *Session) {
+	if old != nil && old.ExternalID != "" && db.externalIDs[old.ExternalID] == old.ID {
+		delete(db.externalIDs, old.ExternalID)
+	}
+	if b != nil && b.ExternalID != "" {
+		db.externalIDs[b.ExternalID] = b.ID
+	}
 }
 
 // DeleteSession removes a given session by its ID.
@@ -67,13 +205,40 @@ func (db *memoryDB) DeleteSession(id int64) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	if _, ok := db.sessions[id]; !ok {
+	session, ok := db.sessions[id]
+	if !ok {
 		return fmt.Errorf("memorydb: could not delete session with ID %d, does not exist", id)
 	}
+	delete(db.slugs, session.Slug)
+	db.indexExternalID(session, nil)
+	db.search.remove(id)
 	delete(db.sessions, id)
 	return nil
 }
 
+// DeleteSessions removes the sessions with the given IDs under a single lock.
+func (db *memoryDB) DeleteSessions(ctx context.Context, ids []int64) (deleted int, errs map[int64]error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, id := range ids {
+		session, ok := db.sessions[id]
+		if !ok {
+			if errs == nil {
+				errs = make(map[int64]error)
+			}
+			errs[id] = ErrSessionNotFound
+			continue
+		}
+		delete(db.slugs, session.Slug)
+		db.indexExternalID(session, nil)
+		db.search.remove(id)
+		delete(db.sessions, id)
+		deleted++
+	}
+	return deleted, errs
+}
+
 // UpdateSession updates the entry for a given session.
 func (db *memoryDB) UpdateSession(b *Session) error {
 	if b.ID == 0 {
@@ -83,17 +248,242 @@ func (db *memoryDB) UpdateSession(b *Session) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	db.updateSession(b)
+	return nil
+}
+
+// updateSession replaces the stored session with b. The caller must hold
+// db.mu.
+func (db *memoryDB) updateSession(b *Session) {
+	// Keep the slug unless the title changed, so that shared links still
+	// work after other edits.
+	old, ok := db.sessions[b.ID]
+	b.ChangedFields = nil
+	if ok {
+		keepSize(b, old)
+		b.ChangedFields = ChangedFields(old, b)
+	}
+	if ok && old.Title == b.Title && old.Slug != "" {
+		b.Slug = old.Slug
+	} else {
+		if ok {
+			delete(db.slugs, old.Slug)
+		}
+		db.setSlug(b)
+	}
+	// Edits don't carry the counters, the public ID, the creation time or
+	// the playlist position, which are kept from the stored session.
+	if ok {
+		b.Favorites, b.ViewCount = old.Favorites, old.ViewCount
+		b.CreatedAt, b.Position = old.CreatedAt, old.Position
+		b.PublicID = old.PublicID
+		keepClaim(b, old)
+		keepLock(b, old)
+	}
+	setPublicID(b)
+	b.UpdatedAt = time.Now()
+	db.indexExternalID(old, b)
+	db.search.set(b)
 	db.sessions[b.ID] = b
+}
+
+// TouchSession sets the UpdatedAt time of a session to now. The touched
+// session replaces the stored one, as readers may hold it.
+func (db *memoryDB) TouchSession(ctx context.Context, id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	b, ok := db.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	c := *b
+	c.UpdatedAt = time.Now()
+	db.sessions[id] = &c
 	return nil
 }
 
-// sessionsByTitle implements sort.Interface, ordering sessions by Title.
+// IncrementViewCount adds n to the ViewCount of a session. The stored
+// session is replaced rather than changed, as views are counted while
+// readers may hold it.
+func (db *memoryDB) IncrementViewCount(ctx context.Context, id int64, n int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	b, ok := db.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	c := *b
+	c.ViewCount += n
+	db.sessions[id] = &c
+	return nil
+}
+
+// ClaimNextUnprocessed claims the oldest claimable session for workerID. The
+// claimed session replaces the stored one, as readers may hold it.
+func (db *memoryDB) ClaimNextUnprocessed(ctx context.Context, workerID string, lease time.Duration) (*Session, error) {
+	if !validClaim(workerID, lease) {
+		return nil, fmt.Errorf("memorydb: bad claim by %q for %v", workerID, lease)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	var sessions []*Session
+	for _, b := range db.sessions {
+		if claimable(b, now) {
+			sessions = append(sessions, b)
+		}
+	}
+	if len(sessions) == 0 {
+		return nil, ErrNothingToClaim
+	}
+
+	sort.Sort(sessionsByCreatedAt(sessions))
+	c := *sessions[0]
+	c.ClaimedBy, c.ClaimExpiry = workerID, now.Add(lease)
+	db.sessions[c.ID] = &c
+	return &c, nil
+}
+
+// ReleaseClaim clears the claim of workerID on a session.
+func (db *memoryDB) ReleaseClaim(ctx context.Context, id int64, workerID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	b, ok := db.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if b.ClaimedBy != workerID || !b.ClaimExpiry.After(time.Now()) {
+		return ErrClaimNotHeld
+	}
+	c := *b
+	c.ClaimedBy, c.ClaimExpiry = "", time.Time{}
+	db.sessions[id] = &c
+	return nil
+}
+
+// MarkProcessed sets the ProcessedAt time of a session to now and clears its
+// claim.
+func (db *memoryDB) MarkProcessed(ctx context.Context, id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	b, ok := db.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	c := *b
+	c.ProcessedAt = time.Now()
+	c.ClaimedBy, c.ClaimExpiry = "", time.Time{}
+	db.sessions[id] = &c
+	return nil
+}
+
+// LockSession acquires or renews the edit lock of userID on a session.
+func (db *memoryDB) LockSession(ctx context.Context, id int64, userID, name string, ttl time.Duration) error {
+	if !validLock(userID, ttl) {
+		return fmt.Errorf("memorydb: bad lock by %q for %v", userID, ttl)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	b, ok := db.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	now := time.Now()
+	if b.LockedByOther(userID, now) {
+		return ErrSessionLocked
+	}
+	c := *b
+	c.LockedBy, c.LockedByName, c.LockExpiry = userID, name, now.Add(ttl)
+	db.sessions[id] = &c
+	return nil
+}
+
+// UnlockSession releases the edit lock of userID on a session.
+func (db *memoryDB) UnlockSession(ctx context.Context, id int64, userID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	b, ok := db.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if b.LockedBy != userID {
+		return nil
+	}
+	c := *b
+	c.LockedBy, c.LockedByName, c.LockExpiry = "", "", time.Time{}
+	db.sessions[id] = &c
+	return nil
+}
+
+// setSlug assigns b a slug derived from its title that no other session uses.
+// The caller must hold db.mu.
+func (db *memoryDB) setSlug(b *Session) {
+	b.Slug, _ = uniqueSlug(b.Title, func(slug string) (bool, error) {
+		id, ok := db.slugs[slug]
+		return ok && id != b.ID, nil
+	})
+	db.slugs[b.Slug] = b.ID
+}
+
+// sessionsByTitle implements sort.Interface, ordering sessions by Title, then
+// by ID so that sessions sharing a title are always in the same order.
 // https://golang.org/pkg/sort/#example__sortWrapper
 type sessionsByTitle []*Session
 
-func (s sessionsByTitle) Less(i, j int) bool { return s[i].Title < s[j].Title }
-func (s sessionsByTitle) Len() int           { return len(s) }
-func (s sessionsByTitle) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sessionsByTitle) Less(i, j int) bool {
+	if s[i].Title != s[j].Title {
+		return s[i].Title < s[j].Title
+	}
+	return s[i].ID < s[j].ID
+}
+func (s sessionsByTitle) Len() int      { return len(s) }
+func (s sessionsByTitle) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// sessionsByFavorites implements sort.Interface, ordering sessions by
+// descending Favorites, then by title.
+type sessionsByFavorites struct{ sessionsByTitle }
+
+func (s sessionsByFavorites) Less(i, j int) bool {
+	a, b := s.sessionsByTitle[i], s.sessionsByTitle[j]
+	if a.Favorites != b.Favorites {
+		return a.Favorites > b.Favorites
+	}
+	return s.sessionsByTitle.Less(i, j)
+}
+
+// sessionsByViews implements sort.Interface, ordering sessions by descending
+// ViewCount, then by title.
+type sessionsByViews struct{ sessionsByTitle }
+
+func (s sessionsByViews) Less(i, j int) bool {
+	a, b := s.sessionsByTitle[i], s.sessionsByTitle[j]
+	if a.ViewCount != b.ViewCount {
+		return a.ViewCount > b.ViewCount
+	}
+	return s.sessionsByTitle.Less(i, j)
+}
+
+// sessionsByPublishedAt implements sort.Interface, ordering sessions by
+// PublishedAt, then by ID.
+type sessionsByPublishedAt []*Session
+
+func (s sessionsByPublishedAt) Less(i, j int) bool {
+	if !s[i].PublishedAt.Equal(s[j].PublishedAt) {
+		return s[i].PublishedAt.Before(s[j].PublishedAt)
+	}
+	return s[i].ID < s[j].ID
+}
+func (s sessionsByPublishedAt) Len() int      { return len(s) }
+func (s sessionsByPublishedAt) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 
 // ListSessions returns a list of sessions, ordered by title.
 func (db *memoryDB) ListSessions() ([]*Session, error) {
@@ -109,19 +499,300 @@ func (db *memoryDB) ListSessions() ([]*Session, error) {
 	return sessions, nil
 }
 
-// ListSessionsCreatedBy returns a list of sessions, ordered by title, filtered by
-// the user who created the session entry.
-func (db *memoryDB) ListSessionsCreatedBy(userID string) ([]*Session, error) {
-	if userID == "" {
-		return db.ListSessions()
+// IterateSessions calls fn for each session in title order. The sessions are
+// listed first, so fn may use the database.
+func (db *memoryDB) IterateSessions(ctx context.Context, fn func(*Session) error) error {
+	sessions, err := db.ListSessions()
+	if err != nil {
+		return err
 	}
+	for _, b := range sessions {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// ListSessionsAtSnapshot returns copies of all sessions, ordered by title,
+// taken under the lock so later writes don't change them.
+func (db *memoryDB) ListSessionsAtSnapshot(ctx context.Context) ([]*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	sessions := make([]*Session, 0, len(db.sessions))
+	for _, b := range db.sessions {
+		c := *b
+		c.Tags = append([]string(nil), b.Tags...)
+		sessions = append(sessions, &c)
+	}
+
+	sort.Sort(sessionsByTitle(sessions))
+	return sessions, nil
+}
+
+// SearchSessions returns a page of the sessions matching query.
+func (db *memoryDB) SearchSessions(ctx context.Context, query string, limit, offset int) ([]*Session, error) {
+	if limit <= 0 || offset < 0 {
+		return nil, fmt.Errorf("memorydb: bad page size %d or offset %d", limit, offset)
+	}
+	return pageOf(db.searchIndexed(searchTerms(query)), limit, offset), nil
+}
+
+// searchIndexed returns the sessions containing every one of terms, ordered
+// by title, looked up in the search index.
+func (db *memoryDB) searchIndexed(terms []string) []*Session {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for id := range db.search.lookup(terms) {
+		sessions = append(sessions, db.sessions[id])
+	}
+	sort.Sort(sessionsByTitle(sessions))
+	return sessions
+}
+
+// SearchWithFacets returns the sessions matching query and tags, with the
+// counts of their other tags.
+func (db *memoryDB) SearchWithFacets(ctx context.Context, query string, tags []string) ([]*Session, map[string]int, error) {
+	// An empty query leaves the tags to select sessions, so they can't be
+	// looked up in the index.
+	var sessions []*Session
+	if terms := searchTerms(query); len(terms) > 0 {
+		sessions = db.searchIndexed(terms)
+	} else {
+		var err error
+		if sessions, err = db.ListSessions(); err != nil {
+			return nil, nil, err
+		}
+	}
+	results, facets := facetSessions(sessions, query, tags)
+	return results, facets, nil
+}
+
+// CountSearchSessions returns the number of sessions matching query.
+func (db *memoryDB) CountSearchSessions(ctx context.Context, query string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return len(db.search.lookup(searchTerms(query))), nil
+}
+
+// pageKey is the position encoded in memoryDB page tokens: the title and ID of
+// the last session on the previous page.
+type pageKey struct {
+	Title string `json:"t"`
+	ID    int64  `json:"id"`
+}
+
+// ListSessionsPage returns up to limit sessions, ordered by title, that sort
+// after the session encoded in pageToken.
+func (db *memoryDB) ListSessionsPage(ctx context.Context, pageToken string, limit int) (*SessionList, error) {
+	sessions, err := db.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	return pageAfter(sessions, pageToken, limit)
+}
+
+// ListSessionsByTagPage returns up to limit sessions carrying tag, ordered by
+// title, that sort after the session encoded in pageToken.
+func (db *memoryDB) ListSessionsByTagPage(ctx context.Context, tag string, limit int, pageToken string) ([]*Session, string, error) {
+	db.mu.Lock()
+	var tagged []*Session
+	for _, s := range db.sessions {
+		if s.hasTags([]string{tag}) {
+			tagged = append(tagged, s)
+		}
+	}
+	db.mu.Unlock()
+
+	sort.Sort(sessionsByTitle(tagged))
+	list, err := pageAfter(tagged, pageToken, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return list.Sessions, list.NextPageToken, nil
+}
+
+// pageAfter returns up to limit of sessions, which are ordered by title,
+// that sort after the session encoded in pageToken, and the token of the
+// next page.
+func pageAfter(sessions []*Session, pageToken string, limit int) (*SessionList, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("memorydb: bad page size %d", limit)
+	}
+	var after *pageKey
+	if pageToken != "" {
+		b, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return nil, ErrBadPageToken
+		}
+		after = &pageKey{}
+		if err := json.Unmarshal(b, after); err != nil {
+			return nil, ErrBadPageToken
+		}
+	}
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(sessions), func(i int) bool {
+			s := sessions[i]
+			return s.Title > after.Title || s.Title == after.Title && s.ID > after.ID
+		})
+	}
+
+	list := &SessionList{Sessions: []*Session{}}
+	end := start + limit
+	if end < len(sessions) {
+		last := sessions[end-1]
+		b, err := json.Marshal(pageKey{Title: last.Title, ID: last.ID})
+		if err != nil {
+			return nil, err
+		}
+		list.NextPageToken = base64.RawURLEncoding.EncodeToString(b)
+	} else {
+		end = len(sessions)
+	}
+	list.Sessions = sessions[start:end]
+	return list, nil
+}
+
+// ListSessionsFor returns the sessions v may see listed, ordered by title.
+func (db *memoryDB) ListSessionsFor(ctx context.Context, v Viewer) ([]*Session, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	var sessions []*Session
+	for _, b := range db.sessions {
+		if v.CanList(b) {
+			sessions = append(sessions, b)
+		}
+	}
+
+	sort.Sort(sessionsByTitle(sessions))
+	return sessions, nil
+}
+
+// ListSessionSummaries returns the summaries of all sessions, ordered by
+// title.
+func (db *memoryDB) ListSessionSummaries(ctx context.Context) ([]*SessionSummary, error) {
+	sessions, err := db.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]*SessionSummary, len(sessions))
+	for i, s := range sessions {
+		summaries[i] = s.Summary()
+	}
+	return summaries, nil
+}
+
+// ListSessionsSorted returns all sessions in the given order.
+func (db *memoryDB) ListSessionsSorted(ctx context.Context, order string) ([]*Session, error) {
+	sessions, err := db.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	switch order {
+	case SortByTitle:
+	case SortByFavorites:
+		sort.Sort(sessionsByFavorites{sessions})
+	case SortByViews:
+		sort.Sort(sessionsByViews{sessions})
+	default:
+		return nil, ErrBadSortOrder
+	}
+	return sessions, nil
+}
+
+// ListSessionsCreatedBy returns a list of sessions, filtered by the user who
+// created the session entry, in the given order.
+func (db *memoryDB) ListSessionsCreatedBy(ctx context.Context, userID, order string, desc bool) ([]*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		if userID == "" || b.CreatedByID == userID {
+			sessions = append(sessions, b)
+		}
+	}
+
+	var s sort.Interface
+	switch order {
+	case SortByTitle:
+		s = sessionsByTitle(sessions)
+	case SortByCreated:
+		s = sessionsByCreatedAt(sessions)
+	case SortByUpdated:
+		s = sessionsByUpdatedAt(sessions)
+	default:
+		return nil, ErrBadSortOrder
+	}
+	if desc {
+		s = sort.Reverse(s)
+	}
+	sort.Sort(s)
+	return sessions, nil
+}
+
+// CountSessionsCreatedBy returns the number of sessions created by the given
+// user.
+func (db *memoryDB) CountSessionsCreatedBy(ctx context.Context, userID string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if userID == "" {
+		return len(db.sessions), nil
+	}
+
+	n := 0
 	for _, b := range db.sessions {
 		if b.CreatedByID == userID {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// StorageUsageByUser returns the total SizeBytes of the sessions created by
+// each user, keyed by CreatedByID.
+func (db *memoryDB) StorageUsageByUser(ctx context.Context) (map[string]int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	usage := make(map[string]int64)
+	for _, b := range db.sessions {
+		usage[b.CreatedByID] += b.SizeBytes
+	}
+	return usage, nil
+}
+
+// ListSessionsByPosition returns a list of sessions, ordered by position.
+func (db *memoryDB) ListSessionsByPosition(ctx context.Context) ([]*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		sessions = append(sessions, b)
+	}
+
+	sort.Sort(sessionsByPosition(sessions))
+	return sessions, nil
+}
+
+// ListSessionsByPresenter returns the sessions the named person presents,
+// ordered by title.
+func (db *memoryDB) ListSessionsByPresenter(ctx context.Context, presenter string) ([]*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		if b.presentedBy(presenter) {
 			sessions = append(sessions, b)
 		}
 	}
@@ -129,3 +800,345 @@ func (db *memoryDB) ListSessionsCreatedBy(userID string) ([]*Session, error) {
 	sort.Sort(sessionsByTitle(sessions))
 	return sessions, nil
 }
+
+// ListSessionsCreatedBetween returns the sessions added between from and to,
+// inclusive, ordered by creation time.
+func (db *memoryDB) ListSessionsCreatedBetween(ctx context.Context, from, to time.Time) ([]*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		if !b.CreatedAt.Before(from) && !b.CreatedAt.After(to) {
+			sessions = append(sessions, b)
+		}
+	}
+
+	sort.Sort(sessionsByCreatedAt(sessions))
+	return sessions, nil
+}
+
+// ListRecentSessions returns the limit most recently added sessions, newest
+// first.
+func (db *memoryDB) ListRecentSessions(ctx context.Context, limit int) ([]*Session, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("memorydb: bad limit %d", limit)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		sessions = append(sessions, b)
+	}
+
+	sort.Sort(sort.Reverse(sessionsByCreatedAt(sessions)))
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return sessions, nil
+}
+
+// ListSessionsWithoutThumbnail returns up to limit sessions with a video but
+// no thumbnail, ordered by video URL, then by ID, as in the Datastore backend.
+func (db *memoryDB) ListSessionsWithoutThumbnail(ctx context.Context, limit int) ([]*Session, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("memorydb: bad limit %d", limit)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		if b.ThumbnailURL == "" && b.VideoURL != "" {
+			sessions = append(sessions, b)
+		}
+	}
+
+	sort.Sort(sessionsByVideoURL(sessions))
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return sessions, nil
+}
+
+// ListArchiveCounts returns the number of sessions published in each month.
+func (db *memoryDB) ListArchiveCounts(ctx context.Context) ([]ArchiveBucket, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		sessions = append(sessions, b)
+	}
+	return ArchiveBuckets(sessions), nil
+}
+
+// ListSessionsByMonth returns the sessions published in the given month,
+// ordered by publication time.
+func (db *memoryDB) ListSessionsByMonth(ctx context.Context, year, month int) ([]*Session, error) {
+	start, end, err := monthRange(year, month)
+	if err != nil {
+		return nil, fmt.Errorf("memorydb: %v", err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		in := b.PublishedAt.IsZero()
+		if !start.IsZero() {
+			in = !b.PublishedAt.Before(start) && b.PublishedAt.Before(end)
+		}
+		if in {
+			sessions = append(sessions, b)
+		}
+	}
+
+	sort.Sort(sessionsByPublishedAt(sessions))
+	return sessions, nil
+}
+
+// ListSessionsNear returns up to limit sessions held within radiusKm of the
+// given point, nearest first.
+func (db *memoryDB) ListSessionsNear(ctx context.Context, lat, lng, radiusKm float64, limit int) ([]*Session, error) {
+	if !validNearQuery(lat, lng, radiusKm, limit) {
+		return nil, ErrBadLocation
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		sessions = append(sessions, b)
+	}
+	return nearest(sessions, lat, lng, radiusKm, limit), nil
+}
+
+// ListSessionsOnThisDay returns the sessions published on the month and day
+// of ref, in any year, most recently published first.
+func (db *memoryDB) ListSessionsOnThisDay(ctx context.Context, ref time.Time) ([]*Session, error) {
+	lo, hi := onThisDayRange(ref)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		// MonthDay is computed here rather than stored, so it can't be
+		// stale.
+		if md := monthDay(b.PublishedAt); md != 0 && md >= lo && md <= hi {
+			sessions = append(sessions, b)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sessionsByPublishedAt(sessions)))
+	return sessions, nil
+}
+
+// MoveSession moves a session to a new position, renumbering the other
+// sessions so that positions stay contiguous and unique.
+func (db *memoryDB) MoveSession(ctx context.Context, id int64, newPosition int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		sessions = append(sessions, b)
+	}
+
+	if _, err := moveSession(sessions, id, newPosition); err != nil {
+		return fmt.Errorf("memorydb: could not move session: %v", err)
+	}
+	return nil
+}
+
+// ReorderSessions puts the sessions with the given IDs in that order, under
+// one lock.
+func (db *memoryDB) ReorderSessions(ctx context.Context, ids []int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var sessions []*Session
+	for _, b := range db.sessions {
+		sessions = append(sessions, b)
+	}
+	_, err := reorderSessions(sessions, ids)
+	if err == ErrSessionNotFound {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("memorydb: could not reorder sessions: %v", err)
+	}
+	return nil
+}
+
+// RenameTag replaces oldTag with newTag on every session carrying it.
+func (db *memoryDB) RenameTag(ctx context.Context, oldTag, newTag string) (int, error) {
+	if oldTag == newTag {
+		return 0, nil
+	}
+	return db.replaceTag(oldTag, newTag), nil
+}
+
+// RemoveTag removes tag from every session carrying it.
+func (db *memoryDB) RemoveTag(ctx context.Context, tag string) (int, error) {
+	return db.replaceTag(tag, ""), nil
+}
+
+// AddTagToSessions appends tag to the sessions with the given IDs that don't
+// carry it, under one lock.
+func (db *memoryDB) AddTagToSessions(ctx context.Context, ids []int64, tag string) (updated, missing int, err error) {
+	if tag == "" {
+		return 0, 0, errors.New("memorydb: empty tag")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, id := range uniqueIDs(ids) {
+		b, ok := db.sessions[id]
+		if !ok {
+			missing++
+			continue
+		}
+		if tags, ok := addTag(b.Tags, tag); ok {
+			b.Tags = tags
+			db.search.set(b)
+			updated++
+		}
+	}
+	return updated, missing, nil
+}
+
+// BackfillDerivedFields fills in missing derived fields of all sessions.
+func (db *memoryDB) BackfillDerivedFields(ctx context.Context) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	updated := 0
+	for _, b := range db.sessions {
+		changed := fillDerivedFields(b)
+		if b.Slug == "" {
+			db.setSlug(b)
+			changed = true
+		}
+		if changed {
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+func (db *memoryDB) replaceTag(oldTag, newTag string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	affected := 0
+	for _, b := range db.sessions {
+		if tags, ok := replaceTag(b.Tags, oldTag, newTag); ok {
+			b.Tags = tags
+			db.search.set(b)
+			affected++
+		}
+	}
+	return affected
+}
+
+// MergeSessions adds the tags of mergeID to keepID and deletes mergeID.
+func (db *memoryDB) MergeSessions(ctx context.Context, keepID, mergeID int64) error {
+	if keepID == mergeID {
+		return ErrMergeIntoSelf
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	keep, ok := db.sessions[keepID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	merge, ok := db.sessions[mergeID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	keep.Tags = mergeTags(keep.Tags, merge.Tags)
+	keep.Favorites += merge.Favorites
+	keep.ViewCount += merge.ViewCount
+	db.search.set(keep)
+	delete(db.slugs, merge.Slug)
+	db.indexExternalID(merge, nil)
+	db.search.remove(mergeID)
+	delete(db.sessions, mergeID)
+	return nil
+}
+
+// AdjacentSessions returns the sessions immediately before and after the
+// given one in title order, or nil at either end.
+func (db *memoryDB) AdjacentSessions(ctx context.Context, id int64) (prev, next *Session, err error) {
+	sessions, err := db.ListSessions()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, s := range sessions {
+		if s.ID != id {
+			continue
+		}
+		if i > 0 {
+			prev = sessions[i-1]
+		}
+		if i+1 < len(sessions) {
+			next = sessions[i+1]
+		}
+		return prev, next, nil
+	}
+	return nil, nil, ErrSessionNotFound
+}
+
+// RandomSessions returns up to n distinct sessions chosen at random.
+func (db *memoryDB) RandomSessions(ctx context.Context, n int) ([]*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ids := make([]int64, 0, len(db.sessions))
+	for id := range db.sessions {
+		ids = append(ids, id)
+	}
+	if n > len(ids) {
+		n = len(ids)
+	}
+	if n < 0 {
+		n = 0
+	}
+	sessions := make([]*Session, 0, n)
+	for _, i := range rand.Perm(len(ids))[:n] {
+		sessions = append(sessions, db.sessions[ids[i]])
+	}
+	return sessions, nil
+}
+
+// RelatedSessions returns up to limit other sessions by the same author or
+// sharing tags with the given session, most related first.
+func (db *memoryDB) RelatedSessions(ctx context.Context, id int64, limit int) ([]*Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	session, ok := db.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	var candidates []*Session
+	for _, b := range db.sessions {
+		candidates = append(candidates, b)
+	}
+
+	if !hasRelatedFields(session) {
+		return recentSessions(candidates, id, limit), nil
+	}
+	return rankRelated(session, candidates, limit), nil
+}
@@ -0,0 +1,648 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Ensure migratingDB conforms to the SessionDatabase interface.
+var _ SessionDatabase = &migratingDB{}
+
+// migratingDB moves sessions from one backend to another with live traffic.
+// Writes go to the primary and are then copied to the secondary; failed
+// secondary writes are logged and otherwise ignored. A configurable share of
+// reads is served by the secondary, and in shadow mode every read is run
+// against both and differences are logged.
+type migratingDB struct {
+	primary, secondary SessionDatabase
+
+	readPercent int32 // share of reads served by the secondary, 0-100.
+	shadow      int32 // 1 if reads are compared across both backends.
+	mismatches  int64 // number of shadow reads that differed.
+}
+
+// newMigratingDB creates a SessionDatabase that dual-writes to primary and
+// secondary. All reads are served by primary until changed with
+// SetMigrationReads.
+func newMigratingDB(primary, secondary SessionDatabase) *migratingDB {
+	return &migratingDB{
+		primary:   primary,
+		secondary: secondary,
+	}
+}
+
+// errNotMigrating is returned by SetMigrationReads if db isn't migrating.
+var errNotMigrating = errors.New("migratingdb: the database is not being migrated")
+
+// SetMigrationReads sets the percentage of reads served by the secondary
+// backend of a migrating database, and whether reads are shadow-compared
+// across both backends. The migrating database may be wrapped by others,
+// such as the history and slow query log wrappers. It can be called while
+// requests are being served.
+func SetMigrationReads(sdb SessionDatabase, percent int, shadow bool) error {
+	db, ok := sdb.(*migratingDB)
+	for !ok {
+		w, isWrapper := sdb.(interface {
+			unwrap() SessionDatabase
+		})
+		if !isWrapper {
+			return errNotMigrating
+		}
+		sdb = w.unwrap()
+		db, ok = sdb.(*migratingDB)
+	}
+	if percent < 0 || percent > 100 {
+		return errors.New("migratingdb: read percentage must be between 0 and 100")
+	}
+	var v int32
+	if shadow {
+		v = 1
+	}
+	atomic.StoreInt32(&db.readPercent, int32(percent))
+	atomic.StoreInt32(&db.shadow, v)
+	return nil
+}
+
+// Close closes both databases.
+func (db *migratingDB) Close() {
+	db.primary.Close()
+	db.secondary.Close()
+}
+
+// read runs fn against the backend chosen for this read. In shadow mode it
+// also runs fn against the other backend and logs any difference. The chosen
+// backend's result is returned.
+func (db *migratingDB) read(name string, fn func(SessionDatabase) (interface{}, error)) (interface{}, error) {
+	src, other := db.primary, db.secondary
+	if rand.Intn(100) < int(atomic.LoadInt32(&db.readPercent)) {
+		src, other = other, src
+	}
+
+	v, err := fn(src)
+	if atomic.LoadInt32(&db.shadow) == 1 {
+		ov, oerr := fn(other)
+		if !sameResult(v, err, ov, oerr) {
+			atomic.AddInt64(&db.mismatches, 1)
+			log.Printf("migratingdb: %s differs between backends: got %s, %v and %s, %v",
+				name, encodeResult(v), err, encodeResult(ov), oerr)
+		}
+	}
+	return v, err
+}
+
+// sameResult reports whether two read results are equivalent. Values are
+// compared by their JSON encoding, which ignores backend-specific details such
+// as time zones of otherwise equal times.
+func sameResult(v1 interface{}, err1 error, v2 interface{}, err2 error) bool {
+	if (err1 == nil) != (err2 == nil) {
+		return false
+	}
+	if err1 != nil {
+		// Backends word their errors differently; only not-found is comparable.
+		return (err1 == ErrSessionNotFound) == (err2 == ErrSessionNotFound)
+	}
+	return bytes.Equal(encodeResult(v1), encodeResult(v2))
+}
+
+// encodeResult returns the JSON encoding of a read result for comparing and
+// logging.
+func encodeResult(v interface{}) []byte {
+	b, err := json.Marshal(normalizeTimes(v))
+	if err != nil {
+		return []byte(err.Error())
+	}
+	return b
+}
+
+// normalizeTimes returns v with the times of any sessions in it converted to
+// UTC, so that the same instant encodes identically.
+func normalizeTimes(v interface{}) interface{} {
+	norm := func(s *Session) *Session {
+		if s == nil {
+			return nil
+		}
+		c := *s
+		c.CreatedAt = c.CreatedAt.UTC()
+		c.PublishedAt = c.PublishedAt.UTC()
+		return &c
+	}
+	switch v := v.(type) {
+	case *Session:
+		return norm(v)
+	case []*Session:
+		out := make([]*Session, len(v))
+		for i, s := range v {
+			out[i] = norm(s)
+		}
+		return out
+	case facetedResults:
+		return facetedResults{normalizeTimes(v.Results).([]*Session), v.Facets}
+	}
+	return v
+}
+
+// writeSecondary logs the failure of a write to the secondary backend.
+func (db *migratingDB) writeSecondary(name string, err error) {
+	if err != nil {
+		log.Printf("migratingdb: secondary %s failed: %v", name, err)
+	}
+}
+
+// ListSessions returns a list of sessions, ordered by title.
+func (db *migratingDB) ListSessions() ([]*Session, error) {
+	v, err := db.read("ListSessions", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessions()
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// ListArchiveCounts returns the number of sessions published in each month.
+func (db *migratingDB) ListArchiveCounts(ctx context.Context) ([]ArchiveBucket, error) {
+	v, err := db.read("ListArchiveCounts", func(d SessionDatabase) (interface{}, error) {
+		return d.ListArchiveCounts(ctx)
+	})
+	buckets, _ := v.([]ArchiveBucket)
+	return buckets, err
+}
+
+// ListSessionsByMonth returns the sessions published in the given month.
+func (db *migratingDB) ListSessionsByMonth(ctx context.Context, year, month int) ([]*Session, error) {
+	v, err := db.read("ListSessionsByMonth", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionsByMonth(ctx, year, month)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// ListSessionsAtSnapshot returns all sessions as they were at a single point
+// in time.
+func (db *migratingDB) ListSessionsAtSnapshot(ctx context.Context) ([]*Session, error) {
+	v, err := db.read("ListSessionsAtSnapshot", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionsAtSnapshot(ctx)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// SearchSessions returns a page of the sessions matching query.
+func (db *migratingDB) SearchSessions(ctx context.Context, query string, limit, offset int) ([]*Session, error) {
+	v, err := db.read("SearchSessions", func(d SessionDatabase) (interface{}, error) {
+		return d.SearchSessions(ctx, query, limit, offset)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// SearchWithFacets returns the sessions matching query and tags, with the
+// counts of their other tags.
+func (db *migratingDB) SearchWithFacets(ctx context.Context, query string, tags []string) ([]*Session, map[string]int, error) {
+	v, err := db.read("SearchWithFacets", func(d SessionDatabase) (interface{}, error) {
+		results, facets, err := d.SearchWithFacets(ctx, query, tags)
+		return facetedResults{results, facets}, err
+	})
+	r, _ := v.(facetedResults)
+	return r.Results, r.Facets, err
+}
+
+// facetedResults holds the results of SearchWithFacets, so reads from both
+// databases can be compared.
+type facetedResults struct {
+	Results []*Session
+	Facets  map[string]int
+}
+
+// CountSearchSessions returns the number of sessions matching query.
+func (db *migratingDB) CountSearchSessions(ctx context.Context, query string) (int, error) {
+	v, err := db.read("CountSearchSessions", func(d SessionDatabase) (interface{}, error) {
+		return d.CountSearchSessions(ctx, query)
+	})
+	n, _ := v.(int)
+	return n, err
+}
+
+// ListSessionsPage returns a page of sessions from the primary. Page tokens
+// are specific to a backend, so pages aren't split between them.
+func (db *migratingDB) ListSessionsPage(ctx context.Context, pageToken string, limit int) (*SessionList, error) {
+	return db.primary.ListSessionsPage(ctx, pageToken, limit)
+}
+
+// ListSessionsByTagPage returns a page of the sessions with tag from the
+// primary, as page tokens are specific to a backend.
+func (db *migratingDB) ListSessionsByTagPage(ctx context.Context, tag string, limit int, pageToken string) ([]*Session, string, error) {
+	return db.primary.ListSessionsByTagPage(ctx, tag, limit, pageToken)
+}
+
+// IterateSessions calls fn for each session in the primary, in title order.
+// Sessions are streamed to fn, so they can't be compared between backends.
+func (db *migratingDB) IterateSessions(ctx context.Context, fn func(*Session) error) error {
+	return db.primary.IterateSessions(ctx, fn)
+}
+
+// ListSessionsFor returns the sessions v may see listed, ordered by title.
+func (db *migratingDB) ListSessionsFor(ctx context.Context, viewer Viewer) ([]*Session, error) {
+	v, err := db.read("ListSessionsFor", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionsFor(ctx, viewer)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// ListSessionSummaries returns the summaries of all sessions, ordered by
+// title.
+func (db *migratingDB) ListSessionSummaries(ctx context.Context) ([]*SessionSummary, error) {
+	v, err := db.read("ListSessionSummaries", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionSummaries(ctx)
+	})
+	summaries, _ := v.([]*SessionSummary)
+	return summaries, err
+}
+
+// ListSessionsSorted returns all sessions in the given order.
+func (db *migratingDB) ListSessionsSorted(ctx context.Context, order string) ([]*Session, error) {
+	v, err := db.read("ListSessionsSorted", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionsSorted(ctx, order)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// ListSessionsCreatedBy returns a list of sessions, filtered by the user who
+// created the session entry, in the given order.
+func (db *migratingDB) ListSessionsCreatedBy(ctx context.Context, userID, order string, desc bool) ([]*Session, error) {
+	v, err := db.read("ListSessionsCreatedBy", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionsCreatedBy(ctx, userID, order, desc)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// CountSessionsCreatedBy returns the number of sessions created by the given
+// user.
+func (db *migratingDB) CountSessionsCreatedBy(ctx context.Context, userID string) (int, error) {
+	v, err := db.read("CountSessionsCreatedBy", func(d SessionDatabase) (interface{}, error) {
+		return d.CountSessionsCreatedBy(ctx, userID)
+	})
+	n, _ := v.(int)
+	return n, err
+}
+
+// StorageUsageByUser returns the total SizeBytes of the sessions created by
+// each user, keyed by CreatedByID.
+func (db *migratingDB) StorageUsageByUser(ctx context.Context) (map[string]int64, error) {
+	v, err := db.read("StorageUsageByUser", func(d SessionDatabase) (interface{}, error) {
+		return d.StorageUsageByUser(ctx)
+	})
+	usage, _ := v.(map[string]int64)
+	return usage, err
+}
+
+// ListSessionsNear returns up to limit sessions held within radiusKm of the
+// given point, nearest first.
+func (db *migratingDB) ListSessionsNear(ctx context.Context, lat, lng, radiusKm float64, limit int) ([]*Session, error) {
+	v, err := db.read("ListSessionsNear", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionsNear(ctx, lat, lng, radiusKm, limit)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// ListSessionsOnThisDay returns the sessions published on the month and day
+// of ref, in any year, most recently published first.
+func (db *migratingDB) ListSessionsOnThisDay(ctx context.Context, ref time.Time) ([]*Session, error) {
+	v, err := db.read("ListSessionsOnThisDay", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionsOnThisDay(ctx, ref)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// ListSessionsByPosition returns a list of sessions, ordered by position.
+func (db *migratingDB) ListSessionsByPosition(ctx context.Context) ([]*Session, error) {
+	v, err := db.read("ListSessionsByPosition", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionsByPosition(ctx)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// ListSessionsByPresenter returns the sessions the named person presents,
+// ordered by title.
+func (db *migratingDB) ListSessionsByPresenter(ctx context.Context, presenter string) ([]*Session, error) {
+	v, err := db.read("ListSessionsByPresenter", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionsByPresenter(ctx, presenter)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// ListRecentSessions returns the limit most recently added sessions, newest
+// first.
+func (db *migratingDB) ListRecentSessions(ctx context.Context, limit int) ([]*Session, error) {
+	v, err := db.read("ListRecentSessions", func(d SessionDatabase) (interface{}, error) {
+		return d.ListRecentSessions(ctx, limit)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// ListSessionsWithoutThumbnail returns up to limit sessions with a video but
+// no thumbnail.
+func (db *migratingDB) ListSessionsWithoutThumbnail(ctx context.Context, limit int) ([]*Session, error) {
+	v, err := db.read("ListSessionsWithoutThumbnail", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionsWithoutThumbnail(ctx, limit)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// ListSessionsCreatedBetween returns the sessions added between from and to,
+// inclusive, ordered by creation time.
+func (db *migratingDB) ListSessionsCreatedBetween(ctx context.Context, from, to time.Time) ([]*Session, error) {
+	v, err := db.read("ListSessionsCreatedBetween", func(d SessionDatabase) (interface{}, error) {
+		return d.ListSessionsCreatedBetween(ctx, from, to)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// GetSession retrieves a session by its ID.
+func (db *migratingDB) GetSession(id int64) (*Session, error) {
+	v, err := db.read("GetSession", func(d SessionDatabase) (interface{}, error) {
+		return d.GetSession(id)
+	})
+	session, _ := v.(*Session)
+	return session, err
+}
+
+// GetSessionsOrdered retrieves the sessions with the given IDs, in order.
+func (db *migratingDB) GetSessionsOrdered(ctx context.Context, ids []int64) ([]*Session, error) {
+	v, err := db.read("GetSessionsOrdered", func(d SessionDatabase) (interface{}, error) {
+		return d.GetSessionsOrdered(ctx, ids)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// GetSessionBySlug retrieves a session by its slug.
+func (db *migratingDB) GetSessionBySlug(ctx context.Context, slug string) (*Session, error) {
+	v, err := db.read("GetSessionBySlug", func(d SessionDatabase) (interface{}, error) {
+		return d.GetSessionBySlug(ctx, slug)
+	})
+	session, _ := v.(*Session)
+	return session, err
+}
+
+// GetSessionByPublicID retrieves a session by its public ID.
+func (db *migratingDB) GetSessionByPublicID(ctx context.Context, publicID string) (*Session, error) {
+	v, err := db.read("GetSessionByPublicID", func(d SessionDatabase) (interface{}, error) {
+		return d.GetSessionByPublicID(ctx, publicID)
+	})
+	session, _ := v.(*Session)
+	return session, err
+}
+
+// RelatedSessions returns up to limit sessions related to the given one.
+func (db *migratingDB) RelatedSessions(ctx context.Context, id int64, limit int) ([]*Session, error) {
+	v, err := db.read("RelatedSessions", func(d SessionDatabase) (interface{}, error) {
+		return d.RelatedSessions(ctx, id, limit)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// AdjacentSessions returns the sessions immediately before and after the
+// given one in title order, or nil at either end.
+func (db *migratingDB) AdjacentSessions(ctx context.Context, id int64) (prev, next *Session, err error) {
+	v, err := db.read("AdjacentSessions", func(d SessionDatabase) (interface{}, error) {
+		prev, next, err := d.AdjacentSessions(ctx, id)
+		return [2]*Session{prev, next}, err
+	})
+	adjacent, _ := v.([2]*Session)
+	return adjacent[0], adjacent[1], err
+}
+
+// RandomSessions returns up to n distinct sessions chosen at random.
+func (db *migratingDB) RandomSessions(ctx context.Context, n int) ([]*Session, error) {
+	v, err := db.read("RandomSessions", func(d SessionDatabase) (interface{}, error) {
+		return d.RandomSessions(ctx, n)
+	})
+	sessions, _ := v.([]*Session)
+	return sessions, err
+}
+
+// LookupByContentHash returns a session whose uploaded file has the given
+// content hash.
+func (db *migratingDB) LookupByContentHash(ctx context.Context, hash string) (*Session, error) {
+	v, err := db.read("LookupByContentHash", func(d SessionDatabase) (interface{}, error) {
+		return d.LookupByContentHash(ctx, hash)
+	})
+	session, _ := v.(*Session)
+	return session, err
+}
+
+// SessionExists reports whether a session with the given ID exists.
+func (db *migratingDB) SessionExists(ctx context.Context, id int64) (bool, error) {
+	v, err := db.read("SessionExists", func(d SessionDatabase) (interface{}, error) {
+		return d.SessionExists(ctx, id)
+	})
+	ok, _ := v.(bool)
+	return ok, err
+}
+
+// AddSession saves a given session to the primary, which assigns its ID, and
+// then stores a copy under the same ID in the secondary.
+func (db *migratingDB) AddSession(b *Session) (id int64, err error) {
+	id, err = db.primary.AddSession(b)
+	if err != nil {
+		return 0, err
+	}
+	c := *b
+	db.writeSecondary("AddSession", db.secondary.UpdateSession(&c))
+	return id, nil
+}
+
+// DeleteSession removes a given session by its ID.
+func (db *migratingDB) DeleteSession(id int64) error {
+	if err := db.primary.DeleteSession(id); err != nil {
+		return err
+	}
+	db.writeSecondary("DeleteSession", db.secondary.DeleteSession(id))
+	return nil
+}
+
+// DeleteSessions removes the sessions with the given IDs.
+func (db *migratingDB) DeleteSessions(ctx context.Context, ids []int64) (deleted int, errs map[int64]error) {
+	deleted, errs = db.primary.DeleteSessions(ctx, ids)
+	_, secondaryErrs := db.secondary.DeleteSessions(ctx, ids)
+	for id, err := range secondaryErrs {
+		if errs[id] == nil {
+			db.writeSecondary("DeleteSessions", err)
+		}
+	}
+	return deleted, errs
+}
+
+// UpdateSession updates the entry for a given session.
+func (db *migratingDB) UpdateSession(b *Session) error {
+	if err := db.primary.UpdateSession(b); err != nil {
+		return err
+	}
+	c := *b
+	db.writeSecondary("UpdateSession", db.secondary.UpdateSession(&c))
+	return nil
+}
+
+// MoveSession moves a session to a new position.
+func (db *migratingDB) MoveSession(ctx context.Context, id int64, newPosition int) error {
+	if err := db.primary.MoveSession(ctx, id, newPosition); err != nil {
+		return err
+	}
+	db.writeSecondary("MoveSession", db.secondary.MoveSession(ctx, id, newPosition))
+	return nil
+}
+
+// ReorderSessions puts the sessions with the given IDs in that order.
+func (db *migratingDB) ReorderSessions(ctx context.Context, ids []int64) error {
+	if err := db.primary.ReorderSessions(ctx, ids); err != nil {
+		return err
+	}
+	db.writeSecondary("ReorderSessions", db.secondary.ReorderSessions(ctx, ids))
+	return nil
+}
+
+// RenameTag replaces oldTag with newTag on every session carrying it.
+func (db *migratingDB) RenameTag(ctx context.Context, oldTag, newTag string) (affected int, err error) {
+	affected, err = db.primary.RenameTag(ctx, oldTag, newTag)
+	if err != nil {
+		return affected, err
+	}
+	_, err = db.secondary.RenameTag(ctx, oldTag, newTag)
+	db.writeSecondary("RenameTag", err)
+	return affected, nil
+}
+
+// UpsertSessionByExternalID adds or replaces a session by its ExternalID in
+// the primary, then writes the result to the secondary under the same ID.
+func (db *migratingDB) UpsertSessionByExternalID(ctx context.Context, b *Session) (int64, bool, error) {
+	id, created, err := db.primary.UpsertSessionByExternalID(ctx, b)
+	if err != nil {
+		return 0, false, err
+	}
+	c := *b
+	db.writeSecondary("UpsertSessionByExternalID", db.secondary.UpdateSession(&c))
+	return id, created, nil
+}
+
+// TouchSession sets the UpdatedAt time of a session to now in both databases.
+func (db *migratingDB) TouchSession(ctx context.Context, id int64) error {
+	if err := db.primary.TouchSession(ctx, id); err != nil {
+		return err
+	}
+	db.writeSecondary("TouchSession", db.secondary.TouchSession(ctx, id))
+	return nil
+}
+
+// IncrementViewCount adds n to the ViewCount of a session in both databases.
+func (db *migratingDB) IncrementViewCount(ctx context.Context, id int64, n int64) error {
+	if err := db.primary.IncrementViewCount(ctx, id, n); err != nil {
+		return err
+	}
+	db.writeSecondary("IncrementViewCount", db.secondary.IncrementViewCount(ctx, id, n))
+	return nil
+}
+
+// ClaimNextUnprocessed claims a session in the primary database. Claims are
+// only kept in the primary, which alone decides which worker holds one.
+func (db *migratingDB) ClaimNextUnprocessed(ctx context.Context, workerID string, lease time.Duration) (*Session, error) {
+	return db.primary.ClaimNextUnprocessed(ctx, workerID, lease)
+}
+
+// ReleaseClaim gives up a claim in the primary database.
+func (db *migratingDB) ReleaseClaim(ctx context.Context, id int64, workerID string) error {
+	return db.primary.ReleaseClaim(ctx, id, workerID)
+}
+
+// MarkProcessed marks a session processed in both databases.
+func (db *migratingDB) MarkProcessed(ctx context.Context, id int64) error {
+	if err := db.primary.MarkProcessed(ctx, id); err != nil {
+		return err
+	}
+	db.writeSecondary("MarkProcessed", db.secondary.MarkProcessed(ctx, id))
+	return nil
+}
+
+// LockSession acquires an edit lock in the primary database, which decides
+// who holds it, and copies it to the secondary, as reads checking for locks
+// may go to either.
+func (db *migratingDB) LockSession(ctx context.Context, id int64, userID, name string, ttl time.Duration) error {
+	if err := db.primary.LockSession(ctx, id, userID, name, ttl); err != nil {
+		return err
+	}
+	db.writeSecondary("LockSession", db.secondary.LockSession(ctx, id, userID, name, ttl))
+	return nil
+}
+
+// UnlockSession releases an edit lock in both databases.
+func (db *migratingDB) UnlockSession(ctx context.Context, id int64, userID string) error {
+	if err := db.primary.UnlockSession(ctx, id, userID); err != nil {
+		return err
+	}
+	db.writeSecondary("UnlockSession", db.secondary.UnlockSession(ctx, id, userID))
+	return nil
+}
+
+// MergeSessions merges the session mergeID into keepID.
+func (db *migratingDB) MergeSessions(ctx context.Context, keepID, mergeID int64) error {
+	if err := db.primary.MergeSessions(ctx, keepID, mergeID); err != nil {
+		return err
+	}
+	db.writeSecondary("MergeSessions", db.secondary.MergeSessions(ctx, keepID, mergeID))
+	return nil
+}
+
+// BackfillDerivedFields fills in missing derived fields of all sessions in
+// both databases, returning the number changed in the primary.
+func (db *migratingDB) BackfillDerivedFields(ctx context.Context) (updated int, err error) {
+	updated, err = db.primary.BackfillDerivedFields(ctx)
+	if err != nil {
+		return updated, err
+	}
+	_, err = db.secondary.BackfillDerivedFields(ctx)
+	db.writeSecondary("BackfillDerivedFields", err)
+	return updated, nil
+}
+
+// AddTagToSessions adds tag to the given sessions in both databases,
+// returning the counts of the primary.
+func (db *migratingDB) AddTagToSessions(ctx context.Context, ids []int64, tag string) (updated, missing int, err error) {
+	updated, missing, err = db.primary.AddTagToSessions(ctx, ids, tag)
+	if err != nil {
+		return updated, missing, err
+	}
+	_, _, err = db.secondary.AddTagToSessions(ctx, ids, tag)
+	db.writeSecondary("AddTagToSessions", err)
+	return updated, missing, nil
+}
+
+// RemoveTag removes tag from every session carrying it.
+func (db *migratingDB) RemoveTag(ctx context.Context, tag string) (affected int, err error) {
+	affected, err = db.primary.RemoveTag(ctx, tag)
+	if err != nil {
+		return affected, err
+	}
+	_, err = db.secondary.RemoveTag(ctx, tag)
+	db.writeSecondary("RemoveTag", err)
+	return affected, nil
+}
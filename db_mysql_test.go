@@ -0,0 +1,46 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build mysql
+// +build mysql
+
+// The MySQL backend isn't part of this tree; build with -tags mysql alongside
+// a db_mysql.go that provides newMySQLDB to run this test.
+
+package vyfe_api
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestMySQLDB(t *testing.T) {
+	t.Parallel()
+
+	host := os.Getenv("GOLANG_SAMPLES_MYSQL_HOST")
+	port := os.Getenv("GOLANG_SAMPLES_MYSQL_PORT")
+
+	if host == "" {
+		t.Skip("GOLANG_SAMPLES_MYSQL_HOST not set.")
+	}
+	if port == "" {
+		port = "3306"
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("Could not parse port: %v", err)
+	}
+
+	db, err := newMySQLDB(MySQLConfig{
+		Username: "root",
+		Host:     host,
+		Port:     p,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB(t, db)
+}
@@ -0,0 +1,45 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"strconv"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Ensure singleflightDB conforms to the SessionDatabase interface.
+var _ SessionDatabase = &singleflightDB{}
+
+// singleflightDB wraps a SessionDatabase so that concurrent GetSession calls
+// for the same ID share a single call to the wrapped database, e.g. when a
+// popular session's page gets a burst of requests. All other methods go
+// straight to the wrapped database, so it can be stacked with other wrappers.
+//
+// Callers sharing a call get the same *Session and must not modify it.
+type singleflightDB struct {
+	SessionDatabase
+
+	group singleflight.Group
+}
+
+// newSingleflightDB creates a SessionDatabase that deduplicates concurrent
+// GetSession calls to db.
+func newSingleflightDB(db SessionDatabase) *singleflightDB {
+	return &singleflightDB{SessionDatabase: db}
+}
+
+// unwrap returns the wrapped database.
+func (db *singleflightDB) unwrap() SessionDatabase { return db.SessionDatabase }
+
+// GetSession retrieves a session by its ID, sharing the result with any
+// concurrent calls for the same ID.
+func (db *singleflightDB) GetSession(id int64) (*Session, error) {
+	v, err, _ := db.group.Do(strconv.FormatInt(id, 10), func() (interface{}, error) {
+		return db.SessionDatabase.GetSession(id)
+	})
+	session, _ := v.(*Session)
+	return session, err
+}
@@ -0,0 +1,314 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Ensure slowlogDB conforms to the SessionDatabase interface.
+var _ SessionDatabase = &slowlogDB{}
+
+// slowlogDB wraps a SessionDatabase, logging every call that takes longer
+// than a threshold with its name, duration and IDs or other key arguments.
+// Results and errors are passed through unchanged, so it can be stacked with
+// other wrappers.
+type slowlogDB struct {
+	db        SessionDatabase
+	threshold time.Duration
+
+	// logf writes the log lines. It defaults to log.Printf.
+	logf func(format string, v ...interface{})
+}
+
+// newSlowlogDB creates a SessionDatabase that logs calls to db taking
+// longer than threshold.
+func newSlowlogDB(db SessionDatabase, threshold time.Duration) *slowlogDB {
+	return &slowlogDB{db: db, threshold: threshold, logf: log.Printf}
+}
+
+// unwrap returns the wrapped database.
+func (db *slowlogDB) unwrap() SessionDatabase { return db.db }
+
+// observe logs the call op, started at start, if it took longer than the
+// threshold. kv lists alternating keys and values to include. It is meant to
+// be deferred.
+func (db *slowlogDB) observe(op string, start time.Time, kv ...interface{}) {
+	d := time.Since(start)
+	if d <= db.threshold {
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "slowlogdb: slow operation op=%s duration=%v", op, d)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&buf, " %v=%v", kv[i], kv[i+1])
+	}
+	db.logf("%s", buf.String())
+}
+
+func (db *slowlogDB) ListSessions() ([]*Session, error) {
+	defer db.observe("ListSessions", time.Now())
+	return db.db.ListSessions()
+}
+
+func (db *slowlogDB) ListArchiveCounts(ctx context.Context) ([]ArchiveBucket, error) {
+	defer db.observe("ListArchiveCounts", time.Now())
+	return db.db.ListArchiveCounts(ctx)
+}
+
+func (db *slowlogDB) ListSessionsByMonth(ctx context.Context, year, month int) ([]*Session, error) {
+	defer db.observe("ListSessionsByMonth", time.Now(), "year", year, "month", month)
+	return db.db.ListSessionsByMonth(ctx, year, month)
+}
+
+func (db *slowlogDB) ListSessionsAtSnapshot(ctx context.Context) ([]*Session, error) {
+	defer db.observe("ListSessionsAtSnapshot", time.Now())
+	return db.db.ListSessionsAtSnapshot(ctx)
+}
+
+func (db *slowlogDB) SearchSessions(ctx context.Context, query string, limit, offset int) ([]*Session, error) {
+	defer db.observe("SearchSessions", time.Now(), "query", fmt.Sprintf("%q", query), "limit", limit, "offset", offset)
+	return db.db.SearchSessions(ctx, query, limit, offset)
+}
+
+func (db *slowlogDB) CountSearchSessions(ctx context.Context, query string) (int, error) {
+	defer db.observe("CountSearchSessions", time.Now(), "query", fmt.Sprintf("%q", query))
+	return db.db.CountSearchSessions(ctx, query)
+}
+
+func (db *slowlogDB) SearchWithFacets(ctx context.Context, query string, tags []string) ([]*Session, map[string]int, error) {
+	defer db.observe("SearchWithFacets", time.Now(), "query", fmt.Sprintf("%q", query), "tags", fmt.Sprintf("%q", tags))
+	return db.db.SearchWithFacets(ctx, query, tags)
+}
+
+func (db *slowlogDB) ListSessionsPage(ctx context.Context, pageToken string, limit int) (*SessionList, error) {
+	defer db.observe("ListSessionsPage", time.Now(), "limit", limit)
+	return db.db.ListSessionsPage(ctx, pageToken, limit)
+}
+
+func (db *slowlogDB) ListSessionsByTagPage(ctx context.Context, tag string, limit int, pageToken string) ([]*Session, string, error) {
+	defer db.observe("ListSessionsByTagPage", time.Now(), "tag", tag, "limit", limit)
+	return db.db.ListSessionsByTagPage(ctx, tag, limit, pageToken)
+}
+
+// IterateSessions is timed as a whole, including the time spent in fn.
+func (db *slowlogDB) IterateSessions(ctx context.Context, fn func(*Session) error) error {
+	defer db.observe("IterateSessions", time.Now())
+	return db.db.IterateSessions(ctx, fn)
+}
+
+func (db *slowlogDB) ListSessionsFor(ctx context.Context, v Viewer) ([]*Session, error) {
+	defer db.observe("ListSessionsFor", time.Now(), "user", v.UserID)
+	return db.db.ListSessionsFor(ctx, v)
+}
+
+func (db *slowlogDB) ListSessionSummaries(ctx context.Context) ([]*SessionSummary, error) {
+	defer db.observe("ListSessionSummaries", time.Now())
+	return db.db.ListSessionSummaries(ctx)
+}
+
+func (db *slowlogDB) ListSessionsSorted(ctx context.Context, order string) ([]*Session, error) {
+	defer db.observe("ListSessionsSorted", time.Now(), "order", order)
+	return db.db.ListSessionsSorted(ctx, order)
+}
+
+func (db *slowlogDB) ListSessionsCreatedBy(ctx context.Context, userID, order string, desc bool) ([]*Session, error) {
+	defer db.observe("ListSessionsCreatedBy", time.Now(), "user", userID, "order", order, "desc", desc)
+	return db.db.ListSessionsCreatedBy(ctx, userID, order, desc)
+}
+
+func (db *slowlogDB) CountSessionsCreatedBy(ctx context.Context, userID string) (int, error) {
+	defer db.observe("CountSessionsCreatedBy", time.Now(), "user", userID)
+	return db.db.CountSessionsCreatedBy(ctx, userID)
+}
+
+func (db *slowlogDB) StorageUsageByUser(ctx context.Context) (map[string]int64, error) {
+	defer db.observe("StorageUsageByUser", time.Now())
+	return db.db.StorageUsageByUser(ctx)
+}
+
+func (db *slowlogDB) ListSessionsNear(ctx context.Context, lat, lng, radiusKm float64, limit int) ([]*Session, error) {
+	defer db.observe("ListSessionsNear", time.Now(), "lat", lat, "lng", lng, "radius", radiusKm, "limit", limit)
+	return db.db.ListSessionsNear(ctx, lat, lng, radiusKm, limit)
+}
+
+func (db *slowlogDB) ListSessionsOnThisDay(ctx context.Context, ref time.Time) ([]*Session, error) {
+	defer db.observe("ListSessionsOnThisDay", time.Now(), "ref", ref.Format("01-02"))
+	return db.db.ListSessionsOnThisDay(ctx, ref)
+}
+
+func (db *slowlogDB) ListSessionsByPosition(ctx context.Context) ([]*Session, error) {
+	defer db.observe("ListSessionsByPosition", time.Now())
+	return db.db.ListSessionsByPosition(ctx)
+}
+
+func (db *slowlogDB) ListSessionsByPresenter(ctx context.Context, presenter string) ([]*Session, error) {
+	defer db.observe("ListSessionsByPresenter", time.Now(), "presenter", presenter)
+	return db.db.ListSessionsByPresenter(ctx, presenter)
+}
+
+func (db *slowlogDB) ListSessionsCreatedBetween(ctx context.Context, from, to time.Time) ([]*Session, error) {
+	defer db.observe("ListSessionsCreatedBetween", time.Now(), "from", from.Format(time.RFC3339), "to", to.Format(time.RFC3339))
+	return db.db.ListSessionsCreatedBetween(ctx, from, to)
+}
+
+func (db *slowlogDB) ListRecentSessions(ctx context.Context, limit int) ([]*Session, error) {
+	defer db.observe("ListRecentSessions", time.Now(), "limit", limit)
+	return db.db.ListRecentSessions(ctx, limit)
+}
+
+func (db *slowlogDB) ListSessionsWithoutThumbnail(ctx context.Context, limit int) ([]*Session, error) {
+	defer db.observe("ListSessionsWithoutThumbnail", time.Now(), "limit", limit)
+	return db.db.ListSessionsWithoutThumbnail(ctx, limit)
+}
+
+func (db *slowlogDB) GetSession(id int64) (*Session, error) {
+	defer db.observe("GetSession", time.Now(), "id", id)
+	return db.db.GetSession(id)
+}
+
+func (db *slowlogDB) GetSessionsOrdered(ctx context.Context, ids []int64) ([]*Session, error) {
+	defer db.observe("GetSessionsOrdered", time.Now(), "ids", ids)
+	return db.db.GetSessionsOrdered(ctx, ids)
+}
+
+func (db *slowlogDB) GetSessionBySlug(ctx context.Context, slug string) (*Session, error) {
+	defer db.observe("GetSessionBySlug", time.Now(), "slug", slug)
+	return db.db.GetSessionBySlug(ctx, slug)
+}
+
+func (db *slowlogDB) GetSessionByPublicID(ctx context.Context, publicID string) (*Session, error) {
+	defer db.observe("GetSessionByPublicID", time.Now(), "publicId", publicID)
+	return db.db.GetSessionByPublicID(ctx, publicID)
+}
+
+func (db *slowlogDB) RelatedSessions(ctx context.Context, id int64, limit int) ([]*Session, error) {
+	defer db.observe("RelatedSessions", time.Now(), "id", id, "limit", limit)
+	return db.db.RelatedSessions(ctx, id, limit)
+}
+
+func (db *slowlogDB) AdjacentSessions(ctx context.Context, id int64) (*Session, *Session, error) {
+	defer db.observe("AdjacentSessions", time.Now(), "id", id)
+	return db.db.AdjacentSessions(ctx, id)
+}
+
+func (db *slowlogDB) RandomSessions(ctx context.Context, n int) ([]*Session, error) {
+	defer db.observe("RandomSessions", time.Now(), "n", n)
+	return db.db.RandomSessions(ctx, n)
+}
+
+func (db *slowlogDB) LookupByContentHash(ctx context.Context, hash string) (*Session, error) {
+	defer db.observe("LookupByContentHash", time.Now(), "hash", hash)
+	return db.db.LookupByContentHash(ctx, hash)
+}
+
+func (db *slowlogDB) SessionExists(ctx context.Context, id int64) (bool, error) {
+	defer db.observe("SessionExists", time.Now(), "id", id)
+	return db.db.SessionExists(ctx, id)
+}
+
+func (db *slowlogDB) AddSession(b *Session) (int64, error) {
+	defer db.observe("AddSession", time.Now())
+	return db.db.AddSession(b)
+}
+
+func (db *slowlogDB) UpsertSessionByExternalID(ctx context.Context, b *Session) (int64, bool, error) {
+	defer db.observe("UpsertSessionByExternalID", time.Now(), "externalId", b.ExternalID)
+	return db.db.UpsertSessionByExternalID(ctx, b)
+}
+
+func (db *slowlogDB) DeleteSession(id int64) error {
+	defer db.observe("DeleteSession", time.Now(), "id", id)
+	return db.db.DeleteSession(id)
+}
+
+func (db *slowlogDB) DeleteSessions(ctx context.Context, ids []int64) (int, map[int64]error) {
+	defer db.observe("DeleteSessions", time.Now(), "ids", ids)
+	return db.db.DeleteSessions(ctx, ids)
+}
+
+func (db *slowlogDB) UpdateSession(b *Session) error {
+	defer db.observe("UpdateSession", time.Now(), "id", b.ID)
+	return db.db.UpdateSession(b)
+}
+
+func (db *slowlogDB) MoveSession(ctx context.Context, id int64, newPosition int) error {
+	defer db.observe("MoveSession", time.Now(), "id", id, "position", newPosition)
+	return db.db.MoveSession(ctx, id, newPosition)
+}
+
+func (db *slowlogDB) ReorderSessions(ctx context.Context, ids []int64) error {
+	defer db.observe("ReorderSessions", time.Now(), "ids", len(ids))
+	return db.db.ReorderSessions(ctx, ids)
+}
+
+func (db *slowlogDB) RenameTag(ctx context.Context, oldTag, newTag string) (int, error) {
+	defer db.observe("RenameTag", time.Now(), "old", oldTag, "new", newTag)
+	return db.db.RenameTag(ctx, oldTag, newTag)
+}
+
+func (db *slowlogDB) RemoveTag(ctx context.Context, tag string) (int, error) {
+	defer db.observe("RemoveTag", time.Now(), "tag", tag)
+	return db.db.RemoveTag(ctx, tag)
+}
+
+func (db *slowlogDB) AddTagToSessions(ctx context.Context, ids []int64, tag string) (int, int, error) {
+	defer db.observe("AddTagToSessions", time.Now(), "ids", len(ids), "tag", tag)
+	return db.db.AddTagToSessions(ctx, ids, tag)
+}
+
+func (db *slowlogDB) TouchSession(ctx context.Context, id int64) error {
+	defer db.observe("TouchSession", time.Now(), "id", id)
+	return db.db.TouchSession(ctx, id)
+}
+
+func (db *slowlogDB) IncrementViewCount(ctx context.Context, id int64, n int64) error {
+	defer db.observe("IncrementViewCount", time.Now(), "id", id, "n", n)
+	return db.db.IncrementViewCount(ctx, id, n)
+}
+
+func (db *slowlogDB) ClaimNextUnprocessed(ctx context.Context, workerID string, lease time.Duration) (*Session, error) {
+	defer db.observe("ClaimNextUnprocessed", time.Now(), "worker", workerID, "lease", lease)
+	return db.db.ClaimNextUnprocessed(ctx, workerID, lease)
+}
+
+func (db *slowlogDB) ReleaseClaim(ctx context.Context, id int64, workerID string) error {
+	defer db.observe("ReleaseClaim", time.Now(), "id", id, "worker", workerID)
+	return db.db.ReleaseClaim(ctx, id, workerID)
+}
+
+func (db *slowlogDB) MarkProcessed(ctx context.Context, id int64) error {
+	defer db.observe("MarkProcessed", time.Now(), "id", id)
+	return db.db.MarkProcessed(ctx, id)
+}
+
+func (db *slowlogDB) LockSession(ctx context.Context, id int64, userID, name string, ttl time.Duration) error {
+	defer db.observe("LockSession", time.Now(), "id", id, "user", userID, "ttl", ttl)
+	return db.db.LockSession(ctx, id, userID, name, ttl)
+}
+
+func (db *slowlogDB) UnlockSession(ctx context.Context, id int64, userID string) error {
+	defer db.observe("UnlockSession", time.Now(), "id", id, "user", userID)
+	return db.db.UnlockSession(ctx, id, userID)
+}
+
+func (db *slowlogDB) MergeSessions(ctx context.Context, keepID, mergeID int64) error {
+	defer db.observe("MergeSessions", time.Now(), "keep", keepID, "merge", mergeID)
+	return db.db.MergeSessions(ctx, keepID, mergeID)
+}
+
+func (db *slowlogDB) BackfillDerivedFields(ctx context.Context) (int, error) {
+	defer db.observe("BackfillDerivedFields", time.Now())
+	return db.db.BackfillDerivedFields(ctx)
+}
+
+func (db *slowlogDB) Close() {
+	db.db.Close()
+}
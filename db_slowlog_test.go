@@ -0,0 +1,48 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowlogDB(t *testing.T) {
+	var lines []string
+	logf := func(format string, v ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, v...))
+	}
+
+	db := newSlowlogDB(slowDB{n: 1, delay: 20 * time.Millisecond}, 5*time.Millisecond)
+	db.logf = logf
+
+	s, err := db.GetSession(1)
+	if err != nil || s.ID != 1 {
+		t.Fatalf("GetSession(1) = %+v, %v; want session passed through", s, err)
+	}
+	if _, err := db.GetSession(2); err != ErrSessionNotFound {
+		t.Errorf("GetSession(2) err = %v; want %v", err, ErrSessionNotFound)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2: %q", len(lines), lines)
+	}
+	for _, want := range []string{"op=GetSession", "duration=", "id=1"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("log line %q does not contain %q", lines[0], want)
+		}
+	}
+
+	lines = nil
+	db = newSlowlogDB(slowDB{n: 1}, time.Second)
+	db.logf = logf
+	if _, err := db.GetSession(1); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 0 {
+		t.Errorf("fast call logged: %q", lines)
+	}
+}
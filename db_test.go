@@ -5,9 +5,14 @@
 package vyfe_api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"strconv"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,39 +23,44 @@ import (
 	"github.com/GoogleCloudPlatform/golang-samples/internal/testutil"
 )
 
-func testDB(t *testing.T, db BookDatabase) {
+func testDB(t *testing.T, db SessionDatabase) {
 	defer db.Close()
 
-	b := &Book{
+	b := &Session{
 		Author:      "testy mc testface",
 		Title:       fmt.Sprintf("t-%d", time.Now().Unix()),
 		Description: "desc",
 	}
 
-	id, err := db.AddBook(b)
+	id, err := db.AddSession(b)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if id == 0 {
+		t.Fatal("AddSession: got zero ID")
+	}
+	if b.ID != id {
+		t.Errorf("AddSession: got struct ID %d, want %d", b.ID, id)
+	}
 
-	b.ID = id
 	b.Description = "newdesc"
-	if err := db.UpdateBook(b); err != nil {
+	if err := db.UpdateSession(b); err != nil {
 		t.Error(err)
 	}
 
-	gotBook, err := db.GetBook(id)
+	gotSession, err := db.GetSession(id)
 	if err != nil {
 		t.Error(err)
 	}
-	if got, want := gotBook.Description, b.Description; got != want {
+	if got, want := gotSession.Description, b.Description; got != want {
 		t.Errorf("Update description: got %q, want %q", got, want)
 	}
 
-	if err := db.DeleteBook(id); err != nil {
+	if err := db.DeleteSession(id); err != nil {
 		t.Error(err)
 	}
 
-	if _, err := db.GetBook(id); err == nil {
+	if _, err := db.GetSession(id); err == nil {
 		t.Error("want non-nil err")
 	}
 }
@@ -59,6 +69,41 @@ func TestMemoryDB(t *testing.T) {
 	testDB(t, newMemoryDB())
 }
 
+func TestOpenCheckedDB(t *testing.T) {
+	defer func(b, max, timeout time.Duration) {
+		startupBackoff, startupMaxBackoff, StartupRetryTimeout = b, max, timeout
+	}(startupBackoff, startupMaxBackoff, StartupRetryTimeout)
+	startupBackoff, startupMaxBackoff = time.Millisecond, 4*time.Millisecond
+	StartupRetryTimeout = time.Second
+
+	// A fake backend that isn't reachable for its first three checks.
+	checks := 0
+	check := func() error {
+		if checks++; checks <= 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	db, err := openCheckedDB("fakedb", check, func() SessionDatabase { return newMemoryDB() })
+	if err != nil {
+		t.Fatalf("got err %v after %d checks, want a database", err, checks)
+	}
+	if checks != 4 {
+		t.Errorf("got %d checks, want 4", checks)
+	}
+	testDB(t, db)
+
+	StartupRetryTimeout = 10 * time.Millisecond
+	opened := false
+	_, err = openCheckedDB("fakedb", func() error { return errors.New("connection refused") }, func() SessionDatabase {
+		opened = true
+		return newMemoryDB()
+	})
+	if err == nil || opened {
+		t.Errorf("unreachable backend: got err %v and opened %v, want an error and no database", err, opened)
+	}
+}
+
 func TestDatastoreDB(t *testing.T) {
 	tc := testutil.SystemTest(t)
 	ctx := context.Background()
@@ -76,31 +121,2034 @@ func TestDatastoreDB(t *testing.T) {
 	testDB(t, db)
 }
 
-func TestMySQLDB(t *testing.T) {
-	t.Parallel()
+func TestDatastoreDBBackfillSlugs(t *testing.T) {
+	tc := testutil.SystemTest(t)
+	ctx := context.Background()
+
+	client, err := datastore.NewClient(ctx, tc.ProjectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	db, err := newDatastoreDB(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two sessions with the same title, saved before slugs existed, end up
+	// in the same backfill batch.
+	title := fmt.Sprintf("Backfill twin %d", time.Now().UnixNano())
+	keys := []*datastore.Key{
+		datastore.IncompleteKey("Session", nil),
+		datastore.IncompleteKey("Session", nil),
+	}
+	keys, err = client.PutMulti(ctx, keys, []*Session{{Title: title}, {Title: title}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.DeleteMulti(ctx, keys)
+
+	if _, err := db.BackfillDerivedFields(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a, err := db.GetSession(keys[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.GetSession(keys[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Slug == "" || a.Slug == b.Slug {
+		t.Errorf("got slugs %q and %q, want two different slugs", a.Slug, b.Slug)
+	}
+}
 
-	host := os.Getenv("GOLANG_SAMPLES_MYSQL_HOST")
-	port := os.Getenv("GOLANG_SAMPLES_MYSQL_PORT")
+func TestDatastoreDBOffloadedDescription(t *testing.T) {
+	tc := testutil.SystemTest(t)
+	ctx := context.Background()
 
-	if host == "" {
-		t.Skip("GOLANG_SAMPLES_MYSQL_HOST not set.")
+	client, err := datastore.NewClient(ctx, tc.ProjectID)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if port == "" {
-		port = "3306"
+	defer client.Close()
+
+	db, err := newDatastoreDB(client)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	p, err := strconv.Atoi(port)
+	defer func(store BlobStore, threshold int) {
+		DescriptionStore, DescriptionOffloadThreshold = store, threshold
+	}(DescriptionStore, DescriptionOffloadThreshold)
+	DescriptionStore, DescriptionOffloadThreshold = memoryBlobStore{}, 100
+
+	author := fmt.Sprintf("Offload author %d", time.Now().UnixNano())
+	transcript := strings.Repeat("and then we sharded the database again. ", 20)
+	id, err := db.AddSession(&Session{Title: "offloaded", Author: author, Description: transcript})
 	if err != nil {
-		t.Fatalf("Could not parse port: %v", err)
+		t.Fatal(err)
 	}
+	defer db.DeleteSession(id)
 
-	db, err := newMySQLDB(MySQLConfig{
-		Username: "root",
-		Host:     host,
-		Port:     p,
-	})
+	stored := &Session{}
+	if err := client.Get(ctx, datastore.IDKey("Session", id, nil), stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Description != "" || stored.DescriptionRef == "" {
+		t.Fatalf("stored entity has a %d byte description and ref %q, want it offloaded", len(stored.Description), stored.DescriptionRef)
+	}
+
+	s, err := db.GetSession(id)
 	if err != nil {
 		t.Fatal(err)
 	}
-	testDB(t, db)
+	if s.Description != transcript {
+		t.Errorf("GetSession: got a %d byte description, want the %d byte original", len(s.Description), len(transcript))
+	}
+	listed, err := db.ListSessionsByPresenter(ctx, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].Description != transcript {
+		t.Errorf("ListSessionsByPresenter: got %d sessions, want the one with its full description", len(listed))
+	}
+
+	// An edit that keeps the description keeps it offloaded.
+	s.Title = "offloaded and edited"
+	if err := db.UpdateSession(s); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := db.GetSession(id); err != nil || s.Description != transcript {
+		t.Errorf("after UpdateSession: got %v, want the full description", err)
+	}
+}
+
+func TestDatastoreIgnoresFieldMismatch(t *testing.T) {
+	// An entity saved by another version of the app, whose Session had a
+	// Legacy field and no Presenters.
+	props := []datastore.Property{
+		{Name: "Title", Value: "old session"},
+		{Name: "Author", Value: "ann"},
+		{Name: "Legacy", Value: "dropped"},
+	}
+	s := &Session{}
+	err := datastore.LoadStruct(s, props)
+	if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+		t.Fatalf("loading entity with an extra property: got error %v, want *datastore.ErrFieldMismatch", err)
+	}
+	if err := ignoreFieldMismatch(err); err != nil {
+		t.Fatalf("ignoreFieldMismatch: got %v, want nil", err)
+	}
+	if s.Title != "old session" || s.Author != "ann" || s.Presenters != nil {
+		t.Errorf("got session %+v, want the entity's title and author and no presenters", s)
+	}
+
+	for _, err := range []error{nil, datastore.ErrNoSuchEntity, errors.New("boom")} {
+		if got := ignoreFieldMismatch(err); got != err {
+			t.Errorf("ignoreFieldMismatch(%v) = %v, want it unchanged", err, got)
+		}
+	}
+}
+
+func TestMemoryDBReorderSessions(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	var ids []int64
+	for _, title := range []string{"a", "b", "c", "d", "e"} {
+		id, err := db.AddSession(&Session{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for i, id := range ids {
+		if err := db.MoveSession(ctx, id, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reverse b, c and e among the slots they hold; a and d stay put.
+	if err := db.ReorderSessions(ctx, []int64{ids[4], ids[2], ids[1]}); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := db.ListSessionsByPosition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for _, s := range sessions {
+		got += s.Title
+	}
+	if want := "aecdb"; got != want {
+		t.Errorf("got order %q, want %q", got, want)
+	}
+
+	if err := db.ReorderSessions(ctx, []int64{ids[0], 12345}); err != ErrSessionNotFound {
+		t.Errorf("reordering a missing session: got err %v, want ErrSessionNotFound", err)
+	}
+	if err := db.ReorderSessions(ctx, []int64{ids[0], ids[0]}); err == nil {
+		t.Error("want non-nil err reordering a duplicate ID")
+	}
+	if s, _ := db.GetSession(ids[0]); s.Position != 0 {
+		t.Errorf("failed reorders moved session a to %d", s.Position)
+	}
+
+	// Edits keep the position, whatever they carry.
+	e, err := db.GetSession(ids[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := *e
+	edit.Position = 0
+	if err := db.UpdateSession(&edit); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := db.GetSession(ids[4]); s.Position != 1 {
+		t.Errorf("edit moved session e to %d, want 1", s.Position)
+	}
+
+	// A duplicate position among the listed sessions doesn't push one of
+	// them onto an unlisted session's position: all are renumbered.
+	db.sessions[ids[3]].Position = 2
+	db.sessions[ids[1]].Position = 3
+	if err := db.ReorderSessions(ctx, []int64{ids[3], ids[2]}); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err = db.ListSessionsByPosition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = ""
+	for i, s := range sessions {
+		if s.Position != i {
+			t.Errorf("session %q: got position %d, want %d", s.Title, s.Position, i)
+		}
+		got += s.Title
+	}
+	if want := "aedcb"; got != want {
+		t.Errorf("got order %q, want %q", got, want)
+	}
+}
+
+func TestMemoryDBMoveSession(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	var ids []int64
+	for _, title := range []string{"a", "b", "c", "d"} {
+		id, err := db.AddSession(&Session{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Move "d" to the front, then "a" past the end.
+	if err := db.MoveSession(ctx, ids[3], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MoveSession(ctx, ids[0], 100); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := db.ListSessionsByPosition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for i, s := range sessions {
+		if s.Position != i {
+			t.Errorf("session %q: got position %d, want %d", s.Title, s.Position, i)
+		}
+		got += s.Title
+	}
+	if want := "dbca"; got != want {
+		t.Errorf("got order %q, want %q", got, want)
+	}
+
+	if err := db.MoveSession(ctx, 12345, 0); err == nil {
+		t.Error("want non-nil err moving a missing session")
+	}
+	if err := db.MoveSession(ctx, ids[0], -1); err == nil {
+		t.Error("want non-nil err moving to a negative position")
+	}
+}
+
+func TestMemoryDBTags(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	a := &Session{Title: "a", Tags: []string{"go", "cloud"}}
+	b := &Session{Title: "b", Tags: []string{"golang", "go"}}
+	c := &Session{Title: "c", Tags: []string{"web"}}
+	for _, s := range []*Session{a, b, c} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := db.RenameTag(ctx, "go", "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("RenameTag: got %d affected, want 2", n)
+	}
+	if got, want := fmt.Sprint(a.Tags), "[cloud golang]"; got != want {
+		t.Errorf("RenameTag: got tags %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(b.Tags), "[golang]"; got != want {
+		t.Errorf("RenameTag: got tags %s, want %s", got, want)
+	}
+
+	n, err = db.RemoveTag(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("RemoveTag: got %d affected, want 2", n)
+	}
+
+	if n, err := db.RemoveTag(ctx, "missing"); n != 0 || err != nil {
+		t.Errorf("RemoveTag(missing): got (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestMemoryDBAddTagToSessions(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	a := &Session{Title: "a", Tags: []string{"go", "cloud"}}
+	b := &Session{Title: "b", Tags: []string{"web"}}
+	c := &Session{Title: "c"}
+	for _, s := range []*Session{a, b, c} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a already carries the tag, 999 doesn't exist and b is listed twice.
+	updated, missing, err := db.AddTagToSessions(ctx, []int64{a.ID, b.ID, 999, c.ID, b.ID}, "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 2 || missing != 1 {
+		t.Errorf("got %d updated, %d missing; want 2, 1", updated, missing)
+	}
+	for _, tt := range []struct {
+		s    *Session
+		want string
+	}{
+		{a, "[go cloud]"},
+		{b, "[web go]"},
+		{c, "[go]"},
+	} {
+		s, err := db.GetSession(tt.s.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(s.Tags); got != tt.want {
+			t.Errorf("session %s: got tags %s, want %s", s.Title, got, tt.want)
+		}
+	}
+
+	// Adding it again changes nothing.
+	if updated, missing, err := db.AddTagToSessions(ctx, []int64{a.ID, b.ID, c.ID}, "go"); updated != 0 || missing != 0 || err != nil {
+		t.Errorf("second add: got (%d, %d, %v), want (0, 0, nil)", updated, missing, err)
+	}
+	if _, _, err := db.AddTagToSessions(ctx, []int64{a.ID}, ""); err == nil {
+		t.Error("adding an empty tag succeeded")
+	}
+}
+
+func TestMemoryDBListSessionsByPresenter(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, s := range []*Session{
+		{Title: "solo", Author: "Ada"},
+		{Title: "panel", Author: "Grace", Presenters: []string{"Ada", "Alan"}},
+		{Title: "duo", Author: "Alan", Presenters: []string{"Grace"}},
+		{Title: "other", Author: "Ada Lovelace"},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		presenter string
+		want      string
+	}{
+		{"Ada", "[panel solo]"},
+		{"Alan", "[duo panel]"},
+		{"Grace", "[duo panel]"},
+		{"Linus", "[]"},
+		{"", "[]"},
+	} {
+		sessions, err := db.ListSessionsByPresenter(ctx, tt.presenter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, s := range sessions {
+			titles = append(titles, s.Title)
+		}
+		if got := fmt.Sprint(titles); got != tt.want {
+			t.Errorf("ListSessionsByPresenter(%q) = %s, want %s", tt.presenter, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryDBUpdateSessionChangedFields(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+
+	s := &Session{Title: "Before", Author: "Ada", Tags: []string{}}
+	id, err := db.AddSession(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Add a view so the update has counters to keep, which aren't changes.
+	if err := db.IncrementViewCount(context.Background(), id, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Edits are built from the form, so they carry neither the stored
+	// counters nor an empty, rather than nil, list of tags.
+	edit := &Session{ID: id, Title: "After", Author: "Ada"}
+	if err := db.UpdateSession(edit); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Title"}; !reflect.DeepEqual(edit.ChangedFields, want) {
+		t.Errorf("got changed fields %q, want %q", edit.ChangedFields, want)
+	}
+
+	edit = &Session{ID: id, Title: "After", Author: "Ada", VideoURL: "https://example.com/v.mp4", Tags: []string{"go"}}
+	if err := db.UpdateSession(edit); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"VideoURL", "Tags"}; !reflect.DeepEqual(edit.ChangedFields, want) {
+		t.Errorf("got changed fields %q, want %q", edit.ChangedFields, want)
+	}
+
+	same := *edit
+	if err := db.UpdateSession(&same); err != nil {
+		t.Fatal(err)
+	}
+	if same.ChangedFields == nil || len(same.ChangedFields) != 0 {
+		t.Errorf("unchanged update: got changed fields %#v, want none", same.ChangedFields)
+	}
+}
+
+func TestMemoryDBRelatedSessions(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	add := func(s *Session) int64 {
+		id, err := db.AddSession(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	id := add(&Session{Title: "main", Author: "ann", Tags: []string{"go", "web"}})
+	sameAuthor := add(&Session{Title: "same author", Author: "ann"})
+	twoTags := add(&Session{Title: "two tags", Author: "bob", Tags: []string{"web", "go"}})
+	add(&Session{Title: "unrelated", Author: "cid", Tags: []string{"ops"}})
+
+	related, err := db.RelatedSessions(ctx, id, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(related) != 2 || related[0].ID != twoTags || related[1].ID != sameAuthor {
+		t.Errorf("RelatedSessions: got %v, want [%d %d]", related, twoTags, sameAuthor)
+	}
+
+	// Without an author or tags, the most recent other sessions are returned.
+	bare := add(&Session{Title: "bare"})
+	related, err = db.RelatedSessions(ctx, bare, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(related) != 2 {
+		t.Errorf("RelatedSessions(bare): got %d sessions, want 2", len(related))
+	}
+	for _, s := range related {
+		if s.ID == bare {
+			t.Error("RelatedSessions(bare): result includes the session itself")
+		}
+	}
+}
+
+func TestMemoryDBBackfillDerivedFields(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	// Seed sessions as saved before the derived fields existed.
+	db.sessions[1] = &Session{ID: 1, Title: "Old Talk", PublishedDate: "2016-03-04"}
+	db.sessions[2] = &Session{ID: 2, Title: "Old Talk"}
+	db.nextID = 3
+	id, err := db.AddSession(&Session{Title: "New Talk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := db.BackfillDerivedFields(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 2 {
+		t.Errorf("updated %d sessions, want 2", updated)
+	}
+	for _, id := range []int64{1, 2, id} {
+		s := db.sessions[id]
+		if s.Slug == "" || s.Random == 0 {
+			t.Errorf("session %d: got slug %q, random %v, want them set", id, s.Slug, s.Random)
+		}
+	}
+	if db.sessions[1].Slug == db.sessions[2].Slug {
+		t.Errorf("sessions 1 and 2 share slug %q", db.sessions[1].Slug)
+	}
+	if want := time.Date(2016, time.March, 4, 0, 0, 0, 0, time.UTC); !db.sessions[1].PublishedAt.Equal(want) {
+		t.Errorf("PublishedAt: got %v, want %v", db.sessions[1].PublishedAt, want)
+	}
+	if got, err := db.GetSessionBySlug(ctx, db.sessions[2].Slug); err != nil || got.ID != 2 {
+		t.Errorf("GetSessionBySlug(%q): got %v, %v, want session 2", db.sessions[2].Slug, got, err)
+	}
+
+	if updated, err := db.BackfillDerivedFields(ctx); err != nil || updated != 0 {
+		t.Errorf("second backfill: got %d, %v, want 0, nil", updated, err)
+	}
+}
+
+func TestMemoryDBUpsertSessionByExternalID(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	if _, _, err := db.UpsertSessionByExternalID(ctx, &Session{Title: "no id"}); err != ErrNoExternalID {
+		t.Errorf("no ExternalID: got err %v, want ErrNoExternalID", err)
+	}
+
+	id, created, err := db.UpsertSessionByExternalID(ctx, &Session{Title: "Talk", ExternalID: "cms-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Error("first upsert: got created false, want true")
+	}
+	first, err := db.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdAt, slug := first.CreatedAt, first.Slug
+
+	id2, created, err := db.UpsertSessionByExternalID(ctx, &Session{Title: "Talk", Author: "ann", ExternalID: "cms-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || id2 != id {
+		t.Errorf("second upsert: got id %d, created %v, want %d, false", id2, created, id)
+	}
+	s, err := db.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Author != "ann" || !s.CreatedAt.Equal(createdAt) || s.Slug != slug {
+		t.Errorf("second upsert: got %+v, want the author updated and creation time and slug kept", s)
+	}
+	if sessions, _ := db.ListSessions(); len(sessions) != 1 {
+		t.Errorf("got %d sessions, want 1", len(sessions))
+	}
+
+	// A deleted session is added again.
+	if err := db.DeleteSession(id); err != nil {
+		t.Fatal(err)
+	}
+	id3, created, err := db.UpsertSessionByExternalID(ctx, &Session{Title: "Talk", ExternalID: "cms-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || id3 == id {
+		t.Errorf("upsert after delete: got id %d, created %v, want a new session", id3, created)
+	}
+}
+
+// testExternalIDIndex checks that sessions added, edited and deleted without
+// UpsertSessionByExternalID are still found by their external IDs.
+func testExternalIDIndex(t *testing.T, db SessionDatabase) {
+	ctx := context.Background()
+	prefix := fmt.Sprintf("index-%d-", time.Now().UnixNano())
+	upsert := func(externalID string) (int64, bool) {
+		id, created, err := db.UpsertSessionByExternalID(ctx, &Session{Title: "Indexed", ExternalID: prefix + externalID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created {
+			defer db.DeleteSession(id)
+		}
+		return id, created
+	}
+
+	id, err := db.AddSession(&Session{Title: "Indexed", ExternalID: prefix + "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, created := upsert("a"); created || got != id {
+		t.Errorf("upsert after add: got id %d, created %v, want %d, false", got, created, id)
+	}
+
+	s, err := db.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := *s
+	edited.ExternalID = prefix + "b"
+	if err := db.UpdateSession(&edited); err != nil {
+		t.Fatal(err)
+	}
+	if got, created := upsert("b"); created || got != id {
+		t.Errorf("upsert after changing the external ID: got id %d, created %v, want %d, false", got, created, id)
+	}
+	if got, created := upsert("a"); !created || got == id {
+		t.Errorf("upsert of the old external ID: got id %d, created %v, want a new session", got, created)
+	}
+
+	if err := db.DeleteSession(id); err != nil {
+		t.Fatal(err)
+	}
+	if got, created := upsert("b"); !created || got == id {
+		t.Errorf("upsert after delete: got id %d, created %v, want a new session", got, created)
+	}
+}
+
+func TestMemoryDBExternalIDIndex(t *testing.T) {
+	testExternalIDIndex(t, newMemoryDB())
+}
+
+func TestDatastoreDBExternalIDIndex(t *testing.T) {
+	tc := testutil.SystemTest(t)
+	ctx := context.Background()
+
+	client, err := datastore.NewClient(ctx, tc.ProjectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	db, err := newDatastoreDB(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExternalIDIndex(t, db)
+}
+
+func TestMemoryDBTouchSession(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	id, err := db.AddSession(&Session{Title: "t", Author: "a", Tags: []string{"go"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := db.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := *held
+	time.Sleep(time.Millisecond)
+
+	if err := db.TouchSession(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	// Readers may still use the session they got before the touch.
+	if !held.UpdatedAt.Equal(before.UpdatedAt) {
+		t.Errorf("TouchSession changed a session already returned to a reader")
+	}
+	s, err := db.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := *s
+	if !after.UpdatedAt.After(before.UpdatedAt) {
+		t.Errorf("UpdatedAt: got %v, want after %v", after.UpdatedAt, before.UpdatedAt)
+	}
+	after.UpdatedAt = before.UpdatedAt
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("TouchSession changed other fields: got %+v, want %+v", after, before)
+	}
+
+	if err := db.TouchSession(ctx, 999); err != ErrSessionNotFound {
+		t.Errorf("TouchSession(missing): got err %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestMemoryDBClaimNextUnprocessed(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		if _, err := db.AddSession(&Session{Title: fmt.Sprintf("s%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two workers claim concurrently until nothing is left.
+	claimed := make([][]int64, 2)
+	var wg sync.WaitGroup
+	for w := range claimed {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			worker := fmt.Sprintf("worker-%d", w)
+			for {
+				s, err := db.ClaimNextUnprocessed(ctx, worker, time.Hour)
+				if err == ErrNothingToClaim {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if s.ClaimedBy != worker {
+					t.Errorf("claimed session %d has ClaimedBy %q, want %q", s.ID, s.ClaimedBy, worker)
+				}
+				claimed[w] = append(claimed[w], s.ID)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	seen := make(map[int64]string)
+	for w, ids := range claimed {
+		for _, id := range ids {
+			if other, ok := seen[id]; ok {
+				t.Errorf("session %d claimed by both %s and worker-%d", id, other, w)
+			}
+			seen[id] = fmt.Sprintf("worker-%d", w)
+		}
+	}
+	if len(seen) != n {
+		t.Errorf("got %d sessions claimed, want %d", len(seen), n)
+	}
+
+	// Released and expired claims can be claimed again; processed sessions
+	// can't.
+	id := int64(1)
+	if err := db.ReleaseClaim(ctx, id, "other"); err != ErrClaimNotHeld {
+		t.Errorf("ReleaseClaim by another worker: got err %v, want ErrClaimNotHeld", err)
+	}
+	if err := db.ReleaseClaim(ctx, id, seen[id]); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := db.ClaimNextUnprocessed(ctx, "other", time.Millisecond); err != nil || s.ID != id {
+		t.Fatalf("claim after release: got %v, %v; want session %d", s, err, id)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if err := db.ReleaseClaim(ctx, id, "other"); err != ErrClaimNotHeld {
+		t.Errorf("ReleaseClaim after expiry: got err %v, want ErrClaimNotHeld", err)
+	}
+	if s, err := db.ClaimNextUnprocessed(ctx, "worker-0", time.Hour); err != nil || s.ID != id {
+		t.Fatalf("claim after expiry: got %v, %v; want session %d", s, err, id)
+	}
+
+	if err := db.MarkProcessed(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ProcessedAt.IsZero() || s.ClaimedBy != "" || !s.ClaimExpiry.IsZero() {
+		t.Errorf("after MarkProcessed: got ProcessedAt %v, ClaimedBy %q, ClaimExpiry %v", s.ProcessedAt, s.ClaimedBy, s.ClaimExpiry)
+	}
+	if err := db.UpdateSession(&Session{ID: id, Title: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := db.GetSession(id); s.ProcessedAt.IsZero() {
+		t.Error("UpdateSession cleared ProcessedAt")
+	}
+	if _, err := db.ClaimNextUnprocessed(ctx, "worker-0", time.Hour); err != ErrNothingToClaim {
+		t.Errorf("claim with all sessions claimed or processed: got err %v, want ErrNothingToClaim", err)
+	}
+	// A new video needs processing again.
+	if err := db.UpdateSession(&Session{ID: id, Title: "edited", VideoURL: "https://example.com/new.mp4"}); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := db.ClaimNextUnprocessed(ctx, "worker-0", time.Hour); err != nil || s.ID != id {
+		t.Errorf("claim after a new video: got %v, %v; want session %d", s, err, id)
+	}
+
+	if err := db.MarkProcessed(ctx, 999); err != ErrSessionNotFound {
+		t.Errorf("MarkProcessed(missing): got err %v, want ErrSessionNotFound", err)
+	}
+	if _, err := db.ClaimNextUnprocessed(ctx, "", time.Hour); err == nil {
+		t.Error("claim without a worker ID succeeded")
+	}
+}
+
+func TestMemoryDBLockSession(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	id, err := db.AddSession(&Session{Title: "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.LockSession(ctx, id, "alice", "Alice", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.LockSession(ctx, id, "bob", "Bob", time.Hour); err != ErrSessionLocked {
+		t.Errorf("second lock while live: got err %v, want ErrSessionLocked", err)
+	}
+	s, err := db.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.LockedByOther("bob", time.Now()) || s.LockedByOther("alice", time.Now()) || s.LockedByName != "Alice" {
+		t.Errorf("got lock by %q (%q) until %v, want alice's", s.LockedBy, s.LockedByName, s.LockExpiry)
+	}
+
+	// The holder can renew the lock, and edits keep it.
+	if err := db.LockSession(ctx, id, "alice", "Alice", time.Hour); err != nil {
+		t.Errorf("renewing lock: %v", err)
+	}
+	if err := db.UpdateSession(&Session{ID: id, Title: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := db.GetSession(id); s.LockedBy != "alice" {
+		t.Errorf("after UpdateSession: got LockedBy %q, want alice", s.LockedBy)
+	}
+
+	// Only the holder releases the lock.
+	if err := db.UnlockSession(ctx, id, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.LockSession(ctx, id, "bob", "Bob", time.Hour); err != ErrSessionLocked {
+		t.Errorf("lock after unlock by another user: got err %v, want ErrSessionLocked", err)
+	}
+	if err := db.UnlockSession(ctx, id, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.LockSession(ctx, id, "bob", "Bob", time.Millisecond); err != nil {
+		t.Errorf("lock after release: %v", err)
+	}
+
+	// Locks expire.
+	time.Sleep(2 * time.Millisecond)
+	if err := db.LockSession(ctx, id, "alice", "Alice", time.Hour); err != nil {
+		t.Errorf("lock after expiry: %v", err)
+	}
+
+	if err := db.LockSession(ctx, 999, "alice", "Alice", time.Hour); err != ErrSessionNotFound {
+		t.Errorf("LockSession(missing): got err %v, want ErrSessionNotFound", err)
+	}
+	if err := db.LockSession(ctx, id, "", "", time.Hour); err == nil {
+		t.Error("lock without a user ID succeeded")
+	}
+}
+
+func TestMemoryDBAdjacentSessions(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	var ids []int64
+	for _, title := range []string{"c", "a", "b", "b"} {
+		id, err := db.AddSession(&Session{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	c, a, b1, b2 := ids[0], ids[1], ids[2], ids[3]
+
+	id := func(s *Session) int64 {
+		if s == nil {
+			return 0
+		}
+		return s.ID
+	}
+	for _, tc := range []struct{ id, prev, next int64 }{
+		{a, 0, b1},
+		{b1, a, b2},
+		{b2, b1, c},
+		{c, b2, 0},
+	} {
+		prev, next, err := db.AdjacentSessions(ctx, tc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id(prev) != tc.prev || id(next) != tc.next {
+			t.Errorf("AdjacentSessions(%d): got %d, %d, want %d, %d", tc.id, id(prev), id(next), tc.prev, tc.next)
+		}
+	}
+
+	if _, _, err := db.AdjacentSessions(ctx, 999); err != ErrSessionNotFound {
+		t.Errorf("AdjacentSessions(missing): got err %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestMemoryDBRandomSessions(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	sessions, err := db.RandomSessions(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("RandomSessions on an empty catalog: got %d sessions, want 0", len(sessions))
+	}
+
+	for _, title := range []string{"a", "b", "c"} {
+		if _, err := db.AddSession(&Session{Title: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range []int{2, 3, 10} {
+		sessions, err := db.RandomSessions(ctx, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := n
+		if want > 3 {
+			want = 3
+		}
+		seen := make(map[int64]bool)
+		for _, s := range sessions {
+			seen[s.ID] = true
+		}
+		if len(sessions) != want || len(seen) != want {
+			t.Errorf("RandomSessions(%d): got %v, want %d distinct sessions", n, sessions, want)
+		}
+	}
+}
+
+func TestMemoryDBUpdateSessionKeepsCreatedAt(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+
+	id, err := db.AddSession(&Session{Title: "Before"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := s.CreatedAt
+
+	// Edits are built from the form or the JSON body, so they carry no
+	// creation time.
+	if err := db.UpdateSession(&Session{ID: id, Title: "After"}); err != nil {
+		t.Fatal(err)
+	}
+	s, err = db.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.CreatedAt.Equal(created) {
+		t.Errorf("got CreatedAt %v after an edit, want %v", s.CreatedAt, created)
+	}
+}
+
+func TestMemoryDBListSessionsCreatedBetween(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, title := range []string{"a", "b", "c"} {
+		if _, err := db.AddSession(&Session{Title: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Spread the creation times out an hour apart.
+	base := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for id, s := range db.sessions {
+		s.CreatedAt = base.Add(time.Duration(id) * time.Hour)
+	}
+
+	sessions, err := db.ListSessionsCreatedBetween(ctx, base.Add(2*time.Hour), base.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].Title != "b" || sessions[1].Title != "c" {
+		t.Errorf("got %v, want sessions b and c", sessions)
+	}
+}
+
+func TestMemoryDBListSessionsStableOrder(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+
+	var want []int64
+	for _, title := range []string{"same", "same", "same", "same"} {
+		id, err := db.AddSession(&Session{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, id)
+	}
+
+	// Map iteration order varies between calls, so list a few times.
+	for i := 0; i < 10; i++ {
+		sessions, err := db.ListSessions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, s := range sessions {
+			if s.ID != want[j] {
+				t.Fatalf("ListSessions: position %d has ID %d, want %d", j, s.ID, want[j])
+			}
+		}
+	}
+}
+
+func TestMemoryDBSlugs(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	first := &Session{Title: "Go at Scale!"}
+	if _, err := db.AddSession(first); err != nil {
+		t.Fatal(err)
+	}
+	second := &Session{Title: "Go at scale"}
+	if _, err := db.AddSession(second); err != nil {
+		t.Fatal(err)
+	}
+	if first.Slug != "go-at-scale" || second.Slug != "go-at-scale-2" {
+		t.Errorf("got slugs %q and %q, want go-at-scale and go-at-scale-2", first.Slug, second.Slug)
+	}
+
+	got, err := db.GetSessionBySlug(ctx, "go-at-scale-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != second.ID {
+		t.Errorf("GetSessionBySlug: got ID %d, want %d", got.ID, second.ID)
+	}
+
+	// Edits that keep the title keep the slug.
+	if err := db.UpdateSession(&Session{ID: second.ID, Title: "Go at scale", Author: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.GetSession(second.ID); got.Slug != "go-at-scale-2" {
+		t.Errorf("after editing author: got slug %q, want go-at-scale-2", got.Slug)
+	}
+
+	// A new title frees the old slug.
+	if err := db.UpdateSession(&Session{ID: second.ID, Title: "Testing"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetSessionBySlug(ctx, "go-at-scale-2"); err != ErrSessionNotFound {
+		t.Errorf("old slug: got err %v, want ErrSessionNotFound", err)
+	}
+	if got, err := db.GetSessionBySlug(ctx, "testing"); err != nil || got.ID != second.ID {
+		t.Errorf("new slug: got %v, %v, want session %d", got, err, second.ID)
+	}
+
+	if err := db.DeleteSession(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetSessionBySlug(ctx, "go-at-scale"); err != ErrSessionNotFound {
+		t.Errorf("deleted slug: got err %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestMemoryDBDeleteSessions(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	var ids []int64
+	for _, title := range []string{"a", "b", "c"} {
+		id, err := db.AddSession(&Session{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	const missing = 12345
+	deleted, errs := db.DeleteSessions(ctx, []int64{ids[0], missing, ids[2]})
+	if deleted != 2 {
+		t.Errorf("got %d deleted, want 2", deleted)
+	}
+	if len(errs) != 1 || errs[missing] != ErrSessionNotFound {
+		t.Errorf("got errs %v, want ErrSessionNotFound for %d only", errs, missing)
+	}
+
+	sessions, err := db.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != ids[1] {
+		t.Errorf("got %v remaining, want only session %d", sessions, ids[1])
+	}
+}
+
+func TestMigratingDB(t *testing.T) {
+	primary, secondary := newMemoryDB(), newMemoryDB()
+	db := newMigratingDB(primary, secondary)
+	defer db.Close()
+
+	id, err := db.AddSession(&Session{Title: "dual"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := secondary.GetSession(id); err != nil || s.Title != "dual" {
+		t.Fatalf("secondary: got %v, %v, want the added session under ID %d", s, err, id)
+	}
+
+	// Make the backends disagree, then read everything from the secondary.
+	if err := secondary.UpdateSession(&Session{ID: id, Title: "changed"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetMigrationReads(db, 100, true); err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.GetSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Title != "changed" {
+		t.Errorf("100%% secondary reads: got title %q, want %q", s.Title, "changed")
+	}
+	if db.mismatches != 1 {
+		t.Errorf("got %d shadow mismatches, want 1", db.mismatches)
+	}
+
+	if err := SetMigrationReads(db, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := db.GetSession(id); s.Title != "dual" {
+		t.Errorf("primary reads: got title %q, want %q", s.Title, "dual")
+	}
+
+	if err := db.DeleteSession(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.GetSession(id); err != ErrSessionNotFound {
+		t.Errorf("secondary after delete: got err %v, want ErrSessionNotFound", err)
+	}
+
+	if err := SetMigrationReads(primary, 50, false); err != errNotMigrating {
+		t.Errorf("not migrating: got err %v, want errNotMigrating", err)
+	}
+
+	wrapped := newSlowlogDB(newHistoryDB(db, NewHistory(1)), time.Second)
+	if err := SetMigrationReads(wrapped, 100, false); err != nil {
+		t.Errorf("wrapped: got err %v, want the migrating database found", err)
+	}
+	if p := atomic.LoadInt32(&db.readPercent); p != 100 {
+		t.Errorf("wrapped: got %d%% secondary reads, want 100", p)
+	}
+}
+
+func TestMemoryDBGetSessionsOrdered(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+
+	var ids []int64
+	for _, title := range []string{"a", "b", "c"} {
+		id, err := db.AddSession(&Session{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	const missing = 999
+	sessions, err := db.GetSessionsOrdered(context.Background(), []int64{ids[2], missing, ids[0], ids[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range sessions {
+		got = append(got, s.Title)
+	}
+	if strings.Join(got, ",") != "c,a,b" {
+		t.Errorf("got %v, want [c a b]", got)
+	}
+}
+
+func TestMemoryDBListSessionsPageConcurrentInsert(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, title := range []string{"b", "d", "f", "h"} {
+		if _, err := db.AddSession(&Session{Title: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	token := ""
+	for i := 0; ; i++ {
+		list, err := db.ListSessionsPage(ctx, token, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range list.Sessions {
+			got = append(got, s.Title)
+		}
+		if i == 0 {
+			// Sorts before the next page; an offset would repeat "d".
+			if _, err := db.AddSession(&Session{Title: "a"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if token = list.NextPageToken; token == "" {
+			break
+		}
+	}
+	if strings.Join(got, ",") != "b,d,f,h" {
+		t.Errorf("got %v, want [b d f h]", got)
+	}
+
+	if _, err := db.ListSessionsPage(ctx, "not a token", 2); err != ErrBadPageToken {
+		t.Errorf("bad token: got err %v, want %v", err, ErrBadPageToken)
+	}
+}
+
+func TestMemoryDBListSessionsByTagPage(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	want := make(map[int64]bool)
+	for i := 0; i < 23; i++ {
+		s := &Session{Title: fmt.Sprintf("s%d", i%7)}
+		if i%3 != 0 {
+			s.Tags = []string{"other", "go"}
+		}
+		id, err := db.AddSession(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%3 != 0 {
+			want[id] = true
+		}
+	}
+
+	seen := make(map[int64]bool)
+	var last *Session
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatal("pages never end")
+		}
+		sessions, next, err := db.ListSessionsByTagPage(ctx, "go", 4, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) > 4 {
+			t.Errorf("got a page of %d sessions, want at most 4", len(sessions))
+		}
+		for _, s := range sessions {
+			if !want[s.ID] || seen[s.ID] {
+				t.Errorf("got session %d (%s), which is untagged or was already listed", s.ID, s.Title)
+			}
+			seen[s.ID] = true
+			if last != nil && !sessionsByTitle([]*Session{last, s}).Less(0, 1) {
+				t.Errorf("got %s (%d) after %s (%d), want title order", s.Title, s.ID, last.Title, last.ID)
+			}
+			last = s
+		}
+		if token = next; token == "" {
+			break
+		}
+	}
+	if len(seen) != len(want) {
+		t.Errorf("got %d sessions across pages, want %d", len(seen), len(want))
+	}
+
+	if sessions, next, err := db.ListSessionsByTagPage(ctx, "missing", 4, ""); len(sessions) != 0 || next != "" || err != nil {
+		t.Errorf("unused tag: got %v, %q, %v; want an empty last page", sessions, next, err)
+	}
+	if _, _, err := db.ListSessionsByTagPage(ctx, "go", 4, "not a token"); err != ErrBadPageToken {
+		t.Errorf("bad token: got err %v, want %v", err, ErrBadPageToken)
+	}
+}
+
+func TestMemoryDBArchive(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, s := range []*Session{
+		{Title: "jan", PublishedAt: time.Date(2016, time.January, 31, 23, 0, 0, 0, time.UTC)},
+		{Title: "mar1", PublishedAt: time.Date(2016, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{Title: "mar2", PublishedAt: time.Date(2016, time.March, 2, 0, 0, 0, 0, time.UTC)},
+		{Title: "undated"},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buckets, err := db.ListArchiveCounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ArchiveBucket{
+		{Year: 2016, Month: time.March, Count: 2},
+		{Year: 2016, Month: time.January, Count: 1},
+		{Count: 1},
+	}
+	if fmt.Sprint(buckets) != fmt.Sprint(want) {
+		t.Errorf("ListArchiveCounts: got %v, want %v", buckets, want)
+	}
+
+	for _, tt := range []struct {
+		year, month int
+		want        string
+	}{
+		{2016, 3, "mar1,mar2"},
+		{2016, 2, ""},
+		{0, 0, "undated"},
+	} {
+		sessions, err := db.ListSessionsByMonth(ctx, tt.year, tt.month)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range sessions {
+			got = append(got, s.Title)
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("ListSessionsByMonth(%d, %d): got %v, want %s", tt.year, tt.month, got, tt.want)
+		}
+	}
+
+	if _, err := db.ListSessionsByMonth(ctx, 2016, 13); err == nil {
+		t.Error("ListSessionsByMonth(2016, 13): want non-nil err")
+	}
+}
+
+func TestMemoryDBListSessionsOnThisDay(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, s := range []*Session{
+		{Title: "2015-07-04", PublishedAt: time.Date(2015, time.July, 4, 10, 0, 0, 0, time.UTC)},
+		{Title: "2019-07-04", PublishedAt: time.Date(2019, time.July, 4, 0, 0, 0, 0, time.UTC)},
+		{Title: "2019-07-05", PublishedAt: time.Date(2019, time.July, 5, 0, 0, 0, 0, time.UTC)},
+		{Title: "2016-02-29", PublishedAt: time.Date(2016, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{Title: "2017-02-28", PublishedAt: time.Date(2017, time.February, 28, 0, 0, 0, 0, time.UTC)},
+		{Title: "2016-03-01", PublishedAt: time.Date(2016, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{Title: "undated"},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		ref  time.Time
+		want string
+	}{
+		{time.Date(2020, time.July, 4, 12, 0, 0, 0, time.UTC), "2019-07-04,2015-07-04"},
+		// Leap day sessions come up on February 28 when there's no leap
+		// day, and only on the leap day when there is.
+		{time.Date(2021, time.February, 28, 0, 0, 0, 0, time.UTC), "2017-02-28,2016-02-29"},
+		{time.Date(2024, time.February, 28, 0, 0, 0, 0, time.UTC), "2017-02-28"},
+		{time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC), "2016-02-29"},
+		{time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC), "2016-03-01"},
+		// 2100 isn't a leap year.
+		{time.Date(2100, time.February, 28, 0, 0, 0, 0, time.UTC), "2017-02-28,2016-02-29"},
+		{time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC), ""},
+	} {
+		sessions, err := db.ListSessionsOnThisDay(ctx, tt.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range sessions {
+			got = append(got, s.Title)
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("ListSessionsOnThisDay(%s): got %v, want %s", tt.ref.Format("2006-01-02"), got, tt.want)
+		}
+	}
+}
+
+func TestMemoryDBListSessionsNear(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	// Distances from Trafalgar Square, London.
+	for _, s := range []*Session{
+		{Title: "covent garden", Latitude: 51.5117, Longitude: -0.1240}, // 0.6 km
+		{Title: "tower bridge", Latitude: 51.5055, Longitude: -0.0754},  // 3.6 km
+		{Title: "heathrow", Latitude: 51.4700, Longitude: -0.4543},      // 23 km
+		{Title: "paris", Latitude: 48.8566, Longitude: 2.3522},          // 340 km
+		{Title: "unknown location"},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		radiusKm float64
+		limit    int
+		want     string
+	}{
+		{5, 10, "covent garden,tower bridge"},
+		{30, 10, "covent garden,tower bridge,heathrow"},
+		{30, 1, "covent garden"},
+		{0.1, 10, ""},
+	} {
+		sessions, err := db.ListSessionsNear(ctx, 51.5080, -0.1281, tt.radiusKm, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range sessions {
+			got = append(got, s.Title)
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("ListSessionsNear(radius %v, limit %d): got %v, want %s", tt.radiusKm, tt.limit, got, tt.want)
+		}
+	}
+
+	for _, bad := range [][3]float64{{91, 0, 5}, {0, 181, 5}, {51.5, -0.1, 0}} {
+		if _, err := db.ListSessionsNear(ctx, bad[0], bad[1], bad[2], 10); err != ErrBadLocation {
+			t.Errorf("ListSessionsNear(%v): got err %v, want ErrBadLocation", bad, err)
+		}
+	}
+}
+
+// slowGetDB counts GetSession calls and blocks them until release is closed.
+type slowGetDB struct {
+	SessionDatabase
+	calls   int32
+	release chan struct{}
+}
+
+func (db *slowGetDB) GetSession(id int64) (*Session, error) {
+	atomic.AddInt32(&db.calls, 1)
+	<-db.release
+	return db.SessionDatabase.GetSession(id)
+}
+
+func TestSingleflightDBGetSession(t *testing.T) {
+	mem := newMemoryDB()
+	defer mem.Close()
+	id, err := mem.AddSession(&Session{Title: "popular"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &slowGetDB{SessionDatabase: mem, release: make(chan struct{})}
+	db := newSingleflightDB(backend)
+
+	const n = 50
+	var wg sync.WaitGroup
+	results := make(chan *Session, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := db.GetSession(id)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- s
+		}()
+	}
+	// Give the goroutines time to join the first call before releasing it.
+	time.Sleep(100 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+	close(results)
+
+	if calls := atomic.LoadInt32(&backend.calls); calls != 1 {
+		t.Errorf("got %d backend calls, want 1", calls)
+	}
+	for s := range results {
+		if s == nil || s.Title != "popular" {
+			t.Errorf("got session %+v, want popular", s)
+		}
+	}
+}
+
+func TestMemoryDBListSessionsAtSnapshot(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	id, err := db.AddSession(&Session{Title: "before", Tags: []string{"go"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := db.ListSessionsAtSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.RenameTag(ctx, "go", "golang"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateSession(&Session{ID: id, Title: "after"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddSession(&Session{Title: "added"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshot) != 1 || snapshot[0].Title != "before" || snapshot[0].Tags[0] != "go" {
+		t.Errorf("got snapshot %+v, want only the session as it was", snapshot)
+	}
+}
+
+func TestMemoryDBSearchSessions(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if _, err := db.AddSession(&Session{Title: fmt.Sprintf("Go talk %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.AddSession(&Session{Title: "Rust talk", Tags: []string{"systems"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := db.CountSearchSessions(ctx, "go TALK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("CountSearchSessions: got %d, want 5", count)
+	}
+
+	seen := 0
+	for offset := 0; offset < count+2; offset += 2 {
+		sessions, err := db.SearchSessions(ctx, "go TALK", 2, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range sessions {
+			if !strings.HasPrefix(s.Title, "Go talk") {
+				t.Errorf("offset %d: got %q, want a Go talk", offset, s.Title)
+			}
+		}
+		seen += len(sessions)
+	}
+	if seen != count {
+		t.Errorf("got %d results across pages, want %d", seen, count)
+	}
+
+	if n, err := db.CountSearchSessions(ctx, "systems"); err != nil || n != 1 {
+		t.Errorf("CountSearchSessions(systems): got %d, %v, want 1", n, err)
+	}
+	if n, err := db.CountSearchSessions(ctx, "  "); err != nil || n != 0 {
+		t.Errorf("CountSearchSessions(empty): got %d, %v, want 0", n, err)
+	}
+}
+
+// searchWords are the words of the sessions generated by addSearchSessions,
+// chosen so that some contain others.
+var searchWords = []string{"go", "golang", "Gopher", "rust", "trust", "cloud", "Cloud-native", "web", "webassembly", "data"}
+
+// addSearchSessions adds n sessions with random titles, authors, descriptions
+// and tags made of vocab to db.
+func addSearchSessions(tb testing.TB, db *memoryDB, n int, vocab []string, rnd *rand.Rand) {
+	words := func(k int) string {
+		var w []string
+		for i := 0; i < k; i++ {
+			w = append(w, vocab[rnd.Intn(len(vocab))])
+		}
+		return strings.Join(w, " ")
+	}
+	for i := 0; i < n; i++ {
+		s := &Session{Title: words(3), Author: words(1), Description: words(8), Tags: strings.Fields(words(2))}
+		if _, err := db.AddSession(s); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func TestMemoryDBSearchIndexMatchesScan(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(1))
+	addSearchSessions(t, db, 300, searchWords, rnd)
+
+	queries := []string{"", "go", "GO rust", "ust", "o", "cloud-native", "native web", "assembly", "gopher golang data", "missing", "go missing"}
+	check := func(when string) {
+		all, err := db.ListSessions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range queries {
+			want := filterSessions(all, q)
+			got, err := db.SearchSessions(ctx, q, len(all)+1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Errorf("%s: %q: got %d results, want %d", when, q, len(got), len(want))
+				continue
+			}
+			for i := range got {
+				if got[i].ID != want[i].ID {
+					t.Errorf("%s: %q: result %d is session %d, want %d", when, q, i, got[i].ID, want[i].ID)
+					break
+				}
+			}
+			if n, err := db.CountSearchSessions(ctx, q); err != nil || n != len(want) {
+				t.Errorf("%s: CountSearchSessions(%q): got %d, %v, want %d", when, q, n, err, len(want))
+			}
+		}
+	}
+	check("after adding")
+
+	// Every kind of change keeps the index in step.
+	if err := db.UpdateSession(&Session{ID: 1, Title: "webassembly only"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteSession(2); err != nil {
+		t.Fatal(err)
+	}
+	db.DeleteSessions(ctx, []int64{3, 4})
+	if _, err := db.RenameTag(ctx, "go", "nativego"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RemoveTag(ctx, "rust"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.AddTagToSessions(ctx, []int64{5, 6, 7}, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MergeSessions(ctx, 8, 9); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.UpsertSessionByExternalID(ctx, &Session{Title: "trust data", ExternalID: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	queries = append(queries, "nativego", "webassembly only")
+	check("after changes")
+}
+
+// benchmarkWords returns a vocabulary of n words, so that benchmark queries
+// match only some sessions.
+func benchmarkWords(n int) []string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = fmt.Sprintf("word%04d", i)
+	}
+	return words
+}
+
+func BenchmarkMemoryDBSearchSessions(b *testing.B) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+	addSearchSessions(b, db, 10000, benchmarkWords(2000), rand.New(rand.NewSource(1)))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.SearchSessions(ctx, "word0042", 20, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSearchScan is the full scan that BenchmarkMemoryDBSearchSessions
+// is compared with.
+func BenchmarkSearchScan(b *testing.B) {
+	db := newMemoryDB()
+	defer db.Close()
+	addSearchSessions(b, db, 10000, benchmarkWords(2000), rand.New(rand.NewSource(1)))
+	sessions, err := db.ListSessions()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pageOf(filterSessions(sessions, "word0042"), 20, 0)
+	}
+}
+
+func TestMemoryDBListSessionsFor(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, s := range []*Session{
+		{Title: "public", CreatedByID: "owner"},
+		{Title: "unlisted", CreatedByID: "owner", Visibility: VisibilityUnlisted},
+		{Title: "private", CreatedByID: "owner", Visibility: VisibilityPrivate},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		viewer Viewer
+		want   string
+	}{
+		{Viewer{}, "public"},
+		{Viewer{UserID: "other"}, "public"},
+		{Viewer{UserID: "owner"}, "private,public,unlisted"},
+		{Viewer{UserID: "admin", Admin: true}, "private,public,unlisted"},
+	} {
+		sessions, err := db.ListSessionsFor(ctx, tt.viewer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range sessions {
+			got = append(got, s.Title)
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%+v: got %v, want %s", tt.viewer, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryDBMergeSessions(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	keepID, err := db.AddSession(&Session{Title: "Go", Tags: []string{"go", "talk"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergeID, err := db.AddSession(&Session{Title: "Go (duplicate)", Tags: []string{"talk", "gophercon"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.MergeSessions(ctx, keepID, keepID); err != ErrMergeIntoSelf {
+		t.Errorf("merge into self: got err %v, want %v", err, ErrMergeIntoSelf)
+	}
+	if err := db.MergeSessions(ctx, keepID, 999); err != ErrSessionNotFound {
+		t.Errorf("missing session: got err %v, want %v", err, ErrSessionNotFound)
+	}
+
+	if err := db.MergeSessions(ctx, keepID, mergeID); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := db.GetSession(keepID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(kept.Tags, ","); got != "go,talk,gophercon" {
+		t.Errorf("got tags %s, want go,talk,gophercon", got)
+	}
+	if _, err := db.GetSession(mergeID); err != ErrSessionNotFound {
+		t.Errorf("merged session: got err %v, want %v", err, ErrSessionNotFound)
+	}
+	if _, err := db.GetSessionBySlug(ctx, "go-duplicate"); err != ErrSessionNotFound {
+		t.Errorf("merged slug: got err %v, want %v", err, ErrSessionNotFound)
+	}
+}
+
+func TestMemoryDBListSessionsSorted(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, s := range []*Session{
+		{Title: "b", Favorites: 5, ViewCount: 10},
+		{Title: "a", Favorites: 5, ViewCount: 30},
+		{Title: "c", Favorites: 9, ViewCount: 10},
+		{Title: "a", Favorites: 5, ViewCount: 10},
+		{Title: "d"},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		order string
+		want  string
+	}{
+		{SortByTitle, "a/5/30,a/5/10,b/5/10,c/9/10,d/0/0"},
+		{SortByFavorites, "c/9/10,a/5/30,a/5/10,b/5/10,d/0/0"},
+		{SortByViews, "a/5/30,a/5/10,b/5/10,c/9/10,d/0/0"},
+	} {
+		// Sort twice to check that ties come out the same each time.
+		for i := 0; i < 2; i++ {
+			sessions, err := db.ListSessionsSorted(ctx, tt.order)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range sessions {
+				got = append(got, fmt.Sprintf("%s/%d/%d", s.Title, s.Favorites, s.ViewCount))
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("%s: got %v, want %s", tt.order, got, tt.want)
+			}
+		}
+	}
+
+	if _, err := db.ListSessionsSorted(ctx, "likes"); err != ErrBadSortOrder {
+		t.Errorf("ListSessionsSorted(likes): got %v, want ErrBadSortOrder", err)
+	}
+}
+
+func TestMemoryDBListSessionsCreatedBy(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	// Sessions 1 and 2 share a title and creation time, so only their IDs
+	// tell them apart.
+	created := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, s := range []*Session{
+		{Title: "a", CreatedByID: "u"},
+		{Title: "a", CreatedByID: "u"},
+		{Title: "c", CreatedByID: "u"},
+		{Title: "b", CreatedByID: "u"},
+		{Title: "z", CreatedByID: "someone else"},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, s := range db.sessions {
+		s.CreatedAt = created
+		if id >= 3 {
+			s.CreatedAt = created.Add(time.Duration(id) * time.Hour)
+		}
+		s.UpdatedAt = created.Add(-time.Duration(id) * time.Hour)
+	}
+
+	for _, tt := range []struct {
+		order string
+		desc  bool
+		want  string
+	}{
+		{SortByTitle, false, "1,2,4,3"},
+		{SortByTitle, true, "3,4,2,1"},
+		{SortByCreated, false, "1,2,3,4"},
+		{SortByCreated, true, "4,3,2,1"},
+		{SortByUpdated, false, "4,3,2,1"},
+		{SortByUpdated, true, "1,2,3,4"},
+	} {
+		// List twice to check that ties come out the same each time.
+		for i := 0; i < 2; i++ {
+			sessions, err := db.ListSessionsCreatedBy(ctx, "u", tt.order, tt.desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range sessions {
+				got = append(got, fmt.Sprint(s.ID))
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("%s desc=%v: got IDs %v, want %s", tt.order, tt.desc, got, tt.want)
+			}
+		}
+	}
+
+	if _, err := db.ListSessionsCreatedBy(ctx, "u", SortByViews, false); err != ErrBadSortOrder {
+		t.Errorf("ListSessionsCreatedBy(views): got %v, want ErrBadSortOrder", err)
+	}
+}
+
+func TestMemoryDBListSessionsWithoutThumbnail(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, s := range []*Session{
+		{Title: "needs 1", VideoURL: "https://example.com/1.mp4"},
+		{Title: "done", VideoURL: "https://example.com/2.mp4", ThumbnailURL: "https://example.com/2.jpg"},
+		{Title: "no video"},
+		{Title: "needs 2", VideoURL: "https://example.com/3.mp4"},
+		{Title: "thumbnail only", ThumbnailURL: "https://example.com/4.jpg"},
+		{Title: "needs 3", VideoURL: "https://example.com/5.mp4"},
+		{Title: "shares 2", VideoURL: "https://example.com/3.mp4"},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		limit int
+		want  string
+	}{
+		{10, "needs 1,needs 2,shares 2,needs 3"},
+		{2, "needs 1,needs 2"},
+	} {
+		sessions, err := db.ListSessionsWithoutThumbnail(ctx, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range sessions {
+			got = append(got, s.Title)
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("limit %d: got %v, want %s", tt.limit, got, tt.want)
+		}
+	}
+
+	if _, err := db.ListSessionsWithoutThumbnail(ctx, 0); err == nil {
+		t.Error("limit 0: got nil error")
+	}
+}
+
+func TestMemoryDBListSessionSummaries(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	id, err := db.AddSession(&Session{
+		Title:        "Go",
+		Author:       "Gopher",
+		ThumbnailURL: "https://example.com/go.jpg",
+		Description:  strings.Repeat("long ", 1000),
+		Visibility:   VisibilityUnlisted,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, err := db.ListSessionSummaries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*SessionSummary{{
+		ID:           id,
+		Title:        "Go",
+		Author:       "Gopher",
+		ThumbnailURL: "https://example.com/go.jpg",
+		Visibility:   VisibilityUnlisted,
+	}}
+	if !reflect.DeepEqual(summaries, want) {
+		t.Errorf("got %+v, want %+v", summaries, want)
+	}
+
+	b, err := json.Marshal(summaries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["description"]; ok {
+		t.Errorf("summary %s has a description", b)
+	}
+}
+
+func TestMemoryDBSearchWithFacets(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, s := range []*Session{
+		{Title: "Go generics", Tags: []string{"go", "generics", "talk"}},
+		{Title: "Go modules", Tags: []string{"go", "modules", "talk"}},
+		{Title: "Go tour", Tags: []string{"go", "tutorial"}},
+		{Title: "Rust intro", Tags: []string{"rust", "talk"}},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		query      string
+		tags       []string
+		wantTitles string
+		wantFacets map[string]int
+	}{
+		{"go", nil, "Go generics,Go modules,Go tour",
+			map[string]int{"go": 3, "generics": 1, "modules": 1, "talk": 2, "tutorial": 1}},
+		{"go", []string{"talk"}, "Go generics,Go modules",
+			map[string]int{"go": 2, "generics": 1, "modules": 1}},
+		{"", []string{"talk"}, "Go generics,Go modules,Rust intro",
+			map[string]int{"go": 2, "generics": 1, "modules": 1, "rust": 1}},
+		{"", nil, "", map[string]int{}},
+	} {
+		results, facets, err := db.SearchWithFacets(ctx, tt.query, tt.tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, s := range results {
+			titles = append(titles, s.Title)
+		}
+		if got := strings.Join(titles, ","); got != tt.wantTitles {
+			t.Errorf("SearchWithFacets(%q, %v): got %s, want %s", tt.query, tt.tags, got, tt.wantTitles)
+		}
+		if !reflect.DeepEqual(facets, tt.wantFacets) {
+			t.Errorf("SearchWithFacets(%q, %v): got facets %v, want %v", tt.query, tt.tags, facets, tt.wantFacets)
+		}
+		// Every facet counts the results carrying the tag.
+		for tag, n := range facets {
+			carrying := 0
+			for _, s := range results {
+				if s.hasTags([]string{tag}) {
+					carrying++
+				}
+			}
+			if n != carrying {
+				t.Errorf("SearchWithFacets(%q, %v): facet %s is %d, but %d results carry it", tt.query, tt.tags, tag, n, carrying)
+			}
+		}
+	}
+}
+
+func TestMemoryDBStorageUsageByUser(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	for _, s := range []*Session{
+		{Title: "a1", CreatedByID: "alice", SizeBytes: 1000},
+		{Title: "a2", CreatedByID: "alice", SizeBytes: 250},
+		{Title: "b1", CreatedByID: "bob", SizeBytes: 4096},
+		{Title: "b2", CreatedByID: "bob"},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := db.StorageUsageByUser(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"alice": 1250, "bob": 4096}; !reflect.DeepEqual(usage, want) {
+		t.Errorf("StorageUsageByUser: got %v, want %v", usage, want)
+	}
 }
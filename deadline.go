@@ -0,0 +1,39 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// errSoftDeadline stops IterateSessions in ListSessionsWithDeadline.
+var errSoftDeadline = errors.New("soft deadline passed")
+
+// ListSessionsWithDeadline reads sessions from db in title order with
+// IterateSessions until they run out or softDeadline has passed, whichever
+// is first. If it stopped early, it returns the sessions read so far with
+// partial set, rather than an error. As the deadline is only checked
+// between sessions, a single slow read can still overrun it; ctx bounds
+// that.
+func ListSessionsWithDeadline(ctx context.Context, db SessionDatabase, softDeadline time.Duration) (sessions []*Session, partial bool, err error) {
+	deadline := time.Now().Add(softDeadline)
+	err = db.IterateSessions(ctx, func(s *Session) error {
+		sessions = append(sessions, s)
+		if time.Now().After(deadline) {
+			return errSoftDeadline
+		}
+		return nil
+	})
+	if err == errSoftDeadline {
+		return sessions, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return sessions, false, nil
+}
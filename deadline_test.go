@@ -0,0 +1,69 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// slowDB is a SessionDatabase whose IterateSessions yields n sessions, one
+// every delay, and whose GetSession takes delay to return one of them.
+type slowDB struct {
+	SessionDatabase
+	n     int
+	delay time.Duration
+}
+
+func (db slowDB) GetSession(id int64) (*Session, error) {
+	time.Sleep(db.delay)
+	if id < 1 || id > int64(db.n) {
+		return nil, ErrSessionNotFound
+	}
+	return &Session{ID: id, Title: fmt.Sprint(id - 1)}, nil
+}
+
+func (db slowDB) IterateSessions(ctx context.Context, fn func(*Session) error) error {
+	for i := 0; i < db.n; i++ {
+		time.Sleep(db.delay)
+		if err := fn(&Session{ID: int64(i + 1), Title: fmt.Sprint(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestListSessionsWithDeadline(t *testing.T) {
+	ctx := context.Background()
+
+	db := slowDB{n: 100, delay: 10 * time.Millisecond}
+	sessions, partial, err := ListSessionsWithDeadline(ctx, db, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !partial {
+		t.Error("slow listing: got partial false, want true")
+	}
+	if len(sessions) == 0 || len(sessions) >= db.n {
+		t.Errorf("slow listing: got %d sessions, want some but not all %d", len(sessions), db.n)
+	}
+	for i, s := range sessions {
+		if s.ID != int64(i+1) {
+			t.Fatalf("slow listing: session %d has ID %d, want %d", i, s.ID, i+1)
+		}
+	}
+
+	db = slowDB{n: 3}
+	sessions, partial, err = ListSessionsWithDeadline(ctx, db, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial || len(sessions) != 3 {
+		t.Errorf("fast listing: got %d sessions, partial %v, want all 3", len(sessions), partial)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import "time"
+
+// SessionDefaults are the values new sessions start with, configured in
+// NewSessionDefaults.
+type SessionDefaults struct {
+	Tags        []string
+	Description string
+	Visibility  string
+	// PublishedToday makes the current date, as "2006-01-02", the default
+	// PublishedDate.
+	PublishedToday bool
+}
+
+// Session returns a new session holding the defaults, as of now.
+func (d SessionDefaults) Session(now time.Time) *Session {
+	s := &Session{}
+	d.Apply(s, now)
+	return s
+}
+
+// Apply fills in the fields of s that are blank with the defaults, as of now.
+// Fields that are set are kept.
+func (d SessionDefaults) Apply(s *Session, now time.Time) {
+	if len(s.Tags) == 0 && len(d.Tags) > 0 {
+		s.Tags = append([]string(nil), d.Tags...)
+	}
+	if s.Description == "" {
+		s.Description = d.Description
+	}
+	if s.Visibility == "" {
+		s.Visibility = d.Visibility
+	}
+	if s.PublishedDate == "" && d.PublishedToday {
+		s.PublishedDate = now.Format("2006-01-02")
+	}
+}
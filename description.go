@@ -0,0 +1,133 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"cloud.google.com/go/storage"
+
+	"golang.org/x/net/context"
+)
+
+// BlobStore stores objects by name. It holds the descriptions the Datastore
+// backend offloads (see DescriptionOffloadThreshold).
+type BlobStore interface {
+	// Put writes data as the object with the given name, replacing any
+	// object with that name.
+	Put(ctx context.Context, name string, data []byte) error
+
+	// Get returns the contents of the object with the given name.
+	Get(ctx context.Context, name string) ([]byte, error)
+}
+
+// bucketBlobStore is a BlobStore backed by a Cloud Storage bucket.
+type bucketBlobStore struct {
+	bucket *storage.BucketHandle
+}
+
+// NewBucketBlobStore returns a BlobStore keeping objects in bucket. They are
+// private, whatever PrivateObjects is set to.
+func NewBucketBlobStore(bucket *storage.BucketHandle) BlobStore {
+	return bucketBlobStore{bucket: bucket}
+}
+
+func (s bucketBlobStore) Put(ctx context.Context, name string, data []byte) error {
+	w := s.bucket.Object(name).NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		w.CloseWithError(err)
+		return err
+	}
+	return w.Close()
+}
+
+func (s bucketBlobStore) Get(ctx context.Context, name string) ([]byte, error) {
+	r, err := s.bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// descriptionObjectName returns the name of the object an offloaded
+// description is stored as. Names are derived from the content, so sessions
+// with the same description share an object, and an object never changes.
+func descriptionObjectName(description string) string {
+	sum := sha256.Sum256([]byte(description))
+	return "descriptions/" + hex.EncodeToString(sum[:]) + ".gz"
+}
+
+// storeDescription writes description, gzipped, to store if it is longer
+// than threshold bytes, and returns the name of the object. It returns ""
+// if the description should stay inline, or if store is nil or threshold is
+// not positive.
+func storeDescription(ctx context.Context, store BlobStore, threshold int, description string) (string, error) {
+	if store == nil || threshold <= 0 || len(description) <= threshold {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(description)); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	name := descriptionObjectName(description)
+	if err := store.Put(ctx, name, buf.Bytes()); err != nil {
+		return "", fmt.Errorf("could not store description: %v", err)
+	}
+	return name, nil
+}
+
+// descriptionEntity returns the session to save for b, given the name ref
+// that storeDescription returned for its description: a copy of b holding
+// ref instead of the description if it was stored, or else b, with any
+// stale reference dropped. b itself is not changed, so callers keep the
+// full description.
+func descriptionEntity(b *Session, ref string) *Session {
+	switch {
+	case ref != "":
+		c := *b
+		c.Description, c.DescriptionRef = "", ref
+		return &c
+	case b.Description != "" && b.DescriptionRef != "":
+		c := *b
+		c.DescriptionRef = ""
+		return &c
+	}
+	return b
+}
+
+// inflateDescription reads b's description back from store if it was
+// offloaded.
+func inflateDescription(ctx context.Context, store BlobStore, b *Session) error {
+	if b.DescriptionRef == "" || b.Description != "" {
+		return nil
+	}
+	if store == nil {
+		return fmt.Errorf("no store to read description %s from", b.DescriptionRef)
+	}
+	data, err := store.Get(ctx, b.DescriptionRef)
+	if err != nil {
+		return fmt.Errorf("could not read description %s: %v", b.DescriptionRef, err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("could not read description %s: %v", b.DescriptionRef, err)
+	}
+	text, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("could not read description %s: %v", b.DescriptionRef, err)
+	}
+	b.Description = string(text)
+	return nil
+}
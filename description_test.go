@@ -0,0 +1,84 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// memoryBlobStore is a BlobStore keeping objects in a map.
+type memoryBlobStore map[string][]byte
+
+func (s memoryBlobStore) Put(ctx context.Context, name string, data []byte) error {
+	s[name] = data
+	return nil
+}
+
+func (s memoryBlobStore) Get(ctx context.Context, name string) ([]byte, error) {
+	data, ok := s[name]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return data, nil
+}
+
+func TestDescriptionOffload(t *testing.T) {
+	ctx := context.Background()
+	store := memoryBlobStore{}
+	const threshold = 1500
+
+	transcript := strings.Repeat("and then we sharded the database again. ", 200)
+	b := &Session{Title: "transcribed", Description: transcript}
+	ref, err := storeDescription(ctx, store, threshold, b.Description)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref == "" || len(store) != 1 {
+		t.Fatalf("got ref %q and %d objects, want the description stored", ref, len(store))
+	}
+	if n := len(store[ref]); n >= len(transcript)/10 {
+		t.Errorf("stored %d bytes for a %d byte description, want it compressed", n, len(transcript))
+	}
+
+	entity := descriptionEntity(b, ref)
+	if entity.Description != "" || entity.DescriptionRef != ref {
+		t.Errorf("got entity description %d bytes, ref %q; want none and %q", len(entity.Description), entity.DescriptionRef, ref)
+	}
+	if b.Description != transcript || b.DescriptionRef != "" {
+		t.Error("descriptionEntity changed the session passed in")
+	}
+
+	if err := inflateDescription(ctx, store, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Description != transcript {
+		t.Errorf("inflated description has %d bytes, want the original %d", len(entity.Description), len(transcript))
+	}
+
+	// The same description is stored under the same name.
+	if again, err := storeDescription(ctx, store, threshold, transcript); err != nil || again != ref || len(store) != 1 {
+		t.Errorf("storing again: got %q, %v and %d objects; want %q and 1 object", again, err, len(store), ref)
+	}
+
+	// Short descriptions stay inline, and drop a reference to a long one.
+	short := &Session{Description: "short", DescriptionRef: ref}
+	ref, err = storeDescription(ctx, store, threshold, short.Description)
+	if err != nil || ref != "" {
+		t.Errorf("short description: got ref %q, %v; want none", ref, err)
+	}
+	if e := descriptionEntity(short, ref); e.Description != "short" || e.DescriptionRef != "" {
+		t.Errorf("short description: got entity %+v, want it inline", e)
+	}
+
+	// A session read from a list, without its description, keeps its
+	// reference when saved.
+	listed := &Session{DescriptionRef: entity.DescriptionRef}
+	if e := descriptionEntity(listed, ""); e.DescriptionRef != listed.DescriptionRef {
+		t.Errorf("listed session: got ref %q, want %q", e.DescriptionRef, listed.DescriptionRef)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// FindDuplicateSessions reads every session in db with IterateSessions and
+// groups those that are likely duplicates of each other: sessions with the
+// same title and author, ignoring case and spacing, or with the same
+// ContentHash. A session matching one member of a group by title and another
+// by content joins both in a single group. Only groups of more than one
+// session are returned, each in title order and ordered by its first
+// session.
+func FindDuplicateSessions(ctx context.Context, db SessionDatabase) ([][]*Session, error) {
+	var sessions []*Session
+	// parent links each session to another in its group, as a disjoint-set
+	// forest; a session is the root of its group if it is its own parent.
+	var parent []int
+	find := func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	first := make(map[string]int) // the first session with each key
+
+	err := db.IterateSessions(ctx, func(s *Session) error {
+		i := len(sessions)
+		sessions = append(sessions, s)
+		parent = append(parent, i)
+		for _, key := range duplicateKeys(s) {
+			j, ok := first[key]
+			if !ok {
+				first[key] = i
+				continue
+			}
+			// Join under the earlier root, so groups keep title order.
+			ri, rj := find(i), find(j)
+			if ri < rj {
+				parent[rj] = ri
+			} else {
+				parent[ri] = rj
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[int][]*Session)
+	var roots []int
+	for i, s := range sessions {
+		r := find(i)
+		if len(members[r]) == 0 {
+			roots = append(roots, r)
+		}
+		members[r] = append(members[r], s)
+	}
+	groups := [][]*Session{}
+	for _, r := range roots {
+		if len(members[r]) > 1 {
+			groups = append(groups, members[r])
+		}
+	}
+	return groups, nil
+}
+
+// duplicateKeys returns the keys under which s matches its duplicates: its
+// normalized title and author, if it has a title, and its content hash, if
+// it has one.
+func duplicateKeys(s *Session) []string {
+	var keys []string
+	if title := normalizeForDuplicates(s.Title); title != "" {
+		keys = append(keys, "title:"+title+"\x00"+normalizeForDuplicates(s.Author))
+	}
+	if s.ContentHash != "" {
+		keys = append(keys, "hash:"+s.ContentHash)
+	}
+	return keys
+}
+
+// normalizeForDuplicates lowercases s and collapses its runs of whitespace
+// into single spaces, trimming them from the ends.
+func normalizeForDuplicates(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
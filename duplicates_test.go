@@ -0,0 +1,55 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestFindDuplicateSessions(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+
+	for _, s := range []*Session{
+		{Title: "Go  Generics", Author: "Ada"},
+		{Title: "go generics", Author: "ada "},
+		{Title: "Go generics", Author: "Grace"},
+		{Title: "Intro to Rust", ContentHash: "abc"},
+		{Title: "Rust intro (re-upload)", ContentHash: "abc"},
+		{Title: "Rust: the talk", ContentHash: "def"},
+		{Title: "rust: THE talk", ContentHash: ""},
+		{Title: "Unique"},
+		{Title: "", Author: "Ada"},
+		{Title: "", Author: "Ada"},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, err := FindDuplicateSessions(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, g := range groups {
+		var titles []string
+		for _, s := range g {
+			titles = append(titles, s.Title)
+		}
+		got = append(got, titles)
+	}
+	want := [][]string{
+		{"Go  Generics", "go generics"},
+		{"Intro to Rust", "Rust intro (re-upload)"},
+		{"Rust: the talk", "rust: THE talk"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"reflect"
+	"time"
+)
+
+// The types of SessionEvent.
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+)
+
+// SessionEvent is the message published to PubsubTopicID when a session is
+// created, updated or deleted, unless LegacyPubsubPayload is set.
+type SessionEvent struct {
+	Type      string `json:"type"`
+	SessionID int64  `json:"sessionId"`
+
+	// Session is the session as saved. It is nil for EventDeleted, or if
+	// the session could not be read back.
+	Session *Session `json:"session"`
+
+	// ChangedFields lists the fields of the session an EventUpdated
+	// changed, as returned by ChangedFields, so subscribers can skip the
+	// updates they don't care about. It is null if they aren't known.
+	ChangedFields []string `json:"changedFields"`
+
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// untrackedFields are the fields of Session left out of ChangedFields, as
+// the database maintains them itself rather than taking them from edits.
+var untrackedFields = map[string]bool{
+	"ID":             true,
+	"PublishedAt":    true,
+	"CreatedAt":      true,
+	"UpdatedAt":      true,
+	"Favorites":      true,
+	"ViewCount":      true,
+	"PublicID":       true,
+	"Slug":           true,
+	"DescriptionRef": true,
+}
+
+// ChangedFields returns the names of the fields of Session, such as "Title"
+// or "VideoURL", that differ between old and new, in declaration order.
+// Only the fields sent to clients are compared, other than those in
+// untrackedFields, and nil and empty lists are equal.
+func ChangedFields(old, new *Session) []string {
+	changed := []string{}
+	o, n := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	t := o.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if untrackedFields[f.Name] || f.Tag.Get("json") == "-" {
+			continue
+		}
+		of, nf := o.Field(i), n.Field(i)
+		if f.Type.Kind() == reflect.Slice && of.Len() == 0 && nf.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(of.Interface(), nf.Interface()) {
+			changed = append(changed, f.Name)
+		}
+	}
+	return changed
+}
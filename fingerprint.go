@@ -0,0 +1,53 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// counterFields are the fields of Session counting how the session is used,
+// which change too often to be part of its fingerprint unless
+// FingerprintCounters is set.
+var counterFields = map[string]bool{
+	"Favorites": true,
+	"ViewCount": true,
+}
+
+// Fingerprint returns a hex-encoded SHA-256 hash of the fields of the session
+// that ChangedFields compares, in declaration order, plus the counters in
+// counterFields if FingerprintCounters is set. Sessions for which
+// ChangedFields finds no changes have the same fingerprint, so it can be used
+// as an ETag or a cache key, or to tell whether a session changed.
+func (b *Session) Fingerprint() string {
+	h := sha256.New()
+	v := reflect.ValueOf(b).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("json") == "-" {
+			continue
+		}
+		if untrackedFields[f.Name] && !(FingerprintCounters && counterFields[f.Name]) {
+			continue
+		}
+		var value interface{} = v.Field(i).Interface()
+		if f.Type.Kind() == reflect.Slice && v.Field(i).Len() == 0 {
+			// Nil and empty lists are equal.
+			value = nil
+		}
+		enc, err := json.Marshal(value)
+		if err != nil {
+			// Only values such as NaN coordinates get here.
+			enc = []byte(fmt.Sprint(value))
+		}
+		fmt.Fprintf(h, "%s=%s\n", f.Name, enc)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
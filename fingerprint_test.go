@@ -0,0 +1,78 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	base := func() *Session {
+		return &Session{
+			ID:          1,
+			Title:       "Go at scale",
+			Author:      "ann",
+			Tags:        []string{"go"},
+			Description: "All about Go.",
+			CreatedAt:   time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC),
+			ViewCount:   10,
+		}
+	}
+
+	// Sessions differing only in fields the database maintains, counters or
+	// nil versus empty lists are equal.
+	same := base()
+	same.ID = 2
+	same.CreatedAt = time.Now()
+	same.Slug = "go-at-scale"
+	same.ViewCount = 99
+	same.Favorites = 3
+	same.Presenters = []string{}
+	if got, want := same.Fingerprint(), base().Fingerprint(); got != want {
+		t.Errorf("equal sessions: got fingerprint %s, want %s", got, want)
+	}
+	if got, want := base().Fingerprint(), base().Fingerprint(); got != want {
+		t.Errorf("fingerprint isn't stable: got %s, then %s", got, want)
+	}
+
+	// Changing any meaningful field changes the fingerprint.
+	v := reflect.ValueOf(base()).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if untrackedFields[f.Name] || f.Tag.Get("json") == "-" {
+			continue
+		}
+		changed := base()
+		field := reflect.ValueOf(changed).Elem().Field(i)
+		switch field.Interface().(type) {
+		case string:
+			field.SetString("changed")
+		case int, int64:
+			field.SetInt(42)
+		case float64:
+			field.SetFloat(1.5)
+		case []string:
+			field.Set(reflect.ValueOf([]string{"changed"}))
+		case []Caption:
+			field.Set(reflect.ValueOf([]Caption{{Lang: "en", URL: "https://example.com/en.vtt", Format: CaptionVTT}}))
+		case time.Time:
+			field.Set(reflect.ValueOf(time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)))
+		default:
+			t.Errorf("%s: no test value for type %s", f.Name, f.Type)
+			continue
+		}
+		if changed.Fingerprint() == base().Fingerprint() {
+			t.Errorf("changing %s didn't change the fingerprint", f.Name)
+		}
+	}
+
+	defer func(v bool) { FingerprintCounters = v }(FingerprintCounters)
+	FingerprintCounters = true
+	if same.Fingerprint() == base().Fingerprint() {
+		t.Error("with FingerprintCounters: changing ViewCount didn't change the fingerprint")
+	}
+}
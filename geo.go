@@ -0,0 +1,199 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// ErrBadLocation is returned by ListSessionsNear for a latitude or longitude
+// out of range, or a radius or limit that isn't positive.
+var ErrBadLocation = errors.New("bad location query")
+
+// earthRadiusKm is the mean radius of the Earth.
+const earthRadiusKm = 6371.0
+
+// geoHashPrecision is the number of characters of the GeoHash stored with
+// sessions, locating them to within about 5 m.
+const geoHashPrecision = 9
+
+// geoHashAlphabet is the base32 alphabet of geohashes.
+const geoHashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// HasLocation reports whether the session has a location. The zero value of
+// Latitude and Longitude means it has none.
+func (s *Session) HasLocation() bool {
+	return s.Latitude != 0 || s.Longitude != 0
+}
+
+// validNearQuery reports whether the arguments of ListSessionsNear are in
+// range.
+func validNearQuery(lat, lng, radiusKm float64, limit int) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180 && radiusKm > 0 && limit > 0
+}
+
+// encodeGeoHash returns the geohash of the given point with the given number
+// of characters. Each character halves the cell alternately in longitude
+// and latitude five times, starting with longitude.
+func encodeGeoHash(lat, lng float64, precision int) string {
+	latLo, latHi := -90.0, 90.0
+	lngLo, lngHi := -180.0, 180.0
+	hash := make([]byte, precision)
+	even := true
+	for i := range hash {
+		c := 0
+		for bit := 0; bit < 5; bit++ {
+			c <<= 1
+			if even {
+				mid := (lngLo + lngHi) / 2
+				if lng >= mid {
+					c |= 1
+					lngLo = mid
+				} else {
+					lngHi = mid
+				}
+			} else {
+				mid := (latLo + latHi) / 2
+				if lat >= mid {
+					c |= 1
+					latLo = mid
+				} else {
+					latHi = mid
+				}
+			}
+			even = !even
+		}
+		hash[i] = geoHashAlphabet[c]
+	}
+	return string(hash)
+}
+
+// geoHashCellSize returns the height and width, in degrees, of the cells of
+// geohashes with the given number of characters.
+func geoHashCellSize(precision int) (lat, lng float64) {
+	bits := 5 * precision
+	return 180 / math.Pow(2, float64(bits/2)), 360 / math.Pow(2, float64(bits-bits/2))
+}
+
+// setGeoHash sets the GeoHash of s from its location, reporting whether it
+// changed.
+func setGeoHash(s *Session) bool {
+	hash := ""
+	if s.HasLocation() {
+		hash = encodeGeoHash(s.Latitude, s.Longitude, geoHashPrecision)
+	}
+	if s.GeoHash == hash {
+		return false
+	}
+	s.GeoHash = hash
+	return true
+}
+
+// geoHashPrefixes returns the geohash prefixes of the cells covering every
+// point within radiusKm of the given point. The cells are the longest that
+// are at least as tall and wide as the bounding box of the circle, so the
+// box lies within the (at most four) cells holding its corners. It returns
+// nil if the box is too large for any cell, e.g. near the poles, in which
+// case every located session must be considered.
+func geoHashPrefixes(lat, lng, radiusKm float64) []string {
+	angle := radiusKm / earthRadiusKm
+	dLat := angle * 180 / math.Pi
+	// The widest longitude of a circle on the sphere is asin(sin(angle) /
+	// cos(lat)); it wraps all the way around if the circle holds a pole.
+	x := math.Sin(angle) / math.Cos(lat*math.Pi/180)
+	if lat+dLat >= 90 || lat-dLat <= -90 || angle >= math.Pi/2 || x >= 1 {
+		return nil
+	}
+	dLng := math.Asin(x) * 180 / math.Pi
+
+	precision := 0
+	for p := 1; p <= geoHashPrecision; p++ {
+		cellLat, cellLng := geoHashCellSize(p)
+		if cellLat < 2*dLat || cellLng < 2*dLng {
+			break
+		}
+		precision = p
+	}
+	if precision == 0 {
+		return nil
+	}
+
+	var prefixes []string
+	seen := make(map[string]bool)
+	for _, corner := range [][2]float64{
+		{lat - dLat, lng - dLng}, {lat - dLat, lng + dLng},
+		{lat + dLat, lng - dLng}, {lat + dLat, lng + dLng},
+	} {
+		p := encodeGeoHash(corner[0], wrapLongitude(corner[1]), precision)
+		if !seen[p] {
+			seen[p] = true
+			prefixes = append(prefixes, p)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// wrapLongitude returns lng in the range [-180, 180).
+func wrapLongitude(lng float64) float64 {
+	return math.Mod(math.Mod(lng+180, 360)+360, 360) - 180
+}
+
+// distanceKm returns the great-circle distance between two points, by the
+// haversine formula.
+func distanceKm(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// nearest returns up to limit of the located sessions within radiusKm of the
+// given point, nearest first. Sessions at the same distance are ordered by
+// ID.
+func nearest(sessions []*Session, lat, lng, radiusKm float64, limit int) []*Session {
+	var near sessionsByDistance
+	for _, s := range sessions {
+		if !s.HasLocation() {
+			continue
+		}
+		if d := distanceKm(lat, lng, s.Latitude, s.Longitude); d <= radiusKm {
+			near = append(near, sessionDistance{s, d})
+		}
+	}
+	sort.Sort(near)
+	if len(near) > limit {
+		near = near[:limit]
+	}
+
+	result := make([]*Session, len(near))
+	for i, n := range near {
+		result[i] = n.session
+	}
+	return result
+}
+
+// sessionDistance is a session and its distance from a point.
+type sessionDistance struct {
+	session *Session
+	km      float64
+}
+
+// sessionsByDistance implements sort.Interface, ordering sessions by
+// distance, then by ID.
+type sessionsByDistance []sessionDistance
+
+func (s sessionsByDistance) Less(i, j int) bool {
+	if s[i].km != s[j].km {
+		return s[i].km < s[j].km
+	}
+	return s[i].session.ID < s[j].session.ID
+}
+func (s sessionsByDistance) Len() int      { return len(s) }
+func (s sessionsByDistance) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,62 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestEncodeGeoHash(t *testing.T) {
+	if got, want := encodeGeoHash(57.64911, 10.40744, 11), "u4pruydqqvj"; got != want {
+		t.Errorf("encodeGeoHash: got %q, want %q", got, want)
+	}
+}
+
+func TestGeoHashPrefixesCoverRadius(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, c := range []struct {
+		lat, lng, radiusKm float64
+	}{
+		{51.5, -0.12, 5},
+		{-33.9, 151.2, 50},
+		{0.01, 179.99, 10}, // across the equator and the antimeridian
+		{70, 20, 300},
+	} {
+		prefixes := geoHashPrefixes(c.lat, c.lng, c.radiusKm)
+		if prefixes == nil {
+			t.Errorf("%v: got no prefixes", c)
+			continue
+		}
+		// Points in the circle, by moving up to radiusKm in any direction.
+		for i := 0; i < 1000; i++ {
+			bearing := rnd.Float64() * 2 * math.Pi
+			angle := rnd.Float64() * c.radiusKm / earthRadiusKm
+			lat1, lng1 := c.lat*math.Pi/180, c.lng*math.Pi/180
+			lat2 := math.Asin(math.Sin(lat1)*math.Cos(angle) + math.Cos(lat1)*math.Sin(angle)*math.Cos(bearing))
+			lng2 := lng1 + math.Atan2(math.Sin(bearing)*math.Sin(angle)*math.Cos(lat1), math.Cos(angle)-math.Sin(lat1)*math.Sin(lat2))
+			lat, lng := lat2*180/math.Pi, wrapLongitude(lng2*180/math.Pi)
+
+			hash := encodeGeoHash(lat, lng, geoHashPrecision)
+			covered := false
+			for _, p := range prefixes {
+				if strings.HasPrefix(hash, p) {
+					covered = true
+				}
+			}
+			if !covered {
+				t.Errorf("%v: point %v,%v (%s) isn't in prefixes %v", c, lat, lng, hash, prefixes)
+				break
+			}
+		}
+	}
+
+	// Circles around a pole aren't covered by cells.
+	if p := geoHashPrefixes(89.9, 0, 50); p != nil {
+		t.Errorf("near the pole: got prefixes %v, want nil", p)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrVersionNotFound is returned by History.Version for a version that was
+// never recorded or has been dropped.
+var ErrVersionNotFound = errors.New("session version not found")
+
+// SessionVersion is a saved copy of a session.
+type SessionVersion struct {
+	// Version numbers a session's versions from 1, in the order saved.
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"savedAt"`
+	Session Session   `json:"session"`
+}
+
+// History keeps the most recent versions of each session in memory. It is
+// local to the process, so each instance of the app only knows the versions
+// saved through it since it started.
+type History struct {
+	mu       sync.Mutex
+	limit    int
+	versions map[int64][]SessionVersion // oldest first
+}
+
+// NewHistory returns a History keeping the last limit versions of each
+// session.
+func NewHistory(limit int) *History {
+	return &History{limit: limit, versions: make(map[int64][]SessionVersion)}
+}
+
+// snapshot returns the copy of s that is kept as a version.
+func snapshot(s *Session) Session {
+	c := *s
+	c.Tags = append([]string(nil), s.Tags...)
+	return c
+}
+
+// Record saves a copy of s as its next version.
+func (h *History) Record(s *Session) {
+	c := snapshot(s)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.record(c)
+}
+
+// RecordChanged saves a copy of s as its next version unless it is the same
+// as the latest kept version. It is used after writes that may have left a
+// session unchanged.
+func (h *History) RecordChanged(s *Session) {
+	c := snapshot(s)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if versions := h.versions[s.ID]; len(versions) > 0 && reflect.DeepEqual(versions[len(versions)-1].Session, c) {
+		return
+	}
+	h.record(c)
+}
+
+// record saves c as its session's next version. The caller must hold h.mu.
+func (h *History) record(c Session) {
+	versions := h.versions[c.ID]
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions)-1].Version + 1
+	}
+	versions = append(versions, SessionVersion{Version: next, SavedAt: time.Now(), Session: c})
+	if len(versions) > h.limit {
+		versions = versions[len(versions)-h.limit:]
+	}
+	h.versions[c.ID] = versions
+}
+
+// Forget drops the kept versions of a session, once it has been deleted.
+func (h *History) Forget(id int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.versions, id)
+}
+
+// IDs returns the IDs of the sessions with kept versions.
+func (h *History) IDs() []int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ids := make([]int64, 0, len(h.versions))
+	for id := range h.versions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Versions returns the kept versions of a session, oldest first.
+func (h *History) Versions(id int64) []SessionVersion {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]SessionVersion(nil), h.versions[id]...)
+}
+
+// Version returns the given version of a session, or ErrVersionNotFound.
+func (h *History) Version(id int64, version int) (*SessionVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, v := range h.versions[id] {
+		if v.Version == version {
+			return &v, nil
+		}
+	}
+	return nil, ErrVersionNotFound
+}
+
+// FieldDiff is a field that differs between two versions of a session.
+type FieldDiff struct {
+	// Field is the field's JSON name, as in SessionFormFields.
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// DiffSessions compares the fields of SessionFormFields between two versions
+// of a session, returning those that changed in form order. Tags are
+// compared as a comma-separated list.
+func DiffSessions(old, new *Session) []FieldDiff {
+	var diffs []FieldDiff
+	for _, f := range SessionFormFields {
+		o, n := formValue(f, old), formValue(f, new)
+		if o != n {
+			diffs = append(diffs, FieldDiff{Field: f.Name, Old: o, New: n})
+		}
+	}
+	return diffs
+}
+
+// formValue returns the value of form field f in s as a string.
+func formValue(f FormField, s *Session) string {
+	switch {
+	case f.value != nil:
+		return f.value(s)
+	case f.Type == "tags":
+		return strings.Join(s.Tags, ", ")
+	case f.Type == "list":
+		return strings.Join(s.Presenters, ", ")
+	case f.Type == "visibility":
+		return s.Visibility
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestDiffSessions(t *testing.T) {
+	old := &Session{
+		Title:       "Go",
+		Author:      "Gopher",
+		Description: "A talk",
+		Tags:        []string{"go"},
+		Visibility:  VisibilityPublic,
+	}
+	new := *old
+	new.Title = "Go 2"
+	new.Presenters = []string{"Gopher", "Ann"}
+	new.Tags = []string{"go", "generics"}
+	new.Visibility = VisibilityPrivate
+
+	got := DiffSessions(old, &new)
+	want := []FieldDiff{
+		{Field: "title", Old: "Go", New: "Go 2"},
+		{Field: "presenters", Old: "", New: "Gopher, Ann"},
+		{Field: "tags", Old: "go", New: "go, generics"},
+		{Field: "visibility", Old: VisibilityPublic, New: VisibilityPrivate},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffSessions = %+v, want %+v", got, want)
+	}
+	if d := DiffSessions(old, old); d != nil {
+		t.Errorf("DiffSessions of the same session = %+v, want none", d)
+	}
+}
+
+func TestHistoryDB(t *testing.T) {
+	h := NewHistory(2)
+	db := newHistoryDB(newMemoryDB(), h)
+
+	s := &Session{Title: "v1"}
+	id, err := db.AddSession(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range []string{"v2", "v3"} {
+		s.Title = title
+		if err := db.UpdateSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions := h.Versions(id)
+	if len(versions) != 2 {
+		t.Fatalf("got %d versions, want the last 2", len(versions))
+	}
+	for i, want := range []struct {
+		version int
+		title   string
+	}{{2, "v2"}, {3, "v3"}} {
+		if v := versions[i]; v.Version != want.version || v.Session.Title != want.title {
+			t.Errorf("versions[%d] = %d %q, want %d %q", i, v.Version, v.Session.Title, want.version, want.title)
+		}
+	}
+	if _, err := h.Version(id, 1); err != ErrVersionNotFound {
+		t.Errorf("Version(1) err = %v, want ErrVersionNotFound", err)
+	}
+}
+
+func TestHistoryDBTagsAndDeletes(t *testing.T) {
+	ctx := context.Background()
+	h := NewHistory(10)
+	db := newHistoryDB(newMemoryDB(), h)
+
+	id, err := db.AddSession(&Session{Title: "tagged", Tags: []string{"go"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RenameTag(ctx, "go", "golang"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.AddTagToSessions(ctx, []int64{id}, "talks"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RemoveTag(ctx, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TouchSession(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := h.Versions(id)
+	if len(versions) != 4 {
+		t.Fatalf("got %d versions, want 4", len(versions))
+	}
+	if got, want := versions[2].Session.Tags, []string{"golang", "talks"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("version 3 tags = %v, want %v", got, want)
+	}
+
+	if err := db.DeleteSession(id); err != nil {
+		t.Fatal(err)
+	}
+	if v := h.Versions(id); len(v) != 0 {
+		t.Errorf("got %d versions after delete, want none", len(v))
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strconv"
+	"time"
+)
+
+// crockford is the Crockford base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// SessionIDPattern matches the IDs sessions can be looked up by in URLs:
+// numeric IDs and public IDs. It has no capturing groups, so it can be used
+// in route patterns.
+const SessionIDPattern = `[0-9]+|[0-7][0-9A-HJKMNP-TV-Z]{25}`
+
+// NewPublicID returns a new ULID: 26 characters encoding the current time
+// in milliseconds followed by 80 random bits. ULIDs sort by creation time
+// but, unlike the numeric IDs, don't reveal how many sessions there are or
+// let others be guessed.
+func NewPublicID() string {
+	var b [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(b[:8], ms<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic("could not read random bytes: " + err.Error())
+	}
+
+	// Encode the 128 bits, padded to 130, 5 bits at a time from the end.
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var id [26]byte
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id[:])
+}
+
+// IsPublicID reports whether s is formatted like an ID from NewPublicID.
+func IsPublicID(s string) bool {
+	if len(s) != 26 || s[0] > '7' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isCrockford(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isCrockford(c byte) bool {
+	for i := 0; i < len(crockford); i++ {
+		if crockford[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+// setPublicID gives b a new PublicID if StringIDs is set and it has none.
+// It reports whether it changed b.
+func setPublicID(b *Session) bool {
+	if !StringIDs || b.PublicID != "" {
+		return false
+	}
+	b.PublicID = NewPublicID()
+	return true
+}
+
+// URLID returns the ID used for b in URLs: its PublicID, if it has one, or
+// else its numeric ID.
+func (b *Session) URLID() string {
+	if b.PublicID != "" {
+		return b.PublicID
+	}
+	return strconv.FormatInt(b.ID, 10)
+}
+
+// URLID returns the ID used for the summarized session in URLs, as
+// Session.URLID does.
+func (s *SessionSummary) URLID() string {
+	return (&Session{ID: s.ID, PublicID: s.PublicID}).URLID()
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"regexp"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestNewPublicID(t *testing.T) {
+	const n = 10000
+	seen := make(map[string]bool, n)
+	prev := ""
+	for i := 0; i < n; i++ {
+		id := NewPublicID()
+		if !IsPublicID(id) {
+			t.Fatalf("NewPublicID() = %q, not a public ID", id)
+		}
+		if seen[id] {
+			t.Fatalf("NewPublicID() returned %q twice", id)
+		}
+		seen[id] = true
+		// The first 10 characters encode the time, so IDs sort by it.
+		if id[:10] < prev {
+			t.Errorf("ID %q sorts before earlier ID %q", id, prev)
+		}
+		prev = id[:10]
+	}
+}
+
+func TestSessionIDPattern(t *testing.T) {
+	re := regexp.MustCompile("^(?:" + SessionIDPattern + ")$")
+	for _, tt := range []struct {
+		id       string
+		public   bool
+		routable bool
+	}{
+		{"42", false, true},
+		{NewPublicID(), true, true},
+		{"01ARZ3NDEKTSV4RRFFQ69G5FAV", true, true},
+		{"81ARZ3NDEKTSV4RRFFQ69G5FAV", false, false}, // overflows 128 bits
+		{"01ARZ3NDEKTSV4RRFFQ69G5FAI", false, false}, // I isn't in the alphabet
+		{"01arz3ndektsv4rrffq69g5fav", false, false},
+		{"search", false, false},
+		{"random", false, false},
+		{"", false, false},
+	} {
+		if got := IsPublicID(tt.id); got != tt.public {
+			t.Errorf("IsPublicID(%q) = %v, want %v", tt.id, got, tt.public)
+		}
+		if got := re.MatchString(tt.id); got != tt.routable {
+			t.Errorf("SessionIDPattern matches %q = %v, want %v", tt.id, got, tt.routable)
+		}
+	}
+}
+
+func TestMemoryDBPublicIDs(t *testing.T) {
+	defer func(on bool) { StringIDs = on }(StringIDs)
+	ctx := context.Background()
+	db := newMemoryDB()
+	defer db.Close()
+
+	StringIDs = false
+	old := &Session{Title: "before"}
+	if _, err := db.AddSession(old); err != nil {
+		t.Fatal(err)
+	}
+	if old.PublicID != "" || old.URLID() != "1" {
+		t.Errorf("StringIDs off: got PublicID %q, URLID %q; want none and the numeric ID", old.PublicID, old.URLID())
+	}
+
+	StringIDs = true
+	b := &Session{Title: "after"}
+	id, err := db.AddSession(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPublicID(b.PublicID) || b.URLID() != b.PublicID {
+		t.Fatalf("got PublicID %q, URLID %q; want a public ID used in URLs", b.PublicID, b.URLID())
+	}
+	got, err := db.GetSessionByPublicID(ctx, b.PublicID)
+	if err != nil || got.ID != id {
+		t.Errorf("GetSessionByPublicID = %+v, %v; want session %d", got, err, id)
+	}
+	if _, err := db.GetSessionByPublicID(ctx, NewPublicID()); err != ErrSessionNotFound {
+		t.Errorf("unknown public ID: got err %v, want ErrSessionNotFound", err)
+	}
+
+	// Edits don't carry the public ID, but keep it.
+	publicID := b.PublicID
+	if err := db.UpdateSession(&Session{ID: id, Title: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.GetSession(id); got.PublicID != publicID {
+		t.Errorf("after edit: got PublicID %q, want %q", got.PublicID, publicID)
+	}
+
+	// Sessions added before get one from the backfill.
+	if _, err := db.BackfillDerivedFields(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.GetSession(old.ID); !IsPublicID(got.PublicID) {
+		t.Errorf("after backfill: got PublicID %q, want a public ID", got.PublicID)
+	}
+}
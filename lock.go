@@ -0,0 +1,30 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrSessionLocked is returned by LockSession when another user holds a live
+// edit lock on the session.
+var ErrSessionLocked = errors.New("session is being edited by someone else")
+
+// LockedByOther reports whether a user other than userID holds a live edit
+// lock on s at now.
+func (s *Session) LockedByOther(userID string, now time.Time) bool {
+	return s.LockedBy != "" && s.LockedBy != userID && s.LockExpiry.After(now)
+}
+
+// validLock reports whether the arguments of LockSession are usable.
+func validLock(userID string, ttl time.Duration) bool {
+	return userID != "" && ttl > 0
+}
+
+// keepLock copies the edit lock of old to b, as edits don't carry it.
+func keepLock(b, old *Session) {
+	b.LockedBy, b.LockedByName, b.LockExpiry = old.LockedBy, old.LockedByName, old.LockExpiry
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	"golang.org/x/net/context"
+)
+
+// ErrObjectExists is returned when uploading an object whose name is taken
+// while ObjectWrites.PreventOverwrite is set.
+var ErrObjectExists = errors.New("object already exists")
+
+// ObjectWriteConfig configures how uploaded objects are written and
+// replaced.
+type ObjectWriteConfig struct {
+	// PreventOverwrite makes an upload fail with ErrObjectExists, rather
+	// than replace the object, if one with the same name exists. Uploads
+	// get random names, so this guards against collisions and bugs.
+	PreventOverwrite bool
+
+	// DeleteReplaced deletes the objects uploaded for a session when an
+	// edit replaces its video or thumbnail URL, unless another upload with
+	// the same content still uses them.
+	DeleteReplaced bool
+}
+
+// publicURL is the format of the stored URLs of uploaded objects.
+const publicURL = "https://storage.googleapis.com/%s/%s"
+
+// ObjectURL returns the URL stored for the object with the given name in
+// StorageBucket.
+func ObjectURL(name string) string {
+	return fmt.Sprintf(publicURL, StorageBucketName, name)
+}
+
+// ObjectName returns the name of the object in StorageBucket that a URL
+// returned by ObjectURL points to. It reports false for other URLs.
+func ObjectName(url string) (string, bool) {
+	if StorageBucketName == "" {
+		return "", false
+	}
+	prefix := ObjectURL("")
+	if !strings.HasPrefix(url, prefix) || url == prefix {
+		return "", false
+	}
+	return strings.TrimPrefix(url, prefix), true
+}
+
+// SessionView is a session as returned to API clients, with its attachment
+// URLs replaced by ones the client can fetch.
+type SessionView struct {
+	Session
+
+	// URLsExpire is when the signed attachment URLs stop working. It is zero
+	// if the URLs are public.
+	URLsExpire time.Time `json:"urlsExpire,omitempty"`
+}
+
+// signObjectURL returns a signed GET URL for the named object in
+// StorageBucket. It is a variable so tests can replace it.
+var signObjectURL = func(name string, expires time.Time) (string, error) {
+	return storage.SignedURL(StorageBucketName, name, &storage.SignedURLOptions{
+		GoogleAccessID: SignedURLGoogleAccessID,
+		PrivateKey:     SignedURLPrivateKey,
+		Method:         "GET",
+		Expires:        expires,
+	})
+}
+
+// GetSessionWithURLs retrieves a session by its ID from db. If PrivateObjects
+// is set, its uploaded video and thumbnail URLs are replaced with URLs signed
+// for SignedURLExpiry. Otherwise the stored public URLs are returned as is.
+func GetSessionWithURLs(ctx context.Context, db SessionDatabase, id int64) (*SessionView, error) {
+	session, err := db.GetSession(id)
+	if err != nil {
+		return nil, err
+	}
+	view := &SessionView{Session: *session}
+	if !PrivateObjects {
+		return view, nil
+	}
+
+	view.URLsExpire = time.Now().Add(SignedURLExpiry)
+	for _, url := range []*string{&view.VideoURL, &view.ThumbnailURL} {
+		name, ok := ObjectName(*url)
+		if !ok {
+			continue
+		}
+		signed, err := signObjectURL(name, view.URLsExpire)
+		if err != nil {
+			return nil, fmt.Errorf("could not sign URL for %s: %v", name, err)
+		}
+		*url = signed
+	}
+	return view, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestGetSessionWithURLs(t *testing.T) {
+	defer func(db SessionDatabase, bucket string, private bool, sign func(string, time.Time) (string, error)) {
+		DB, StorageBucketName, PrivateObjects, signObjectURL = db, bucket, private, sign
+	}(DB, StorageBucketName, PrivateObjects, signObjectURL)
+
+	DB = newMemoryDB()
+	StorageBucketName = "bucket"
+	signObjectURL = func(name string, expires time.Time) (string, error) {
+		return "https://signed.example.com/" + name, nil
+	}
+
+	const external = "https://example.com/video.mp4"
+	id, err := DB.AddSession(&Session{
+		VideoURL:     external,
+		ThumbnailURL: ObjectURL("thumb.webp"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	PrivateObjects = false
+	view, err := GetSessionWithURLs(ctx, DB, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view.ThumbnailURL != ObjectURL("thumb.webp") || !view.URLsExpire.IsZero() {
+		t.Errorf("public: got thumbnail %q, expiry %v, want stored URL and no expiry", view.ThumbnailURL, view.URLsExpire)
+	}
+
+	PrivateObjects = true
+	view, err = GetSessionWithURLs(ctx, DB, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view.ThumbnailURL != "https://signed.example.com/thumb.webp" {
+		t.Errorf("private: got thumbnail %q, want signed URL", view.ThumbnailURL)
+	}
+	if view.VideoURL != external {
+		t.Errorf("private: got video %q, want %q unchanged", view.VideoURL, external)
+	}
+	if view.URLsExpire.IsZero() {
+		t.Error("private: want non-zero expiry")
+	}
+	if stored, _ := DB.GetSession(id); stored.ThumbnailURL != ObjectURL("thumb.webp") {
+		t.Errorf("private: stored thumbnail changed to %q", stored.ThumbnailURL)
+	}
+
+	if _, err := GetSessionWithURLs(ctx, DB, id+1); err != ErrSessionNotFound {
+		t.Errorf("missing session: got err %v, want ErrSessionNotFound", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import "sort"
+
+// relatedScore scores how related candidate is to s: one point for a shared
+// author, plus one for each shared tag.
+func relatedScore(s, candidate *Session) int {
+	score := 0
+	if s.Author != "" && candidate.Author == s.Author {
+		score++
+	}
+	for _, t := range s.Tags {
+		for _, ct := range candidate.Tags {
+			if t == ct {
+				score++
+				break
+			}
+		}
+	}
+	return score
+}
+
+// hasRelatedFields reports whether s has any field used to find related
+// sessions.
+func hasRelatedFields(s *Session) bool {
+	return s.Author != "" || len(s.Tags) > 0
+}
+
+// scoredSession is a candidate related session and its score.
+type scoredSession struct {
+	session *Session
+	score   int
+}
+
+// byScore implements sort.Interface, ordering sessions by descending score,
+// then by ID.
+type byScore []scoredSession
+
+func (s byScore) Less(i, j int) bool {
+	if s[i].score != s[j].score {
+		return s[i].score > s[j].score
+	}
+	return s[i].session.ID < s[j].session.ID
+}
+func (s byScore) Len() int      { return len(s) }
+func (s byScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// rankRelated returns up to limit of the candidates related to s, highest
+// score first. Ties are broken by ID. s itself and unrelated candidates are
+// left out.
+func rankRelated(s *Session, candidates []*Session, limit int) []*Session {
+	var ranked []scoredSession
+	for _, c := range candidates {
+		if c.ID == s.ID {
+			continue
+		}
+		if score := relatedScore(s, c); score > 0 {
+			ranked = append(ranked, scoredSession{c, score})
+		}
+	}
+	sort.Sort(byScore(ranked))
+
+	related := make([]*Session, 0, limit)
+	for _, r := range ranked {
+		if len(related) == limit {
+			break
+		}
+		related = append(related, r.session)
+	}
+	return related
+}
+
+// recentSessions returns up to limit of the candidates, most recently created
+// first, leaving out the session with ID exclude.
+func recentSessions(candidates []*Session, exclude int64, limit int) []*Session {
+	var recent []*Session
+	for _, c := range candidates {
+		if c.ID != exclude {
+			recent = append(recent, c)
+		}
+	}
+	sort.Sort(sessionsByNewest(recent))
+	if len(recent) > limit {
+		recent = recent[:limit]
+	}
+	return recent
+}
+
+// sessionsByNewest implements sort.Interface, ordering sessions by descending
+// CreatedAt, then by ID.
+type sessionsByNewest []*Session
+
+func (s sessionsByNewest) Less(i, j int) bool {
+	if !s[i].CreatedAt.Equal(s[j].CreatedAt) {
+		return s[i].CreatedAt.After(s[j].CreatedAt)
+	}
+	return s[i].ID < s[j].ID
+}
+func (s sessionsByNewest) Len() int      { return len(s) }
+func (s sessionsByNewest) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,51 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// startupBackoff is the delay before the first retry of a failed startup
+// check. It doubles after each attempt, up to startupMaxBackoff.
+var (
+	startupBackoff    = 500 * time.Millisecond
+	startupMaxBackoff = 5 * time.Second
+)
+
+// retryStartup runs check until it succeeds or StartupRetryTimeout has passed,
+// backing off exponentially between attempts, and returns the last error. It
+// lets backends wait out dependencies that aren't reachable yet during a cold
+// start instead of crashing the instance.
+func retryStartup(name string, check func() error) error {
+	deadline := time.Now().Add(StartupRetryTimeout)
+	backoff := startupBackoff
+	for attempt := 1; ; attempt++ {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		log.Printf("%s: attempt %d failed, retrying in %v: %v", name, attempt, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > startupMaxBackoff {
+			backoff = startupMaxBackoff
+		}
+	}
+}
+
+// openCheckedDB returns the database opened by open once check, run with
+// retryStartup, succeeds. The backend constructors use it so that each
+// verifies its connection the same way, named by name in logs and errors.
+func openCheckedDB(name string, check func() error, open func() SessionDatabase) (SessionDatabase, error) {
+	if err := retryStartup(name, check); err != nil {
+		return nil, fmt.Errorf("%s: could not connect: %v", name, err)
+	}
+	return open(), nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryStartup(t *testing.T) {
+	defer func(b, max, timeout time.Duration) {
+		startupBackoff, startupMaxBackoff, StartupRetryTimeout = b, max, timeout
+	}(startupBackoff, startupMaxBackoff, StartupRetryTimeout)
+	startupBackoff, startupMaxBackoff = time.Millisecond, 4*time.Millisecond
+	StartupRetryTimeout = time.Second
+
+	unavailable := errors.New("unavailable")
+	calls := 0
+	err := retryStartup("test", func() error {
+		if calls++; calls <= 3 {
+			return unavailable
+		}
+		return nil
+	})
+	if err != nil || calls != 4 {
+		t.Errorf("got err %v after %d calls, want nil after 4", err, calls)
+	}
+
+	StartupRetryTimeout = 20 * time.Millisecond
+	if err := retryStartup("test", func() error { return unavailable }); err != unavailable {
+		t.Errorf("always failing: got err %v, want %v", err, unavailable)
+	}
+}
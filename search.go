@@ -0,0 +1,105 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import "strings"
+
+// searchTerms splits a search query into lower-case terms.
+func searchTerms(query string) []string {
+	return strings.Fields(strings.ToLower(query))
+}
+
+// matches reports whether every term appears, ignoring case, in the
+// session's title, author, description or tags.
+func (b *Session) matches(terms []string) bool {
+	text := strings.ToLower(strings.Join(append([]string{b.Title, b.Author, b.Description}, b.Tags...), "\n"))
+	for _, t := range terms {
+		if !strings.Contains(text, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterSessions returns the sessions matching query, keeping their order.
+// An empty query matches nothing.
+func filterSessions(sessions []*Session, query string) []*Session {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	var matched []*Session
+	for _, b := range sessions {
+		if b.matches(terms) {
+			matched = append(matched, b)
+		}
+	}
+	return matched
+}
+
+// hasTags reports whether the session carries every one of tags.
+func (b *Session) hasTags(tags []string) bool {
+	for _, t := range tags {
+		found := false
+		for _, bt := range b.Tags {
+			if bt == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// facetSessions returns the sessions matching query that carry every one of
+// tags, keeping their order, with their TagFacets. An empty query matches
+// every session, unless tags is empty too.
+func facetSessions(sessions []*Session, query string, tags []string) ([]*Session, map[string]int) {
+	terms := searchTerms(query)
+	matched := []*Session{}
+	if len(terms) == 0 && len(tags) == 0 {
+		return matched, map[string]int{}
+	}
+	for _, b := range sessions {
+		if b.matches(terms) && b.hasTags(tags) {
+			matched = append(matched, b)
+		}
+	}
+	return matched, TagFacets(matched, tags)
+}
+
+// TagFacets counts the sessions carrying each tag, leaving out the tags in
+// selected.
+func TagFacets(sessions []*Session, selected []string) map[string]int {
+	skip := make(map[string]bool)
+	for _, t := range selected {
+		skip[t] = true
+	}
+	facets := make(map[string]int)
+	for _, b := range sessions {
+		for _, t := range b.Tags {
+			if !skip[t] {
+				facets[t]++
+			}
+		}
+	}
+	return facets
+}
+
+// pageOf returns the sessions in the page of the given size starting at
+// offset.
+func pageOf(sessions []*Session, limit, offset int) []*Session {
+	if offset >= len(sessions) {
+		return []*Session{}
+	}
+	end := offset + limit
+	if end > len(sessions) {
+		end = len(sessions)
+	}
+	return sessions[offset:end]
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"strings"
+)
+
+// searchIndex is an inverted index from the tokens of the searchable text of
+// sessions (see Session.matches) to the IDs of the sessions containing them,
+// so that memoryDB can answer searches without scanning every session.
+//
+// Tokens are the whitespace-separated words of the lowercased text. Query
+// terms have no whitespace either, so a term appears in a session's text
+// exactly when it appears within one of its tokens, and a lookup gives the
+// same results as matches.
+type searchIndex struct {
+	postings map[string]map[int64]bool // maps from token to session IDs.
+	tokens   map[int64][]string        // maps from session ID to its tokens.
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[int64]bool),
+		tokens:   make(map[int64][]string),
+	}
+}
+
+// sessionTokens returns the distinct tokens of the searchable text of s.
+func sessionTokens(s *Session) []string {
+	text := strings.ToLower(strings.Join(append([]string{s.Title, s.Author, s.Description}, s.Tags...), "\n"))
+	var tokens []string
+	seen := make(map[string]bool)
+	for _, t := range strings.Fields(text) {
+		if !seen[t] {
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// set indexes s, replacing what was indexed for its ID before.
+func (x *searchIndex) set(s *Session) {
+	x.remove(s.ID)
+	tokens := sessionTokens(s)
+	for _, t := range tokens {
+		ids, ok := x.postings[t]
+		if !ok {
+			ids = make(map[int64]bool)
+			x.postings[t] = ids
+		}
+		ids[s.ID] = true
+	}
+	x.tokens[s.ID] = tokens
+}
+
+// remove drops the session with the given ID from the index. The tokens
+// recorded for it are used, rather than its current text, so that sessions
+// changed in place are removed fully.
+func (x *searchIndex) remove(id int64) {
+	for _, t := range x.tokens[id] {
+		ids := x.postings[t]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(x.postings, t)
+		}
+	}
+	delete(x.tokens, id)
+}
+
+// lookup returns the IDs of the sessions whose text contains every one of
+// terms, which must be lowercase and free of whitespace, as returned by
+// searchTerms. No terms match nothing.
+func (x *searchIndex) lookup(terms []string) map[int64]bool {
+	var result map[int64]bool
+	for _, term := range terms {
+		matched := x.termIDs(term)
+		if result == nil {
+			result = matched
+		} else {
+			for id := range result {
+				if !matched[id] {
+					delete(result, id)
+				}
+			}
+		}
+		if len(result) == 0 {
+			return nil
+		}
+	}
+	return result
+}
+
+// termIDs returns the IDs of the sessions with a token containing term. Only
+// the distinct tokens are scanned, rather than the text of every session.
+func (x *searchIndex) termIDs(term string) map[int64]bool {
+	matched := make(map[int64]bool)
+	for t, ids := range x.postings {
+		if !strings.Contains(t, term) {
+			continue
+		}
+		for id := range ids {
+			matched[id] = true
+		}
+	}
+	return matched
+}
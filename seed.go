@@ -0,0 +1,86 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// seedJSON holds the example sessions loaded by SeedSessions.
+const seedJSON = `[
+	{
+		"title": "Getting Started with Go on App Engine",
+		"author": "Ann Example",
+		"publishedDate": "2016-03-04",
+		"description": "Deploying a first Go web app to App Engine flexible environment, from hello world to a datastore-backed service.",
+		"tags": ["go", "app engine"]
+	},
+	{
+		"title": "Cloud Datastore Patterns",
+		"author": "Bob Example",
+		"publishedDate": "2016-05-12",
+		"description": "Modelling entities, choosing keys and avoiding hot spots in Cloud Datastore.",
+		"tags": ["datastore", "databases"]
+	},
+	{
+		"title": "Serving Video from Cloud Storage",
+		"author": "Ann Example",
+		"publishedDate": "2016-07-21",
+		"description": "Uploading, caching and streaming large media files with Cloud Storage.",
+		"tags": ["storage", "video"]
+	},
+	{
+		"title": "Background Work with Pub/Sub",
+		"author": "Cid Example",
+		"publishedDate": "2016-09-08",
+		"description": "Moving slow work out of request handlers with Pub/Sub topics and worker processes.",
+		"tags": ["pubsub", "go"]
+	},
+	{
+		"title": "Signing In with OAuth 2.0",
+		"author": "Bob Example",
+		"description": "Adding Google sign-in to a web app and keeping users' profiles in a session cookie.",
+		"tags": ["auth"]
+	}
+]`
+
+// SeedSessions adds example sessions to db for local development. Sessions
+// whose title is already in db are skipped, so it is safe to run repeatedly.
+func SeedSessions(ctx context.Context, db SessionDatabase) error {
+	var seeds []*Session
+	if err := json.Unmarshal([]byte(seedJSON), &seeds); err != nil {
+		return fmt.Errorf("could not parse seed sessions: %v", err)
+	}
+
+	titles := make(map[string]bool)
+	err := db.IterateSessions(ctx, func(s *Session) error {
+		titles[s.Title] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range seeds {
+		if titles[s.Title] {
+			continue
+		}
+		if s.PublishedDate != "" {
+			t, err := ParsePublishedDate(s.PublishedDate)
+			if err != nil {
+				return fmt.Errorf("seed session %q: %v", s.Title, err)
+			}
+			s.PublishedAt = t
+		}
+		if _, err := db.AddSession(s); err != nil {
+			return fmt.Errorf("could not add seed session %q: %v", s.Title, err)
+		}
+		titles[s.Title] = true
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestSeedSessions(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	if _, err := db.AddSession(&Session{Title: "Cloud Datastore Patterns"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := SeedSessions(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+		sessions, err := db.ListSessions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 5 {
+			t.Errorf("run %d: got %d sessions, want 5", i+1, len(sessions))
+		}
+		seen := make(map[string]bool)
+		for _, s := range sessions {
+			if seen[s.Title] {
+				t.Errorf("run %d: duplicate session %q", i+1, s.Title)
+			}
+			seen[s.Title] = true
+			if err := s.Validate(); err != nil {
+				t.Errorf("run %d: seed session %q: %v", i+1, s.Title, err)
+			}
+		}
+	}
+}
@@ -1,17 +1,251 @@
+package vyfe_api
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
 
-package vyfe_api
+	"golang.org/x/net/context"
+)
+
+// ErrSessionNotFound is returned when no session exists with a given ID.
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSnapshotTooLarge is returned by ListSessionsAtSnapshot when there are
+// too many sessions to read in one snapshot. Callers should fall back to
+// reading page by page with ListSessionsPage, which isn't consistent.
+var ErrSnapshotTooLarge = errors.New("too many sessions for a consistent snapshot")
+
+// ErrMergeIntoSelf is returned by MergeSessions when both IDs are the same.
+var ErrMergeIntoSelf = errors.New("cannot merge a session into itself")
+
+// ErrNoExternalID is returned by UpsertSessionByExternalID for a session
+// without an ExternalID.
+var ErrNoExternalID = errors.New("session has no external ID")
+
+// ErrBadPageToken is returned by ListSessionsPage for a malformed page token.
+var ErrBadPageToken = errors.New("bad page token")
+
+// ErrBadSortOrder is returned by ListSessionsSorted and ListSessionsCreatedBy
+// for an unknown order.
+var ErrBadSortOrder = errors.New("unknown sort order")
+
+// Sort orders accepted by ListSessionsSorted.
+const (
+	// SortByTitle orders sessions by title.
+	SortByTitle = "title"
+	// SortByFavorites orders the most favorited sessions first.
+	SortByFavorites = "favorites"
+	// SortByViews orders the most viewed sessions first.
+	SortByViews = "views"
+)
+
+// Sort orders accepted by ListSessionsCreatedBy, besides SortByTitle.
+const (
+	// SortByCreated orders sessions by when they were added.
+	SortByCreated = "created"
+	// SortByUpdated orders sessions by when they were last saved.
+	SortByUpdated = "updated"
+)
 
 // Session holds metadata about a book.
 type Session struct {
-	ID            int64
-	Title         string
-	Author        string
-	PublishedDate string
-	VideoURL      string
-	Description   string
-	CreatedBy     string
-	CreatedByID   string
+	ID            int64    `json:"id"`
+	Title         string   `json:"title"`
+	Author        string   `json:"author"`
+	PublishedDate string   `json:"publishedDate"`
+	VideoURL      string   `json:"videoUrl"`
+	ThumbnailURL  string   `json:"thumbnailUrl"`
+	Description   string   `json:"description"`
+	CreatedBy     string   `json:"createdBy"`
+	CreatedByID   string   `json:"createdById"`
+	Tags          []string `json:"tags"`
+
+	// Presenters are the names of the people presenting the session with
+	// Author, who remains its primary presenter.
+	Presenters []string `json:"presenters,omitempty"`
+
+	// Captions are the caption files of the video, at most one per
+	// language.
+	Captions []Caption `json:"captions,omitempty"`
+
+	// PublishedAt is PublishedDate parsed into a canonical UTC time. It is
+	// zero if PublishedDate is empty.
+	PublishedAt time.Time `json:"publishedAt"`
+
+	// MonthDay is the month and day of PublishedAt, e.g. 704 for July 4, or
+	// 0 if it is zero. Backends that can't query on parts of a time store
+	// it for ListSessionsOnThisDay.
+	MonthDay int `json:"-"`
+
+	// CreatedAt is when the session was added to the database.
+	CreatedAt time.Time `json:"createdAt"`
+
+	// UpdatedAt is when the session was last saved or touched.
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// Favorites is the number of users who favorited the session.
+	Favorites int64 `json:"favorites"`
+
+	// ViewCount is the number of times the session has been viewed.
+	ViewCount int64 `json:"viewCount"`
+
+	// Position is the session's index in the curated playlist order.
+	Position int `json:"position"`
+
+	// PublicID is a ULID (see NewPublicID) used in place of ID in URLs. It
+	// is set by the database when the session is added while StringIDs is
+	// set, and is empty otherwise.
+	PublicID string `json:"publicId,omitempty"`
+
+	// Slug is a unique, URL-friendly name derived from Title. It is set by
+	// the database when the session is added or its title changes.
+	Slug string `json:"slug"`
+
+	// ContentHash is the hex-encoded SHA-256 of the uploaded video, used to
+	// reuse the stored object when the same file is uploaded again. It is
+	// empty if no file was uploaded.
+	ContentHash string `json:"contentHash"`
+
+	// SizeBytes is the total size of the objects uploaded for the session's
+	// video and thumbnail. Objects shared with other sessions, as uploads
+	// of the same content are, count towards each of them. It is set by
+	// the server when a file is uploaded; UpdateSession keeps the stored
+	// size unless the video or thumbnail changed.
+	SizeBytes int64 `json:"sizeBytes"`
+
+	// Objects are the names of the bucket objects uploaded for the session.
+	// Its URLs are given by clients and may name objects uploaded for other
+	// sessions, so only these objects are deleted with the session or when
+	// an edit replaces them.
+	Objects []string `json:"-"`
+
+	// Visibility is who can see the session: VisibilityPublic (the default
+	// when empty), VisibilityUnlisted or VisibilityPrivate.
+	Visibility string `json:"visibility"`
+
+	// ExternalID is the session's ID in the system it was imported from,
+	// such as an upstream CMS. It is empty for sessions added here.
+	ExternalID string `json:"externalId,omitempty"`
+
+	// DescriptionRef is the name of the object in DescriptionStore holding
+	// the description, if it was too long to keep in the entity. Backends
+	// that offload descriptions fill Description back in when a single
+	// session is read, but not in lists.
+	DescriptionRef string `json:"descriptionRef,omitempty"`
+
+	// Latitude and Longitude are where the session was held, in degrees.
+	// Both are zero if it isn't known.
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+
+	// GeoHash is the geohash of Latitude and Longitude, or empty if the
+	// session has no location. Backends without geographic queries store it
+	// for ListSessionsNear.
+	GeoHash string `json:"-"`
+
+	// Random is a uniformly distributed value in [0, 1) set when the session
+	// is added, used by RandomSessions to sample sessions.
+	Random float64 `json:"-"`
+
+	// ClaimedBy is the ID of the worker processing the session, and
+	// ClaimExpiry is when its lease ends and another worker may claim the
+	// session. Both are zero if the session was never claimed or its claim
+	// was released. See ClaimNextUnprocessed.
+	ClaimedBy   string    `json:"-"`
+	ClaimExpiry time.Time `json:"-"`
+
+	// ProcessedAt is when a worker marked the session processed, or zero if
+	// none has.
+	ProcessedAt time.Time `json:"-"`
+
+	// LockedBy is the ID of the user holding the advisory edit lock on the
+	// session, LockedByName their display name, and LockExpiry when the
+	// lock lapses. All are zero if the session was never locked or the
+	// lock was released. See LockSession.
+	LockedBy     string    `json:"-"`
+	LockedByName string    `json:"-"`
+	LockExpiry   time.Time `json:"-"`
+
+	// ChangedFields is set by UpdateSession to the fields the update
+	// changed, as returned by ChangedFields, or nil if the session wasn't
+	// stored before. It isn't stored.
+	ChangedFields []string `json:"-" datastore:"-"`
+}
+
+// SessionList is a page of sessions as returned by ListSessionsPage.
+type SessionList struct {
+	Sessions []*Session `json:"sessions"`
+
+	// NextPageToken is passed as the pageToken query parameter to fetch the
+	// next page. It is empty on the last page.
+	NextPageToken string `json:"nextPageToken,omitempty"`
+}
+
+// ListResponse is the envelope in which the JSON API returns lists of
+// sessions.
+type ListResponse struct {
+	Data     []*Session `json:"data"`
+	PageInfo PageInfo   `json:"pageInfo"`
+
+	// TotalCount is the number of items across all pages. It is only set
+	// when the client asks for it with the withCount query parameter.
+	TotalCount *int `json:"totalCount,omitempty"`
+}
+
+// PageInfo describes the page of a ListResponse.
+type PageInfo struct {
+	// NextCursor is passed as the pageToken query parameter to fetch the
+	// next page. It is empty on the last page.
+	NextCursor  string `json:"nextCursor"`
+	HasNextPage bool   `json:"hasNextPage"`
+
+	// PageSize is the number of items in the page.
+	PageSize int `json:"pageSize"`
+}
+
+// NewListResponse returns the ListResponse holding a page of sessions
+// followed by the page nextCursor returns, if any.
+func NewListResponse(sessions []*Session, nextCursor string) *ListResponse {
+	if sessions == nil {
+		sessions = []*Session{}
+	}
+	return &ListResponse{
+		Data: sessions,
+		PageInfo: PageInfo{
+			NextCursor:  nextCursor,
+			HasNextPage: nextCursor != "",
+			PageSize:    len(sessions),
+		},
+	}
+}
+
+// SessionSummary holds the fields of a session shown in lists of sessions.
+type SessionSummary struct {
+	ID           int64  `json:"id"`
+	PublicID     string `json:"publicId,omitempty"`
+	Title        string `json:"title"`
+	Author       string `json:"author"`
+	ThumbnailURL string `json:"thumbnailUrl"`
+
+	// CreatedByID and Visibility decide who the session is listed for (see
+	// Viewer.CanListSummary).
+	CreatedByID string `json:"-"`
+	Visibility  string `json:"-"`
+}
+
+// Summary returns the fields of b shown in lists of sessions.
+func (b *Session) Summary() *SessionSummary {
+	return &SessionSummary{
+		ID:           b.ID,
+		PublicID:     b.PublicID,
+		Title:        b.Title,
+		Author:       b.Author,
+		ThumbnailURL: b.ThumbnailURL,
+		CreatedByID:  b.CreatedByID,
+		Visibility:   b.Visibility,
+	}
 }
 
 // CreatedByDisplayName returns a string appropriate for displaying the name of
@@ -23,6 +257,23 @@ func (b *Session) CreatedByDisplayName() string {
 	return b.CreatedBy
 }
 
+// presentedBy reports whether the person with the given name presents the
+// session, as its Author or one of its Presenters.
+func (b *Session) presentedBy(name string) bool {
+	if name == "" {
+		return false
+	}
+	if b.Author == name {
+		return true
+	}
+	for _, p := range b.Presenters {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
 // SetCreatorAnonymous sets the CreatedByID field to the "anonymous" ID.
 func (b *Session) SetCreatorAnonymous() {
 	b.CreatedBy = ""
@@ -34,23 +285,472 @@ type SessionDatabase interface {
 	// ListBooks returns a list of books, ordered by title.
 	ListSessions() ([]*Session, error)
 
-	// ListSessionsCreatedBy returns a list of sessions, ordered by title, filtered by
-	// the user who created the session entry.
-	ListSessionsCreatedBy(userID string) ([]*Session, error)
+	// ListArchiveCounts returns the number of sessions published in each
+	// month, newest first, with sessions without a published date counted
+	// in a final undated bucket.
+	ListArchiveCounts(ctx context.Context) ([]ArchiveBucket, error)
+
+	// ListSessionsByMonth returns the sessions published in the given month,
+	// ordered by publication time. Year and month 0 list the sessions
+	// without a published date.
+	ListSessionsByMonth(ctx context.Context, year, month int) ([]*Session, error)
+
+	// ListSessionsOnThisDay returns the sessions published on the month and
+	// day of ref, in any year, most recently published first. On February
+	// 28 of a year without a leap day, sessions published on February 29
+	// are included too.
+	ListSessionsOnThisDay(ctx context.Context, ref time.Time) ([]*Session, error)
+
+	// ListSessionsNear returns up to limit sessions held within radiusKm of
+	// the given point, nearest first. Sessions without a location are never
+	// included. It returns ErrBadLocation if the point is out of range or
+	// radiusKm or limit isn't positive.
+	ListSessionsNear(ctx context.Context, lat, lng, radiusKm float64, limit int) ([]*Session, error)
+
+	// ListSessionsAtSnapshot returns all sessions, ordered by title, as
+	// they were at a single point in time, even while writes happen. It
+	// returns ErrSnapshotTooLarge if the database is too large for that.
+	ListSessionsAtSnapshot(ctx context.Context) ([]*Session, error)
+
+	// SearchSessions returns up to limit sessions, ordered by title, that
+	// contain every word of query in their title, author, description or
+	// tags, skipping the first offset matches. An empty query matches
+	// nothing.
+	SearchSessions(ctx context.Context, query string, limit, offset int) ([]*Session, error)
+
+	// CountSearchSessions returns the number of sessions SearchSessions
+	// matches for query across all pages.
+	CountSearchSessions(ctx context.Context, query string) (int, error)
+
+	// SearchWithFacets returns the sessions, ordered by title, that match
+	// query as SearchSessions does and carry every one of tags, with the
+	// number of them carrying each other tag. An empty query with tags
+	// matches on tags alone; with no tags either, it matches nothing.
+	SearchWithFacets(ctx context.Context, query string, tags []string) (results []*Session, facets map[string]int, err error)
+
+	// ListSessionsPage returns up to limit sessions, ordered by title,
+	// following the page that returned pageToken ("" for the first page).
+	// Pages are keyed on the last session returned, not on an offset, so
+	// sessions added between requests don't shift later pages.
+	ListSessionsPage(ctx context.Context, pageToken string, limit int) (*SessionList, error)
+
+	// ListSessionsByTagPage is ListSessionsPage for the sessions carrying
+	// tag. It returns ErrBadPageToken for a malformed page token, and ""
+	// as nextPageToken on the last page.
+	ListSessionsByTagPage(ctx context.Context, tag string, limit int, pageToken string) (sessions []*Session, nextPageToken string, err error)
+
+	// IterateSessions calls fn for each session in title order, reading
+	// them as it goes rather than all at once. It stops at the first error
+	// from fn and returns it.
+	IterateSessions(ctx context.Context, fn func(*Session) error) error
+
+	// ListSessionsFor returns the sessions v may see listed, ordered by
+	// title: public sessions, and for admins and their creators, unlisted
+	// and private ones.
+	ListSessionsFor(ctx context.Context, v Viewer) ([]*Session, error)
+
+	// ListSessionSummaries returns the summaries of all sessions, ordered
+	// by title, reading only the fields lists show.
+	ListSessionSummaries(ctx context.Context) ([]*SessionSummary, error)
+
+	// ListSessionsSorted returns all sessions in the given order, one of
+	// SortByTitle, SortByFavorites or SortByViews. Sessions with the same
+	// count are ordered by title, then ID. It returns ErrBadSortOrder for
+	// any other order.
+	ListSessionsSorted(ctx context.Context, order string) ([]*Session, error)
+
+	// ListSessionsCreatedBy returns a list of sessions, filtered by the user
+	// who created the session entry, in the given order: SortByTitle,
+	// SortByCreated or SortByUpdated, reversed if desc is set. Ties are
+	// broken by ID, in the same direction. It returns ErrBadSortOrder for
+	// any other order.
+	ListSessionsCreatedBy(ctx context.Context, userID, order string, desc bool) ([]*Session, error)
+
+	// CountSessionsCreatedBy returns the number of sessions created by the
+	// given user.
+	CountSessionsCreatedBy(ctx context.Context, userID string) (int, error)
+
+	// StorageUsageByUser returns the total SizeBytes of the sessions created
+	// by each user, keyed by CreatedByID. Users without sessions are left
+	// out.
+	StorageUsageByUser(ctx context.Context) (map[string]int64, error)
+
+	// ListSessionsByPosition returns a list of sessions, ordered by position.
+	ListSessionsByPosition(ctx context.Context) ([]*Session, error)
+
+	// ListSessionsByPresenter returns the sessions presented by the person
+	// with the given name, as their Author or one of their Presenters,
+	// ordered by title.
+	ListSessionsByPresenter(ctx context.Context, presenter string) ([]*Session, error)
+
+	// ListSessionsCreatedBetween returns the sessions added between from and
+	// to, inclusive, ordered by creation time.
+	ListSessionsCreatedBetween(ctx context.Context, from, to time.Time) ([]*Session, error)
+
+	// ListRecentSessions returns the limit most recently added sessions,
+	// newest first.
+	ListRecentSessions(ctx context.Context, limit int) ([]*Session, error)
+
+	// ListSessionsWithoutThumbnail returns up to limit sessions that have a
+	// VideoURL but no ThumbnailURL, for a job generating their thumbnails,
+	// ordered by VideoURL, then by ID.
+	ListSessionsWithoutThumbnail(ctx context.Context, limit int) ([]*Session, error)
 
 	// GetSession retrieves a book by its ID.
 	GetSession(id int64) (*Session, error)
 
+	// GetSessionsOrdered retrieves the sessions with the given IDs, in the
+	// same order as ids. IDs with no session are skipped.
+	GetSessionsOrdered(ctx context.Context, ids []int64) ([]*Session, error)
+
+	// GetSessionBySlug retrieves a session by its slug, returning
+	// ErrSessionNotFound if no session has it.
+	GetSessionBySlug(ctx context.Context, slug string) (*Session, error)
+
+	// GetSessionByPublicID retrieves a session by its PublicID, returning
+	// ErrSessionNotFound if no session has it.
+	GetSessionByPublicID(ctx context.Context, publicID string) (*Session, error)
+
+	// RelatedSessions returns up to limit other sessions by the same author or
+	// sharing tags with the given session, most related first. If the session
+	// has neither an author nor tags, the most recently added sessions are
+	// returned instead.
+	RelatedSessions(ctx context.Context, id int64, limit int) ([]*Session, error)
+
+	// AdjacentSessions returns the sessions immediately before and after the
+	// given one in title order, or nil at either end. It returns
+	// ErrSessionNotFound if there is no session with the ID.
+	AdjacentSessions(ctx context.Context, id int64) (prev, next *Session, err error)
+
+	// RandomSessions returns up to n distinct sessions chosen at random. It
+	// returns fewer if the catalog has fewer than n sessions, and none if it
+	// is empty.
+	RandomSessions(ctx context.Context, n int) ([]*Session, error)
+
+	// LookupByContentHash returns a session whose uploaded file has the given
+	// content hash, or ErrSessionNotFound if there is none.
+	LookupByContentHash(ctx context.Context, hash string) (*Session, error)
+
+	// SessionExists reports whether a session with the given ID exists,
+	// without fetching the full entity.
+	SessionExists(ctx context.Context, id int64) (bool, error)
+
 	// AddSession saves a given book, assigning it a new ID.
 	AddSession(b *Session) (id int64, err error)
 
+	// UpsertSessionByExternalID adds b if no session has its ExternalID,
+	// and otherwise replaces that session with b, keeping its ID, creation
+	// time, position, counters and slug (unless the title changed). The
+	// check and write are atomic. It reports whether the session was
+	// created, and returns ErrNoExternalID if b has no ExternalID.
+	UpsertSessionByExternalID(ctx context.Context, b *Session) (id int64, created bool, err error)
+
 	// DeleteBook removes a given book by its ID.
 	DeleteSession(id int64) error
 
-	// UpdateBook updates the entry for a given book.
+	// DeleteSessions removes the sessions with the given IDs, returning the
+	// number deleted and an error for each ID that wasn't, such as
+	// ErrSessionNotFound for IDs that don't exist.
+	DeleteSessions(ctx context.Context, ids []int64) (deleted int, errs map[int64]error)
+
+	// UpdateBook updates the entry for a given book. Favorites and
+	// ViewCount are kept from the stored session, as is SizeBytes while the
+	// video and thumbnail are unchanged. It sets b.ChangedFields by
+	// comparing b with the stored session.
 	UpdateSession(b *Session) error
 
+	// MoveSession moves a session to a new position, renumbering the other
+	// sessions so that positions stay contiguous and unique.
+	MoveSession(ctx context.Context, id int64, newPosition int) error
+
+	// ReorderSessions puts the sessions with the given IDs in that order,
+	// in one write, by redistributing the slots they hold among all
+	// sessions and renumbering the rest around them. It returns
+	// ErrSessionNotFound if any of them doesn't exist. At most
+	// MaxReorderSessions may be given.
+	ReorderSessions(ctx context.Context, ids []int64) error
+
+	// RenameTag replaces oldTag with newTag on every session carrying it,
+	// returning the number of sessions changed.
+	RenameTag(ctx context.Context, oldTag, newTag string) (affected int, err error)
+
+	// RemoveTag removes tag from every session carrying it, returning the
+	// number of sessions changed.
+	RemoveTag(ctx context.Context, tag string) (affected int, err error)
+
+	// AddTagToSessions appends tag to each of the sessions with the given
+	// IDs that doesn't already carry it, returning the number of sessions
+	// changed and the number of IDs with no session, which are skipped.
+	AddTagToSessions(ctx context.Context, ids []int64, tag string) (updated, missing int, err error)
+
+	// TouchSession sets the UpdatedAt time of a session to now without
+	// changing anything else. It returns ErrSessionNotFound if there is no
+	// session with the ID.
+	TouchSession(ctx context.Context, id int64) error
+
+	// IncrementViewCount adds n to the ViewCount of a session atomically,
+	// without changing UpdatedAt. It returns ErrSessionNotFound if there is
+	// no session with the ID.
+	IncrementViewCount(ctx context.Context, id int64, n int64) error
+
+	// ClaimNextUnprocessed atomically claims a session that isn't processed
+	// and isn't claimed, or whose claim expired, for workerID until lease
+	// from now, and returns it. No two workers hold a claim on the same
+	// session at once. It returns ErrNothingToClaim if there is no such
+	// session.
+	ClaimNextUnprocessed(ctx context.Context, workerID string, lease time.Duration) (*Session, error)
+
+	// ReleaseClaim gives up the claim of workerID on a session, so that
+	// other workers can claim it at once. It returns ErrClaimNotHeld if
+	// workerID doesn't hold the claim, or ErrSessionNotFound if there is no
+	// session with the ID.
+	ReleaseClaim(ctx context.Context, id int64, workerID string) error
+
+	// MarkProcessed sets the ProcessedAt time of a session to now and clears
+	// its claim, so that it isn't claimed again. It returns
+	// ErrSessionNotFound if there is no session with the ID.
+	MarkProcessed(ctx context.Context, id int64) error
+
+	// LockSession atomically acquires, or renews, the advisory edit lock on
+	// a session for the user with the given ID and display name, until ttl
+	// from now. It returns ErrSessionLocked if another user holds a lock
+	// that hasn't expired, or ErrSessionNotFound if there is no session with
+	// the ID. Use Session.LockedByOther to check for a lock.
+	LockSession(ctx context.Context, id int64, userID, name string, ttl time.Duration) error
+
+	// UnlockSession releases the edit lock of userID on a session. It does
+	// nothing if userID doesn't hold the lock, and returns
+	// ErrSessionNotFound if there is no session with the ID.
+	UnlockSession(ctx context.Context, id int64, userID string) error
+
+	// MergeSessions merges the session mergeID into keepID: keepID gets
+	// the tags of both and the sum of their Favorites and ViewCount, and
+	// mergeID is deleted, atomically. It returns ErrSessionNotFound if
+	// either session doesn't exist.
+	MergeSessions(ctx context.Context, keepID, mergeID int64) error
+
+	// BackfillDerivedFields fills in the derived fields (Slug, Random and
+	// PublishedAt) of sessions saved before they existed, returning the
+	// number of sessions changed. Sessions that have them are left alone.
+	// ContentHash isn't backfilled, as that would mean reading every object.
+	BackfillDerivedFields(ctx context.Context) (updated int, err error)
+
 	// Close closes the database, freeing up any available resources.
 	// TODO(cbro): Close() should return an error.
 	Close()
 }
+
+// sessionsByPosition implements sort.Interface, ordering sessions by Position,
+// then by ID for sessions sharing a position.
+type sessionsByPosition []*Session
+
+func (s sessionsByPosition) Less(i, j int) bool {
+	if s[i].Position != s[j].Position {
+		return s[i].Position < s[j].Position
+	}
+	return s[i].ID < s[j].ID
+}
+func (s sessionsByPosition) Len() int      { return len(s) }
+func (s sessionsByPosition) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// sessionsByCreatedAt implements sort.Interface, ordering sessions by
+// CreatedAt, then by ID.
+type sessionsByCreatedAt []*Session
+
+func (s sessionsByCreatedAt) Less(i, j int) bool {
+	if !s[i].CreatedAt.Equal(s[j].CreatedAt) {
+		return s[i].CreatedAt.Before(s[j].CreatedAt)
+	}
+	return s[i].ID < s[j].ID
+}
+func (s sessionsByCreatedAt) Len() int      { return len(s) }
+func (s sessionsByCreatedAt) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// keepSize copies the size of the uploaded files of old to b if b has the
+// same video and thumbnail, as edits don't carry it.
+func keepSize(b, old *Session) {
+	if b.VideoURL == old.VideoURL && b.ThumbnailURL == old.ThumbnailURL {
+		b.SizeBytes = old.SizeBytes
+	}
+}
+
+// sessionsByVideoURL implements sort.Interface, ordering sessions by
+// VideoURL, then by ID.
+type sessionsByVideoURL []*Session
+
+func (s sessionsByVideoURL) Less(i, j int) bool {
+	if s[i].VideoURL != s[j].VideoURL {
+		return s[i].VideoURL < s[j].VideoURL
+	}
+	return s[i].ID < s[j].ID
+}
+func (s sessionsByVideoURL) Len() int      { return len(s) }
+func (s sessionsByVideoURL) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// sessionsByUpdatedAt implements sort.Interface, ordering sessions by
+// UpdatedAt, then by ID.
+type sessionsByUpdatedAt []*Session
+
+func (s sessionsByUpdatedAt) Less(i, j int) bool {
+	if !s[i].UpdatedAt.Equal(s[j].UpdatedAt) {
+		return s[i].UpdatedAt.Before(s[j].UpdatedAt)
+	}
+	return s[i].ID < s[j].ID
+}
+func (s sessionsByUpdatedAt) Len() int      { return len(s) }
+func (s sessionsByUpdatedAt) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// moveSession moves the session with the given ID to newPosition within
+// sessions and renumbers every session from zero, closing any gaps or
+// duplicate positions. It returns the sessions whose Position changed.
+// Positions past the end of the list are clamped to the last position.
+func moveSession(sessions []*Session, id int64, newPosition int) ([]*Session, error) {
+	if newPosition < 0 {
+		return nil, fmt.Errorf("invalid position %d", newPosition)
+	}
+
+	ordered := make([]*Session, len(sessions))
+	copy(ordered, sessions)
+	sort.Sort(sessionsByPosition(ordered))
+
+	from := -1
+	for i, s := range ordered {
+		if s.ID == id {
+			from = i
+			break
+		}
+	}
+	if from == -1 {
+		return nil, fmt.Errorf("session not found with ID %d", id)
+	}
+
+	moved := ordered[from]
+	ordered = append(ordered[:from], ordered[from+1:]...)
+	if newPosition > len(ordered) {
+		newPosition = len(ordered)
+	}
+	ordered = append(ordered[:newPosition], append([]*Session{moved}, ordered[newPosition:]...)...)
+
+	var changed []*Session
+	for i, s := range ordered {
+		if s.Position != i {
+			s.Position = i
+			changed = append(changed, s)
+		}
+	}
+	return changed, nil
+}
+
+// MaxReorderSessions is the most sessions ReorderSessions takes at once,
+// which is the most entities Cloud Datastore writes in one transaction.
+const MaxReorderSessions = 500
+
+// reorderSessions puts the sessions with the given IDs, in the order of ids,
+// into the slots they hold among all sessions, then renumbers every session
+// from zero so that positions stay contiguous and unique. Sessions that
+// aren't listed keep their order. It returns the sessions whose Position
+// changed, or ErrSessionNotFound if any of ids isn't among sessions.
+func reorderSessions(sessions []*Session, ids []int64) ([]*Session, error) {
+	if len(ids) > MaxReorderSessions {
+		return nil, fmt.Errorf("at most %d sessions can be reordered at once", MaxReorderSessions)
+	}
+	byID := make(map[int64]*Session, len(sessions))
+	for _, s := range sessions {
+		byID[s.ID] = s
+	}
+	listed := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		if _, ok := byID[id]; !ok {
+			return nil, ErrSessionNotFound
+		}
+		if listed[id] {
+			return nil, fmt.Errorf("duplicate session ID %d", id)
+		}
+		listed[id] = true
+	}
+
+	ordered := make([]*Session, len(sessions))
+	copy(ordered, sessions)
+	sort.Sort(sessionsByPosition(ordered))
+	next := 0
+	for i, s := range ordered {
+		if listed[s.ID] {
+			ordered[i] = byID[ids[next]]
+			next++
+		}
+	}
+
+	var changed []*Session
+	for i, s := range ordered {
+		if s.Position != i {
+			s.Position = i
+			changed = append(changed, s)
+		}
+	}
+	return changed, nil
+}
+
+// mergeTags returns the tags of keep followed by those of merge that keep
+// doesn't already carry.
+func mergeTags(keep, merge []string) []string {
+	out := append([]string(nil), keep...)
+	seen := make(map[string]bool, len(keep))
+	for _, t := range keep {
+		seen[t] = true
+	}
+	for _, t := range merge {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// addTag returns tags with tag appended, reporting whether it was missing.
+func addTag(tags []string, tag string) ([]string, bool) {
+	for _, t := range tags {
+		if t == tag {
+			return tags, false
+		}
+	}
+	return append(append([]string(nil), tags...), tag), true
+}
+
+// uniqueIDs returns ids without duplicates, in their first order.
+func uniqueIDs(ids []int64) []int64 {
+	out := make([]int64, 0, len(ids))
+	seen := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// replaceTag returns tags with oldTag replaced by newTag, or removed if newTag
+// is empty. newTag is not duplicated if tags already carries it. It reports
+// whether tags contained oldTag.
+func replaceTag(tags []string, oldTag, newTag string) ([]string, bool) {
+	found, hasNew := false, false
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t == oldTag {
+			found = true
+			continue
+		}
+		if t == newTag {
+			hasNew = true
+		}
+		out = append(out, t)
+	}
+	if !found {
+		return tags, false
+	}
+	if newTag != "" && !hasNew {
+		out = append(out, newTag)
+	}
+	return out, true
+}
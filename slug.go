@@ -0,0 +1,53 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// defaultSlug is used for titles that contain no letters or digits.
+const defaultSlug = "session"
+
+// slugify returns title lowercased, keeping ASCII letters and digits and
+// replacing every other run of characters with a single hyphen.
+func slugify(title string) string {
+	var b bytes.Buffer
+	hyphen := false
+	for _, r := range strings.ToLower(title) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(r)
+			continue
+		}
+		hyphen = true
+	}
+	if b.Len() == 0 {
+		return defaultSlug
+	}
+	return b.String()
+}
+
+// uniqueSlug returns the slug for title, adding a numeric suffix ("-2", "-3",
+// ...) if taken reports that the plain slug is already in use.
+func uniqueSlug(title string, taken func(slug string) (bool, error)) (string, error) {
+	base := slugify(title)
+	slug := base
+	for n := 2; ; n++ {
+		used, err := taken(slug)
+		if err != nil {
+			return "", err
+		}
+		if !used {
+			return slug, nil
+		}
+		slug = base + "-" + strconv.Itoa(n)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Stats is an overview of the sessions in a database.
+type Stats struct {
+	Total           int `json:"total"`
+	CreatedLast24h  int `json:"createdLast24h"`
+	CreatedLast7d   int `json:"createdLast7d"`
+	DistinctAuthors int `json:"distinctAuthors"`
+}
+
+// CollectStats computes Stats for db as of now.
+func CollectStats(ctx context.Context, db SessionDatabase, now time.Time) (*Stats, error) {
+	stats := &Stats{}
+
+	var err error
+	if stats.Total, err = db.CountSessionsCreatedBy(ctx, ""); err != nil {
+		return nil, err
+	}
+
+	week, err := db.ListSessionsCreatedBetween(ctx, now.Add(-7*24*time.Hour), now)
+	if err != nil {
+		return nil, err
+	}
+	stats.CreatedLast7d = len(week)
+	for _, s := range week {
+		if s.CreatedAt.After(now.Add(-24 * time.Hour)) {
+			stats.CreatedLast24h++
+		}
+	}
+
+	sessions, err := db.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	authors := make(map[string]bool)
+	for _, s := range sessions {
+		if s.Author != "" {
+			authors[s.Author] = true
+		}
+	}
+	stats.DistinctAuthors = len(authors)
+
+	return stats, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestCollectStats(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+
+	now := time.Now()
+	for _, s := range []*Session{
+		{Title: "new", Author: "ann"},
+		{Title: "this week", Author: "ann"},
+		{Title: "old", Author: "bob"},
+		{Title: "anonymous"},
+	} {
+		if _, err := db.AddSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.sessions[1].CreatedAt = now.Add(-time.Hour)
+	db.sessions[2].CreatedAt = now.Add(-3 * 24 * time.Hour)
+	db.sessions[3].CreatedAt = now.Add(-30 * 24 * time.Hour)
+	db.sessions[4].CreatedAt = now.Add(-2 * time.Hour)
+
+	stats, err := CollectStats(context.Background(), db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Stats{Total: 4, CreatedLast24h: 2, CreatedLast7d: 3, DistinctAuthors: 2}
+	if *stats != want {
+		t.Errorf("got %+v, want %+v", *stats, want)
+	}
+}
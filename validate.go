@@ -0,0 +1,217 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// publishedDateLayouts are the accepted formats for Session.PublishedDate.
+var publishedDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02",
+	"Jan 2, 2006",
+}
+
+// ParsePublishedDate parses a published date in any of the accepted layouts
+// (RFC 3339, "2006-01-02" or "Jan 2, 2006") and returns it in UTC.
+func ParsePublishedDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range publishedDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf(MsgUnrecognizedDate, s)
+}
+
+// Keys of the messages in a ValidationError. Each is the English message's
+// format string, which is also its key in golang.org/x/text/message catalogs.
+const (
+	MsgRequired         = "is required"
+	MsgTooLong          = "must be at most %d characters"
+	MsgUnrecognizedDate = "unrecognized date %q, use a format like 2006-01-02"
+	MsgBadVisibility    = "must be public, unlisted or private"
+	MsgBlockedTerm      = "must not contain %q"
+	MsgOutOfRange       = "must be between %v and %v"
+	MsgBadCaptions      = "must each have a language tag, used once, and a format of vtt or srt"
+	MsgHostNotAllowed   = "must be on one of these hosts: %s"
+)
+
+// Message is a user-facing message that can be translated: the key of its
+// format string and the arguments to format it with.
+type Message struct {
+	Key  string
+	Args []interface{}
+}
+
+// String formats the message in English.
+func (m Message) String() string {
+	return fmt.Sprintf(m.Key, m.Args...)
+}
+
+// FormField describes a field of the session form and the rules Validate
+// applies to it.
+type FormField struct {
+	// Name is the field's JSON name, e.g. "title".
+	Name string `json:"name"`
+	// Type is one of "string", "date", "url", "tags", "list" or
+	// "visibility". MaxLength applies to each item of a "list".
+	Type      string `json:"type"`
+	Required  bool   `json:"required"`
+	MaxLength int    `json:"maxLength,omitempty"`
+
+	// value returns the field's value, or nil if Validate doesn't check
+	// Required and MaxLength for it.
+	value func(*Session) string
+}
+
+// SessionFormFields are the user-editable fields of a Session. Validate
+// enforces the rules listed here, so they can be served to clients without
+// drifting from validation.
+var SessionFormFields = []FormField{
+	{Name: "title", Type: "string", Required: true, MaxLength: 200, value: func(s *Session) string { return s.Title }},
+	{Name: "author", Type: "string", MaxLength: 200, value: func(s *Session) string { return s.Author }},
+	{Name: "presenters", Type: "list", MaxLength: maxPresenterLength},
+	{Name: "publishedDate", Type: "date", MaxLength: 64, value: func(s *Session) string { return s.PublishedDate }},
+	{Name: "description", Type: "string", MaxLength: 5000, value: func(s *Session) string { return s.Description }},
+	{Name: "tags", Type: "tags"},
+	{Name: "videoUrl", Type: "url", MaxLength: 2048, value: func(s *Session) string { return s.VideoURL }},
+	{Name: "thumbnailUrl", Type: "url", MaxLength: 2048, value: func(s *Session) string { return s.ThumbnailURL }},
+	{Name: "visibility", Type: "visibility"},
+}
+
+// ValidationError lists the invalid fields of a session.
+type ValidationError struct {
+	// Fields maps the JSON name of each invalid field to a description of
+	// the problem.
+	Fields map[string]Message
+}
+
+func (e *ValidationError) Error() string {
+	var names []string
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = name + ": " + e.Fields[name].String()
+	}
+	return "invalid session: " + strings.Join(msgs, "; ")
+}
+
+// maxPresenterLength is the MaxLength of the "presenters" form field.
+const maxPresenterLength = 200
+
+// Validate checks the fields of the session against SessionFormFields,
+// checks that each of Presenters is at most maxPresenterLength long, that
+// PublishedDate parses, that the title, description and tags
+// contain none of BlockedTerms, that VideoURL is on one of
+// AllowedVideoHosts, that Captions have one valid language and format each
+// and that the location is in range, returning a *ValidationError if any are
+// invalid.
+func (s *Session) Validate() error {
+	fields := make(map[string]Message)
+
+	for _, f := range SessionFormFields {
+		if f.value == nil {
+			continue
+		}
+		v := f.value(s)
+		switch {
+		case f.Required && strings.TrimSpace(v) == "":
+			fields[f.Name] = Message{Key: MsgRequired}
+		case f.MaxLength > 0 && utf8.RuneCountInString(v) > f.MaxLength:
+			fields[f.Name] = Message{Key: MsgTooLong, Args: []interface{}{f.MaxLength}}
+		}
+	}
+
+	if _, ok := fields["publishedDate"]; !ok && s.PublishedDate != "" {
+		if _, err := ParsePublishedDate(s.PublishedDate); err != nil {
+			fields["publishedDate"] = Message{Key: MsgUnrecognizedDate, Args: []interface{}{strings.TrimSpace(s.PublishedDate)}}
+		}
+	}
+
+	checkBlocked := func(name, text string) {
+		if _, ok := fields[name]; ok {
+			return
+		}
+		if term, ok := blockedTerm(text); ok {
+			fields[name] = Message{Key: MsgBlockedTerm, Args: []interface{}{term}}
+		}
+	}
+	checkBlocked("title", s.Title)
+	checkBlocked("description", s.Description)
+	for _, tag := range s.Tags {
+		checkBlocked("tags", tag)
+	}
+	for _, p := range s.Presenters {
+		if utf8.RuneCountInString(p) > maxPresenterLength {
+			fields["presenters"] = Message{Key: MsgTooLong, Args: []interface{}{maxPresenterLength}}
+			break
+		}
+	}
+
+	if _, ok := fields["videoUrl"]; !ok && s.VideoURL != "" && !videoHostAllowed(s.VideoURL) {
+		fields["videoUrl"] = Message{Key: MsgHostNotAllowed, Args: []interface{}{strings.Join(AllowedVideoHosts, ", ")}}
+	}
+
+	seenLangs := make(map[string]bool)
+	for _, c := range s.Captions {
+		if !ValidLang(c.Lang) || seenLangs[c.Lang] || (c.Format != CaptionVTT && c.Format != CaptionSRT) {
+			fields["captions"] = Message{Key: MsgBadCaptions}
+			break
+		}
+		seenLangs[c.Lang] = true
+	}
+
+	switch s.Visibility {
+	case "", VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+	default:
+		fields["visibility"] = Message{Key: MsgBadVisibility}
+	}
+
+	if s.Latitude < -90 || s.Latitude > 90 {
+		fields["latitude"] = Message{Key: MsgOutOfRange, Args: []interface{}{-90, 90}}
+	}
+	if s.Longitude < -180 || s.Longitude > 180 {
+		fields["longitude"] = Message{Key: MsgOutOfRange, Args: []interface{}{-180, 180}}
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// videoHostAllowed reports whether rawURL is on one of AllowedVideoHosts or
+// their subdomains, or AllowedVideoHosts is empty.
+func videoHostAllowed(rawURL string) bool {
+	if len(AllowedVideoHosts) == 0 {
+		return true
+	}
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return false
+	}
+	for _, allowed := range AllowedVideoHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePublishedDate(t *testing.T) {
+	want := time.Date(2016, time.March, 4, 0, 0, 0, 0, time.UTC)
+	for _, s := range []string{"2016-03-04", "Mar 4, 2016", "2016-03-04T00:00:00Z", "2016-03-04T01:00:00+01:00"} {
+		got, err := ParsePublishedDate(s)
+		if err != nil {
+			t.Errorf("ParsePublishedDate(%q): %v", s, err)
+			continue
+		}
+		if !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("ParsePublishedDate(%q): got %v, want %v", s, got, want)
+		}
+	}
+
+	for _, s := range []string{"2024-13-99", "yesterday"} {
+		if _, err := ParsePublishedDate(s); err == nil {
+			t.Errorf("ParsePublishedDate(%q): want non-nil err", s)
+		}
+	}
+}
+
+func TestValidatePublishedDate(t *testing.T) {
+	if err := (&Session{Title: "t", PublishedDate: "2016-03-04"}).Validate(); err != nil {
+		t.Errorf("valid date: got err %v, want nil", err)
+	}
+	if err := (&Session{Title: "t"}).Validate(); err != nil {
+		t.Errorf("empty date: got err %v, want nil", err)
+	}
+
+	err := (&Session{PublishedDate: "yesterday"}).Validate()
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("invalid date: got err %v, want *ValidationError", err)
+	}
+	if _, ok := verr.Fields["publishedDate"]; !ok {
+		t.Errorf("invalid date: got fields %v, want publishedDate", verr.Fields)
+	}
+}
+
+func TestValidateFormFields(t *testing.T) {
+	err := (&Session{Author: strings.Repeat("a", 201)}).Validate()
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("got err %v, want *ValidationError", err)
+	}
+	if _, ok := verr.Fields["title"]; !ok {
+		t.Errorf("missing title: got fields %v, want title", verr.Fields)
+	}
+	if _, ok := verr.Fields["author"]; !ok {
+		t.Errorf("long author: got fields %v, want author", verr.Fields)
+	}
+}
+
+func TestValidateVideoHost(t *testing.T) {
+	defer func(hosts []string) { AllowedVideoHosts = hosts }(AllowedVideoHosts)
+
+	for _, tt := range []struct {
+		hosts    []string
+		videoURL string
+		valid    bool
+	}{
+		{[]string{"youtube.com", "vimeo.com"}, "https://www.youtube.com/watch?v=abc", true},
+		{[]string{"youtube.com", "vimeo.com"}, "https://vimeo.com/123", true},
+		{[]string{"youtube.com", "vimeo.com"}, "https://evil.example.com/video.mp4", false},
+		{[]string{"youtube.com", "vimeo.com"}, "https://notyoutube.com/watch?v=abc", false},
+		{[]string{"youtube.com", "vimeo.com"}, "javascript:alert(1)", false},
+		{[]string{"youtube.com", "vimeo.com"}, "", true},
+		{nil, "https://evil.example.com/video.mp4", true},
+	} {
+		AllowedVideoHosts = tt.hosts
+		err := (&Session{Title: "t", VideoURL: tt.videoURL}).Validate()
+		if tt.valid && err != nil {
+			t.Errorf("hosts %q, %q: got err %v, want nil", tt.hosts, tt.videoURL, err)
+		}
+		if verr, ok := err.(*ValidationError); !tt.valid && (!ok || verr.Fields["videoUrl"].Key != MsgHostNotAllowed) {
+			t.Errorf("hosts %q, %q: got err %v, want a disallowed host", tt.hosts, tt.videoURL, err)
+		}
+	}
+}
+
+func TestValidateCaptions(t *testing.T) {
+	for _, tt := range []struct {
+		captions []Caption
+		valid    bool
+	}{
+		{[]Caption{{Lang: "en", Format: CaptionVTT}, {Lang: "pt-BR", Format: CaptionSRT}}, true},
+		{[]Caption{{Lang: "", Format: CaptionVTT}}, false},
+		{[]Caption{{Lang: "english!", Format: CaptionVTT}}, false},
+		{[]Caption{{Lang: "en", Format: "ass"}}, false},
+		{[]Caption{{Lang: "en", Format: CaptionVTT}, {Lang: "en", Format: CaptionSRT}}, false},
+	} {
+		err := (&Session{Title: "t", Captions: tt.captions}).Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%+v: got err %v, want nil", tt.captions, err)
+		}
+		if verr, ok := err.(*ValidationError); !tt.valid && (!ok || verr.Fields["captions"].Key != MsgBadCaptions) {
+			t.Errorf("%+v: got err %v, want invalid captions", tt.captions, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ViewBuffer counts session views in memory and adds them to a database in
+// batches, every interval or as soon as threshold views are pending, with
+// one IncrementViewCount per session. View counts lag by up to the interval,
+// and views still buffered if the process dies without Close are lost.
+type ViewBuffer struct {
+	db        SessionDatabase
+	threshold int64
+
+	mu      sync.Mutex
+	pending map[int64]int64 // views by session ID
+	total   int64           // sum of pending
+
+	full      chan struct{} // signals the flush loop that threshold is reached
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewViewBuffer returns a ViewBuffer writing to db and starts its flush
+// loop. Call Close to stop it.
+func NewViewBuffer(db SessionDatabase, interval time.Duration, threshold int64) *ViewBuffer {
+	b := &ViewBuffer{
+		db:        db,
+		threshold: threshold,
+		pending:   make(map[int64]int64),
+		full:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go b.loop(interval)
+	return b
+}
+
+// Add counts a view of the session with the given ID.
+func (b *ViewBuffer) Add(id int64) {
+	b.mu.Lock()
+	b.pending[id]++
+	b.total++
+	full := b.total >= b.threshold
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default: // A flush is already due.
+		}
+	}
+}
+
+// loop flushes the buffer every interval and whenever it fills, until Close.
+func (b *ViewBuffer) loop(interval time.Duration) {
+	defer close(b.stopped)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-b.full:
+		case <-b.stop:
+			return
+		}
+		if err := b.Flush(context.Background()); err != nil {
+			log.Printf("Could not flush view counts: %v", err)
+		}
+	}
+}
+
+// Flush adds the pending views to the database. Views that fail to be
+// written are kept for the next flush, except those of deleted sessions.
+func (b *ViewBuffer) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[int64]int64)
+	b.total = 0
+	b.mu.Unlock()
+
+	var firstErr error
+	for id, n := range pending {
+		err := b.db.IncrementViewCount(ctx, id, n)
+		if err == nil || err == ErrSessionNotFound {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		b.mu.Lock()
+		b.pending[id] += n
+		b.total += n
+		b.mu.Unlock()
+	}
+	return firstErr
+}
+
+// Close stops the flush loop and flushes the remaining views. Views added
+// after Close are only written by further calls to Flush.
+func (b *ViewBuffer) Close(ctx context.Context) error {
+	b.closeOnce.Do(func() {
+		close(b.stop)
+		<-b.stopped
+	})
+	return b.Flush(ctx)
+}
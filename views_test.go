@@ -0,0 +1,63 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestViewBuffer(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	ctx := context.Background()
+
+	a, err := db.AddSession(&Session{Title: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.AddSession(&Session{Title: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewCount := func(id int64) int64 {
+		s, err := db.GetSession(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.ViewCount
+	}
+
+	// The interval is long enough that only reaching the threshold or
+	// closing flushes.
+	buf := NewViewBuffer(db, time.Hour, 3)
+	buf.Add(a)
+	buf.Add(b)
+	if got := viewCount(a); got != 0 {
+		t.Errorf("view count before a flush: got %d, want 0", got)
+	}
+
+	buf.Add(a)
+	deadline := time.Now().Add(5 * time.Second)
+	for viewCount(a) != 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got, want := [2]int64{viewCount(a), viewCount(b)}, [2]int64{2, 1}; got != want {
+		t.Fatalf("view counts after reaching the threshold: got %v, want %v", got, want)
+	}
+
+	// Views below the threshold are written on Close, and views of deleted
+	// sessions are dropped.
+	buf.Add(b)
+	buf.Add(12345)
+	if err := buf.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := viewCount(b); got != 2 {
+		t.Errorf("view count after Close: got %d, want 2", got)
+	}
+}
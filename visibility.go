@@ -0,0 +1,72 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import "errors"
+
+// Values of Session.Visibility. An empty Visibility means public.
+const (
+	// VisibilityPublic sessions are listed and visible to everyone.
+	VisibilityPublic = "public"
+	// VisibilityUnlisted sessions are visible to anyone with the link, but
+	// only listed for their creator and admins.
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPrivate sessions are only visible to their creator and
+	// admins.
+	VisibilityPrivate = "private"
+)
+
+// ErrForbidden is returned when a session exists but the viewer may not see
+// it.
+var ErrForbidden = errors.New("session is private")
+
+// Viewer is the user sessions are read for. The zero Viewer is an anonymous
+// user.
+type Viewer struct {
+	// UserID is the user's ID, as in Session.CreatedByID, or empty for an
+	// anonymous user.
+	UserID string
+	Admin  bool
+}
+
+// owns reports whether v created b.
+func (v Viewer) owns(b *Session) bool {
+	return v.UserID != "" && b.CreatedByID == v.UserID
+}
+
+// CanList reports whether b is shown to v in lists of sessions.
+func (v Viewer) CanList(b *Session) bool {
+	return b.Visibility == "" || b.Visibility == VisibilityPublic || v.Admin || v.owns(b)
+}
+
+// CanListSummary reports whether the session summarized by s is shown to v
+// in lists of sessions.
+func (v Viewer) CanListSummary(s *SessionSummary) bool {
+	return v.CanList(&Session{CreatedByID: s.CreatedByID, Visibility: s.Visibility})
+}
+
+// CanGet reports whether v may open b directly, by its ID or link.
+func (v Viewer) CanGet(b *Session) bool {
+	return b.Visibility != VisibilityPrivate || v.Admin || v.owns(b)
+}
+
+// CanManage reports whether v may change b, including its Visibility, delete
+// it or manage its stored files.
+func (v Viewer) CanManage(b *Session) bool {
+	return v.Admin || v.owns(b)
+}
+
+// GetSessionFor retrieves a session by its ID from db, returning ErrForbidden
+// if v may not see it.
+func GetSessionFor(db SessionDatabase, id int64, v Viewer) (*Session, error) {
+	session, err := db.GetSession(id)
+	if err != nil {
+		return nil, err
+	}
+	if !v.CanGet(session) {
+		return nil, ErrForbidden
+	}
+	return session, nil
+}
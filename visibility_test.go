@@ -0,0 +1,56 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package vyfe_api
+
+import "testing"
+
+func TestVisibility(t *testing.T) {
+	var (
+		anonymous = Viewer{}
+		owner     = Viewer{UserID: "owner"}
+		other     = Viewer{UserID: "other"}
+		admin     = Viewer{UserID: "admin", Admin: true}
+	)
+
+	tests := []struct {
+		visibility string
+		viewer     Viewer
+		list, get  bool
+	}{
+		{"", anonymous, true, true},
+		{VisibilityPublic, anonymous, true, true},
+		{VisibilityPublic, other, true, true},
+		{VisibilityUnlisted, anonymous, false, true},
+		{VisibilityUnlisted, other, false, true},
+		{VisibilityUnlisted, owner, true, true},
+		{VisibilityUnlisted, admin, true, true},
+		{VisibilityPrivate, anonymous, false, false},
+		{VisibilityPrivate, other, false, false},
+		{VisibilityPrivate, owner, true, true},
+		{VisibilityPrivate, admin, true, true},
+	}
+
+	db := newMemoryDB()
+	defer db.Close()
+	for _, tt := range tests {
+		s := &Session{Title: "t", CreatedByID: "owner", Visibility: tt.visibility}
+		id, err := db.AddSession(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := tt.viewer.CanList(s); got != tt.list {
+			t.Errorf("%q for %+v: CanList = %v, want %v", tt.visibility, tt.viewer, got, tt.list)
+		}
+		_, err = GetSessionFor(db, id, tt.viewer)
+		if got := err == nil; got != tt.get {
+			t.Errorf("%q for %+v: GetSessionFor err = %v, want visible %v", tt.visibility, tt.viewer, err, tt.get)
+		}
+		if !tt.get && err != ErrForbidden {
+			t.Errorf("%q for %+v: got err %v, want ErrForbidden", tt.visibility, tt.viewer, err)
+		}
+		db.DeleteSession(id)
+	}
+}